@@ -5,6 +5,7 @@ import (
 	"RTSPSender/internal/webrtc"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 
@@ -22,6 +23,16 @@ func serveHTTP() {
 
 	router.POST("/camera/push/stop", Stop)
 	router.POST("/camera/push/start", Start)
+	router.GET("/camera/push/status", Status)
+
+	// WHEP preview of the publishing cameras, by room_id
+	router.POST("/camera/whep/:uuid", WHEPSubscribe)
+	router.PATCH("/camera/whep/:uuid/:viewer", WHEPTrickle)
+	router.DELETE("/camera/whep/:uuid/:viewer", WHEPUnsubscribe)
+
+	// local recording of the publishing cameras
+	router.POST("/camera/record/start", StartRecord)
+	router.POST("/camera/record/stop", StopRecord)
 
 	err := router.Run(port)
 	if err != nil {
@@ -37,7 +48,7 @@ func Start(c *gin.Context) {
 		MakeResponse(false, -1, "Missing mandatory field `configs`!", c)
 		return
 	}
-	log.Println("Configure Request, params: ", configs)
+	log.Println("Configure Request, params: ", webrtc.RedactConfigs(configs))
 
 	var client config.RTSPClient
 	err := json.Unmarshal([]byte(configs), &client)
@@ -46,6 +57,20 @@ func Start(c *gin.Context) {
 		return
 	}
 
+	if err := webrtc.ValidateCameraURL(client.URL, client.SDP); err != nil {
+		MakeResponse(false, -3, "Please input validate RTSP camera URL! "+err.Error(), c)
+		return
+	}
+	for _, layer := range client.Simulcast {
+		if len(layer.URL) == 0 {
+			continue
+		}
+		if err := webrtc.ValidateCameraURL(layer.URL, client.SDP); err != nil {
+			MakeResponse(false, -3, fmt.Sprintf("Please input validate RTSP URL for simulcast layer %s! %v", layer.RID, err), c)
+			return
+		}
+	}
+
 	room := client.Room
 	if len(room) == 0 {
 		MakeResponse(false, -5, "Please input room number", c)
@@ -57,6 +82,10 @@ func Start(c *gin.Context) {
 		return
 	}
 	uuid := room + "_" + id
+	if config.Config.Failed(uuid) {
+		// the status reported the failed background publish, start again
+		config.Config.DelClient(uuid)
+	}
 	if config.Config.Exist(uuid) {
 		MakeResponse(false, -8, fmt.Sprintf("Camera ID %s is currently publishing!", id), c)
 		return
@@ -92,6 +121,14 @@ func Start(c *gin.Context) {
 		return
 	}
 
+	if webrtc.IsPushURL(client.URL) {
+		// the encoder may publish long after, don't hold the request
+		startedSuccess = true
+		go streamPushWebRTC(uuid)
+		MakeResponse(true, 1, fmt.Sprintf("Waiting for the encoder of camera %s in Room %s, see /camera/push/status", id, room), c)
+		return
+	}
+
 	msg, err := StreamWebRTC(uuid)
 
 	if err != nil {
@@ -139,6 +176,130 @@ func Stop(c *gin.Context) {
 	MakeResponse(true, 1, fmt.Sprintf("Stop ID %s successfully!", id), c)
 }
 
+func Status(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"state": 1, "clients": config.Config.Stats(), "states": config.Config.States()})
+}
+
+// WHEPSubscribe answers the WHEP offer of a preview viewer
+func WHEPSubscribe(c *gin.Context) {
+	uuid := c.Param("uuid")
+	muxer := config.Config.WebRTC(uuid)
+	if muxer == nil {
+		c.String(http.StatusNotFound, "Camera %s is not publishing", uuid)
+		return
+	}
+	if c.ContentType() != "application/sdp" {
+		c.String(http.StatusUnsupportedMediaType, "Offer must be application/sdp")
+		return
+	}
+	offer, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	viewer, answer, err := muxer.AddViewer(string(offer))
+	if err == webrtc.ErrViewerLimit {
+		c.String(http.StatusServiceUnavailable, "Camera %s has too many viewers", uuid)
+		return
+	} else if err != nil {
+		log.Println("WHEP offer refused", err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/camera/whep/%s/%s", uuid, viewer))
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// WHEPTrickle adds the ICE candidates of a viewer
+func WHEPTrickle(c *gin.Context) {
+	muxer := config.Config.WebRTC(c.Param("uuid"))
+	if muxer == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if c.ContentType() != "application/trickle-ice-sdpfrag" {
+		c.String(http.StatusUnsupportedMediaType, "Fragment must be application/trickle-ice-sdpfrag")
+		return
+	}
+	frag, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = muxer.AddViewerCandidates(c.Param("viewer"), string(frag))
+	if err == webrtc.ErrViewerNotFound {
+		c.Status(http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.String(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// WHEPUnsubscribe closes the PeerConnection of a viewer
+func WHEPUnsubscribe(c *gin.Context) {
+	muxer := config.Config.WebRTC(c.Param("uuid"))
+	if muxer == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err := muxer.RemoveViewer(c.Param("viewer")); err == webrtc.ErrViewerNotFound {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// StartRecord records a publishing camera to its record_dir
+func StartRecord(c *gin.Context) {
+	id := c.PostForm("id")
+	room := c.PostForm("room")
+	if len(id) == 0 || len(room) == 0 {
+		MakeResponse(false, -5, "Please input room number and Camera ID", c)
+		return
+	}
+
+	muxer := config.Config.WebRTC(room + "_" + id)
+	if muxer == nil {
+		MakeResponse(false, -1, fmt.Sprintf("Camera ID %s is not publishing!", id), c)
+		return
+	}
+	if err := muxer.StartRecording(); err == webrtc.ErrRecording {
+		MakeResponse(false, -2, fmt.Sprintf("Camera ID %s is already recorded!", id), c)
+		return
+	} else if err != nil {
+		MakeResponse(false, -3, fmt.Sprintf("Record ID %s failed: %v", id, err), c)
+		return
+	}
+	MakeResponse(true, 1, fmt.Sprintf("Record ID %s successfully!", id), c)
+}
+
+// StopRecord closes the recording of a camera
+func StopRecord(c *gin.Context) {
+	id := c.PostForm("id")
+	room := c.PostForm("room")
+	if len(id) == 0 || len(room) == 0 {
+		MakeResponse(false, -5, "Please input room number and Camera ID", c)
+		return
+	}
+
+	muxer := config.Config.WebRTC(room + "_" + id)
+	if muxer == nil {
+		MakeResponse(false, -1, fmt.Sprintf("Camera ID %s is not publishing!", id), c)
+		return
+	}
+	if err := muxer.StopRecording(); err == webrtc.ErrNotRecording {
+		MakeResponse(false, -2, fmt.Sprintf("Camera ID %s is not recorded!", id), c)
+		return
+	} else if err != nil {
+		MakeResponse(false, -3, fmt.Sprintf("Stop recording ID %s failed: %v", id, err), c)
+		return
+	}
+	MakeResponse(true, 1, fmt.Sprintf("Stop recording ID %s successfully!", id), c)
+}
+
 func MakeResponse(success bool, code int, data string, c *gin.Context) {
 	var state = 1
 	if !success {
@@ -155,11 +316,7 @@ func StreamWebRTC(uuid string) (string, error) {
 	}
 
 	client := config.Config.Clients[uuid]
-	muxerWebRTC := webrtc.NewMuxer(webrtc.Options{
-		ICEServers:    client.ICEServers,
-		ICEUsername:   client.ICEUsername,
-		ICECredential: client.ICECredential,
-	})
+	muxerWebRTC := webrtc.NewMuxer(client.Options())
 
 	msg, err := muxerWebRTC.WriteHeader(
 		client.ID,
@@ -173,11 +330,28 @@ func StreamWebRTC(uuid string) (string, error) {
 		return msg, err
 	}
 
-	config.Config.AddRTC2Stream(uuid, muxerWebRTC)
+	if !config.Config.AddRTC2Stream(uuid, muxerWebRTC) {
+		// stopped while describing the camera
+		muxerWebRTC.Close()
+		return "", fmt.Errorf("Stream %s stopped", uuid)
+	}
 
 	return "", nil
 }
 
+// streamPushWebRTC publishes a camera pushed by its encoder in the background,
+// a failure is reported by the status and PublishingState
+func streamPushWebRTC(uuid string) {
+	msg, err := StreamWebRTC(uuid)
+	if err != nil {
+		if len(msg) > 0 {
+			msg += ", "
+		}
+		log.Printf("Publish %s failed: %s%v", uuid, msg, err)
+		config.Config.SetError(uuid, msg+err.Error())
+	}
+}
+
 //func reconnect(uuid string) {
 //	log.Println("Prepare to reconnect: ", uuid)
 //
@@ -193,8 +367,8 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Credentials", "true")
 		c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, x-access-token")
-		c.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Cache-Control, Content-Language, Content-Type")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Access-Control-Allow-Origin, Access-Control-Allow-Headers, Cache-Control, Content-Language, Content-Type, Location")
+		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
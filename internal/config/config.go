@@ -10,9 +10,6 @@ import (
 //Config global
 var Config = Configs{}
 
-// `(rtsp[s]?):\/\/((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)`
-const RTSPReg = `(rtsp):\/\/((25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)`
-
 //Configs struct
 type Configs struct {
 	mutex   sync.RWMutex
@@ -30,12 +27,128 @@ type RTSPClient struct {
 
 	Display       string   `json:"display"`
 	Mic           string   `json:"mic"`
+	AudioSource   string   `json:"audio_source"`
 	Janus         string   `json:"janus"`
 	ICEServers    []string `json:"ice_servers"`
 	ICEUsername   string   `json:"ice_username"`
 	ICECredential string   `json:"ice_credential"`
 
+	MaxPayloadSize  int    `json:"max_payload_size"`
+	KeyframeRequest string `json:"keyframe_request"`
+	GOPCacheSize    int    `json:"gop_cache_size"`
+
+	CreateRoom   bool                `json:"create_room"`
+	DestroyRoom  bool                `json:"destroy_room"`
+	RoomTemplate webrtc.RoomTemplate `json:"room_template"`
+
+	Simulcast []webrtc.SimulcastLayer `json:"simulcast"`
+	Adaptive  bool                    `json:"adaptive"`
+
+	CongestionControl bool `json:"congestion_control"`
+	InitialBitrate    int  `json:"initial_bitrate"`
+	MinBitrate        int  `json:"min_bitrate"`
+	MaxBitrate        int  `json:"max_bitrate"`
+	PacingRate        int  `json:"pacing_rate"`
+	PacingQueueSize   int  `json:"pacing_queue_size"`
+
+	FECOverhead     int `json:"fec_overhead"`
+	AudioRedundancy int `json:"audio_redundancy"`
+
+	ReorderLatency int  `json:"reorder_latency"`
+	CameraNACK     bool `json:"camera_nack"`
+
+	RTSPTransport    string `json:"rtsp_transport"`
+	RTSPReadTimeout  int    `json:"rtsp_read_timeout"`
+	RTSPWriteTimeout int    `json:"rtsp_write_timeout"`
+	RTSPKeepalive    string `json:"rtsp_keepalive"`
+	RTSPAnyPort      bool   `json:"rtsp_any_port"`
+	RTSPCAFile       string `json:"rtsp_ca_file"`
+	RTSPSkipVerify   bool   `json:"rtsp_skip_verify"`
+
+	SDP string `json:"sdp"`
+
+	Sink        string `json:"sink"`
+	WHIPURL     string `json:"whip_url"`
+	WHIPToken   string `json:"whip_token"`
+	WHIPTrickle bool   `json:"whip_trickle"`
+
+	WHEPMaxViewers int `json:"whep_max_viewers"`
+
+	RestreamAddress string `json:"restream_address"`
+	RestreamUser    string `json:"restream_user"`
+	RestreamPass    string `json:"restream_pass"`
+
+	RecordDir             string `json:"record_dir"`
+	Record                bool   `json:"record"`
+	RecordSegmentDuration int    `json:"record_segment_duration"`
+	RecordSegmentSize     int    `json:"record_segment_size"`
+	RecordRetention       int    `json:"record_retention"`
+
 	WebRTC *webrtc.Muxer
+	// Error is set when the publish started in the background failed
+	Error string `json:"-"`
+}
+
+// client states reported by the status
+const (
+	StateWaiting    = "waiting"
+	StatePublishing = "publishing"
+	StateFailed     = "failed"
+)
+
+// ClientState is the publish state of a client
+type ClientState struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Options maps the client configs to the options of its muxer
+func (client RTSPClient) Options() webrtc.Options {
+	return webrtc.Options{
+		ICEServers:            client.ICEServers,
+		ICEUsername:           client.ICEUsername,
+		ICECredential:         client.ICECredential,
+		AudioSource:           client.AudioSource,
+		MaxPayloadSize:        client.MaxPayloadSize,
+		KeyframeRequest:       client.KeyframeRequest,
+		GOPCacheSize:          client.GOPCacheSize,
+		CreateRoom:            client.CreateRoom,
+		DestroyRoom:           client.DestroyRoom,
+		RoomTemplate:          client.RoomTemplate,
+		Simulcast:             client.Simulcast,
+		Adaptive:              client.Adaptive,
+		CongestionControl:     client.CongestionControl,
+		InitialBitrate:        client.InitialBitrate,
+		MinBitrate:            client.MinBitrate,
+		MaxBitrate:            client.MaxBitrate,
+		PacingRate:            client.PacingRate,
+		PacingQueueSize:       client.PacingQueueSize,
+		FECOverhead:           client.FECOverhead,
+		AudioRedundancy:       client.AudioRedundancy,
+		ReorderLatency:        client.ReorderLatency,
+		CameraNACK:            client.CameraNACK,
+		RTSPTransport:         client.RTSPTransport,
+		RTSPReadTimeout:       client.RTSPReadTimeout,
+		RTSPWriteTimeout:      client.RTSPWriteTimeout,
+		RTSPKeepalive:         client.RTSPKeepalive,
+		RTSPAnyPort:           client.RTSPAnyPort,
+		RTSPCAFile:            client.RTSPCAFile,
+		RTSPSkipVerify:        client.RTSPSkipVerify,
+		SDP:                   client.SDP,
+		Sink:                  client.Sink,
+		WHIPURL:               client.WHIPURL,
+		WHIPToken:             client.WHIPToken,
+		WHIPTrickle:           client.WHIPTrickle,
+		WHEPMaxViewers:        client.WHEPMaxViewers,
+		RestreamAddress:       client.RestreamAddress,
+		RestreamUser:          client.RestreamUser,
+		RestreamPass:          client.RestreamPass,
+		RecordDir:             client.RecordDir,
+		Record:                client.Record,
+		RecordSegmentDuration: client.RecordSegmentDuration,
+		RecordSegmentSize:     client.RecordSegmentSize,
+		RecordRetention:       client.RecordRetention,
+	}
 }
 
 func (element *Configs) UpdateMicphoneRecordingState(state bool) {
@@ -86,6 +199,27 @@ func (element *Configs) AddRTC2Stream(id string, WebRTC *webrtc.Muxer) bool {
 	return false
 }
 
+// SetError marks the background publish of a client failed
+func (element *Configs) SetError(id string, err string) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+
+	if tmp, ok := element.Clients[id]; ok {
+		tmp.Error = err
+		element.Clients[id] = tmp
+		return true
+	}
+	return false
+}
+
+// Failed tells if the background publish of a client failed
+func (element *Configs) Failed(uuid string) bool {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	client, ok := element.Clients[uuid]
+	return ok && client.Error != ""
+}
+
 func (element *Configs) Exist(uuid string) bool {
 	element.mutex.Lock()
 	defer element.mutex.Unlock()
@@ -107,6 +241,63 @@ func (element *Configs) List() (string, []string) {
 	return fist, res
 }
 
+// WebRTC returns the muxer of a publishing client, nil if not publishing
+func (element *Configs) WebRTC(id string) *webrtc.Muxer {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	if client, ok := element.Clients[id]; ok {
+		return client.WebRTC
+	}
+	return nil
+}
+
+// Stats returns the counters of the publishing clients
+func (element *Configs) Stats() map[string]webrtc.Stats {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	res := make(map[string]webrtc.Stats)
+	for k, client := range element.Clients {
+		if client.WebRTC != nil {
+			res[k] = client.WebRTC.Stats()
+		}
+	}
+	return res
+}
+
+// States returns the publish state of the clients, a client started in the
+// background is waiting until its camera is described
+func (element *Configs) States() map[string]ClientState {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	res := make(map[string]ClientState)
+	for k, client := range element.Clients {
+		res[k] = client.state()
+	}
+	return res
+}
+
+// State returns the publish state of a client, false if it does not exist
+func (element *Configs) State(id string) (ClientState, bool) {
+	element.mutex.Lock()
+	defer element.mutex.Unlock()
+	client, ok := element.Clients[id]
+	if !ok {
+		return ClientState{}, false
+	}
+	return client.state(), true
+}
+
+func (client RTSPClient) state() ClientState {
+	switch {
+	case client.WebRTC != nil:
+		return ClientState{State: StatePublishing}
+	case client.Error != "":
+		return ClientState{State: StateFailed, Error: client.Error}
+	default:
+		return ClientState{State: StateWaiting}
+	}
+}
+
 func GetMD5Hash(text string) string {
 	hash := md5.Sum([]byte(text))
 	return hex.EncodeToString(hash[:])
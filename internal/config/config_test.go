@@ -0,0 +1,79 @@
+package config
+
+import (
+	"RTSPSender/internal/webrtc"
+	"reflect"
+	"testing"
+)
+
+// A client started in the background waits, then publishes or fails
+func TestClientStates(t *testing.T) {
+	configs := Configs{Clients: map[string]RTSPClient{}}
+	configs.AddClient("1_waiting", RTSPClient{ID: "waiting"})
+	configs.AddClient("1_publishing", RTSPClient{ID: "publishing"})
+	configs.AddClient("1_failed", RTSPClient{ID: "failed"})
+	configs.AddRTC2Stream("1_publishing", &webrtc.Muxer{})
+	if !configs.SetError("1_failed", "no encoder published") || configs.SetError("1_unknown", "error") {
+		t.Fatal("SetError of the clients")
+	}
+
+	want := map[string]ClientState{
+		"1_waiting":    {State: StateWaiting},
+		"1_publishing": {State: StatePublishing},
+		"1_failed":     {State: StateFailed, Error: "no encoder published"},
+	}
+	states := configs.States()
+	if len(states) != len(want) {
+		t.Fatalf("states %+v", states)
+	}
+	for id, state := range want {
+		if states[id] != state {
+			t.Errorf("%s state %+v, want %+v", id, states[id], state)
+		}
+	}
+	if !configs.Failed("1_failed") || configs.Failed("1_waiting") || configs.Failed("1_unknown") {
+		t.Fatal("Failed of the clients")
+	}
+	if state, ok := configs.State("1_failed"); !ok || state != want["1_failed"] {
+		t.Errorf("1_failed state %+v", state)
+	}
+	if _, ok := configs.State("1_unknown"); ok {
+		t.Error("state of an unknown client")
+	}
+}
+
+// Every client config named like a muxer option is passed to the muxer
+func TestClientOptions(t *testing.T) {
+	var client RTSPClient
+	value := reflect.ValueOf(&client).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value.Type().Field(i).Name)
+		case reflect.Int:
+			field.SetInt(int64(i + 1))
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		}
+	}
+
+	options := reflect.ValueOf(client.Options())
+	mapped := 0
+	for i := 0; i < options.NumField(); i++ {
+		name := options.Type().Field(i).Name
+		field := value.FieldByName(name)
+		if !field.IsValid() {
+			continue
+		}
+		mapped++
+		if !reflect.DeepEqual(options.Field(i).Interface(), field.Interface()) {
+			t.Errorf("option %s is %v, want %v", name, options.Field(i).Interface(), field.Interface())
+		}
+	}
+	if mapped == 0 {
+		t.Fatal("no option mapped")
+	}
+}
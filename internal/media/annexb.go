@@ -0,0 +1,111 @@
+package media
+
+// H.264 & H.265 NALU types starting a new access unit
+const (
+	h264NALUTypeSEI = 6
+	h264NALUTypeAUD = 9
+	h265NALUTypeAUD = 35
+	h265NALUTypeSEI = 39
+)
+
+// SplitAnnexB returns the NALUs of an Annex-B byte stream (00 00 01 or
+// 00 00 00 01 start codes). The NALUs share the memory of data.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	zeros := 0
+	for i, b := range data {
+		switch {
+		case b == 0:
+			zeros++
+			continue
+		case b == 1 && zeros >= 2:
+			if start >= 0 {
+				nalus = appendNALU(nalus, data[start:i-zeros])
+			}
+			start = i + 1
+		}
+		zeros = 0
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, data[start:])
+	}
+	return nalus
+}
+
+// trailing zeros belong to the next start code
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// AccessUnits groups the NALUs of an elementary stream in access units: a
+// new one starts with an AUD, parameter set or SEI after a slice, or with
+// the first slice of a picture.
+func AccessUnits(codec Codec, nalus [][]byte) [][][]byte {
+	var aus [][][]byte
+	var au [][]byte
+	hasSlice := false
+	for _, nalu := range nalus {
+		if hasSlice && startsAccessUnit(codec, nalu) {
+			aus = append(aus, au)
+			au = nil
+			hasSlice = false
+		}
+		au = append(au, nalu)
+		if isSlice(codec, nalu) {
+			hasSlice = true
+		}
+	}
+	if len(au) > 0 && hasSlice {
+		aus = append(aus, au)
+	}
+	return aus
+}
+
+func startsAccessUnit(codec Codec, nalu []byte) bool {
+	typ := naluType(codec, nalu)
+	if codec == CodecH265 {
+		switch {
+		case typ == h265NALUTypeAUD || typ == h265NALUTypeSEI || isParameterSet(codec, nalu):
+			return true
+		case isSlice(codec, nalu):
+			// first_slice_segment_in_pic_flag
+			return len(nalu) > 2 && nalu[2]&0x80 != 0
+		}
+		return false
+	}
+	switch {
+	case typ == h264NALUTypeAUD || typ == h264NALUTypeSEI || isParameterSet(codec, nalu):
+		return true
+	case isSlice(codec, nalu):
+		// first_mb_in_slice is 0, its ue(v) is a single 1 bit
+		return len(nalu) > 1 && nalu[1]&0x80 != 0
+	}
+	return false
+}
+
+// FirstParameterSets returns the first VPS (H.265 only), SPS and PPS found
+// in the NALUs, nil if missing.
+func FirstParameterSets(codec Codec, nalus [][]byte) (vps []byte, sps []byte, pps []byte) {
+	var sets parameterSets
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch typ := naluType(codec, nalu); {
+		case codec == CodecH265 && typ == h265NALUTypeVPS && sets.vps == nil:
+			sets.vps = nalu
+		case (codec == CodecH265 && typ == h265NALUTypeSPS || codec == CodecH264 && typ == h264NALUTypeSPS) && sets.sps == nil:
+			sets.sps = nalu
+		case (codec == CodecH265 && typ == h265NALUTypePPS || codec == CodecH264 && typ == h264NALUTypePPS) && sets.pps == nil:
+			sets.pps = nalu
+		}
+	}
+	return sets.vps, sets.sps, sets.pps
+}
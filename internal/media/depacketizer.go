@@ -0,0 +1,128 @@
+package media
+
+import (
+	"errors"
+
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
+	"github.com/pion/rtp"
+)
+
+// The rtph265 decoder has no error value for a FU received without its start
+const h265NonStartingFU = "invalid fragmentation unit (non-starting)"
+
+// naluDecoder decodes the NALUs of H.264/H.265 RTP packets
+type naluDecoder struct {
+	codec Codec
+	h264  *rtph264.Decoder
+	h265  *rtph265.Decoder
+}
+
+func (d *naluDecoder) reset() {
+	switch d.codec {
+	case CodecH265:
+		d.h265 = &rtph265.Decoder{}
+		d.h265.Init()
+	default:
+		d.h264 = &rtph264.Decoder{}
+		d.h264.Init()
+	}
+}
+
+// The NALUs completed by a packet, none while a fragmented NALU is incomplete
+func (d *naluDecoder) decode(pkt *rtp.Packet) ([][]byte, error) {
+	var nalus [][]byte
+	var err error
+	switch d.codec {
+	case CodecH265:
+		nalus, _, err = d.h265.Decode(pkt)
+		// like H.264, the fragments are dropped until the next starting FU
+		if errors.Is(err, rtph265.ErrMorePacketsNeeded) || (err != nil && err.Error() == h265NonStartingFU) {
+			return nil, nil
+		}
+	default:
+		nalus, _, err = d.h264.Decode(pkt)
+		if errors.Is(err, rtph264.ErrMorePacketsNeeded) || errors.Is(err, rtph264.ErrNonStartingPacketAndNoPrevious) {
+			return nil, nil
+		}
+	}
+	return nalus, err
+}
+
+// AccessUnit is the NALUs of a picture
+type AccessUnit struct {
+	NALUs     [][]byte
+	Timestamp uint32
+	// header fields of the first packet, kept by the Repacketizer
+	payloadType uint8
+	ssrc        uint32
+}
+
+// Keyframe returns true if the access unit has a keyframe slice
+func (au AccessUnit) Keyframe(codec Codec) bool {
+	for _, nalu := range au.NALUs {
+		if IsKeyframe(codec, nalu) {
+			return true
+		}
+	}
+	return false
+}
+
+// Depacketizer reassembles H.264/H.265 RTP packets into access units
+type Depacketizer struct {
+	decoder naluDecoder
+
+	au           AccessUnit
+	started      bool
+	lastSequence uint16
+}
+
+// NewDepacketizer creates a Depacketizer of a codec
+func NewDepacketizer(codec Codec) *Depacketizer {
+	d := &Depacketizer{decoder: naluDecoder{codec: codec}}
+	d.decoder.reset()
+	return d
+}
+
+// Push decodes a camera packet, returns the access units it completes
+func (d *Depacketizer) Push(pkt *rtp.Packet) ([]AccessUnit, error) {
+	var out []AccessUnit
+
+	if d.started {
+		if pkt.SequenceNumber != d.lastSequence+1 {
+			// a fragment may be lost, drop the partially received NALU
+			d.decoder.reset()
+		}
+		// the marker bit of the previous access unit may be lost
+		if len(d.au.NALUs) > 0 && pkt.Timestamp != d.au.Timestamp {
+			out = append(out, d.flush())
+		}
+	}
+	d.started = true
+	d.lastSequence = pkt.SequenceNumber
+
+	nalus, err := d.decoder.decode(pkt)
+	if err != nil {
+		d.decoder.reset()
+		return out, err
+	}
+	if len(nalus) > 0 {
+		if len(d.au.NALUs) == 0 {
+			d.au.Timestamp = pkt.Timestamp
+			d.au.payloadType = pkt.PayloadType
+			d.au.ssrc = pkt.SSRC
+		}
+		d.au.NALUs = append(d.au.NALUs, nalus...)
+	}
+
+	if pkt.Marker && len(d.au.NALUs) > 0 {
+		out = append(out, d.flush())
+	}
+	return out, nil
+}
+
+func (d *Depacketizer) flush() AccessUnit {
+	au := d.au
+	d.au = AccessUnit{}
+	return au
+}
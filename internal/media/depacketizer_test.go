@@ -0,0 +1,67 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// The FU packets of a NALU, the first one is lost
+func testFUPackets(codec Codec, nalu []byte, timestamp uint32) []*rtp.Packet {
+	header := []byte{0x7C, 0x05}
+	body := nalu[1:]
+	if codec == CodecH265 {
+		header = []byte{49 << 1, 0x01, 19}
+		body = nalu[2:]
+	}
+	var pkts []*rtp.Packet
+	for i := 0; i < len(body); i += 100 {
+		end := i + 100
+		if end > len(body) {
+			end = len(body)
+		}
+		payload := append([]byte{}, header...)
+		switch {
+		case i == 0:
+			payload[len(payload)-1] |= 0x80
+		case end == len(body):
+			payload[len(payload)-1] |= 0x40
+		}
+		pkts = append(pkts, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: end == len(body), SequenceNumber: uint16(len(pkts)), Timestamp: timestamp},
+			Payload: append(payload, body[i:end]...),
+		})
+	}
+	return pkts
+}
+
+// A stream joined in the middle of a fragmented NALU is decoded from the
+// next starting fragment
+func TestDepacketizerNonStartingFU(t *testing.T) {
+	for _, test := range []struct {
+		codec Codec
+		nalu  []byte
+	}{
+		{codec: CodecH264, nalu: testNALU(5, 350)},
+		{codec: CodecH265, nalu: append([]byte{19 << 1, 0x01}, testNALU(0, 350)[2:]...)},
+	} {
+		d := NewDepacketizer(test.codec)
+		pkts := testFUPackets(test.codec, test.nalu, 0)[1:]
+		next := testFUPackets(test.codec, test.nalu, 3000)
+		for i, pkt := range next {
+			pkt.SequenceNumber = uint16(len(pkts) + 1 + i)
+		}
+		var aus []AccessUnit
+		for _, pkt := range append(pkts, next...) {
+			out, err := d.Push(pkt)
+			if err != nil {
+				t.Fatalf("codec %v packet %d: %v", test.codec, pkt.SequenceNumber, err)
+			}
+			aus = append(aus, out...)
+		}
+		if len(aus) != 1 || aus[0].Timestamp != 3000 || len(aus[0].NALUs) != 1 || !bytes.Equal(aus[0].NALUs[0], test.nalu) {
+			t.Fatalf("codec %v: %d access units", test.codec, len(aus))
+		}
+	}
+}
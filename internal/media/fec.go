@@ -0,0 +1,186 @@
+package media
+
+import (
+	"encoding/binary"
+)
+
+// max number of media packets protected by a FEC packet, the 16 bits mask
+const ulpfecMaxGroupSize = 16
+
+// ULPFEC generates RFC 5109 FEC packets, one per group of consecutive media
+// packets. A lost packet of a group can be recovered from the others.
+type ULPFEC struct {
+	groupSize int
+	group     [][]byte
+	base      uint16
+}
+
+// NewULPFEC creates a ULPFEC generator adding overhead percent of FEC packets,
+// between 1 FEC packet every 16 media packets and 1 for 1.
+func NewULPFEC(overhead int) *ULPFEC {
+	groupSize := ulpfecMaxGroupSize
+	if overhead > 0 {
+		groupSize = (100 + overhead - 1) / overhead
+	}
+	if groupSize < 1 {
+		groupSize = 1
+	}
+	if groupSize > ulpfecMaxGroupSize {
+		groupSize = ulpfecMaxGroupSize
+	}
+	return &ULPFEC{groupSize: groupSize}
+}
+
+// Push adds a marshaled media packet, kept until its group is complete. A
+// group is restarted when the sequence numbers are not consecutive.
+// Returns the FEC payload protecting the group when it is complete, or
+// mostly complete at the end of a frame (marker bit).
+func (f *ULPFEC) Push(pkt []byte) []byte {
+	if len(pkt) < 12 {
+		return nil
+	}
+	sequenceNumber := binary.BigEndian.Uint16(pkt[2:4])
+	if len(f.group) > 0 && sequenceNumber != f.base+uint16(len(f.group)) {
+		f.group = f.group[:0]
+	}
+	if len(f.group) == 0 {
+		f.base = sequenceNumber
+	}
+	f.group = append(f.group, pkt)
+
+	marker := pkt[1]&0x80 != 0
+	if len(f.group) < f.groupSize && !(marker && 2*len(f.group) >= f.groupSize) {
+		return nil
+	}
+	payload := f.encode()
+	f.group = f.group[:0]
+	return payload
+}
+
+// FEC header, ULP level 0 header (short mask) and the XOR of the protected packets
+func (f *ULPFEC) encode() []byte {
+	protectionLength := 0
+	for _, pkt := range f.group {
+		if len(pkt)-12 > protectionLength {
+			protectionLength = len(pkt) - 12
+		}
+	}
+
+	payload := make([]byte, 10+4+protectionLength)
+	var mask uint16
+	var lengthRecovery uint16
+	for i, pkt := range f.group {
+		// P, X, CC, M, PT & timestamp recovery
+		payload[0] ^= pkt[0]
+		payload[1] ^= pkt[1]
+		for j := 4; j < 8; j++ {
+			payload[j] ^= pkt[j]
+		}
+		lengthRecovery ^= uint16(len(pkt) - 12)
+		for j, b := range pkt[12:] {
+			payload[14+j] ^= b
+		}
+		mask |= 0x8000 >> uint(i)
+	}
+	// E = 0, L = 0 (16 bits mask)
+	payload[0] &= 0x3F
+	binary.BigEndian.PutUint16(payload[2:4], f.base)
+	binary.BigEndian.PutUint16(payload[8:10], lengthRecovery)
+	binary.BigEndian.PutUint16(payload[10:12], uint16(protectionLength))
+	binary.BigEndian.PutUint16(payload[12:14], mask)
+	return payload
+}
+
+// RecoverULPFEC recovers the packet missing from the group of a FEC payload
+// (RFC 5109 section 10.2), the receiver side of ULPFEC. The received packets
+// are marshaled and indexed by sequence number, the SSRC is the one of the
+// stream. Returns nil if no packet or several are missing.
+func RecoverULPFEC(fec []byte, ssrc uint32, received map[uint16][]byte) []byte {
+	if len(fec) < 14 {
+		return nil
+	}
+	base := binary.BigEndian.Uint16(fec[2:4])
+	protectionLength := int(binary.BigEndian.Uint16(fec[10:12]))
+	mask := binary.BigEndian.Uint16(fec[12:14])
+	if len(fec) < 14+protectionLength {
+		return nil
+	}
+
+	recovery := append([]byte(nil), fec[:8]...)
+	lengthRecovery := binary.BigEndian.Uint16(fec[8:10])
+	payload := append([]byte(nil), fec[14:14+protectionLength]...)
+	missing := -1
+	for i := 0; i < ulpfecMaxGroupSize; i++ {
+		if mask&(0x8000>>uint(i)) == 0 {
+			continue
+		}
+		pkt, ok := received[base+uint16(i)]
+		if !ok {
+			if missing >= 0 {
+				return nil
+			}
+			missing = i
+			continue
+		}
+		if len(pkt) < 12 || len(pkt)-12 > protectionLength {
+			return nil
+		}
+		recovery[0] ^= pkt[0]
+		recovery[1] ^= pkt[1]
+		for j := 4; j < 8; j++ {
+			recovery[j] ^= pkt[j]
+		}
+		lengthRecovery ^= uint16(len(pkt) - 12)
+		for j, b := range pkt[12:] {
+			payload[j] ^= b
+		}
+	}
+	if missing < 0 || int(lengthRecovery) > len(payload) {
+		return nil
+	}
+
+	pkt := make([]byte, 12, 12+int(lengthRecovery))
+	pkt[0] = 0x80 | recovery[0]&0x3F
+	pkt[1] = recovery[1]
+	binary.BigEndian.PutUint16(pkt[2:4], base+uint16(missing))
+	copy(pkt[4:8], recovery[4:8])
+	binary.BigEndian.PutUint32(pkt[8:12], ssrc)
+	return append(pkt, payload[:lengthRecovery]...)
+}
+
+// REDBlock is a RFC 2198 block: a payload and its RTP timestamp & payload type
+type REDBlock struct {
+	PayloadType uint8
+	Timestamp   uint32
+	Payload     []byte
+}
+
+// RED builds a RFC 2198 payload, the redundant blocks (oldest first) are
+// followed by the primary one. Redundant blocks not fitting in the headers
+// (timestamp offset >= 2^14, length >= 2^10) are skipped.
+func RED(primary REDBlock, redundant []REDBlock) []byte {
+	var blocks []REDBlock
+	for _, block := range redundant {
+		offset := primary.Timestamp - block.Timestamp
+		if offset == 0 || offset >= 1<<14 || len(block.Payload) >= 1<<10 {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+
+	size := 1 + len(primary.Payload)
+	for _, block := range blocks {
+		size += 4 + len(block.Payload)
+	}
+	payload := make([]byte, 0, size)
+	for _, block := range blocks {
+		offset := primary.Timestamp - block.Timestamp
+		header := 1<<31 | uint32(block.PayloadType&0x7F)<<24 | offset<<10 | uint32(len(block.Payload))
+		payload = append(payload, byte(header>>24), byte(header>>16), byte(header>>8), byte(header))
+	}
+	payload = append(payload, primary.PayloadType&0x7F)
+	for _, block := range blocks {
+		payload = append(payload, block.Payload...)
+	}
+	return append(payload, primary.Payload...)
+}
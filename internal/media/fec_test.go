@@ -0,0 +1,172 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func testMediaPacket(t *testing.T, sequenceNumber uint16, timestamp uint32, marker bool, size int) []byte {
+	t.Helper()
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(int(sequenceNumber)*31 + i)
+	}
+	raw, err := (&rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    96,
+			SequenceNumber: sequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           0xCAFE,
+		},
+		Payload: payload,
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestULPFECGroupSize(t *testing.T) {
+	for _, c := range []struct{ overhead, groupSize int }{
+		{0, 16}, {5, 16}, {10, 10}, {25, 4}, {50, 2}, {100, 1}, {200, 1},
+	} {
+		if got := NewULPFEC(c.overhead).groupSize; got != c.groupSize {
+			t.Errorf("overhead %d: group size %d, want %d", c.overhead, got, c.groupSize)
+		}
+	}
+}
+
+func TestULPFECHeader(t *testing.T) {
+	f := NewULPFEC(25)
+	pkts := [][]byte{
+		testMediaPacket(t, 65534, 9000, false, 100),
+		testMediaPacket(t, 65535, 9000, false, 300),
+		testMediaPacket(t, 0, 9000, false, 50),
+		testMediaPacket(t, 1, 9000, true, 200),
+	}
+	var fec []byte
+	for i, pkt := range pkts {
+		fec = f.Push(pkt)
+		if fec == nil && i == len(pkts)-1 || fec != nil && i < len(pkts)-1 {
+			t.Fatalf("FEC packet after media packet %d: %t", i, fec != nil)
+		}
+	}
+
+	// FEC header (10 bytes) then the level 0 header (4 bytes, short mask)
+	if fec[0]&0x80 != 0 {
+		t.Error("E bit set")
+	}
+	if fec[0]&0x40 != 0 {
+		t.Error("L bit set, the mask is 16 bits")
+	}
+	if got := binary.BigEndian.Uint16(fec[2:4]); got != 65534 {
+		t.Errorf("SN base %d, want 65534", got)
+	}
+	if got := binary.BigEndian.Uint32(fec[4:8]); got != 0 {
+		t.Errorf("TS recovery %d, want the XOR of 4 equal timestamps 0", got)
+	}
+	if got := binary.BigEndian.Uint16(fec[8:10]); got != 100^300^50^200 {
+		t.Errorf("length recovery %d", got)
+	}
+	if got := binary.BigEndian.Uint16(fec[10:12]); got != 300 {
+		t.Errorf("protection length %d, want the longest payload 300", got)
+	}
+	if got := binary.BigEndian.Uint16(fec[12:14]); got != 0xF000 {
+		t.Errorf("mask %04x, want f000", got)
+	}
+	if len(fec) != 14+300 {
+		t.Errorf("FEC payload size %d, want %d", len(fec), 14+300)
+	}
+}
+
+func TestULPFECRecovery(t *testing.T) {
+	pkts := [][]byte{
+		testMediaPacket(t, 100, 3000, false, 1000),
+		testMediaPacket(t, 101, 3000, false, 1000),
+		testMediaPacket(t, 102, 3000, false, 120),
+		testMediaPacket(t, 103, 6000, true, 700),
+	}
+	for lost := range pkts {
+		f := NewULPFEC(25)
+		var fec []byte
+		for _, pkt := range pkts {
+			if out := f.Push(pkt); out != nil {
+				fec = out
+			}
+		}
+		received := map[uint16][]byte{}
+		for i, pkt := range pkts {
+			if i != lost {
+				received[uint16(100+i)] = pkt
+			}
+		}
+		if got := RecoverULPFEC(fec, 0xCAFE, received); !bytes.Equal(got, pkts[lost]) {
+			t.Errorf("packet %d not recovered", lost)
+		}
+	}
+}
+
+func TestULPFECMarkerAndGaps(t *testing.T) {
+	f := NewULPFEC(25)
+	// half a group at the end of a frame is protected
+	if f.Push(testMediaPacket(t, 10, 0, false, 10)) != nil {
+		t.Fatal("FEC after a single packet")
+	}
+	fec := f.Push(testMediaPacket(t, 11, 0, true, 10))
+	if fec == nil || binary.BigEndian.Uint16(fec[12:14]) != 0xC000 {
+		t.Fatal("the end of frame did not close the half group")
+	}
+
+	// a sequence gap restarts the group
+	f.Push(testMediaPacket(t, 20, 0, false, 10))
+	f.Push(testMediaPacket(t, 22, 0, false, 10))
+	f.Push(testMediaPacket(t, 23, 0, false, 10))
+	f.Push(testMediaPacket(t, 24, 0, false, 10))
+	fec = f.Push(testMediaPacket(t, 25, 0, false, 10))
+	if fec == nil || binary.BigEndian.Uint16(fec[2:4]) != 22 {
+		t.Fatal("the group was not restarted after the gap")
+	}
+}
+
+func TestRED(t *testing.T) {
+	primary := REDBlock{PayloadType: 111, Timestamp: 100000, Payload: []byte{1, 2, 3}}
+	redundant := []REDBlock{
+		// too old for the 14 bits offset
+		{PayloadType: 111, Timestamp: 100000 - 1<<14, Payload: []byte{9}},
+		{PayloadType: 111, Timestamp: 100000 - 1920, Payload: []byte{4, 5}},
+		{PayloadType: 111, Timestamp: 100000 - 960, Payload: []byte{6, 7, 8, 9}},
+		// too long for the 10 bits length
+		{PayloadType: 111, Timestamp: 100000 - 480, Payload: make([]byte, 1024)},
+	}
+	payload := RED(primary, redundant)
+
+	want := []byte{
+		// F=1, PT 111, offset 1920, length 2
+		0x80 | 111, 1920 >> 6, 1920 << 2 & 0xFF, 2,
+		// F=1, PT 111, offset 960, length 4
+		0x80 | 111, 960 >> 6, 960 << 2 & 0xFF, 4,
+		// F=0, primary PT
+		111,
+		4, 5,
+		6, 7, 8, 9,
+		1, 2, 3,
+	}
+	if !bytes.Equal(payload, want) {
+		t.Fatalf("RED payload\n got %x\nwant %x", payload, want)
+	}
+
+	// the block headers fields
+	header := binary.BigEndian.Uint32(payload[0:4])
+	if header>>31 != 1 || header>>24&0x7F != 111 || header>>10&0x3FFF != 1920 || header&0x3FF != 2 {
+		t.Fatalf("RED block header %08x", header)
+	}
+
+	if got := RED(primary, nil); !bytes.Equal(got, []byte{111, 1, 2, 3}) {
+		t.Fatalf("RED without redundancy %x", got)
+	}
+}
@@ -0,0 +1,355 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sample entry types of the fragmented MP4 tracks
+const (
+	FMP4H264 = "avc1"
+	FMP4H265 = "hvc1"
+	FMP4PCMU = "ulaw"
+	FMP4PCMA = "alaw"
+	FMP4Opus = "Opus"
+)
+
+// FMP4Track is a track of a fragmented MP4 file
+type FMP4Track struct {
+	// Type is the sample entry type, FMP4H264, FMP4H265, FMP4PCMU, FMP4PCMA or FMP4Opus
+	Type      string
+	Timescale uint32
+	// Channels of an audio track
+	Channels int
+	// parameter sets of a video track, VPS for H.265 only
+	VPS []byte
+	SPS []byte
+	PPS []byte
+}
+
+// FMP4Sample is a sample of a fragment, the NALUs of a video sample are
+// prefixed by their 4 bytes length
+type FMP4Sample struct {
+	Data     []byte
+	Duration uint32
+	Keyframe bool
+}
+
+// trun sample flags
+const (
+	fmp4SampleSync    = 0x02000000
+	fmp4SampleNonSync = 0x01010000
+)
+
+// FMP4Writer writes a fragmented MP4 file: the init segment (ftyp & moov)
+// then a moof & mdat pair per fragment.
+type FMP4Writer struct {
+	w        io.Writer
+	tracks   []FMP4Track
+	sequence uint32
+	size     int64
+}
+
+// NewFMP4Writer writes the init segment of the tracks
+func NewFMP4Writer(w io.Writer, tracks []FMP4Track) (*FMP4Writer, error) {
+	m := &FMP4Writer{w: w, tracks: tracks}
+	moov, err := m.moov()
+	if err != nil {
+		return nil, err
+	}
+	ftyp := newMP4Box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+	if err := m.write(ftyp, moov); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Size returns the number of bytes written
+func (m *FMP4Writer) Size() int64 {
+	return m.size
+}
+
+// WriteFragment writes the samples of each track, starting at the decode
+// times of the tracks (in timescale units). Tracks without samples are
+// left out of the fragment.
+func (m *FMP4Writer) WriteFragment(samples [][]FMP4Sample, decodeTimes []uint64) error {
+	if len(samples) != len(m.tracks) || len(decodeTimes) != len(m.tracks) {
+		return errors.New("fragment tracks mismatch")
+	}
+	empty := true
+	for _, track := range samples {
+		if len(track) > 0 {
+			empty = false
+		}
+	}
+	if empty {
+		return nil
+	}
+	m.sequence++
+
+	// the trun data offsets are relative to the moof, its size is known
+	// once the truns are sized, they don't depend on the offset values
+	moof := m.moof(samples, decodeTimes, 0)
+	moof = m.moof(samples, decodeTimes, uint32(len(moof)+8))
+
+	var mdatSize int
+	for _, track := range samples {
+		for _, sample := range track {
+			mdatSize += len(sample.Data)
+		}
+	}
+	mdat := make([]byte, 8, 8+mdatSize)
+	binary.BigEndian.PutUint32(mdat, uint32(8+mdatSize))
+	copy(mdat[4:], "mdat")
+	for _, track := range samples {
+		for _, sample := range track {
+			mdat = append(mdat, sample.Data...)
+		}
+	}
+	return m.write(moof, mdat)
+}
+
+func (m *FMP4Writer) write(boxes ...[]byte) error {
+	for _, box := range boxes {
+		n, err := m.w.Write(box)
+		m.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FMP4Writer) moov() ([]byte, error) {
+	mvhd := newMP4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation & modification times
+		u32(1000), u32(0), // timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix(), make([]byte, 24), // matrix, pre_defined
+		u32(uint32(len(m.tracks)+1))) // next_track_ID
+	boxes := [][]byte{mvhd}
+	var trexs [][]byte
+	for i, track := range m.tracks {
+		trak, err := m.trak(uint32(i+1), track)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, trak)
+		trexs = append(trexs, newMP4FullBox("trex", 0, 0, u32(uint32(i+1)), u32(1), u32(0), u32(0), u32(0)))
+	}
+	boxes = append(boxes, newMP4Box("mvex", trexs...))
+	return newMP4Box("moov", boxes...), nil
+}
+
+func (m *FMP4Writer) trak(id uint32, track FMP4Track) ([]byte, error) {
+	video := track.Type == FMP4H264 || track.Type == FMP4H265
+	var width, height int
+	volume := uint16(0x0100)
+	if video {
+		codec := CodecH264
+		if track.Type == FMP4H265 {
+			codec = CodecH265
+		}
+		var err error
+		if width, height, err = VideoSize(codec, track.SPS); err != nil {
+			return nil, err
+		}
+		volume = 0
+	}
+	sampleEntry, err := fmp4SampleEntry(track, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	tkhd := newMP4FullBox("tkhd", 0, 3, // enabled, in movie
+		u32(0), u32(0), u32(id), u32(0), u32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, alternate_group, volume
+		mp4Matrix(), u32(uint32(width)<<16), u32(uint32(height)<<16))
+	mdhd := newMP4FullBox("mdhd", 0, 0,
+		u32(0), u32(0), u32(track.Timescale), u32(0),
+		u16(0x55C4), u16(0)) // und
+	handler, name, header := "soun", "SoundHandler", newMP4FullBox("smhd", 0, 0, u32(0))
+	if video {
+		handler, name, header = "vide", "VideoHandler", newMP4FullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+	hdlr := newMP4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+	dinf := newMP4Box("dinf", newMP4FullBox("dref", 0, 0, u32(1), newMP4FullBox("url ", 0, 1)))
+	stbl := newMP4Box("stbl",
+		newMP4FullBox("stsd", 0, 0, u32(1), sampleEntry),
+		newMP4FullBox("stts", 0, 0, u32(0)),
+		newMP4FullBox("stsc", 0, 0, u32(0)),
+		newMP4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		newMP4FullBox("stco", 0, 0, u32(0)))
+	minf := newMP4Box("minf", header, dinf, stbl)
+	return newMP4Box("trak", tkhd, newMP4Box("mdia", mdhd, hdlr, minf)), nil
+}
+
+func fmp4SampleEntry(track FMP4Track, width int, height int) ([]byte, error) {
+	switch track.Type {
+	case FMP4H264, FMP4H265:
+		var config []byte
+		var err error
+		if track.Type == FMP4H264 {
+			config, err = avcC(track.SPS, track.PPS)
+		} else {
+			config, err = hvcC(track.VPS, track.SPS, track.PPS)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return newMP4Box(track.Type,
+			make([]byte, 6), u16(1), // reserved, data_reference_index
+			make([]byte, 16), u16(uint16(width)), u16(uint16(height)),
+			u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, reserved, frame_count
+			make([]byte, 32), u16(0x0018), u16(0xFFFF), // compressorname, depth, pre_defined
+			config), nil
+	case FMP4PCMU, FMP4PCMA, FMP4Opus:
+		channels := track.Channels
+		if channels <= 0 {
+			channels = 1
+		}
+		var config [][]byte
+		if track.Type == FMP4Opus {
+			// version, output channels, pre-skip, input sample rate, gain, mapping family
+			config = append(config, newMP4Box("dOps", []byte{0, byte(channels)}, u16(0), u32(track.Timescale), u16(0), []byte{0}))
+		}
+		return newMP4Box(track.Type, append([][]byte{
+			make([]byte, 6), u16(1),
+			make([]byte, 8), u16(uint16(channels)), u16(16), u16(0), u16(0), // reserved, channelcount, samplesize, pre_defined, reserved
+			u32(track.Timescale << 16),
+		}, config...)...), nil
+	}
+	return nil, fmt.Errorf("unsupported MP4 track %s", track.Type)
+}
+
+func (m *FMP4Writer) moof(samples [][]FMP4Sample, decodeTimes []uint64, dataOffset uint32) []byte {
+	boxes := [][]byte{newMP4FullBox("mfhd", 0, 0, u32(m.sequence))}
+	for i, track := range samples {
+		if len(track) == 0 {
+			continue
+		}
+		// default-base-is-moof
+		tfhd := newMP4FullBox("tfhd", 0, 0x020000, u32(uint32(i+1)))
+		tfdt := newMP4FullBox("tfdt", 1, 0, u64(decodeTimes[i]))
+		// data-offset, sample duration, size & flags present
+		entries := make([]byte, 0, 12*len(track))
+		trackOffset := dataOffset
+		for _, sample := range track {
+			flags := uint32(fmp4SampleNonSync)
+			if sample.Keyframe {
+				flags = fmp4SampleSync
+			}
+			entries = append(entries, u32(sample.Duration)...)
+			entries = append(entries, u32(uint32(len(sample.Data)))...)
+			entries = append(entries, u32(flags)...)
+			dataOffset += uint32(len(sample.Data))
+		}
+		trun := newMP4FullBox("trun", 0, 0x000701, u32(uint32(len(track))), u32(trackOffset), entries)
+		boxes = append(boxes, newMP4Box("traf", tfhd, tfdt, trun))
+	}
+	return newMP4Box("moof", boxes...)
+}
+
+func avcC(sps, pps []byte) ([]byte, error) {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil, errors.New("missing H264 parameter sets")
+	}
+	// version, profile, compatibility, level, 4 bytes NALU lengths, 1 SPS
+	b := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	b = append(b, u16(uint16(len(sps)))...)
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = append(b, u16(uint16(len(pps)))...)
+	b = append(b, pps...)
+	return newMP4Box("avcC", b), nil
+}
+
+func hvcC(vps, sps, pps []byte) ([]byte, error) {
+	if len(vps) == 0 || len(pps) == 0 {
+		return nil, errors.New("missing H265 parameter sets")
+	}
+	rbsp := removeEmulationPrevention(sps[:minInt(len(sps), 24)])
+	if len(rbsp) < 15 {
+		return nil, errors.New("invalid H265 SPS")
+	}
+	// version, then the general profile_tier_level of the SPS
+	b := append([]byte{1}, rbsp[3:15]...)
+	b = append(b,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,       // parallelismType
+		0xFD,       // chroma_format_idc 4:2:0
+		0xF8, 0xF8, // bit depths 8
+		0x00, 0x00, // avgFrameRate
+		0x0F, // constantFrameRate, numTemporalLayers, temporalIdNested, 4 bytes NALU lengths
+		3)
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		// array_completeness & NALU type, 1 NALU
+		b = append(b, 0x80|naluType(CodecH265, nalu))
+		b = append(b, u16(1)...)
+		b = append(b, u16(uint16(len(nalu)))...)
+		b = append(b, nalu...)
+	}
+	return newMP4Box("hvcC", b), nil
+}
+
+// AVCCSample prefixes the NALUs of an access unit by their 4 bytes length
+func AVCCSample(au [][]byte) []byte {
+	size := 0
+	for _, nalu := range au {
+		size += 4 + len(nalu)
+	}
+	b := make([]byte, 0, size)
+	for _, nalu := range au {
+		b = append(b, u32(uint32(len(nalu)))...)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+func newMP4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, payload := range payloads {
+		b = append(b, payload...)
+	}
+	return b
+}
+
+func newMP4FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xFFFFFF)
+	return newMP4Box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// unity matrix
+func mp4Matrix() []byte {
+	b := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,226 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// parseTestFMP4 returns the parser of a written file & its top level boxes
+func parseTestFMP4(t *testing.T, data []byte) (*mp4Parser, []mp4Box) {
+	t.Helper()
+	p := &mp4Parser{r: bytes.NewReader(data), size: int64(len(data))}
+	boxes, err := p.children(0, p.size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, boxes
+}
+
+func testFMP4Payload(t *testing.T, p *mp4Parser, box mp4Box, path ...string) []byte {
+	t.Helper()
+	found, ok, err := p.find(box, path...)
+	if err != nil || !ok {
+		t.Fatalf("no %v box in %s: %v", path, box.typ, err)
+	}
+	data, err := p.payload(found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFMP4WriterLayout(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewFMP4Writer(&buf, []FMP4Track{
+		{Type: FMP4H264, Timescale: 90000, SPS: testSPS, PPS: testPPS},
+		{Type: FMP4PCMU, Timescale: 8000, Channels: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idr := AVCCSample([][]byte{testNALU(h264NALUTypeIDR, 3000)})
+	slice := AVCCSample([][]byte{testNALU(1, 500)})
+	audio := bytes.Repeat([]byte{0xFF}, 160)
+	fragments := []struct {
+		samples     [][]FMP4Sample
+		decodeTimes []uint64
+	}{
+		{
+			samples: [][]FMP4Sample{
+				{{Data: idr, Duration: 3600, Keyframe: true}, {Data: slice, Duration: 3600}},
+				{{Data: audio, Duration: 160, Keyframe: true}},
+			},
+			decodeTimes: []uint64{0, 0},
+		},
+		{
+			// the audio track has no sample in this fragment
+			samples:     [][]FMP4Sample{{{Data: slice, Duration: 3600}}, nil},
+			decodeTimes: []uint64{7200, 160},
+		},
+	}
+	for _, fragment := range fragments {
+		if err := w.WriteFragment(fragment.samples, fragment.decodeTimes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Size() != int64(buf.Len()) {
+		t.Fatalf("size %d, %d bytes written", w.Size(), buf.Len())
+	}
+
+	data := buf.Bytes()
+	p, boxes := parseTestFMP4(t, data)
+	var types []string
+	for _, box := range boxes {
+		types = append(types, box.typ)
+	}
+	if want := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat"}; !equalStrings(types, want) {
+		t.Fatalf("boxes %v, want %v", types, want)
+	}
+
+	// init segment: a trak & a trex per track
+	moov, err := p.children(boxes[1].offset, boxes[1].end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var traks int
+	for _, box := range moov {
+		if box.typ == "trak" {
+			traks++
+		}
+	}
+	mvex := moov[len(moov)-1]
+	trexs, err := p.children(mvex.offset, mvex.end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traks != 2 || mvex.typ != "mvex" || len(trexs) != 2 {
+		t.Fatalf("%d traks, %d trexs in %s, want 2", traks, len(trexs), mvex.typ)
+	}
+	stsd := testFMP4Payload(t, p, boxes[1], "trak", "mdia", "minf", "stbl", "stsd")
+	if !bytes.Contains(stsd, []byte("avc1")) || !bytes.Contains(stsd, testSPS) || !bytes.Contains(stsd, testPPS) {
+		t.Fatal("the video sample entry has no avcC with the parameter sets")
+	}
+
+	for i, fragment := range fragments {
+		moof, mdat := boxes[2+2*i], boxes[3+2*i]
+		mfhd := testFMP4Payload(t, p, moof, "mfhd")
+		if sequence := binary.BigEndian.Uint32(mfhd[4:]); sequence != uint32(i+1) {
+			t.Errorf("fragment %d sequence %d", i, sequence)
+		}
+		trafs, err := p.children(moof.offset, moof.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trafs = trafs[1:]
+		var tracks int
+		for _, samples := range fragment.samples {
+			if len(samples) > 0 {
+				tracks++
+			}
+		}
+		if len(trafs) != tracks {
+			t.Fatalf("fragment %d has %d trafs, want %d", i, len(trafs), tracks)
+		}
+
+		for track, traf := range trafs {
+			samples := fragment.samples[track]
+			tfdt := testFMP4Payload(t, p, traf, "tfdt")
+			if dts := binary.BigEndian.Uint64(tfdt[4:]); dts != fragment.decodeTimes[track] {
+				t.Errorf("fragment %d track %d decode time %d, want %d", i, track, dts, fragment.decodeTimes[track])
+			}
+			trun := testFMP4Payload(t, p, traf, "trun")
+			if count := int(binary.BigEndian.Uint32(trun[4:])); count != len(samples) {
+				t.Fatalf("fragment %d track %d has %d samples, want %d", i, track, count, len(samples))
+			}
+			// the data offset is relative to the moof & points in its mdat
+			offset := moof.start + int64(binary.BigEndian.Uint32(trun[8:]))
+			for n, sample := range samples {
+				entry := trun[12+12*n:]
+				if duration := binary.BigEndian.Uint32(entry); duration != sample.Duration {
+					t.Errorf("fragment %d track %d sample %d duration %d", i, track, n, duration)
+				}
+				size := int64(binary.BigEndian.Uint32(entry[4:]))
+				flags := binary.BigEndian.Uint32(entry[8:])
+				if (flags&mp4SampleIsNonSync == 0) != sample.Keyframe {
+					t.Errorf("fragment %d track %d sample %d flags %08x", i, track, n, flags)
+				}
+				if offset < mdat.offset || offset+size > mdat.end || !bytes.Equal(data[offset:offset+size], sample.Data) {
+					t.Fatalf("fragment %d track %d sample %d is not at its data offset", i, track, n)
+				}
+				offset += size
+			}
+		}
+	}
+
+	// and it reads back as a fragmented MP4 video track
+	track, err := ReadMP4VideoTrack(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(track.SPS, testSPS) || !bytes.Equal(track.PPS, testPPS) || len(track.Samples) != 3 {
+		t.Fatalf("read back track %+v", track)
+	}
+	for n, sample := range track.Samples {
+		if sample.DTS != int64(n*3600) || sample.Sync != (n == 0) {
+			t.Errorf("read back sample %d %+v", n, sample)
+		}
+	}
+}
+
+func TestFMP4WriterAudioEntries(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewFMP4Writer(&buf, []FMP4Track{
+		{Type: FMP4PCMA, Timescale: 8000},
+		{Type: FMP4Opus, Timescale: 48000, Channels: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	p, boxes := parseTestFMP4(t, buf.Bytes())
+	traks, err := p.children(boxes[1].offset, boxes[1].end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, typ := range []string{"alaw", "Opus"} {
+		stsd := testFMP4Payload(t, p, traks[1+i], "mdia", "minf", "stbl", "stsd")
+		if entry := string(stsd[12:16]); entry != typ {
+			t.Errorf("track %d sample entry %q, want %q", i, entry, typ)
+		}
+	}
+	stsd := testFMP4Payload(t, p, traks[2], "mdia", "minf", "stbl", "stsd")
+	dOps := bytes.Index(stsd, []byte("dOps"))
+	if dOps < 0 || stsd[dOps+5] != 2 || binary.BigEndian.Uint32(stsd[dOps+8:]) != 48000 {
+		t.Fatal("the Opus entry has no dOps of its 2 channels at 48kHz")
+	}
+}
+
+func TestFMP4WriterFragments(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewFMP4Writer(&buf, []FMP4Track{{Type: FMP4PCMU, Timescale: 8000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	// an empty fragment is not written
+	if err := w.WriteFragment([][]FMP4Sample{nil}, []uint64{0}); err != nil || buf.Len() != size {
+		t.Fatalf("empty fragment written: %v", err)
+	}
+	if err := w.WriteFragment(nil, nil); err == nil {
+		t.Fatal("fragment of no track written")
+	}
+	if _, err := NewFMP4Writer(&buf, []FMP4Track{{Type: FMP4H264, Timescale: 90000}}); err == nil {
+		t.Fatal("H264 track without parameter sets")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
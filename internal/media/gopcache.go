@@ -0,0 +1,60 @@
+package media
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// DefaultGOPCacheSize is the default max number of packets kept by a GOPCache
+const DefaultGOPCacheSize = 2048
+
+// GOPCache keeps the packets of the current group of pictures, from the
+// last keyframe up to the latest access unit. When the GOP grows over the
+// max size the cache is dropped until the next keyframe.
+type GOPCache struct {
+	mutex      sync.Mutex
+	maxPackets int
+	packets    []*rtp.Packet
+	overflow   bool
+}
+
+// NewGOPCache creates a GOPCache, maxPackets <= 0 uses DefaultGOPCacheSize.
+func NewGOPCache(maxPackets int) *GOPCache {
+	if maxPackets <= 0 {
+		maxPackets = DefaultGOPCacheSize
+	}
+	return &GOPCache{maxPackets: maxPackets}
+}
+
+// Push adds the packets of an access unit.
+func (c *GOPCache) Push(au []*rtp.Packet, keyframe bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if keyframe {
+		c.packets = c.packets[:0]
+		c.overflow = false
+	} else if c.overflow || len(c.packets) == 0 {
+		// no keyframe to start from
+		return
+	}
+
+	if len(c.packets)+len(au) > c.maxPackets {
+		c.packets = c.packets[:0]
+		c.overflow = true
+		return
+	}
+	c.packets = append(c.packets, au...)
+}
+
+// Packets returns a copy of the cached GOP, nil if there is no complete GOP.
+func (c *GOPCache) Packets() []*rtp.Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.packets) == 0 {
+		return nil
+	}
+	return append([]*rtp.Packet(nil), c.packets...)
+}
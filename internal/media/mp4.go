@@ -0,0 +1,672 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MP4Sample is a sample (access unit) of a MP4 track, read from the file on demand
+type MP4Sample struct {
+	Offset int64
+	Size   uint32
+	// DTS is the decode time in timescale units, CTSOffset the presentation offset
+	DTS       int64
+	CTSOffset int32
+	Sync      bool
+}
+
+// MP4VideoTrack is the first H.264/H.265 track of a MP4 or fragmented MP4 file
+type MP4VideoTrack struct {
+	Codec     Codec
+	Timescale uint32
+	VPS       []byte
+	SPS       []byte
+	PPS       []byte
+	Samples   []MP4Sample
+	// size of the NALU lengths of the samples
+	lengthSize int
+}
+
+// the sample is not a sync sample, in the trun/trex sample flags
+const mp4SampleIsNonSync = 0x10000
+
+type mp4Box struct {
+	typ   string
+	start int64
+	// payload, after the header
+	offset int64
+	end    int64
+}
+
+// mp4Parser reads the boxes of a file
+type mp4Parser struct {
+	r    io.ReaderAt
+	size int64
+
+	track   *MP4VideoTrack
+	trackID uint32
+	found   bool
+	// trex defaults of the track
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+	// decode time following the last fragment
+	nextDTS int64
+}
+
+// ReadMP4VideoTrack reads the sample table of the first video track, from the
+// moov box and from the moof boxes of a fragmented file.
+func ReadMP4VideoTrack(r io.ReaderAt, size int64) (*MP4VideoTrack, error) {
+	p := &mp4Parser{r: r, size: size}
+	boxes, err := p.children(0, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, box := range boxes {
+		if box.typ != "moov" {
+			continue
+		}
+		if err := p.parseMoov(box); err != nil {
+			return nil, err
+		}
+	}
+	if !p.found {
+		return nil, errors.New("no H.264/H.265 track in the MP4 file")
+	}
+	for _, box := range boxes {
+		if box.typ != "moof" {
+			continue
+		}
+		if err := p.parseMoof(box); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.track.Samples) == 0 {
+		return nil, errors.New("no sample in the MP4 video track")
+	}
+	return p.track, nil
+}
+
+// NALUs reads a sample and splits its length prefixed NALUs
+func (t *MP4VideoTrack) NALUs(r io.ReaderAt, sample MP4Sample) ([][]byte, error) {
+	data := make([]byte, sample.Size)
+	if _, err := r.ReadAt(data, sample.Offset); err != nil {
+		return nil, err
+	}
+	return t.SplitNALUs(data)
+}
+
+// SplitNALUs splits the length prefixed NALUs of a sample
+func (t *MP4VideoTrack) SplitNALUs(data []byte) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < t.lengthSize {
+			return nil, errors.New("truncated MP4 sample")
+		}
+		var n int
+		for _, b := range data[:t.lengthSize] {
+			n = n<<8 | int(b)
+		}
+		data = data[t.lengthSize:]
+		if n > len(data) {
+			return nil, errors.New("truncated MP4 sample")
+		}
+		if n > 0 {
+			nalus = append(nalus, data[:n])
+		}
+		data = data[n:]
+	}
+	return nalus, nil
+}
+
+// ParseDecoderConfig reads the parameter sets & NALU length size of an avcC
+// or hvcC record, as in the FLV sequence headers. The track has no sample.
+func ParseDecoderConfig(codec Codec, record []byte) (*MP4VideoTrack, error) {
+	t := &MP4VideoTrack{Codec: codec}
+	if codec == CodecH265 {
+		return t, t.parseHvcC(record)
+	}
+	return t, t.parseAvcC(record)
+}
+
+func (p *mp4Parser) read(offset int64, n int64) ([]byte, error) {
+	if n < 0 || offset+n > p.size {
+		return nil, errors.New("truncated MP4 box")
+	}
+	buf := make([]byte, n)
+	if _, err := p.r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// The boxes between start and end
+func (p *mp4Parser) children(start int64, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for offset := start; offset+8 <= end; {
+		header, err := p.read(offset, 8)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		box := mp4Box{typ: string(header[4:8]), start: offset, offset: offset + 8}
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			large, err := p.read(offset+8, 8)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(large))
+			box.offset += 8
+		}
+		if size < box.offset-offset || offset+size > end {
+			return nil, fmt.Errorf("invalid MP4 box %q size", box.typ)
+		}
+		box.end = offset + size
+		boxes = append(boxes, box)
+		offset = box.end
+	}
+	return boxes, nil
+}
+
+func (p *mp4Parser) payload(box mp4Box) ([]byte, error) {
+	return p.read(box.offset, box.end-box.offset)
+}
+
+// The first child of a type
+func (p *mp4Parser) child(box mp4Box, typ string) (mp4Box, bool, error) {
+	boxes, err := p.children(box.offset, box.end)
+	if err != nil {
+		return mp4Box{}, false, err
+	}
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true, nil
+		}
+	}
+	return mp4Box{}, false, nil
+}
+
+// The box at a path of types under box
+func (p *mp4Parser) find(box mp4Box, path ...string) (mp4Box, bool, error) {
+	for _, typ := range path {
+		var ok bool
+		var err error
+		box, ok, err = p.child(box, typ)
+		if err != nil || !ok {
+			return box, ok, err
+		}
+	}
+	return box, true, nil
+}
+
+func (p *mp4Parser) parseMoov(moov mp4Box) error {
+	boxes, err := p.children(moov.offset, moov.end)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if box.typ != "trak" || p.found {
+			continue
+		}
+		if err := p.parseTrak(box); err != nil {
+			return err
+		}
+	}
+	if !p.found {
+		return nil
+	}
+
+	trex, ok, err := p.find(moov, "mvex", "trex")
+	if err != nil || !ok {
+		return err
+	}
+	data, err := p.payload(trex)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 24 && binary.BigEndian.Uint32(data[4:]) == p.trackID {
+		p.defaultDuration = binary.BigEndian.Uint32(data[12:])
+		p.defaultSize = binary.BigEndian.Uint32(data[16:])
+		p.defaultFlags = binary.BigEndian.Uint32(data[20:])
+	}
+	return nil
+}
+
+func (p *mp4Parser) parseTrak(trak mp4Box) error {
+	hdlr, ok, err := p.find(trak, "mdia", "hdlr")
+	if err != nil || !ok {
+		return err
+	}
+	data, err := p.payload(hdlr)
+	if err != nil {
+		return err
+	}
+	if len(data) < 12 || string(data[8:12]) != "vide" {
+		return nil
+	}
+
+	stsd, ok, err := p.find(trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil || !ok {
+		return err
+	}
+	track := &MP4VideoTrack{}
+	if ok, err := p.parseStsd(stsd, track); err != nil || !ok {
+		return err
+	}
+
+	tkhd, ok, err := p.find(trak, "tkhd")
+	if err != nil || !ok {
+		return err
+	}
+	data, err = p.payload(tkhd)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 24 && data[0] == 1 {
+		p.trackID = binary.BigEndian.Uint32(data[20:])
+	} else if len(data) >= 16 {
+		p.trackID = binary.BigEndian.Uint32(data[12:])
+	}
+
+	mdhd, ok, err := p.find(trak, "mdia", "mdhd")
+	if err != nil || !ok {
+		return err
+	}
+	data, err = p.payload(mdhd)
+	if err != nil {
+		return err
+	}
+	if len(data) >= 24 && data[0] == 1 {
+		track.Timescale = binary.BigEndian.Uint32(data[20:])
+	} else if len(data) >= 16 {
+		track.Timescale = binary.BigEndian.Uint32(data[12:])
+	}
+	if track.Timescale == 0 {
+		return errors.New("invalid MP4 video track timescale")
+	}
+
+	stbl, _, err := p.find(trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return err
+	}
+	if err := p.parseStbl(stbl, track); err != nil {
+		return err
+	}
+	p.track = track
+	p.found = true
+	return nil
+}
+
+// The codec & parameter sets of the first sample entry
+func (p *mp4Parser) parseStsd(stsd mp4Box, track *MP4VideoTrack) (bool, error) {
+	// version, flags & entry count
+	entries, err := p.children(stsd.offset+8, stsd.end)
+	if err != nil || len(entries) == 0 {
+		return false, err
+	}
+	entry := entries[0]
+	var configType string
+	switch entry.typ {
+	case "avc1", "avc3":
+		track.Codec = CodecH264
+		configType = "avcC"
+	case "hvc1", "hev1":
+		track.Codec = CodecH265
+		configType = "hvcC"
+	default:
+		return false, nil
+	}
+
+	// the visual sample entry fields are followed by the boxes
+	boxes, err := p.children(entry.offset+78, entry.end)
+	if err != nil {
+		return false, err
+	}
+	for _, box := range boxes {
+		if box.typ != configType {
+			continue
+		}
+		data, err := p.payload(box)
+		if err != nil {
+			return false, err
+		}
+		if track.Codec == CodecH265 {
+			return true, track.parseHvcC(data)
+		}
+		return true, track.parseAvcC(data)
+	}
+	return false, fmt.Errorf("no %s in the MP4 video track", configType)
+}
+
+func (t *MP4VideoTrack) parseAvcC(data []byte) error {
+	if len(data) < 6 {
+		return errors.New("invalid avcC")
+	}
+	t.lengthSize = int(data[4]&0x03) + 1
+	pos := 5
+	for _, count := range []int{-1, -2} {
+		if pos >= len(data) {
+			return errors.New("invalid avcC")
+		}
+		n := int(data[pos])
+		if count == -1 {
+			n &= 0x1F
+		}
+		pos++
+		for i := 0; i < n; i++ {
+			if pos+2 > len(data) {
+				return errors.New("invalid avcC")
+			}
+			size := int(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+			if pos+size > len(data) {
+				return errors.New("invalid avcC")
+			}
+			nalu := append([]byte(nil), data[pos:pos+size]...)
+			pos += size
+			if count == -1 && t.SPS == nil {
+				t.SPS = nalu
+			} else if count == -2 && t.PPS == nil {
+				t.PPS = nalu
+			}
+		}
+	}
+	return nil
+}
+
+func (t *MP4VideoTrack) parseHvcC(data []byte) error {
+	if len(data) < 23 {
+		return errors.New("invalid hvcC")
+	}
+	t.lengthSize = int(data[21]&0x03) + 1
+	arrays := int(data[22])
+	pos := 23
+	for i := 0; i < arrays; i++ {
+		if pos+3 > len(data) {
+			return errors.New("invalid hvcC")
+		}
+		typ := data[pos] & 0x3F
+		n := int(binary.BigEndian.Uint16(data[pos+1:]))
+		pos += 3
+		for j := 0; j < n; j++ {
+			if pos+2 > len(data) {
+				return errors.New("invalid hvcC")
+			}
+			size := int(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+			if pos+size > len(data) {
+				return errors.New("invalid hvcC")
+			}
+			nalu := append([]byte(nil), data[pos:pos+size]...)
+			pos += size
+			switch {
+			case typ == h265NALUTypeVPS && t.VPS == nil:
+				t.VPS = nalu
+			case typ == h265NALUTypeSPS && t.SPS == nil:
+				t.SPS = nalu
+			case typ == h265NALUTypePPS && t.PPS == nil:
+				t.PPS = nalu
+			}
+		}
+	}
+	return nil
+}
+
+// The samples of a progressive file, empty in a fragmented one
+func (p *mp4Parser) parseStbl(stbl mp4Box, track *MP4VideoTrack) error {
+	tables := map[string][]byte{}
+	boxes, err := p.children(stbl.offset, stbl.end)
+	if err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		switch box.typ {
+		case "stts", "ctts", "stsc", "stsz", "stco", "co64", "stss":
+			if tables[box.typ], err = p.payload(box); err != nil {
+				return err
+			}
+		}
+	}
+
+	stsz := tables["stsz"]
+	if len(stsz) < 12 {
+		return nil
+	}
+	count := int(binary.BigEndian.Uint32(stsz[8:]))
+	if count == 0 {
+		return nil
+	}
+	samples := make([]MP4Sample, count)
+	fixedSize := binary.BigEndian.Uint32(stsz[4:])
+	for i := range samples {
+		if fixedSize != 0 {
+			samples[i].Size = fixedSize
+			continue
+		}
+		if 12+4*i+4 > len(stsz) {
+			return errors.New("invalid MP4 stsz")
+		}
+		samples[i].Size = binary.BigEndian.Uint32(stsz[12+4*i:])
+	}
+
+	// decode times
+	stts := tables["stts"]
+	dts := int64(0)
+	i := 0
+	for pos := 8; pos+8 <= len(stts) && i < count; pos += 8 {
+		n := int(binary.BigEndian.Uint32(stts[pos:]))
+		delta := int64(binary.BigEndian.Uint32(stts[pos+4:]))
+		for ; n > 0 && i < count; n-- {
+			samples[i].DTS = dts
+			dts += delta
+			i++
+		}
+	}
+
+	// composition offsets, signed in version 1 (and in practice in version 0)
+	ctts := tables["ctts"]
+	i = 0
+	for pos := 8; pos+8 <= len(ctts) && i < count; pos += 8 {
+		n := int(binary.BigEndian.Uint32(ctts[pos:]))
+		offset := int32(binary.BigEndian.Uint32(ctts[pos+4:]))
+		for ; n > 0 && i < count; n-- {
+			samples[i].CTSOffset = offset
+			i++
+		}
+	}
+
+	// sync samples, all of them without stss
+	if stss, ok := tables["stss"]; ok {
+		for pos := 8; pos+4 <= len(stss); pos += 4 {
+			n := int(binary.BigEndian.Uint32(stss[pos:]))
+			if n >= 1 && n <= count {
+				samples[n-1].Sync = true
+			}
+		}
+	} else {
+		for i := range samples {
+			samples[i].Sync = true
+		}
+	}
+
+	// offsets from the chunks
+	var chunkOffsets []int64
+	if stco, ok := tables["stco"]; ok && len(stco) >= 8 {
+		for pos := 8; pos+4 <= len(stco); pos += 4 {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint32(stco[pos:])))
+		}
+	} else if co64, ok := tables["co64"]; ok && len(co64) >= 8 {
+		for pos := 8; pos+8 <= len(co64); pos += 8 {
+			chunkOffsets = append(chunkOffsets, int64(binary.BigEndian.Uint64(co64[pos:])))
+		}
+	}
+	stsc := tables["stsc"]
+	i = 0
+	for pos := 8; pos+12 <= len(stsc) && i < count; pos += 12 {
+		firstChunk := int(binary.BigEndian.Uint32(stsc[pos:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(stsc[pos+4:]))
+		lastChunk := len(chunkOffsets)
+		if pos+24 <= len(stsc) {
+			lastChunk = int(binary.BigEndian.Uint32(stsc[pos+12:])) - 1
+		}
+		for chunk := firstChunk; chunk < lastChunk && chunk < len(chunkOffsets) && i < count; chunk++ {
+			offset := chunkOffsets[chunk]
+			for n := 0; n < perChunk && i < count; n++ {
+				samples[i].Offset = offset
+				offset += int64(samples[i].Size)
+				i++
+			}
+		}
+	}
+	if i < count {
+		return errors.New("invalid MP4 sample to chunk table")
+	}
+
+	track.Samples = samples
+	p.nextDTS = dts
+	return nil
+}
+
+// The samples of the track in a movie fragment
+func (p *mp4Parser) parseMoof(moof mp4Box) error {
+	trafs, err := p.children(moof.offset, moof.end)
+	if err != nil {
+		return err
+	}
+	for _, traf := range trafs {
+		if traf.typ != "traf" {
+			continue
+		}
+		boxes, err := p.children(traf.offset, traf.end)
+		if err != nil {
+			return err
+		}
+
+		// track fragment header
+		baseOffset := moof.start
+		duration, size, flags := p.defaultDuration, p.defaultSize, p.defaultFlags
+		matches := false
+		dts := p.nextDTS
+		for _, box := range boxes {
+			data, err := p.payload(box)
+			if err != nil {
+				return err
+			}
+			switch box.typ {
+			case "tfhd":
+				if len(data) < 8 {
+					return errors.New("invalid MP4 tfhd")
+				}
+				tfFlags := binary.BigEndian.Uint32(data) & 0xFFFFFF
+				matches = binary.BigEndian.Uint32(data[4:]) == p.trackID
+				pos := 8
+				for _, field := range []struct {
+					flag uint32
+					size int
+					dst  *uint32
+				}{{0x01, 8, nil}, {0x02, 4, nil}, {0x08, 4, &duration}, {0x10, 4, &size}, {0x20, 4, &flags}} {
+					if tfFlags&field.flag == 0 {
+						continue
+					}
+					if pos+field.size > len(data) {
+						return errors.New("invalid MP4 tfhd")
+					}
+					if field.flag == 0x01 {
+						baseOffset = int64(binary.BigEndian.Uint64(data[pos:]))
+					} else if field.dst != nil {
+						*field.dst = binary.BigEndian.Uint32(data[pos:])
+					}
+					pos += field.size
+				}
+			case "tfdt":
+				if len(data) >= 12 && data[0] == 1 {
+					dts = int64(binary.BigEndian.Uint64(data[4:]))
+				} else if len(data) >= 8 {
+					dts = int64(binary.BigEndian.Uint32(data[4:]))
+				}
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		dataOffset := baseOffset
+		for _, box := range boxes {
+			if box.typ != "trun" {
+				continue
+			}
+			data, err := p.payload(box)
+			if err != nil {
+				return err
+			}
+			if dataOffset, dts, err = p.parseTrun(data, dataOffset, baseOffset, dts, duration, size, flags); err != nil {
+				return err
+			}
+		}
+		p.nextDTS = dts
+	}
+	return nil
+}
+
+// Append the samples of a track run, returns the offset & decode time following it
+func (p *mp4Parser) parseTrun(data []byte, dataOffset int64, baseOffset int64, dts int64, duration, size, flags uint32) (int64, int64, error) {
+	if len(data) < 8 {
+		return 0, 0, errors.New("invalid MP4 trun")
+	}
+	trFlags := binary.BigEndian.Uint32(data) & 0xFFFFFF
+	count := int(binary.BigEndian.Uint32(data[4:]))
+	pos := 8
+	if trFlags&0x01 != 0 {
+		if pos+4 > len(data) {
+			return 0, 0, errors.New("invalid MP4 trun")
+		}
+		dataOffset = baseOffset + int64(int32(binary.BigEndian.Uint32(data[pos:])))
+		pos += 4
+	}
+	firstFlags, hasFirstFlags := uint32(0), trFlags&0x04 != 0
+	if hasFirstFlags {
+		if pos+4 > len(data) {
+			return 0, 0, errors.New("invalid MP4 trun")
+		}
+		firstFlags = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	}
+
+	for i := 0; i < count; i++ {
+		sample := MP4Sample{Offset: dataOffset, DTS: dts, Size: size}
+		sampleDuration, sampleFlags := duration, flags
+		if i == 0 && hasFirstFlags {
+			sampleFlags = firstFlags
+		}
+		for _, field := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if trFlags&field == 0 {
+				continue
+			}
+			if pos+4 > len(data) {
+				return 0, 0, errors.New("invalid MP4 trun")
+			}
+			v := binary.BigEndian.Uint32(data[pos:])
+			pos += 4
+			switch field {
+			case 0x100:
+				sampleDuration = v
+			case 0x200:
+				sample.Size = v
+			case 0x400:
+				sampleFlags = v
+			case 0x800:
+				sample.CTSOffset = int32(v)
+			}
+		}
+		sample.Sync = sampleFlags&mp4SampleIsNonSync == 0
+		p.track.Samples = append(p.track.Samples, sample)
+		dataOffset += int64(sample.Size)
+		dts += int64(sampleDuration)
+	}
+	return dataOffset, dts, nil
+}
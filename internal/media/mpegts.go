@@ -0,0 +1,395 @@
+package media
+
+import (
+	"errors"
+)
+
+// TSPacketSize is the size of a MPEG-TS packet
+const TSPacketSize = 188
+
+// MPEG-TS stream types
+const (
+	TSStreamH264 = 0x1B
+	TSStreamH265 = 0x24
+	TSStreamAAC  = 0x0F
+	// TSStreamPrivate carries Opus when registered as "Opus"
+	TSStreamPrivate = 0x06
+	// G.711 stream types of the security cameras
+	TSStreamPCMA = 0x90
+	TSStreamPCMU = 0x91
+)
+
+// PCR & PTS are 33 bits, 90 kHz
+const tsTimestampMask = 1<<33 - 1
+
+// TSStream is an elementary stream of the program
+type TSStream struct {
+	PID        uint16
+	StreamType uint8
+	// Registration is the format identifier of the registration descriptor
+	Registration string
+}
+
+// TSFrame is a PES packet of an elementary stream
+type TSFrame struct {
+	PID uint16
+	// PTS & DTS in 90 kHz units, DTS is the PTS when not set
+	PTS  int64
+	DTS  int64
+	Data []byte
+}
+
+type tsPES struct {
+	stream TSStream
+	data   []byte
+	// expected size of the PES packet, 0 if unbounded
+	size int
+	cc   int
+}
+
+// TSDemuxer extracts the PES packets of the first program of a transport
+// stream, its PCR gives the timing.
+type TSDemuxer struct {
+	pmtPID  int
+	pcrPID  int
+	streams []TSStream
+	pes     map[uint16]*tsPES
+	// PAT & PMT sections spanning several packets, from the pointer field
+	sections map[uint16][]byte
+
+	pcr    int64
+	hasPCR bool
+	// PCR discontinuity flag of the last PCR
+	discontinuity bool
+}
+
+// NewTSDemuxer creates a TSDemuxer
+func NewTSDemuxer() *TSDemuxer {
+	return &TSDemuxer{pmtPID: -1, pcrPID: -1, pes: make(map[uint16]*tsPES), sections: make(map[uint16][]byte)}
+}
+
+// Streams returns the elementary streams of the PMT, nil before it is read
+func (d *TSDemuxer) Streams() []TSStream {
+	return d.streams
+}
+
+// PCR returns the last program clock reference (90 kHz) and if it follows a
+// discontinuity
+func (d *TSDemuxer) PCR() (pcr int64, ok bool, discontinuity bool) {
+	return d.pcr, d.hasPCR, d.discontinuity
+}
+
+// Push demuxes a TS packet, returns the PES packets it completes
+func (d *TSDemuxer) Push(pkt []byte) ([]TSFrame, error) {
+	if len(pkt) < TSPacketSize || pkt[0] != 0x47 {
+		return nil, errors.New("invalid TS packet")
+	}
+	pkt = pkt[:TSPacketSize]
+	if pkt[1]&0x80 != 0 {
+		// transport error
+		return nil, nil
+	}
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	adaptation := (pkt[3] >> 4) & 0x03
+	cc := int(pkt[3] & 0x0F)
+
+	payload := pkt[4:]
+	if adaptation&0x02 != 0 {
+		n := int(payload[0])
+		if n > len(payload)-1 {
+			return nil, errors.New("invalid TS adaptation field")
+		}
+		if n > 0 && int(pid) == d.pcrPID {
+			d.readPCR(payload[1 : 1+n])
+		}
+		payload = payload[1+n:]
+	}
+	if adaptation&0x01 == 0 {
+		return nil, nil
+	}
+
+	if pid == 0 || int(pid) == d.pmtPID {
+		d.readSection(pid, pusi, payload)
+		return nil, nil
+	}
+
+	pes, ok := d.pes[pid]
+	if !ok {
+		return nil, nil
+	}
+	var frames []TSFrame
+	if pusi {
+		if frame, ok := pes.flush(); ok {
+			frames = append(frames, frame)
+		}
+		pes.data = append(pes.data[:0], payload...)
+		pes.size = 0
+		if len(payload) >= 6 {
+			if n := int(payload[4])<<8 | int(payload[5]); n > 0 {
+				pes.size = 6 + n
+			}
+		}
+	} else if pes.data != nil {
+		if cc != (pes.cc+1)&0x0F && cc != pes.cc {
+			// a lost packet, drop the PES
+			pes.data = nil
+		} else if cc != pes.cc {
+			pes.data = append(pes.data, payload...)
+		}
+	}
+	pes.cc = cc
+	if pes.size > 0 && len(pes.data) >= pes.size {
+		if frame, ok := pes.flush(); ok {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+// Flush returns the PES packets of unbounded size still buffered, at the end
+// of the stream
+func (d *TSDemuxer) Flush() []TSFrame {
+	var frames []TSFrame
+	for _, stream := range d.streams {
+		if frame, ok := d.pes[stream.PID].flush(); ok {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+func (d *TSDemuxer) readPCR(field []byte) {
+	// discontinuity indicator & PCR flag
+	if field[0]&0x10 == 0 || len(field) < 7 {
+		return
+	}
+	d.pcr = int64(field[1])<<25 | int64(field[2])<<17 | int64(field[3])<<9 | int64(field[4])<<1 | int64(field[5]>>7)
+	d.discontinuity = field[0]&0x80 != 0
+	d.hasPCR = true
+}
+
+// The section after the pointer field, up to its CRC
+func tsSection(payload []byte, tableID byte) []byte {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 8 || section[0] != tableID {
+		return nil
+	}
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if length < 9 || 3+length > len(section) {
+		return nil
+	}
+	// header up to the last section number, without the CRC
+	return section[8 : 3+length-4]
+}
+
+// Buffer the section until its length is received
+func (d *TSDemuxer) readSection(pid uint16, pusi bool, payload []byte) {
+	section, ok := d.sections[pid]
+	switch {
+	case pusi:
+		section = append(section[:0], payload...)
+	case ok:
+		section = append(section, payload...)
+	default:
+		return
+	}
+	d.sections[pid] = section
+
+	if len(section) < 1 || len(section) < 1+int(section[0])+3 {
+		return
+	}
+	header := section[1+int(section[0]):]
+	length := int(header[1]&0x0F)<<8 | int(header[2])
+	if len(header) < 3+length {
+		return
+	}
+	delete(d.sections, pid)
+	if pid == 0 {
+		d.readPAT(section)
+	} else {
+		d.readPMT(section)
+	}
+}
+
+// The PMT of the first program
+func (d *TSDemuxer) readPAT(payload []byte) {
+	programs := tsSection(payload, 0x00)
+	for len(programs) >= 4 {
+		number := int(programs[0])<<8 | int(programs[1])
+		pid := int(programs[2]&0x1F)<<8 | int(programs[3])
+		programs = programs[4:]
+		if number != 0 {
+			d.pmtPID = pid
+			return
+		}
+	}
+}
+
+func (d *TSDemuxer) readPMT(payload []byte) {
+	section := tsSection(payload, 0x02)
+	if len(section) < 4 {
+		return
+	}
+	d.pcrPID = int(section[0]&0x1F)<<8 | int(section[1])
+	infoLength := int(section[2]&0x0F)<<8 | int(section[3])
+	if 4+infoLength > len(section) {
+		return
+	}
+	entries := section[4+infoLength:]
+
+	var streams []TSStream
+	for len(entries) >= 5 {
+		stream := TSStream{
+			StreamType: entries[0],
+			PID:        uint16(entries[1]&0x1F)<<8 | uint16(entries[2]),
+		}
+		n := int(entries[3]&0x0F)<<8 | int(entries[4])
+		if 5+n > len(entries) {
+			break
+		}
+		descriptors := entries[5 : 5+n]
+		for len(descriptors) >= 2 && 2+int(descriptors[1]) <= len(descriptors) {
+			// registration descriptor
+			if descriptors[0] == 0x05 && descriptors[1] >= 4 {
+				stream.Registration = string(descriptors[2:6])
+			}
+			descriptors = descriptors[2+int(descriptors[1]):]
+		}
+		streams = append(streams, stream)
+		entries = entries[5+n:]
+	}
+
+	if tsSameStreams(d.streams, streams) {
+		return
+	}
+	d.streams = streams
+	d.pes = make(map[uint16]*tsPES)
+	for _, stream := range streams {
+		d.pes[stream.PID] = &tsPES{stream: stream}
+	}
+}
+
+func tsSameStreams(a, b []TSStream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse the PES header of the buffered packet
+func (p *tsPES) flush() (TSFrame, bool) {
+	if p == nil || p.data == nil {
+		return TSFrame{}, false
+	}
+	data := p.data
+	p.data = nil
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return TSFrame{}, false
+	}
+	if p.size > 0 && len(data) > p.size {
+		data = data[:p.size]
+	}
+	flags := data[7]
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) {
+		return TSFrame{}, false
+	}
+	frame := TSFrame{PID: p.stream.PID}
+	if flags&0x80 != 0 && headerLength >= 5 {
+		frame.PTS = tsTimestamp(data[9:])
+		frame.DTS = frame.PTS
+		if flags&0x40 != 0 && headerLength >= 10 {
+			frame.DTS = tsTimestamp(data[14:])
+		}
+	}
+	frame.Data = append([]byte(nil), data[9+headerLength:]...)
+	return frame, true
+}
+
+func tsTimestamp(b []byte) int64 {
+	return (int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)) & tsTimestampMask
+}
+
+// TSTimestampDiff returns a - b of two 33 bits timestamps, wrapping around
+func TSTimestampDiff(a int64, b int64) int64 {
+	diff := (a - b) & tsTimestampMask
+	if diff >= 1<<32 {
+		diff -= 1 << 33
+	}
+	return diff
+}
+
+// OpusTSPackets returns the Opus packets of an Opus PES payload (ETSI TS 102
+// 366 control headers)
+func OpusTSPackets(data []byte) [][]byte {
+	var packets [][]byte
+	for len(data) >= 2 && data[0] == 0x7F && data[1]&0xE0 == 0xE0 {
+		startTrim := data[1]&0x10 != 0
+		endTrim := data[1]&0x08 != 0
+		extension := data[1]&0x04 != 0
+		pos := 2
+		size := 0
+		for pos < len(data) {
+			b := data[pos]
+			pos++
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+		if startTrim {
+			pos += 2
+		}
+		if endTrim {
+			pos += 2
+		}
+		if extension {
+			if pos >= len(data) {
+				return packets
+			}
+			pos += 1 + int(data[pos])
+		}
+		if pos+size > len(data) {
+			return packets
+		}
+		packets = append(packets, data[pos:pos+size])
+		data = data[pos+size:]
+	}
+	return packets
+}
+
+// OpusPacketDuration returns the duration of an Opus packet in 48 kHz samples
+func OpusPacketDuration(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame int
+	switch {
+	case config < 12:
+		frame = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		frame = []int{480, 960}[config%2]
+	default:
+		frame = []int{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return int(packet[1]&0x3F) * frame
+}
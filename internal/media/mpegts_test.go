@@ -0,0 +1,270 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	testTSPMTPID   = 0x1000
+	testTSVideoPID = 0x100
+	testTSOpusPID  = 0x101
+)
+
+// testTSWriter packetizes sections & PES packets, with the continuity
+// counters of the PIDs
+type testTSWriter struct {
+	cc map[uint16]byte
+}
+
+func newTestTSWriter() *testTSWriter {
+	return &testTSWriter{cc: make(map[uint16]byte)}
+}
+
+// Split a payload in TS packets, the first one starts it and carries the PCR
+// if pcr >= 0, the last one is stuffed with the adaptation field
+func (w *testTSWriter) packets(pid uint16, payload []byte, pcr int64, discontinuity bool) [][]byte {
+	var pkts [][]byte
+	for first := true; first || len(payload) > 0; first = false {
+		var af []byte
+		if first && pcr >= 0 {
+			flags := byte(0x10)
+			if discontinuity {
+				flags |= 0x80
+			}
+			af = []byte{flags, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7E, 0}
+		}
+		afSize := 0
+		if af != nil {
+			afSize = 1 + len(af)
+		}
+		n := len(payload)
+		if n > 184-afSize {
+			n = 184 - afSize
+		}
+		if pad := 184 - afSize - n; pad > 0 {
+			if af == nil {
+				af = []byte{}
+				pad--
+			}
+			if len(af) == 0 && pad > 0 {
+				af = append(af, 0)
+				pad--
+			}
+			af = append(af, bytes.Repeat([]byte{0xFF}, pad)...)
+		}
+
+		pkt := []byte{0x47, byte(pid>>8) & 0x1F, byte(pid), 0x10 | w.cc[pid]}
+		if first {
+			pkt[1] |= 0x40
+		}
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(append(pkt, byte(len(af))), af...)
+		}
+		pkts = append(pkts, append(pkt, payload[:n]...))
+		payload = payload[n:]
+		w.cc[pid] = (w.cc[pid] + 1) & 0x0F
+	}
+	return pkts
+}
+
+// A section after its pointer field, the CRC is not checked
+func testTSSection(tableID byte, id uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xC1, 0, 0}
+	return append(append(section, body...), 0, 0, 0, 0)
+}
+
+func testTSPAT() []byte {
+	return testTSSection(0x00, 1, []byte{0, 1, 0xE0 | testTSPMTPID>>8, testTSPMTPID & 0xFF})
+}
+
+// H.264 & Opus, the PCR on the video PID
+func testTSPMT() []byte {
+	return testTSPMTDescriptors(nil)
+}
+
+// The PMT with the given descriptors for the video stream
+func testTSPMTDescriptors(descriptors []byte) []byte {
+	body := []byte{0xE0 | testTSVideoPID>>8, testTSVideoPID & 0xFF, 0xF0, 0}
+	body = append(body, TSStreamH264, 0xE0|testTSVideoPID>>8, testTSVideoPID&0xFF, 0xF0|byte(len(descriptors)>>8), byte(len(descriptors)))
+	body = append(body, descriptors...)
+	body = append(body, TSStreamPrivate, 0xE0|testTSOpusPID>>8, testTSOpusPID&0xFF, 0xF0, 6, 0x05, 4, 'O', 'p', 'u', 's')
+	return testTSSection(0x02, 1, body)
+}
+
+func testTSTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>30&0x07)<<1 | 1,
+		byte(ts >> 22),
+		byte(ts>>15&0x7F)<<1 | 1,
+		byte(ts >> 7),
+		byte(ts&0x7F)<<1 | 1,
+	}
+}
+
+// A PES packet with the PTS, and the DTS if >= 0. The length of the
+// unbounded ones is 0, as for the video.
+func testPES(streamID byte, pts int64, dts int64, data []byte, bounded bool) []byte {
+	header := append([]byte{0x80, 0x80, 5}, testTSTimestamp(0x02, pts)...)
+	if dts >= 0 {
+		header = append([]byte{0x80, 0xC0, 10}, testTSTimestamp(0x03, pts)...)
+		header = append(header, testTSTimestamp(0x01, dts)...)
+	}
+	length := 0
+	if bounded {
+		length = len(header) + len(data)
+	}
+	pes := append([]byte{0, 0, 1, streamID, byte(length >> 8), byte(length)}, header...)
+	return append(pes, data...)
+}
+
+func pushTS(t *testing.T, d *TSDemuxer, pkts [][]byte) []TSFrame {
+	t.Helper()
+	var frames []TSFrame
+	for _, pkt := range pkts {
+		if len(pkt) != TSPacketSize {
+			t.Fatalf("TS packet of %d bytes", len(pkt))
+		}
+		out, err := d.Push(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, out...)
+	}
+	return frames
+}
+
+func TestTSDemuxerStreams(t *testing.T) {
+	w := newTestTSWriter()
+	d := NewTSDemuxer()
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+	if d.Streams() != nil {
+		t.Fatal("streams before the PMT")
+	}
+	pushTS(t, d, w.packets(testTSPMTPID, testTSPMT(), -1, false))
+	want := []TSStream{
+		{PID: testTSVideoPID, StreamType: TSStreamH264},
+		{PID: testTSOpusPID, StreamType: TSStreamPrivate, Registration: "Opus"},
+	}
+	if !tsSameStreams(d.Streams(), want) {
+		t.Fatalf("streams %+v, want %+v", d.Streams(), want)
+	}
+}
+
+// A PMT over 2 TS packets, the PAT in between
+func TestTSDemuxerSectionAcrossPackets(t *testing.T) {
+	w := newTestTSWriter()
+	d := NewTSDemuxer()
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+
+	// a private descriptor of 250 bytes
+	descriptor := append([]byte{0x80, 250}, bytes.Repeat([]byte{0xAA}, 250)...)
+	pkts := w.packets(testTSPMTPID, testTSPMTDescriptors(descriptor), -1, false)
+	if len(pkts) != 2 {
+		t.Fatalf("PMT in %d TS packets, want 2", len(pkts))
+	}
+	pushTS(t, d, pkts[:1])
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+	if d.Streams() != nil {
+		t.Fatal("streams before the end of the PMT")
+	}
+	pushTS(t, d, pkts[1:])
+	want := []TSStream{
+		{PID: testTSVideoPID, StreamType: TSStreamH264},
+		{PID: testTSOpusPID, StreamType: TSStreamPrivate, Registration: "Opus"},
+	}
+	if !tsSameStreams(d.Streams(), want) {
+		t.Fatalf("streams %+v, want %+v", d.Streams(), want)
+	}
+}
+
+func TestTSDemuxerPES(t *testing.T) {
+	w := newTestTSWriter()
+	d := NewTSDemuxer()
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+	pushTS(t, d, w.packets(testTSPMTPID, testTSPMT(), -1, false))
+
+	// an unbounded video PES over 3 TS packets, completed by the next one
+	video := bytes.Repeat([]byte{0, 0, 0, 1, 0x65, 0x88, 1, 2, 3}, 50)
+	pkts := w.packets(testTSVideoPID, testPES(0xE0, 93600, 90000, video, false), -1, false)
+	if len(pkts) != 3 {
+		t.Fatalf("video PES in %d TS packets, want 3", len(pkts))
+	}
+	if frames := pushTS(t, d, pkts); len(frames) != 0 {
+		t.Fatalf("unbounded PES returned before the next one")
+	}
+	frames := pushTS(t, d, w.packets(testTSVideoPID, testPES(0xE0, 97200, 93600, video[:20], false), -1, false))
+	if len(frames) != 1 || frames[0].PID != testTSVideoPID || frames[0].PTS != 93600 || frames[0].DTS != 90000 || !bytes.Equal(frames[0].Data, video) {
+		t.Fatalf("video frame %+v", frames)
+	}
+	frames = d.Flush()
+	if len(frames) != 1 || frames[0].PTS != 97200 || !bytes.Equal(frames[0].Data, video[:20]) {
+		t.Fatalf("flushed video frame %+v", frames)
+	}
+
+	// a lost TS packet drops the PES
+	pkts = w.packets(testTSVideoPID, testPES(0xE0, 100800, -1, video, false), -1, false)
+	pushTS(t, d, [][]byte{pkts[0], pkts[2]})
+	if frames := d.Flush(); len(frames) != 0 {
+		t.Fatalf("PES with a lost packet returned")
+	}
+}
+
+func TestTSDemuxerOpus(t *testing.T) {
+	w := newTestTSWriter()
+	d := NewTSDemuxer()
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+	pushTS(t, d, w.packets(testTSPMTPID, testTSPMT(), -1, false))
+
+	// 2 Opus packets of 20ms (SILK WB config 9, code 0) with their control headers,
+	// the second one has a 300 bytes size (0xFF + 45)
+	first := append([]byte{9 << 3}, bytes.Repeat([]byte{1}, 99)...)
+	second := append([]byte{9 << 3}, bytes.Repeat([]byte{2}, 299)...)
+	data := append([]byte{0x7F, 0xE0, 100}, first...)
+	data = append(append(data, 0x7F, 0xE0, 0xFF, 45), second...)
+
+	// a bounded PES is returned with its last TS packet
+	frames := pushTS(t, d, w.packets(testTSOpusPID, testPES(0xC0, 180000, -1, data, true), -1, false))
+	if len(frames) != 1 || frames[0].PID != testTSOpusPID || frames[0].PTS != 180000 || frames[0].DTS != 180000 {
+		t.Fatalf("Opus frame %+v", frames)
+	}
+	packets := OpusTSPackets(frames[0].Data)
+	if len(packets) != 2 || !bytes.Equal(packets[0], first) || !bytes.Equal(packets[1], second) {
+		t.Fatalf("got %d Opus packets", len(packets))
+	}
+	if n := OpusPacketDuration(packets[0]); n != 960 {
+		t.Fatalf("Opus packet duration %d, want 960", n)
+	}
+}
+
+func TestTSDemuxerPCR(t *testing.T) {
+	w := newTestTSWriter()
+	d := NewTSDemuxer()
+	pushTS(t, d, w.packets(0, testTSPAT(), -1, false))
+	pushTS(t, d, w.packets(testTSPMTPID, testTSPMT(), -1, false))
+
+	// not the PCR PID
+	pushTS(t, d, w.packets(testTSOpusPID, testPES(0xC0, 0, -1, []byte{1}, true), 1234, false))
+	if _, ok, _ := d.PCR(); ok {
+		t.Fatal("PCR read on another PID")
+	}
+
+	pushTS(t, d, w.packets(testTSVideoPID, testPES(0xE0, 0, -1, []byte{1}, false), 1<<33-1, false))
+	if pcr, ok, discontinuity := d.PCR(); !ok || pcr != 1<<33-1 || discontinuity {
+		t.Fatalf("PCR %d %t %t", pcr, ok, discontinuity)
+	}
+	pushTS(t, d, w.packets(testTSVideoPID, testPES(0xE0, 0, -1, []byte{1}, false), 900, true))
+	if pcr, ok, discontinuity := d.PCR(); !ok || pcr != 900 || !discontinuity {
+		t.Fatalf("PCR %d %t %t", pcr, ok, discontinuity)
+	}
+
+	// across the 33 bits wrap
+	if diff := TSTimestampDiff(900, 1<<33-1); diff != 901 {
+		t.Fatalf("timestamp diff %d, want 901", diff)
+	}
+	if diff := TSTimestampDiff(1<<33-1, 900); diff != -901 {
+		t.Fatalf("timestamp diff %d, want -901", diff)
+	}
+}
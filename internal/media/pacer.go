@@ -0,0 +1,203 @@
+package media
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// DefaultPacerQueueSize is the default max number of packets queued by a Pacer
+const DefaultPacerQueueSize = 1024
+
+// interval between two pacer rounds, the bucket holds up to one round of
+// data (at least a full packet) so a silent period does not allow a burst
+const pacerInterval = 5 * time.Millisecond
+
+// PacerStats are the counters of a Pacer
+type PacerStats struct {
+	// Rate is the current pacing rate (bps)
+	Rate int `json:"rate"`
+	// Queued is the number of packets waiting
+	Queued int `json:"queued"`
+	// Sent is the number of packets written
+	Sent uint64 `json:"sent"`
+	// Dropped is the number of packets dropped because the queue was full, the
+	// whole access units are dropped
+	Dropped uint64 `json:"dropped"`
+	// AverageDelay & MaxDelay are the time spent in the queue, in ms
+	AverageDelay float64 `json:"average_delay_ms"`
+	MaxDelay     float64 `json:"max_delay_ms"`
+}
+
+type pacedPacket struct {
+	pkt    *rtp.Packet
+	write  func(*rtp.Packet) error
+	queued time.Time
+}
+
+// Pacer is a leaky bucket writing the queued packets of a track at a max
+// rate, so the bursts of large keyframes are spread over time. When the queue
+// is full the access unit of the new packet is dropped, its queued packets
+// included, the peer does not get a truncated frame.
+type Pacer struct {
+	mutex    sync.Mutex
+	rate     int
+	maxQueue int
+	queue    []pacedPacket
+	tokens   int
+	last     time.Time
+	// the packets of the dropped access unit are dropped up to its marker
+	dropping      bool
+	dropTimestamp uint32
+
+	sent       uint64
+	dropped    uint64
+	totalDelay time.Duration
+	maxDelay   time.Duration
+	onError    func(error)
+
+	done chan struct{}
+}
+
+// NewPacer creates a Pacer sending at rate bps, maxQueue <= 0 uses DefaultPacerQueueSize.
+func NewPacer(rate int, maxQueue int) *Pacer {
+	if maxQueue <= 0 {
+		maxQueue = DefaultPacerQueueSize
+	}
+	p := &Pacer{
+		rate:     rate,
+		maxQueue: maxQueue,
+		last:     time.Now(),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// SetRate changes the pacing rate (bps).
+func (p *Pacer) SetRate(rate int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rate = rate
+}
+
+// OnWriteError sets the handler of the errors of the queued packets writes.
+func (p *Pacer) OnWriteError(handler func(error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.onError = handler
+}
+
+// Push queues a packet written later with write. Returns false if the packet
+// is dropped.
+func (p *Pacer) Push(pkt *rtp.Packet, write func(*rtp.Packet) error) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.dropping && pkt.Timestamp == p.dropTimestamp {
+		p.dropped++
+		p.dropping = !pkt.Marker
+		return false
+	}
+	p.dropping = false
+
+	if len(p.queue) >= p.maxQueue {
+		// the access unit is dropped, from its queued packets
+		for len(p.queue) > 0 && p.queue[len(p.queue)-1].pkt.Timestamp == pkt.Timestamp {
+			p.queue = p.queue[:len(p.queue)-1]
+			p.dropped++
+		}
+		p.dropped++
+		p.dropping = !pkt.Marker
+		p.dropTimestamp = pkt.Timestamp
+		return false
+	}
+	p.queue = append(p.queue, pacedPacket{pkt: pkt, write: write, queued: time.Now()})
+	return true
+}
+
+// Close stops the pacer, the queued packets are dropped.
+func (p *Pacer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	p.queue = nil
+}
+
+// Stats returns the pacer counters.
+func (p *Pacer) Stats() PacerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := PacerStats{
+		Rate:     p.rate,
+		Queued:   len(p.queue),
+		Sent:     p.sent,
+		Dropped:  p.dropped,
+		MaxDelay: float64(p.maxDelay) / float64(time.Millisecond),
+	}
+	if p.sent > 0 {
+		stats.AverageDelay = float64(p.totalDelay) / float64(p.sent) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+func (p *Pacer) run() {
+	ticker := time.NewTicker(pacerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			items, onError := p.take(now)
+			for _, item := range items {
+				if err := item.write(item.pkt); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}
+}
+
+// Take the packets fitting in the bucket & the handler of their write errors
+func (p *Pacer) take(now time.Time) ([]pacedPacket, func(error)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	burst := p.rate / 8 * int(pacerInterval) / int(time.Second)
+	if burst < 1500 {
+		burst = 1500
+	}
+	p.tokens += int(int64(p.rate) / 8 * int64(now.Sub(p.last)) / int64(time.Second))
+	if p.tokens > burst {
+		p.tokens = burst
+	}
+	p.last = now
+
+	n := 0
+	for n < len(p.queue) && p.tokens > 0 {
+		item := p.queue[n]
+		p.tokens -= item.pkt.MarshalSize()
+		delay := now.Sub(item.queued)
+		p.totalDelay += delay
+		if delay > p.maxDelay {
+			p.maxDelay = delay
+		}
+		n++
+	}
+	p.sent += uint64(n)
+
+	items := append([]pacedPacket(nil), p.queue[:n]...)
+	p.queue = p.queue[n:]
+	return items, p.onError
+}
@@ -0,0 +1,76 @@
+package media
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// When the queue is full the access unit is dropped, from its queued packets
+// up to its marker
+func TestPacerDropsAccessUnits(t *testing.T) {
+	// nothing is sent at 0 bps
+	p := NewPacer(0, 4)
+	defer p.Close()
+	write := func(*rtp.Packet) error { return nil }
+
+	var dropped []uint16
+	for i, pkt := range []rtp.Header{
+		{Timestamp: 3000}, {Timestamp: 3000, Marker: true},
+		{Timestamp: 6000}, {Timestamp: 6000}, {Timestamp: 6000}, {Timestamp: 6000, Marker: true},
+		{Timestamp: 9000, Marker: true},
+	} {
+		pkt.SequenceNumber = uint16(i)
+		if !p.Push(&rtp.Packet{Header: pkt, Payload: []byte{1}}, write) {
+			dropped = append(dropped, pkt.SequenceNumber)
+		}
+	}
+	if len(dropped) != 2 || dropped[0] != 4 || dropped[1] != 5 {
+		t.Fatalf("dropped packets %v", dropped)
+	}
+	stats := p.Stats()
+	if stats.Queued != 3 || stats.Dropped != 4 {
+		t.Fatalf("stats %+v", stats)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, want := range []uint32{3000, 3000, 9000} {
+		if p.queue[i].pkt.Timestamp != want {
+			t.Fatalf("queued packet %d at %d", i, p.queue[i].pkt.Timestamp)
+		}
+	}
+}
+
+// The errors of the paced writes are given to the write error handler
+func TestPacerWriteErrors(t *testing.T) {
+	p := NewPacer(1_000_000, 0)
+	defer p.Close()
+	errs := make(chan error, 2)
+	p.OnWriteError(func(err error) { errs <- err })
+
+	failed := errors.New("track closed")
+	write := func(pkt *rtp.Packet) error {
+		if pkt.SequenceNumber == 1 {
+			return failed
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		p.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Marker: true}, Payload: []byte{1}}, write)
+	}
+	select {
+	case err := <-errs:
+		if err != failed {
+			t.Fatalf("write error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the write error is not reported")
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected write error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
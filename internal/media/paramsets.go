@@ -0,0 +1,149 @@
+package media
+
+import (
+	"bytes"
+	"log"
+)
+
+// H.264 NALU types
+const (
+	h264NALUTypeIDR = 5
+	h264NALUTypeSPS = 7
+	h264NALUTypePPS = 8
+	h264NALUTypeFUA = 28
+)
+
+// H.265 NALU types
+const (
+	h265NALUTypeBLAWLP = 16
+	h265NALUTypeCRANUT = 21
+	h265NALUTypeVPS    = 32
+	h265NALUTypeSPS    = 33
+	h265NALUTypePPS    = 34
+	h265NALUTypeFU     = 49
+)
+
+// parameterSets caches the latest VPS (H.265 only), SPS and PPS of a stream,
+// taken from the SDP and from the in-band NALUs
+type parameterSets struct {
+	vps []byte
+	sps []byte
+	pps []byte
+}
+
+func naluType(codec Codec, nalu []byte) byte {
+	if codec == CodecH265 {
+		return (nalu[0] >> 1) & 0x3F
+	}
+	return nalu[0] & 0x1F
+}
+
+// IsKeyframe returns true if the NALU is a H.264 IDR or a H.265 IRAP picture.
+func IsKeyframe(codec Codec, nalu []byte) bool {
+	if len(nalu) == 0 {
+		return false
+	}
+	typ := naluType(codec, nalu)
+	if codec == CodecH265 {
+		return typ >= h265NALUTypeBLAWLP && typ <= h265NALUTypeCRANUT
+	}
+	return typ == h264NALUTypeIDR
+}
+
+// IsKeyframePacket returns true if a RTP payload made by the Repacketizer
+// (single NALU or FU-A/FU fragment) carries a keyframe slice.
+func IsKeyframePacket(codec Codec, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch typ := naluType(codec, payload); {
+	case codec == CodecH265 && typ == h265NALUTypeFU:
+		if len(payload) < 3 {
+			return false
+		}
+		fuType := payload[2] & 0x3F
+		return fuType >= h265NALUTypeBLAWLP && fuType <= h265NALUTypeCRANUT
+	case codec == CodecH264 && typ == h264NALUTypeFUA:
+		return len(payload) >= 2 && payload[1]&0x1F == h264NALUTypeIDR
+	}
+	return IsKeyframe(codec, payload)
+}
+
+// Update the cache with the parameter sets found in an access unit
+func (p *parameterSets) update(codec Codec, au [][]byte) {
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch typ := naluType(codec, nalu); {
+		case codec == CodecH265 && typ == h265NALUTypeVPS:
+			p.vps = updateParameterSet(p.vps, nalu, "VPS")
+		case codec == CodecH265 && typ == h265NALUTypeSPS, codec == CodecH264 && typ == h264NALUTypeSPS:
+			p.sps = updateParameterSet(p.sps, nalu, "SPS")
+		case codec == CodecH265 && typ == h265NALUTypePPS, codec == CodecH264 && typ == h264NALUTypePPS:
+			p.pps = updateParameterSet(p.pps, nalu, "PPS")
+		}
+	}
+}
+
+func updateParameterSet(cached []byte, nalu []byte, name string) []byte {
+	if bytes.Equal(cached, nalu) {
+		return cached
+	}
+	if cached != nil {
+		log.Printf("Camera %s changed, size %d -> %d", name, len(cached), len(nalu))
+	}
+	return append([]byte(nil), nalu...)
+}
+
+// Put the cached parameter sets right before the first slice of a keyframe
+// access unit, in VPS, SPS, PPS order. The in-band ones were already cached
+// by `update`, so they are moved rather than duplicated.
+func (p *parameterSets) inject(codec Codec, au [][]byte) [][]byte {
+	keyframe := false
+	for _, nalu := range au {
+		if IsKeyframe(codec, nalu) {
+			keyframe = true
+			break
+		}
+	}
+	if !keyframe || p.sps == nil || p.pps == nil {
+		return au
+	}
+
+	var sets [][]byte
+	if codec == CodecH265 && p.vps != nil {
+		sets = append(sets, p.vps)
+	}
+	sets = append(sets, p.sps, p.pps)
+
+	injected := make([][]byte, 0, len(au)+len(sets))
+	for _, nalu := range au {
+		if len(nalu) == 0 || isParameterSet(codec, nalu) {
+			continue
+		}
+		if sets != nil && isSlice(codec, nalu) {
+			injected = append(injected, sets...)
+			sets = nil
+		}
+		injected = append(injected, nalu)
+	}
+	return injected
+}
+
+func isParameterSet(codec Codec, nalu []byte) bool {
+	typ := naluType(codec, nalu)
+	if codec == CodecH265 {
+		return typ == h265NALUTypeVPS || typ == h265NALUTypeSPS || typ == h265NALUTypePPS
+	}
+	return typ == h264NALUTypeSPS || typ == h264NALUTypePPS
+}
+
+// VCL NALU
+func isSlice(codec Codec, nalu []byte) bool {
+	typ := naluType(codec, nalu)
+	if codec == CodecH265 {
+		return typ < h265NALUTypeVPS
+	}
+	return typ >= 1 && typ <= h264NALUTypeIDR
+}
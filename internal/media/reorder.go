@@ -0,0 +1,227 @@
+package media
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// DefaultReorderBufferSize is the max number of packets held by a ReorderBuffer
+const DefaultReorderBufferSize = 512
+
+// a jump of more sequence numbers is a stream restart, not a loss
+const reorderMaxJump = 3000
+
+// ReorderStats are the counters of a ReorderBuffer
+type ReorderStats struct {
+	// Received is the number of packets received
+	Received uint64 `json:"received"`
+	// Lost is the number of missing packets skipped after the latency
+	Lost uint64 `json:"lost"`
+	// Reordered is the number of packets received out of order, in time
+	Reordered uint64 `json:"reordered"`
+	// Late is the number of packets received after being skipped, dropped
+	Late uint64 `json:"late"`
+	// Duplicates is the number of packets received twice, dropped
+	Duplicates uint64 `json:"duplicates"`
+	// NACKed is the number of missing packets requested again
+	NACKed uint64 `json:"nacked"`
+}
+
+type bufferedPacket struct {
+	pkt     *rtp.Packet
+	arrival time.Time
+}
+
+// ReorderBuffer puts the packets of a stream back in order. A missing packet
+// is waited for up to the latency, then skipped. With a 0 latency the packets
+// are only counted.
+type ReorderBuffer struct {
+	latency time.Duration
+	// called with the sequence numbers missing when a gap is seen
+	onMissing func(ssrc uint32, sequenceNumbers []uint16)
+
+	mutex   sync.Mutex
+	started bool
+	next    uint16
+	highest uint16
+	packets map[uint16]bufferedPacket
+	// output state of the recent sequence numbers: delivered or skipped
+	delivered [DefaultReorderBufferSize]bool
+	stats     ReorderStats
+}
+
+// NewReorderBuffer creates a ReorderBuffer, onMissing is optional.
+func NewReorderBuffer(latency time.Duration, onMissing func(ssrc uint32, sequenceNumbers []uint16)) *ReorderBuffer {
+	return &ReorderBuffer{
+		latency:   latency,
+		onMissing: onMissing,
+		packets:   make(map[uint16]bufferedPacket),
+	}
+}
+
+// Reset restarts the sequence numbering, e.g. after a reconnection. The
+// counters are kept.
+func (b *ReorderBuffer) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.started = false
+	b.packets = make(map[uint16]bufferedPacket)
+}
+
+// Stats returns the buffer counters.
+func (b *ReorderBuffer) Stats() ReorderStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.stats
+}
+
+// Push adds a packet and returns the packets ready to be sent, in order.
+// The packet is copied when it has to wait.
+func (b *ReorderBuffer) Push(pkt *rtp.Packet, now time.Time) []*rtp.Packet {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.stats.Received++
+	if !b.started {
+		b.started = true
+		b.next = pkt.SequenceNumber
+		b.highest = pkt.SequenceNumber - 1
+	}
+
+	diff := int16(pkt.SequenceNumber - b.next)
+	switch {
+	case diff < 0 && int(-diff) < DefaultReorderBufferSize:
+		if b.delivered[pkt.SequenceNumber%DefaultReorderBufferSize] {
+			b.stats.Duplicates++
+		} else {
+			b.stats.Late++
+		}
+		return nil
+	case diff < 0 || int(diff) > reorderMaxJump:
+		// the stream restarted
+		out := b.drain()
+		b.next = pkt.SequenceNumber
+		b.highest = pkt.SequenceNumber - 1
+		return append(out, b.release(pkt, now)...)
+	}
+	return b.release(pkt, now)
+}
+
+// Flush returns the packets waiting longer than the latency, skipping the
+// missing ones before them. Push calls it, it's needed at the Deadline when
+// no packet follows the gap.
+func (b *ReorderBuffer) Flush(now time.Time) []*rtp.Packet {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.expire(now)
+}
+
+// Deadline returns when the missing packets are given up and Flush releases
+// the packets waiting behind them, ok is false if no packet is waiting.
+func (b *ReorderBuffer) Deadline() (deadline time.Time, ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, p := range b.packets {
+		if !ok || p.arrival.Before(deadline) {
+			deadline = p.arrival
+			ok = true
+		}
+	}
+	return deadline.Add(b.latency), ok
+}
+
+func (b *ReorderBuffer) release(pkt *rtp.Packet, now time.Time) []*rtp.Packet {
+	if _, ok := b.packets[pkt.SequenceNumber]; ok {
+		b.stats.Duplicates++
+		return nil
+	}
+
+	if int16(pkt.SequenceNumber-b.highest) > 0 {
+		if gap := pkt.SequenceNumber - b.highest - 1; gap > 0 && b.onMissing != nil {
+			missing := make([]uint16, 0, gap)
+			for seq := b.highest + 1; seq != pkt.SequenceNumber; seq++ {
+				missing = append(missing, seq)
+			}
+			b.stats.NACKed += uint64(len(missing))
+			b.onMissing(pkt.SSRC, missing)
+		}
+		b.highest = pkt.SequenceNumber
+	} else {
+		b.stats.Reordered++
+	}
+
+	// fast path, nothing waiting
+	if pkt.SequenceNumber == b.next && len(b.packets) == 0 {
+		b.deliver(pkt.SequenceNumber)
+		return []*rtp.Packet{pkt}
+	}
+
+	copied := &rtp.Packet{Header: pkt.Header.Clone(), Payload: append([]byte(nil), pkt.Payload...)}
+	b.packets[pkt.SequenceNumber] = bufferedPacket{pkt: copied, arrival: now}
+	return b.expire(now)
+}
+
+// Output the packets in order, skip the missing ones waited for too long
+func (b *ReorderBuffer) expire(now time.Time) []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(b.packets) > 0 {
+		if p, ok := b.packets[b.next]; ok {
+			delete(b.packets, b.next)
+			b.deliver(b.next)
+			out = append(out, p.pkt)
+			continue
+		}
+
+		// the oldest packet waiting decides if the gap is given up
+		oldest := now
+		for _, p := range b.packets {
+			if p.arrival.Before(oldest) {
+				oldest = p.arrival
+			}
+		}
+		if now.Sub(oldest) < b.latency && len(b.packets) < DefaultReorderBufferSize {
+			break
+		}
+		for first := b.firstBuffered(); b.next != first; b.next++ {
+			b.delivered[b.next%DefaultReorderBufferSize] = false
+			b.stats.Lost++
+		}
+	}
+	return out
+}
+
+// Lowest sequence number waiting
+func (b *ReorderBuffer) firstBuffered() uint16 {
+	first := b.next
+	minDiff := -1
+	for seq := range b.packets {
+		if d := int(uint16(seq - b.next)); minDiff < 0 || d < minDiff {
+			minDiff = d
+			first = seq
+		}
+	}
+	return first
+}
+
+func (b *ReorderBuffer) deliver(sequenceNumber uint16) {
+	b.delivered[sequenceNumber%DefaultReorderBufferSize] = true
+	b.next = sequenceNumber + 1
+}
+
+// Output every waiting packet
+func (b *ReorderBuffer) drain() []*rtp.Packet {
+	var out []*rtp.Packet
+	for len(b.packets) > 0 {
+		first := b.firstBuffered()
+		out = append(out, b.packets[first].pkt)
+		delete(b.packets, first)
+		b.deliver(first)
+	}
+	return out
+}
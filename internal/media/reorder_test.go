@@ -0,0 +1,47 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func testReorderPacket(sequenceNumber uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sequenceNumber}, Payload: []byte{byte(sequenceNumber)}}
+}
+
+// The packets behind a gap are released at the deadline, without a next packet
+func TestReorderBufferDeadline(t *testing.T) {
+	latency := 50 * time.Millisecond
+	b := NewReorderBuffer(latency, nil)
+	now := time.Now()
+
+	if out := b.Push(testReorderPacket(1), now); len(out) != 1 {
+		t.Fatalf("%d packets released, want 1", len(out))
+	}
+	if _, ok := b.Deadline(); ok {
+		t.Fatal("deadline without a packet waiting")
+	}
+
+	// 2 is missing
+	b.Push(testReorderPacket(3), now.Add(10*time.Millisecond))
+	b.Push(testReorderPacket(4), now.Add(20*time.Millisecond))
+	deadline, ok := b.Deadline()
+	if !ok || !deadline.Equal(now.Add(10*time.Millisecond+latency)) {
+		t.Fatalf("deadline %v %t, want %v", deadline.Sub(now), ok, 10*time.Millisecond+latency)
+	}
+	if out := b.Flush(deadline.Add(-time.Millisecond)); len(out) != 0 {
+		t.Fatalf("%d packets released before the deadline", len(out))
+	}
+	out := b.Flush(deadline)
+	if len(out) != 2 || out[0].SequenceNumber != 3 || out[1].SequenceNumber != 4 {
+		t.Fatalf("released %v", out)
+	}
+	if _, ok := b.Deadline(); ok {
+		t.Fatal("deadline after the flush")
+	}
+	if stats := b.Stats(); stats.Lost != 1 || stats.Received != 3 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
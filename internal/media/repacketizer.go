@@ -0,0 +1,156 @@
+// Package media holds the RTP processing applied to the camera packets
+// before they are written to the WebRTC tracks.
+package media
+
+import (
+	"github.com/pion/rtp"
+)
+
+// Codec is a video codec handled by the media package.
+type Codec int
+
+// supported codecs.
+const (
+	CodecH264 Codec = iota
+	CodecH265
+)
+
+// DefaultMaxPayloadSize fits a RTP packet in the SRTP MTU used by pion (1200 bytes
+// of RTP payload plus headers, SRTP auth tag and ICE/TURN overhead)
+const DefaultMaxPayloadSize = 1200
+
+// Repacketizer packetizes again the access units of a Depacketizer, so no
+// packet payload exceeds MaxPayloadSize. The RTP timestamps are kept, the
+// sequence numbers are continuous. The latest parameter sets are prepended
+// to every keyframe.
+type Repacketizer struct {
+	*Depacketizer
+
+	codec          Codec
+	maxPayloadSize int
+	params         parameterSets
+	gop            *GOPCache
+
+	started        bool
+	sequenceNumber uint16
+}
+
+// NewRepacketizer creates a Repacketizer, maxPayloadSize <= 0 uses DefaultMaxPayloadSize.
+func NewRepacketizer(codec Codec, maxPayloadSize int) *Repacketizer {
+	if maxPayloadSize <= 0 {
+		maxPayloadSize = DefaultMaxPayloadSize
+	}
+	return &Repacketizer{Depacketizer: NewDepacketizer(codec), codec: codec, maxPayloadSize: maxPayloadSize}
+}
+
+// SetParameterSets sets the parameter sets announced out of band (SDP),
+// vps is ignored for H.264. Parameter sets found in-band replace them.
+func (r *Repacketizer) SetParameterSets(vps, sps, pps []byte) {
+	var au [][]byte
+	for _, nalu := range [][]byte{vps, sps, pps} {
+		if len(nalu) > 0 {
+			au = append(au, nalu)
+		}
+	}
+	r.params.update(r.codec, au)
+}
+
+// SetGOPCache sets a cache filled with every packetized access unit.
+func (r *Repacketizer) SetGOPCache(gop *GOPCache) {
+	r.gop = gop
+}
+
+// Push decodes a camera packet. When it completes an access unit, the
+// access unit is returned packetized again.
+func (r *Repacketizer) Push(pkt *rtp.Packet) ([]*rtp.Packet, error) {
+	if !r.started {
+		r.started = true
+		r.sequenceNumber = pkt.SequenceNumber
+	}
+	aus, err := r.Depacketizer.Push(pkt)
+	var out []*rtp.Packet
+	for _, au := range aus {
+		out = append(out, r.packetize(au)...)
+	}
+	return out, err
+}
+
+// Packetize an access unit
+func (r *Repacketizer) packetize(au AccessUnit) []*rtp.Packet {
+	r.params.update(r.codec, au.NALUs)
+	nalus := r.params.inject(r.codec, au.NALUs)
+	keyframe := false
+
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		if IsKeyframe(r.codec, nalu) {
+			keyframe = true
+		}
+		payloads = append(payloads, r.packetizeNALU(nalu)...)
+	}
+
+	packets := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    au.payloadType,
+				SequenceNumber: r.sequenceNumber,
+				Timestamp:      au.Timestamp,
+				SSRC:           au.ssrc,
+			},
+			Payload: payload,
+		}
+		r.sequenceNumber++
+	}
+
+	if r.gop != nil {
+		r.gop.Push(packets, keyframe)
+	}
+	return packets
+}
+
+// Split a NALU into single NAL unit or fragmentation unit payloads
+func (r *Repacketizer) packetizeNALU(nalu []byte) [][]byte {
+	if len(nalu) <= r.maxPayloadSize {
+		return [][]byte{nalu}
+	}
+
+	// H.264 FU-A: indicator + FU header, H.265 FU: 2 bytes payload header + FU header
+	var header []byte
+	var data []byte
+	switch r.codec {
+	case CodecH265:
+		header = []byte{(nalu[0] & 0x81) | (h265NALUTypeFU << 1), nalu[1]}
+		data = nalu[2:]
+	default:
+		header = []byte{(nalu[0] & 0xE0) | h264NALUTypeFUA}
+		data = nalu[1:]
+	}
+	typ := naluType(r.codec, nalu)
+
+	chunkSize := r.maxPayloadSize - len(header) - 1
+	var payloads [][]byte
+	for i := 0; i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fuHeader := typ
+		if i == 0 {
+			fuHeader |= 0x80
+		}
+		if end == len(data) {
+			fuHeader |= 0x40
+		}
+
+		payload := make([]byte, 0, len(header)+1+end-i)
+		payload = append(payload, header...)
+		payload = append(payload, fuHeader)
+		payload = append(payload, data[i:end]...)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
@@ -0,0 +1,265 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	// 352x288 High profile SPS & its PPS
+	testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// testCamera packetizes access units the way the cameras do: the parameter
+// sets in a STAP-A, the NALUs over the camera MTU in FU-A fragments
+type testCamera struct {
+	mtu            int
+	sequenceNumber uint16
+}
+
+func testNALU(typ byte, size int) []byte {
+	nalu := make([]byte, size)
+	nalu[0] = 0x60 | typ
+	for i := 1; i < size; i++ {
+		nalu[i] = byte(i*7 + int(typ))
+	}
+	return nalu
+}
+
+func (c *testCamera) packets(timestamp uint32, nalus ...[]byte) []*rtp.Packet {
+	var payloads [][]byte
+	var stapA []byte
+	for _, nalu := range nalus {
+		typ := nalu[0] & 0x1F
+		if typ == h264NALUTypeSPS || typ == h264NALUTypePPS {
+			if stapA == nil {
+				stapA = []byte{0x78}
+			}
+			stapA = append(stapA, byte(len(nalu)>>8), byte(len(nalu)))
+			stapA = append(stapA, nalu...)
+			continue
+		}
+		if stapA != nil {
+			payloads = append(payloads, stapA)
+			stapA = nil
+		}
+		if len(nalu) <= c.mtu {
+			payloads = append(payloads, nalu)
+			continue
+		}
+		for i := 1; i < len(nalu); i += c.mtu - 2 {
+			end := i + c.mtu - 2
+			if end > len(nalu) {
+				end = len(nalu)
+			}
+			header := typ
+			if i == 1 {
+				header |= 0x80
+			}
+			if end == len(nalu) {
+				header |= 0x40
+			}
+			payload := []byte{nalu[0]&0xE0 | h264NALUTypeFUA, header}
+			payloads = append(payloads, append(payload, nalu[i:end]...))
+		}
+	}
+	if stapA != nil {
+		payloads = append(payloads, stapA)
+	}
+
+	pkts := make([]*rtp.Packet, len(payloads))
+	for i, payload := range payloads {
+		pkts[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    96,
+				SequenceNumber: c.sequenceNumber,
+				Timestamp:      timestamp,
+				SSRC:           0x1234,
+			},
+			Payload: payload,
+		}
+		c.sequenceNumber++
+	}
+	return pkts
+}
+
+func pushAll(t *testing.T, r *Repacketizer, pkts []*rtp.Packet) []*rtp.Packet {
+	t.Helper()
+	var out []*rtp.Packet
+	for _, pkt := range pkts {
+		repacketized, err := r.Push(pkt)
+		if err != nil {
+			t.Fatalf("push %d: %v", pkt.SequenceNumber, err)
+		}
+		out = append(out, repacketized...)
+	}
+	return out
+}
+
+func depacketize(t *testing.T, pkts []*rtp.Packet) []AccessUnit {
+	t.Helper()
+	d := NewDepacketizer(CodecH264)
+	var aus []AccessUnit
+	for _, pkt := range pkts {
+		out, err := d.Push(pkt)
+		if err != nil {
+			t.Fatalf("depacketize %d: %v", pkt.SequenceNumber, err)
+		}
+		aus = append(aus, out...)
+	}
+	return aus
+}
+
+func TestRepacketizerMaxPayloadSize(t *testing.T) {
+	camera := &testCamera{mtu: 1400}
+	idr := testNALU(h264NALUTypeIDR, 5000)
+	r := NewRepacketizer(CodecH264, 1000)
+
+	out := pushAll(t, r, camera.packets(90000, testSPS, testPPS, idr))
+	if len(out) < 6 {
+		t.Fatalf("got %d packets, want the IDR in 5+ fragments", len(out))
+	}
+	for _, pkt := range out {
+		if len(pkt.Payload) > 1000 {
+			t.Errorf("packet %d payload %d > 1000", pkt.SequenceNumber, len(pkt.Payload))
+		}
+	}
+
+	aus := depacketize(t, out)
+	if len(aus) != 1 || len(aus[0].NALUs) != 3 || !bytes.Equal(aus[0].NALUs[2], idr) {
+		t.Fatalf("repacketized access unit differs from the camera one")
+	}
+}
+
+func TestRepacketizerSequenceNumbers(t *testing.T) {
+	camera := &testCamera{mtu: 1400}
+	r := NewRepacketizer(CodecH264, 1200)
+
+	var in []*rtp.Packet
+	in = append(in, camera.packets(0, testSPS, testPPS, testNALU(h264NALUTypeIDR, 3000))...)
+	lost := camera.packets(3000, testNALU(1, 200))
+	in = append(in, camera.packets(6000, testNALU(1, 2000))...)
+	in = append(in, camera.packets(9000, testNALU(1, 300))...)
+	if len(lost) != 1 {
+		t.Fatal("the lost access unit must be a single packet")
+	}
+
+	out := pushAll(t, r, in)
+	for i := 1; i < len(out); i++ {
+		if out[i].SequenceNumber != out[i-1].SequenceNumber+1 {
+			t.Fatalf("sequence number %d follows %d", out[i].SequenceNumber, out[i-1].SequenceNumber)
+		}
+	}
+	if out[0].SequenceNumber != in[0].SequenceNumber {
+		t.Errorf("first sequence number %d, want the camera one %d", out[0].SequenceNumber, in[0].SequenceNumber)
+	}
+	if aus := depacketize(t, out); len(aus) != 3 {
+		t.Errorf("got %d access units, want 3", len(aus))
+	}
+}
+
+func TestRepacketizerTimestampsAndMarker(t *testing.T) {
+	camera := &testCamera{mtu: 1400}
+	r := NewRepacketizer(CodecH264, 1200)
+
+	var in []*rtp.Packet
+	in = append(in, camera.packets(1000, testSPS, testPPS, testNALU(h264NALUTypeIDR, 4000))...)
+	in = append(in, camera.packets(4000, testNALU(1, 1500))...)
+	out := pushAll(t, r, in)
+
+	byTimestamp := map[uint32][]*rtp.Packet{}
+	for _, pkt := range out {
+		byTimestamp[pkt.Timestamp] = append(byTimestamp[pkt.Timestamp], pkt)
+		if pkt.SSRC != 0x1234 || pkt.PayloadType != 96 {
+			t.Errorf("packet %d header not kept", pkt.SequenceNumber)
+		}
+	}
+	if len(byTimestamp) != 2 {
+		t.Fatalf("got timestamps %v, want 1000 & 4000", byTimestamp)
+	}
+	for timestamp, pkts := range byTimestamp {
+		for i, pkt := range pkts {
+			if pkt.Marker != (i == len(pkts)-1) {
+				t.Errorf("timestamp %d packet %d marker %t", timestamp, i, pkt.Marker)
+			}
+		}
+	}
+}
+
+func TestRepacketizerParameterSets(t *testing.T) {
+	camera := &testCamera{mtu: 1400}
+	idr := testNALU(h264NALUTypeIDR, 800)
+
+	// out of band parameter sets only
+	r := NewRepacketizer(CodecH264, 1200)
+	r.SetParameterSets(nil, testSPS, testPPS)
+	aus := depacketize(t, pushAll(t, r, camera.packets(0, idr)))
+	if len(aus) != 1 || len(aus[0].NALUs) != 3 ||
+		!bytes.Equal(aus[0].NALUs[0], testSPS) || !bytes.Equal(aus[0].NALUs[1], testPPS) || !bytes.Equal(aus[0].NALUs[2], idr) {
+		t.Fatalf("SPS/PPS not put in front of the IDR")
+	}
+
+	// in-band parameter sets after the IDR are moved in front of it
+	r = NewRepacketizer(CodecH264, 1200)
+	aus = depacketize(t, pushAll(t, r, camera.packets(0, idr, testSPS, testPPS)))
+	if len(aus) != 1 || len(aus[0].NALUs) != 3 || !bytes.Equal(aus[0].NALUs[0], testSPS) || !bytes.Equal(aus[0].NALUs[2], idr) {
+		t.Fatalf("in-band SPS/PPS not moved in front of the IDR")
+	}
+
+	// the next keyframe gets the cached ones
+	aus = depacketize(t, pushAll(t, r, camera.packets(3000, idr)))
+	if len(aus) != 1 || len(aus[0].NALUs) != 3 || !bytes.Equal(aus[0].NALUs[1], testPPS) {
+		t.Fatalf("cached SPS/PPS not put in front of the next IDR")
+	}
+
+	// not in front of the other frames
+	aus = depacketize(t, pushAll(t, r, camera.packets(6000, testNALU(1, 100))))
+	if len(aus) != 1 || len(aus[0].NALUs) != 1 {
+		t.Fatalf("parameter sets put in front of a P frame")
+	}
+}
+
+func TestRepacketizerGOPCache(t *testing.T) {
+	camera := &testCamera{mtu: 1400}
+	r := NewRepacketizer(CodecH264, 1200)
+	gop := NewGOPCache(0)
+	r.SetGOPCache(gop)
+
+	// no keyframe yet
+	pushAll(t, r, camera.packets(0, testNALU(1, 100)))
+	if pkts := gop.Packets(); pkts != nil {
+		t.Fatalf("cached %d packets before a keyframe", len(pkts))
+	}
+
+	out := pushAll(t, r, camera.packets(3000, testSPS, testPPS, testNALU(h264NALUTypeIDR, 2000)))
+	out = append(out, pushAll(t, r, camera.packets(6000, testNALU(1, 1500)))...)
+	pkts := gop.Packets()
+	if len(pkts) != len(out) {
+		t.Fatalf("cached %d packets, want %d", len(pkts), len(out))
+	}
+	for i := range pkts {
+		if pkts[i].SequenceNumber != out[i].SequenceNumber {
+			t.Fatalf("cached packet %d is %d, want %d", i, pkts[i].SequenceNumber, out[i].SequenceNumber)
+		}
+	}
+
+	// a keyframe starts a new GOP
+	out = pushAll(t, r, camera.packets(9000, testNALU(h264NALUTypeIDR, 500)))
+	if pkts := gop.Packets(); len(pkts) != len(out) || pkts[0].Timestamp != 9000 {
+		t.Fatalf("GOP not restarted on the keyframe")
+	}
+
+	// over the max size the GOP is dropped until the next keyframe
+	small := NewGOPCache(3)
+	r.SetGOPCache(small)
+	pushAll(t, r, camera.packets(12000, testNALU(h264NALUTypeIDR, 500)))
+	pushAll(t, r, camera.packets(15000, testNALU(1, 3000)))
+	if pkts := small.Packets(); pkts != nil {
+		t.Fatalf("overflowed GOP kept %d packets", len(pkts))
+	}
+}
@@ -0,0 +1,163 @@
+package media
+
+import (
+	"fmt"
+
+	"github.com/aler9/gortsplib/pkg/bits"
+	"github.com/aler9/gortsplib/pkg/h264"
+)
+
+// H264ProfileLevelID returns the profile-level-id of a H.264 SPS:
+// profile_idc, constraint flags and level_idc in hex.
+func H264ProfileLevelID(sps []byte) (string, error) {
+	if len(sps) < 4 || naluType(CodecH264, sps) != h264NALUTypeSPS {
+		return "", fmt.Errorf("invalid H264 SPS")
+	}
+	rbsp := removeEmulationPrevention(sps[:minInt(len(sps), 8)])
+	if len(rbsp) < 4 {
+		return "", fmt.Errorf("invalid H264 SPS")
+	}
+	return fmt.Sprintf("%02x%02x%02x", rbsp[1], rbsp[2], rbsp[3]), nil
+}
+
+// H265ProfileTierLevel returns the general profile_idc, tier_flag and
+// level_idc of a H.265 SPS.
+func H265ProfileTierLevel(sps []byte) (profile int, tier int, level int, err error) {
+	if len(sps) < 3 || naluType(CodecH265, sps) != h265NALUTypeSPS {
+		return 0, 0, 0, fmt.Errorf("invalid H265 SPS")
+	}
+	rbsp := removeEmulationPrevention(sps[:minInt(len(sps), 24)])
+
+	// 2 bytes NALU header, then
+	// sps_video_parameter_set_id(4) sps_max_sub_layers_minus1(3) sps_temporal_id_nesting_flag(1)
+	// general_profile_space(2) general_tier_flag(1) general_profile_idc(5)
+	// general_profile_compatibility_flags(32) general constraint flags(48) general_level_idc(8)
+	if len(rbsp) < 15 {
+		return 0, 0, 0, fmt.Errorf("invalid H265 SPS")
+	}
+	profile = int(rbsp[3] & 0x1F)
+	tier = int((rbsp[3] >> 5) & 0x01)
+	level = int(rbsp[14])
+	return profile, tier, level, nil
+}
+
+// Remove the emulation prevention bytes (0x00 0x00 0x03) of a NALU
+func removeEmulationPrevention(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return rbsp
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// VideoSize returns the picture size of a H.264/H.265 SPS, cropping included.
+func VideoSize(codec Codec, sps []byte) (width int, height int, err error) {
+	if codec == CodecH264 {
+		var s h264.SPS
+		if err := s.Unmarshal(sps); err != nil {
+			return 0, 0, err
+		}
+		return s.Width(), s.Height(), nil
+	}
+	if len(sps) < 3 || naluType(CodecH265, sps) != h265NALUTypeSPS {
+		return 0, 0, fmt.Errorf("invalid H265 SPS")
+	}
+	width, height, err = h265VideoSize(removeEmulationPrevention(sps))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid H265 SPS: %v", err)
+	}
+	return width, height, nil
+}
+
+func h265VideoSize(rbsp []byte) (int, int, error) {
+	// after the NALU header & sps_video_parameter_set_id
+	pos := 20
+	maxSubLayers, err := bits.ReadBits(rbsp, &pos, 3)
+	if err != nil {
+		return 0, 0, err
+	}
+	// temporal_id_nesting_flag, then the general profile_tier_level
+	pos += 1 + 96
+	profilePresent := make([]bool, maxSubLayers)
+	levelPresent := make([]bool, maxSubLayers)
+	for i := range profilePresent {
+		if profilePresent[i], err = bits.ReadFlag(rbsp, &pos); err != nil {
+			return 0, 0, err
+		}
+		if levelPresent[i], err = bits.ReadFlag(rbsp, &pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	if maxSubLayers > 0 {
+		pos += 2 * (8 - int(maxSubLayers))
+	}
+	for i := range profilePresent {
+		if profilePresent[i] {
+			pos += 88
+		}
+		if levelPresent[i] {
+			pos += 8
+		}
+	}
+
+	// sps_seq_parameter_set_id
+	if _, err := bits.ReadGolombUnsigned(rbsp, &pos); err != nil {
+		return 0, 0, err
+	}
+	chromaFormat, err := bits.ReadGolombUnsigned(rbsp, &pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if chromaFormat == 3 {
+		// separate_colour_plane_flag
+		pos++
+	}
+	var size [2]uint32
+	for i := range size {
+		if size[i], err = bits.ReadGolombUnsigned(rbsp, &pos); err != nil {
+			return 0, 0, err
+		}
+	}
+	width, height := int(size[0]), int(size[1])
+
+	cropped, err := bits.ReadFlag(rbsp, &pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropped {
+		// left, right, top & bottom offsets in chroma samples
+		var offsets [4]uint32
+		for i := range offsets {
+			if offsets[i], err = bits.ReadGolombUnsigned(rbsp, &pos); err != nil {
+				return 0, 0, err
+			}
+		}
+		subWidth, subHeight := 1, 1
+		switch chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		width -= subWidth * int(offsets[0]+offsets[1])
+		height -= subHeight * int(offsets[2]+offsets[3])
+	}
+	return width, height, nil
+}
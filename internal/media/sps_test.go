@@ -0,0 +1,95 @@
+package media
+
+import "testing"
+
+// SPS of cameras & encoders, with their picture size
+var (
+	// baseline 3.0, 640x480
+	testBaselineSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x3d, 0xa1, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x32, 0x0f, 0x16, 0x2e, 0x48}
+	// main 4.0, 1920x1080 cropped
+	testMainSPS = []byte{0x67, 0x4d, 0x00, 0x28, 0x95, 0xa0, 0x1e, 0x00, 0x89, 0xf9, 0x70, 0x11, 0x00, 0x00, 0x03, 0x03, 0xe8, 0x00, 0x00, 0xe9, 0xe2, 0x10}
+	// high 3.1, 1280x720
+	testHighSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	// H.265 Main, main tier 4.0, 1920x1080 cropped
+	testH265MainSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0xa0, 0x03, 0xc0, 0x80, 0x10, 0xe5, 0x96, 0x56, 0x69, 0x24, 0xca, 0xf0, 0x10, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x01, 0xe0, 0x80}
+	// H.265 Main10, high tier 5.1, 3840x2160
+	testH265Main10SPS = []byte{0x42, 0x01, 0x01, 0x22, 0x20, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x99, 0xa0, 0x01, 0xe0, 0x20, 0x02, 0x1c, 0x59, 0x65, 0x66, 0x92, 0x4c, 0xaf, 0x01, 0x6a, 0x12, 0x20, 0x13, 0x6c, 0x20, 0x00, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x03, 0x03, 0xc1}
+	// H.265 VPS of the Main stream
+	testH265VPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x78, 0x95, 0x98, 0x09}
+)
+
+func TestH264ProfileLevelID(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  []byte
+		want string
+		err  bool
+	}{
+		{name: "baseline", sps: testBaselineSPS, want: "42c01e"},
+		{name: "main", sps: testMainSPS, want: "4d0028"},
+		{name: "high", sps: testHighSPS, want: "64001f"},
+		{name: "PPS", sps: []byte{0x68, 0xce, 0x3c, 0x80}, err: true},
+		{name: "truncated", sps: []byte{0x67, 0x64, 0x00}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := H264ProfileLevelID(test.sps)
+			if (err != nil) != test.err || got != test.want {
+				t.Fatalf("profile-level-id %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestH265ProfileTierLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		sps     []byte
+		profile int
+		tier    int
+		level   int
+		err     bool
+	}{
+		// the compatibility & constraint flags have emulation prevention bytes
+		{name: "main", sps: testH265MainSPS, profile: 1, tier: 0, level: 120},
+		{name: "main10 high tier", sps: testH265Main10SPS, profile: 2, tier: 1, level: 153},
+		{name: "VPS", sps: testH265VPS, err: true},
+		{name: "H264 SPS", sps: testHighSPS, err: true},
+		{name: "truncated", sps: testH265MainSPS[:16], err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, tier, level, err := H265ProfileTierLevel(test.sps)
+			if (err != nil) != test.err {
+				t.Fatalf("error %v", err)
+			}
+			if profile != test.profile || tier != test.tier || level != test.level {
+				t.Fatalf("profile %d tier %d level %d, want %d %d %d", profile, tier, level, test.profile, test.tier, test.level)
+			}
+		})
+	}
+}
+
+func TestVideoSize(t *testing.T) {
+	tests := []struct {
+		name   string
+		codec  Codec
+		sps    []byte
+		width  int
+		height int
+	}{
+		{"baseline", CodecH264, testBaselineSPS, 640, 480},
+		{"main", CodecH264, testMainSPS, 1920, 1080},
+		{"high", CodecH264, testHighSPS, 1280, 720},
+		{"H265 main", CodecH265, testH265MainSPS, 1920, 1080},
+		{"H265 main10", CodecH265, testH265Main10SPS, 3840, 2160},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := VideoSize(test.codec, test.sps)
+			if err != nil || width != test.width || height != test.height {
+				t.Fatalf("%dx%d, %v", width, height, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// Package restream is a RTSP server republishing the camera streams to local
+// readers (recorders), so the cameras keep a single upstream session.
+package restream
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/auth"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtp"
+)
+
+// Server is a RTSP server, shared by the streams of its address. The readers
+// use the TCP (interleaved) transport.
+type Server struct {
+	addr   string
+	server *gortsplib.Server
+
+	mutex   sync.Mutex
+	refs    int
+	streams map[string]*Stream
+}
+
+var (
+	serversMutex sync.Mutex
+	servers      = map[string]*Server{}
+)
+
+// Listen returns the server listening on addr, started by its first user.
+// Each Listen must be followed by a Close.
+func Listen(addr string) (*Server, error) {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+
+	if s, ok := servers[addr]; ok {
+		s.mutex.Lock()
+		s.refs++
+		s.mutex.Unlock()
+		return s, nil
+	}
+	s := &Server{addr: addr, refs: 1, streams: make(map[string]*Stream)}
+	s.server = &gortsplib.Server{
+		Handler:     s,
+		RTSPAddress: addr,
+	}
+	if err := s.server.Start(); err != nil {
+		return nil, err
+	}
+	servers[addr] = s
+	log.Println("RTSP restream server listening on", addr)
+	return s, nil
+}
+
+// Close releases the server, it is stopped with its last user
+func (s *Server) Close() error {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+
+	s.mutex.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mutex.Unlock()
+	if !last {
+		return nil
+	}
+	delete(servers, s.addr)
+	return s.server.Close()
+}
+
+// Publish serves the tracks at rtsp://addr/path, the readers must authenticate
+// if user is set
+func (s *Server) Publish(path string, tracks gortsplib.Tracks, user string, pass string) (*Stream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path = strings.Trim(path, "/")
+	if _, ok := s.streams[path]; ok {
+		return nil, fmt.Errorf("RTSP restream %s already published", path)
+	}
+	st := &Stream{
+		server: s,
+		path:   path,
+		stream: gortsplib.NewServerStream(tracks),
+	}
+	for _, track := range tracks {
+		st.payloadTypes = append(st.payloadTypes, payloadType(track))
+	}
+	if len(user) > 0 {
+		st.validator = auth.NewValidator(user, pass, nil)
+	}
+	s.streams[path] = st
+	return st, nil
+}
+
+// The stream of a request, or the response refusing it
+func (s *Server) stream(path string, req *base.Request) (*Stream, *base.Response) {
+	s.mutex.Lock()
+	st, ok := s.streams[strings.Trim(path, "/")]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, &base.Response{StatusCode: base.StatusNotFound}
+	}
+	if st.validator != nil {
+		if err := st.validator.ValidateRequest(req); err != nil {
+			return nil, &base.Response{
+				StatusCode: base.StatusUnauthorized,
+				Header:     base.Header{"WWW-Authenticate": st.validator.Header()},
+			}
+		}
+	}
+	return st, nil
+}
+
+// OnDescribe implements gortsplib.ServerHandlerOnDescribe
+func (s *Server) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	st, refused := s.stream(ctx.Path, ctx.Request)
+	if refused != nil {
+		return refused, nil, nil
+	}
+	return &base.Response{StatusCode: base.StatusOK}, st.stream, nil
+}
+
+// OnSetup implements gortsplib.ServerHandlerOnSetup
+func (s *Server) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if ctx.Transport != gortsplib.TransportTCP {
+		return &base.Response{StatusCode: base.StatusUnsupportedTransport}, nil, nil
+	}
+	st, refused := s.stream(ctx.Path, ctx.Request)
+	if refused != nil {
+		return refused, nil, nil
+	}
+	return &base.Response{StatusCode: base.StatusOK}, st.stream, nil
+}
+
+// OnPlay implements gortsplib.ServerHandlerOnPlay
+func (s *Server) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	log.Printf("RTSP restream reader %s plays %s", ctx.Conn.NetConn().RemoteAddr(), ctx.Path)
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// OnAnnounce implements gortsplib.ServerHandlerOnAnnounce, the server is read only
+func (s *Server) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
+	return &base.Response{StatusCode: base.StatusMethodNotAllowed}, nil
+}
+
+// Stream is a path of a server, read by any number of readers
+type Stream struct {
+	server       *Server
+	path         string
+	stream       *gortsplib.ServerStream
+	payloadTypes []uint8
+	validator    *auth.Validator
+}
+
+// WriteRTP sends a packet of a track to the readers, with the payload type of
+// the described track
+func (st *Stream) WriteRTP(track int, pkt *rtp.Packet) {
+	if track < 0 || track >= len(st.payloadTypes) {
+		return
+	}
+	// the packet is marshaled before the call returns
+	out := *pkt
+	out.PayloadType = st.payloadTypes[track]
+	st.stream.WritePacketRTP(track, &out)
+}
+
+// Close unregisters the stream & disconnects its readers
+func (st *Stream) Close() {
+	st.server.mutex.Lock()
+	delete(st.server.streams, st.path)
+	st.server.mutex.Unlock()
+	st.stream.Close()
+}
+
+func payloadType(track gortsplib.Track) uint8 {
+	switch track := track.(type) {
+	case *gortsplib.TrackH264:
+		return track.PayloadType
+	case *gortsplib.TrackH265:
+		return track.PayloadType
+	case *gortsplib.TrackOpus:
+		return track.PayloadType
+	case *gortsplib.TrackPCMA:
+		return 8
+	}
+	// PCMU
+	return 0
+}
@@ -0,0 +1,202 @@
+package restream
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x05, 0x07, 0xE4}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+)
+
+// A free local address of the server
+func testAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// Play a stream, the received packets are sent to packets
+func startTestReader(rawURL string, transport gortsplib.Transport, packets chan *rtp.Packet) (*gortsplib.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &gortsplib.Client{
+		Transport: &transport,
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			select {
+			case packets <- ctx.Packet:
+			default:
+			}
+		},
+	}
+	if err := c.Start(u.Scheme, u.Host); err != nil {
+		return nil, err
+	}
+	tracks, baseURL, _, err := c.Describe(u)
+	if err == nil {
+		err = c.SetupAndPlay(tracks, baseURL)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func publishTestStream(t *testing.T, user string, pass string) (*Server, *Stream) {
+	t.Helper()
+	s, err := Listen(testAddress(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	st, err := s.Publish("/1_2", gortsplib.Tracks{
+		&gortsplib.TrackH264{PayloadType: 96, SPS: testSPS, PPS: testPPS, PacketizationMode: 1},
+		&gortsplib.TrackPCMA{},
+	}, user, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	return s, st
+}
+
+// Write packets until each reader got one
+func writeTestPackets(t *testing.T, st *Stream, readers ...chan *rtp.Packet) []*rtp.Packet {
+	t.Helper()
+	received := make([]*rtp.Packet, len(readers))
+	deadline := time.After(5 * time.Second)
+	for n := 0; ; n++ {
+		// the camera payload type is rewritten to the described one
+		st.WriteRTP(0, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 100, Marker: true, SequenceNumber: uint16(n), Timestamp: uint32(n * 3600)},
+			Payload: []byte{0x65, byte(n), 1, 2, 3},
+		})
+		done := true
+		for i, packets := range readers {
+			if received[i] == nil {
+				select {
+				case received[i] = <-packets:
+				default:
+					done = false
+				}
+			}
+		}
+		if done {
+			return received
+		}
+		select {
+		case <-deadline:
+			t.Fatal("the readers received no packet")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// The readers authenticated by the stream credentials share the packets
+// written once
+func TestServerReaders(t *testing.T) {
+	s, st := publishTestStream(t, "user", "pass")
+
+	var readers []chan *rtp.Packet
+	for i := 0; i < 2; i++ {
+		packets := make(chan *rtp.Packet, 10)
+		c, err := startTestReader("rtsp://user:pass@"+s.addr+"/1_2", gortsplib.TransportTCP, packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if tracks := c.Tracks(); len(tracks) != 2 || !bytes.Equal(tracks[0].(*gortsplib.TrackH264).SafeSPS(), testSPS) {
+			t.Fatalf("reader %d tracks %v", i, tracks)
+		}
+		readers = append(readers, packets)
+	}
+	for i, pkt := range writeTestPackets(t, st, readers...) {
+		if pkt.PayloadType != 96 || pkt.Payload[0] != 0x65 {
+			t.Fatalf("reader %d packet %+v", i, pkt.Header)
+		}
+	}
+	// the packets of an unknown track are not sent
+	st.WriteRTP(2, &rtp.Packet{Header: rtp.Header{Version: 2}})
+}
+
+// The readers without the credentials, of an unknown path or over UDP are refused
+func TestServerRefusedReaders(t *testing.T) {
+	s, _ := publishTestStream(t, "user", "pass")
+
+	for _, test := range []struct {
+		url       string
+		transport gortsplib.Transport
+		status    string
+	}{
+		{url: "rtsp://" + s.addr + "/1_2", transport: gortsplib.TransportTCP, status: "401"},
+		{url: "rtsp://user:wrong@" + s.addr + "/1_2", transport: gortsplib.TransportTCP, status: "401"},
+		{url: "rtsp://user:pass@" + s.addr + "/1_3", transport: gortsplib.TransportTCP, status: "404"},
+		{url: "rtsp://user:pass@" + s.addr + "/1_2", transport: gortsplib.TransportUDP, status: "461"},
+	} {
+		c, err := startTestReader(test.url, test.transport, make(chan *rtp.Packet, 1))
+		if err == nil {
+			c.Close()
+			t.Fatalf("%s over %v is read", test.url, test.transport)
+		}
+		if !strings.Contains(err.Error(), test.status) {
+			t.Errorf("%s over %v: %v, want %s", test.url, test.transport, err, test.status)
+		}
+	}
+}
+
+// The server of an address is shared & stopped by its last user, a path is
+// published once
+func TestServerShared(t *testing.T) {
+	s, err := Listen(testAddress(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	st, err := s.Publish("1_2", gortsplib.Tracks{&gortsplib.TrackH264{PayloadType: 96, SPS: testSPS, PPS: testPPS}}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Listen(s.addr)
+	if err != nil || other != s {
+		t.Fatalf("second listen %v", err)
+	}
+	if _, err := other.Publish("1_2", gortsplib.Tracks{&gortsplib.TrackPCMU{}}, "", ""); err == nil {
+		t.Fatal("path published twice")
+	}
+	other.Close()
+
+	// still served, without credentials
+	packets := make(chan *rtp.Packet, 10)
+	c, err := startTestReader("rtsp://"+s.addr+"/1_2", gortsplib.TransportTCP, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPackets(t, st, packets)
+
+	// the readers are disconnected with the stream
+	st.Close()
+	done := make(chan error, 1)
+	go func() { done <- c.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reader is not disconnected")
+	}
+	c.Close()
+}
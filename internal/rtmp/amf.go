@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// AMF0 markers
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+)
+
+var errAMF = errors.New("invalid AMF0 data")
+
+// amfObject is an AMF0 object or ECMA array
+type amfObject map[string]interface{}
+
+// Decode the AMF0 values of a command or data message: float64, bool,
+// string, amfObject, []interface{} or nil
+func amfDecode(data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		v, n, err := amfDecodeValue(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+func amfDecodeValue(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errAMF
+	}
+	switch data[0] {
+	case amf0Number:
+		if len(data) < 9 {
+			return nil, 0, errAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:])), 9, nil
+	case amf0Boolean:
+		if len(data) < 2 {
+			return nil, 0, errAMF
+		}
+		return data[1] != 0, 2, nil
+	case amf0String:
+		s, n, err := amfDecodeString(data[1:], 2)
+		return s, 1 + n, err
+	case amf0LongString:
+		s, n, err := amfDecodeString(data[1:], 4)
+		return s, 1 + n, err
+	case amf0Object:
+		o, n, err := amfDecodeProperties(data[1:])
+		return o, 1 + n, err
+	case amf0ECMAArray:
+		// the count is a hint, the properties end with the object end marker
+		if len(data) < 5 {
+			return nil, 0, errAMF
+		}
+		o, n, err := amfDecodeProperties(data[5:])
+		return o, 5 + n, err
+	case amf0StrictArray:
+		if len(data) < 5 {
+			return nil, 0, errAMF
+		}
+		count := int(binary.BigEndian.Uint32(data[1:]))
+		pos := 5
+		var array []interface{}
+		for i := 0; i < count; i++ {
+			v, n, err := amfDecodeValue(data[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			array = append(array, v)
+			pos += n
+		}
+		return array, pos, nil
+	case amf0Date:
+		if len(data) < 11 {
+			return nil, 0, errAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:])), 11, nil
+	case amf0Null, amf0Undefined:
+		return nil, 1, nil
+	}
+	return nil, 0, errAMF
+}
+
+func amfDecodeString(data []byte, lengthSize int) (string, int, error) {
+	if len(data) < lengthSize {
+		return "", 0, errAMF
+	}
+	var n int
+	if lengthSize == 2 {
+		n = int(binary.BigEndian.Uint16(data))
+	} else {
+		n = int(binary.BigEndian.Uint32(data))
+	}
+	if n < 0 || len(data) < lengthSize+n {
+		return "", 0, errAMF
+	}
+	return string(data[lengthSize : lengthSize+n]), lengthSize + n, nil
+}
+
+// The name & value pairs of an object, up to the object end marker
+func amfDecodeProperties(data []byte) (amfObject, int, error) {
+	o := amfObject{}
+	pos := 0
+	for {
+		name, n, err := amfDecodeString(data[pos:], 2)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		if name == "" && pos < len(data) && data[pos] == amf0ObjectEnd {
+			return o, pos + 1, nil
+		}
+		v, n, err := amfDecodeValue(data[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		o[name] = v
+		pos += n
+	}
+}
+
+// Encode AMF0 values: numbers (float64 or int), bool, string, amfObject or nil
+func amfEncode(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		b = amfAppendValue(b, v)
+	}
+	return b
+}
+
+func amfAppendValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case float64:
+		b = append(b, amf0Number, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+	case int:
+		return amfAppendValue(b, float64(v))
+	case bool:
+		if v {
+			return append(b, amf0Boolean, 1)
+		}
+		return append(b, amf0Boolean, 0)
+	case string:
+		b = append(b, amf0String)
+		b = amfAppendString(b, v)
+	case amfObject:
+		b = append(b, amf0Object)
+		for name, value := range v {
+			b = amfAppendString(b, name)
+			b = amfAppendValue(b, value)
+		}
+		b = append(b, 0, 0, amf0ObjectEnd)
+	default:
+		b = append(b, amf0Null)
+	}
+	return b
+}
+
+func amfAppendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,96 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	values := []interface{}{
+		"connect",
+		1.0,
+		amfObject{"app": "live", "tcUrl": "rtmp://127.0.0.1/live", "fpad": false, "audioCodecs": 3191.0},
+		nil,
+		true,
+	}
+	data := amfEncode(values...)
+	decoded, err := amfDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Fatalf("decoded %#v, want %#v", decoded, values)
+	}
+	// the int numbers are encoded as float64
+	if decoded, err := amfDecode(amfEncode(5)); err != nil || decoded[0] != 5.0 {
+		t.Fatalf("decoded %#v, %v", decoded, err)
+	}
+}
+
+func TestAMFDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{
+			name: "ECMA array",
+			// the count is only a hint
+			data: []byte{amf0ECMAArray, 0, 0, 0, 9, 0, 5, 'w', 'i', 'd', 't', 'h', amf0Number, 0x40, 0x94, 0, 0, 0, 0, 0, 0, 0, 0, amf0ObjectEnd},
+			want: amfObject{"width": 1280.0},
+		},
+		{
+			name: "strict array",
+			data: []byte{amf0StrictArray, 0, 0, 0, 2, amf0Boolean, 1, amf0Null},
+			want: []interface{}{true, nil},
+		},
+		{
+			name: "long string",
+			data: []byte{amf0LongString, 0, 0, 0, 3, 'k', 'e', 'y'},
+			want: "key",
+		},
+		{
+			name: "date",
+			data: []byte{amf0Date, 0x3F, 0xF0, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: 1.0,
+		},
+		{
+			name: "undefined",
+			data: []byte{amf0Undefined},
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := amfDecode(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != 1 || !reflect.DeepEqual(values[0], test.want) {
+				t.Fatalf("decoded %#v, want %#v", values, test.want)
+			}
+		})
+	}
+}
+
+func TestAMFDecodeErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		{amf0Number, 0, 0},
+		{amf0Boolean},
+		{amf0String, 0, 5, 'a'},
+		{amf0Object, 0, 1, 'a'},
+		// no object end
+		{amf0Object, 0, 1, 'a', amf0Null},
+		{amf0StrictArray, 0, 0, 0, 2, amf0Null},
+		{0x11},
+	} {
+		if values, err := amfDecode(data); err == nil {
+			t.Errorf("%x decoded to %#v", data, values)
+		}
+	}
+	// the values before the invalid one are returned
+	values, err := amfDecode(append(amfEncode("onStatus", 0), 0x11))
+	if err == nil || len(values) != 2 {
+		t.Fatalf("decoded %#v, %v", values, err)
+	}
+}
@@ -0,0 +1,320 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Message types
+const (
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAcknowledgement  = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	// TypeAudio is a FLV audio tag body
+	TypeAudio = 8
+	// TypeVideo is a FLV video tag body
+	TypeVideo     = 9
+	typeDataAMF3  = 15
+	typeAMF3      = 17
+	typeDataAMF0  = 18
+	typeCommand   = 20
+	handshakeSize = 1536
+)
+
+// chunk size & window sent to the publishers
+const (
+	serverChunkSize  = 4096
+	serverWindowSize = 2500000
+	// max size of a message, larger ones are a broken stream
+	maxMessageSize = 16 << 20
+)
+
+// Message is a RTMP message: a FLV tag body (audio, video) or an AMF0 data
+// message (onMetaData)
+type Message struct {
+	Type uint8
+	// Timestamp in ms
+	Timestamp uint32
+	StreamID  uint32
+	Payload   []byte
+}
+
+// chunkStream is the state of a chunk stream id, the fields of the previous
+// chunk header are reused by the compressed headers
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+// chunkConn is a RTMP connection, reading the chunk streams and writing the
+// messages of the server side
+type chunkConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	readChunkSize  uint32
+	writeChunkSize uint32
+	streams        map[uint32]*chunkStream
+
+	windowSize uint32
+	received   uint64
+	acked      uint64
+}
+
+func newConn(conn net.Conn) *chunkConn {
+	return &chunkConn{
+		conn:           conn,
+		r:              bufio.NewReaderSize(conn, 64*1024),
+		w:              bufio.NewWriter(conn),
+		readChunkSize:  128,
+		writeChunkSize: 128,
+		streams:        make(map[uint32]*chunkStream),
+	}
+}
+
+// Simple handshake: C0 C1, S0 S1 S2, C2. The S2 echoes C1
+func (c *chunkConn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = 3
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := c.w.Write(s0s1s2); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.r, c2)
+	return err
+}
+
+func (c *chunkConn) readFull(buf []byte) error {
+	n, err := io.ReadFull(c.r, buf)
+	c.received += uint64(n)
+	return err
+}
+
+// Read the next complete message, handling the protocol control messages
+func (c *chunkConn) readMessage() (*Message, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if c.windowSize > 0 && c.received-c.acked >= uint64(c.windowSize) {
+			c.acked = c.received
+			if err := c.writeControl(typeAcknowledgement, uint32(c.received)); err != nil {
+				return nil, err
+			}
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.Type {
+		case typeSetChunkSize:
+			if len(msg.Payload) < 4 {
+				return nil, errors.New("invalid RTMP set chunk size")
+			}
+			size := binary.BigEndian.Uint32(msg.Payload) & 0x7FFFFFFF
+			if size == 0 {
+				return nil, errors.New("invalid RTMP chunk size 0")
+			}
+			c.readChunkSize = size
+		case typeAbort:
+			if len(msg.Payload) >= 4 {
+				if cs, ok := c.streams[binary.BigEndian.Uint32(msg.Payload)]; ok {
+					cs.payload = nil
+				}
+			}
+		case typeWindowAckSize:
+			if len(msg.Payload) >= 4 {
+				c.windowSize = binary.BigEndian.Uint32(msg.Payload)
+			}
+		case typeAcknowledgement, typeUserControl, typeSetPeerBandwidth:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// Read a chunk, returns the message it completes, if any
+func (c *chunkConn) readChunk() (*Message, error) {
+	var header [3]byte
+	if err := c.readFull(header[:1]); err != nil {
+		return nil, err
+	}
+	format := header[0] >> 6
+	csid := uint32(header[0] & 0x3F)
+	switch csid {
+	case 0:
+		if err := c.readFull(header[1:2]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(header[1])
+	case 1:
+		if err := c.readFull(header[1:3]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(header[1]) + uint32(header[2])<<8
+	}
+
+	cs, ok := c.streams[csid]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("RTMP chunk stream %d starts without a full header", csid)
+		}
+		cs = &chunkStream{}
+		c.streams[csid] = cs
+	}
+
+	var buf [11]byte
+	sizes := [4]int{11, 7, 3, 0}
+	if err := c.readFull(buf[:sizes[format]]); err != nil {
+		return nil, err
+	}
+	var timestamp uint32
+	if format < 3 {
+		timestamp = uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2])
+		cs.extended = timestamp == 0xFFFFFF
+	}
+	if format < 2 {
+		cs.length = uint32(buf[3])<<16 | uint32(buf[4])<<8 | uint32(buf[5])
+		cs.typ = buf[6]
+		if cs.length > maxMessageSize {
+			return nil, fmt.Errorf("RTMP message of %d bytes", cs.length)
+		}
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(buf[7:11])
+	}
+	if cs.extended {
+		if err := c.readFull(buf[:4]); err != nil {
+			return nil, err
+		}
+		// a type 3 chunk repeats the extended timestamp of the previous one
+		if format < 3 {
+			timestamp = binary.BigEndian.Uint32(buf[:4])
+		}
+	}
+
+	// the timestamp (delta) applies when a message starts
+	if cs.payload == nil {
+		switch format {
+		case 0:
+			cs.timestamp = timestamp
+			cs.delta = 0
+		case 1, 2:
+			cs.delta = timestamp
+			cs.timestamp += timestamp
+		case 3:
+			cs.timestamp += cs.delta
+		}
+		cs.payload = make([]byte, 0, cs.length)
+	}
+
+	n := cs.length - uint32(len(cs.payload))
+	if n > c.readChunkSize {
+		n = c.readChunkSize
+	}
+	start := len(cs.payload)
+	cs.payload = cs.payload[:start+int(n)]
+	if err := c.readFull(cs.payload[start:]); err != nil {
+		return nil, err
+	}
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &Message{Type: cs.typ, Timestamp: cs.timestamp, StreamID: cs.streamID, Payload: cs.payload}
+	cs.payload = nil
+	return msg, nil
+}
+
+// Write a message in chunks: a full header then type 3 headers
+func (c *chunkConn) writeMessage(csid uint8, msg *Message) error {
+	var header [16]byte
+	header[0] = csid & 0x3F
+	timestamp := msg.Timestamp
+	extended := timestamp >= 0xFFFFFF
+	if extended {
+		timestamp = 0xFFFFFF
+	}
+	header[1], header[2], header[3] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp)
+	length := len(msg.Payload)
+	header[4], header[5], header[6] = byte(length>>16), byte(length>>8), byte(length)
+	header[7] = msg.Type
+	binary.LittleEndian.PutUint32(header[8:12], msg.StreamID)
+	size := 12
+	if extended {
+		binary.BigEndian.PutUint32(header[12:], msg.Timestamp)
+		size = 16
+	}
+	if _, err := c.w.Write(header[:size]); err != nil {
+		return err
+	}
+
+	payload := msg.Payload
+	for {
+		n := len(payload)
+		if n > int(c.writeChunkSize) {
+			n = int(c.writeChunkSize)
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		continuation := []byte{0xC0 | csid&0x3F}
+		if extended {
+			continuation = append(continuation, header[12:16]...)
+		}
+		if _, err := c.w.Write(continuation); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// Write a protocol control message carrying a 32 bits value
+func (c *chunkConn) writeControl(typ uint8, value uint32, extra ...byte) error {
+	payload := make([]byte, 4, 4+len(extra))
+	binary.BigEndian.PutUint32(payload, value)
+	payload = append(payload, extra...)
+	return c.writeMessage(2, &Message{Type: typ, Payload: payload})
+}
+
+// Write an AMF0 command on a message stream
+func (c *chunkConn) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(3, &Message{Type: typeCommand, StreamID: streamID, Payload: amfEncode(values...)})
+}
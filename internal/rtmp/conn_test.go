@@ -0,0 +1,254 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A connection reading data, writing to out
+func newTestConn(data []byte, out *bytes.Buffer) *chunkConn {
+	c := newConn(nil)
+	c.r = bufio.NewReader(bytes.NewReader(data))
+	c.w = bufio.NewWriter(out)
+	return c
+}
+
+// testChunks writes chunks with the header formats given by the test
+type testChunks struct {
+	bytes.Buffer
+}
+
+// Write a chunk header, the message header fields used depend on the format
+// and the extended timestamp is written if ext is not 0
+func (c *testChunks) header(format byte, csid uint32, timestamp uint32, length int, typ byte, streamID uint32, ext uint32) {
+	switch {
+	case csid < 64:
+		c.WriteByte(format<<6 | byte(csid))
+	case csid < 64+256:
+		c.Write([]byte{format << 6, byte(csid - 64)})
+	default:
+		c.Write([]byte{format<<6 | 1, byte(csid - 64), byte((csid - 64) >> 8)})
+	}
+	if format < 3 {
+		if ext != 0 {
+			timestamp = 0xFFFFFF
+		}
+		c.Write([]byte{byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp)})
+	}
+	if format < 2 {
+		c.Write([]byte{byte(length >> 16), byte(length >> 8), byte(length), typ})
+	}
+	if format == 0 {
+		var id [4]byte
+		binary.LittleEndian.PutUint32(id[:], streamID)
+		c.Write(id[:])
+	}
+	if ext != 0 {
+		var ts [4]byte
+		binary.BigEndian.PutUint32(ts[:], ext)
+		c.Write(ts[:])
+	}
+}
+
+func testPayload(size int, seed byte) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = seed + byte(i)
+	}
+	return payload
+}
+
+func readTestMessages(t *testing.T, c *chunkConn) []*Message {
+	t.Helper()
+	var msgs []*Message
+	for {
+		msg, err := c.readMessage()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// The messages are reassembled from interleaved chunk streams, with the
+// compressed headers, the extended timestamps & the chunk size changes
+func TestChunkReassembly(t *testing.T) {
+	video := testPayload(300, 0)
+	audio := testPayload(10, 100)
+	small := testPayload(20, 50)
+	c := &testChunks{}
+
+	// a video message in 3 chunks, an audio message between them
+	c.header(0, 6, 1000, len(video), TypeVideo, 1, 0)
+	c.Write(video[:128])
+	c.header(0, 4, 1000, len(audio), TypeAudio, 1, 0)
+	c.Write(audio)
+	c.header(3, 6, 0, 0, 0, 0, 0)
+	c.Write(video[128:256])
+	c.header(3, 6, 0, 0, 0, 0, 0)
+	c.Write(video[256:])
+	// a new length & a timestamp delta, the same length, then the same delta
+	c.header(1, 6, 40, len(small), TypeVideo, 0, 0)
+	c.Write(small)
+	c.header(2, 6, 40, 0, 0, 0, 0)
+	c.Write(small)
+	c.header(3, 6, 0, 0, 0, 0, 0)
+	c.Write(small)
+	// 2 & 3 bytes chunk stream ids, an extended timestamp
+	c.header(0, 70, 0, 5, typeDataAMF0, 1, 0x1000000)
+	c.Write(audio[:5])
+	c.header(0, 400, 5, 4, TypeAudio, 1, 0)
+	c.Write(audio[:4])
+	// larger chunks
+	c.header(0, 2, 0, 4, typeSetChunkSize, 0, 0)
+	c.Write([]byte{0, 0, 0x10, 0})
+	c.header(0, 6, 2000, len(video), TypeVideo, 1, 0)
+	c.Write(video)
+	// an aborted message of a chunk stream is dropped
+	c.header(0, 7, 0, 5000, TypeVideo, 1, 0)
+	c.Write(testPayload(4096, 0))
+	c.header(0, 2, 0, 4, typeAbort, 0, 0)
+	c.Write([]byte{0, 0, 0, 7})
+	c.header(0, 7, 3000, len(audio), TypeAudio, 1, 0)
+	c.Write(audio)
+
+	msgs := readTestMessages(t, newTestConn(c.Bytes(), &bytes.Buffer{}))
+	want := []*Message{
+		{Type: TypeAudio, Timestamp: 1000, StreamID: 1, Payload: audio},
+		{Type: TypeVideo, Timestamp: 1000, StreamID: 1, Payload: video},
+		{Type: TypeVideo, Timestamp: 1040, StreamID: 1, Payload: small},
+		{Type: TypeVideo, Timestamp: 1080, StreamID: 1, Payload: small},
+		{Type: TypeVideo, Timestamp: 1120, StreamID: 1, Payload: small},
+		{Type: typeDataAMF0, Timestamp: 0x1000000, StreamID: 1, Payload: audio[:5]},
+		{Type: TypeAudio, Timestamp: 5, StreamID: 1, Payload: audio[:4]},
+		{Type: TypeVideo, Timestamp: 2000, StreamID: 1, Payload: video},
+		{Type: TypeAudio, Timestamp: 3000, StreamID: 1, Payload: audio},
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("%d messages, want %d", len(msgs), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(msgs[i], want[i]) {
+			t.Errorf("message %d %+v, want %+v", i, msgs[i], want[i])
+		}
+	}
+}
+
+func TestChunkErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks func(c *testChunks)
+	}{
+		{
+			name:   "no full header",
+			chunks: func(c *testChunks) { c.header(1, 6, 0, 10, TypeVideo, 0, 0) },
+		},
+		{
+			name: "chunk size 0",
+			chunks: func(c *testChunks) {
+				c.header(0, 2, 0, 4, typeSetChunkSize, 0, 0)
+				c.Write([]byte{0, 0, 0, 0})
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &testChunks{}
+			test.chunks(c)
+			if msg, err := newTestConn(c.Bytes(), &bytes.Buffer{}).readMessage(); err == nil || err == io.EOF {
+				t.Fatalf("read %+v, %v", msg, err)
+			}
+		})
+	}
+}
+
+// The written messages are chunked and read back
+func TestWriteMessage(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := newTestConn(nil, out)
+	msgs := []*Message{
+		{Type: typeCommand, Timestamp: 0x1000000, StreamID: 1, Payload: testPayload(300, 0)},
+		{Type: typeCommand, Timestamp: 20, Payload: amfEncode("_result", 1, nil)},
+	}
+	for _, msg := range msgs {
+		if err := w.writeMessage(3, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a full header & the extended timestamp, then 2 continuations
+	if size := 16 + 300 + 2*5; !bytes.HasPrefix(out.Bytes()[size:], []byte{3, 0, 0, 20}) {
+		t.Fatalf("the second message does not start at %d", size)
+	}
+	if read := readTestMessages(t, newTestConn(out.Bytes(), &bytes.Buffer{})); !reflect.DeepEqual(read, msgs) {
+		t.Fatalf("read %+v, want %+v", read, msgs)
+	}
+}
+
+// The received bytes are acknowledged at each window
+func TestAcknowledgement(t *testing.T) {
+	c := &testChunks{}
+	c.header(0, 2, 0, 4, typeWindowAckSize, 0, 0)
+	c.Write([]byte{0, 0, 0, 200})
+	c.header(0, 6, 0, 100, TypeVideo, 1, 0)
+	c.Write(testPayload(100, 0))
+	c.header(0, 6, 0, 100, TypeVideo, 1, 0)
+	c.Write(testPayload(100, 0))
+
+	out := &bytes.Buffer{}
+	if msgs := readTestMessages(t, newTestConn(c.Bytes(), out)); len(msgs) != 2 {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	acks := readTestMessages(t, newTestConn(out.Bytes(), &bytes.Buffer{}))
+	// the acknowledgements are control messages, read as such
+	if len(acks) != 0 {
+		t.Fatalf("acks %+v", acks)
+	}
+	ack := out.Bytes()
+	if len(ack) != 16 || ack[7] != typeAcknowledgement || binary.BigEndian.Uint32(ack[12:]) != uint32(c.Len()) {
+		t.Fatalf("acknowledgement %x of %d bytes", ack, c.Len())
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	for _, version := range []byte{3, 6} {
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- newConn(server).handshake() }()
+
+		c1 := testPayload(handshakeSize, 7)
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write(append([]byte{version}, c1...)); err != nil {
+			t.Fatal(err)
+		}
+		if version != 3 {
+			if err := <-errs; err == nil {
+				t.Fatalf("handshake of version %d", version)
+			}
+			client.Close()
+			continue
+		}
+		s0s1s2 := make([]byte, 1+2*handshakeSize)
+		if _, err := io.ReadFull(client, s0s1s2); err != nil {
+			t.Fatal(err)
+		}
+		if s0s1s2[0] != 3 || !bytes.Equal(s0s1s2[1+handshakeSize:], c1) {
+			t.Fatal("the S2 does not echo the C1")
+		}
+		if _, err := client.Write(s0s1s2[1 : 1+handshakeSize]); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,359 @@
+// Package rtmp is a minimal RTMP server receiving the streams encoders
+// (OBS, hardware encoders) push to rtmp://host/app/key.
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// time allowed for the handshake & the commands before the publish
+const publishSetupTimeout = 10 * time.Second
+
+// Server is a RTMP listener, shared by the streams of its address
+type Server struct {
+	addr     string
+	listener net.Listener
+
+	mutex   sync.Mutex
+	refs    int
+	streams map[string]*Stream
+}
+
+var (
+	serversMutex sync.Mutex
+	servers      = map[string]*Server{}
+)
+
+// Listen returns the server listening on addr, started by its first user.
+// Each Listen must be followed by a Close.
+func Listen(addr string) (*Server, error) {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+
+	if s, ok := servers[addr]; ok {
+		s.mutex.Lock()
+		s.refs++
+		s.mutex.Unlock()
+		return s, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{addr: addr, listener: listener, refs: 1, streams: make(map[string]*Stream)}
+	servers[addr] = s
+	log.Println("RTMP server listening on", listener.Addr())
+	go s.run()
+	return s, nil
+}
+
+// Addr is the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close releases the server, the listener is closed with its last user
+func (s *Server) Close() error {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+
+	s.mutex.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mutex.Unlock()
+	if !last {
+		return nil
+	}
+	delete(servers, s.addr)
+	return s.listener.Close()
+}
+
+func (s *Server) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// Stream registers a path (app/key) the encoders can publish to
+func (s *Server) Stream(path string) (*Stream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path = strings.Trim(path, "/")
+	if _, ok := s.streams[path]; ok {
+		return nil, fmt.Errorf("RTMP stream %s already registered", path)
+	}
+	st := &Stream{server: s, path: path, publishers: make(chan *Publisher, 1)}
+	s.streams[path] = st
+	return st, nil
+}
+
+// Stream is a path of a server, published by one encoder at a time
+type Stream struct {
+	server     *Server
+	path       string
+	publishers chan *Publisher
+
+	mutex  sync.Mutex
+	active *Publisher
+	closed bool
+}
+
+// Accept waits for an encoder to publish the stream, up to timeout (0 waits
+// forever) or until done is closed
+func (st *Stream) Accept(timeout time.Duration, done <-chan struct{}) (*Publisher, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-st.publishers:
+		return p, nil
+	case <-expired:
+		return nil, fmt.Errorf("no encoder published %s in %v", st.path, timeout)
+	case <-done:
+		return nil, errors.New("RTMP stream closed")
+	}
+}
+
+// Close unregisters the stream, the waiting publisher is closed
+func (st *Stream) Close() {
+	st.server.mutex.Lock()
+	delete(st.server.streams, st.path)
+	st.server.mutex.Unlock()
+
+	st.mutex.Lock()
+	st.closed = true
+	st.mutex.Unlock()
+	select {
+	case p := <-st.publishers:
+		p.Close()
+	default:
+	}
+}
+
+// Queue a publisher for Accept, refused if the stream is already published
+func (st *Stream) offer(p *Publisher) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.closed || st.active != nil {
+		return false
+	}
+	select {
+	case st.publishers <- p:
+		st.active = p
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *Stream) release(p *Publisher) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.active == p {
+		st.active = nil
+	}
+}
+
+// Publisher is an encoder publishing a stream
+type Publisher struct {
+	conn     *chunkConn
+	stream   *Stream
+	streamID uint32
+	once     sync.Once
+}
+
+// ReadMessage returns the next audio, video or AMF0 data message. It
+// returns io.EOF when the encoder stops publishing.
+func (p *Publisher) ReadMessage() (*Message, error) {
+	for {
+		msg, err := p.conn.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case TypeAudio, TypeVideo:
+			return msg, nil
+		case typeDataAMF3:
+			if len(msg.Payload) > 0 {
+				msg.Payload = msg.Payload[1:]
+			}
+			msg.Type = typeDataAMF0
+			return msg, nil
+		case typeDataAMF0:
+			return msg, nil
+		case typeCommand, typeAMF3:
+			values, _ := decodeCommand(msg)
+			if len(values) > 0 {
+				switch values[0] {
+				case "FCUnpublish", "deleteStream", "closeStream":
+					return nil, io.EOF
+				}
+			}
+		}
+	}
+}
+
+// RemoteAddr is the address of the encoder
+func (p *Publisher) RemoteAddr() net.Addr {
+	return p.conn.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline of the next reads
+func (p *Publisher) SetReadDeadline(t time.Time) error {
+	return p.conn.conn.SetReadDeadline(t)
+}
+
+// Close ends the publish, the stream can be published again
+func (p *Publisher) Close() error {
+	var err error
+	p.once.Do(func() {
+		err = p.conn.conn.Close()
+		p.stream.release(p)
+	})
+	return err
+}
+
+// Metadata returns the properties of a onMetaData data message
+func (m *Message) Metadata() (map[string]interface{}, bool) {
+	if m.Type != typeDataAMF0 {
+		return nil, false
+	}
+	values, _ := amfDecode(m.Payload)
+	if len(values) > 0 && values[0] == "@setDataFrame" {
+		values = values[1:]
+	}
+	if len(values) < 2 || values[0] != "onMetaData" {
+		return nil, false
+	}
+	o, ok := values[1].(amfObject)
+	return o, ok
+}
+
+func decodeCommand(msg *Message) ([]interface{}, error) {
+	payload := msg.Payload
+	// AMF3 commands start with a 0 byte then the AMF0 values
+	if msg.Type == typeAMF3 && len(payload) > 0 {
+		payload = payload[1:]
+	}
+	return amfDecode(payload)
+}
+
+// Handshake & answer the commands up to the publish, then hand the
+// connection to the stream
+func (s *Server) serve(nc net.Conn) {
+	c := newConn(nc)
+	_ = nc.SetDeadline(time.Now().Add(publishSetupTimeout))
+	if _, err := s.setup(c); err != nil {
+		log.Printf("RTMP publisher %s refused: %v", nc.RemoteAddr(), err)
+		nc.Close()
+	}
+}
+
+func (s *Server) setup(c *chunkConn) (*Publisher, error) {
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+
+	var app string
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type != typeCommand && msg.Type != typeAMF3 {
+			continue
+		}
+		values, err := decodeCommand(msg)
+		if err != nil || len(values) < 2 {
+			return nil, errors.New("invalid RTMP command")
+		}
+		name, _ := values[0].(string)
+		transaction := values[1]
+
+		switch name {
+		case "connect":
+			if len(values) > 2 {
+				if o, ok := values[2].(amfObject); ok {
+					app, _ = o["app"].(string)
+				}
+			}
+			if err := c.writeControl(typeWindowAckSize, serverWindowSize); err != nil {
+				return nil, err
+			}
+			// dynamic limit type
+			if err := c.writeControl(typeSetPeerBandwidth, serverWindowSize, 2); err != nil {
+				return nil, err
+			}
+			if err := c.writeControl(typeSetChunkSize, serverChunkSize); err != nil {
+				return nil, err
+			}
+			c.writeChunkSize = serverChunkSize
+			err := c.writeCommand(0, "_result", transaction,
+				amfObject{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+				amfObject{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0})
+			if err != nil {
+				return nil, err
+			}
+		case "releaseStream", "FCPublish":
+			if err := c.writeCommand(0, "_result", transaction, nil); err != nil {
+				return nil, err
+			}
+		case "createStream":
+			if err := c.writeCommand(0, "_result", transaction, nil, 1); err != nil {
+				return nil, err
+			}
+		case "publish":
+			key := ""
+			if len(values) > 3 {
+				key, _ = values[3].(string)
+			}
+			// the query of the key (tokens) is not part of the path
+			if i := strings.IndexByte(key, '?'); i >= 0 {
+				key = key[:i]
+			}
+			if i := strings.IndexByte(app, '?'); i >= 0 {
+				app = app[:i]
+			}
+			path := strings.Trim(app, "/") + "/" + key
+
+			s.mutex.Lock()
+			st, ok := s.streams[path]
+			s.mutex.Unlock()
+			p := &Publisher{conn: c, stream: st, streamID: msg.StreamID}
+			// the reads are up to the stream reader from now on
+			_ = c.conn.SetDeadline(time.Time{})
+			if !ok || !st.offer(p) {
+				_ = c.writeCommand(msg.StreamID, "onStatus", 0, nil,
+					amfObject{"level": "error", "code": "NetStream.Publish.BadName", "description": "Stream not available."})
+				if !ok {
+					return nil, fmt.Errorf("unknown stream %s", path)
+				}
+				return nil, fmt.Errorf("stream %s already published", path)
+			}
+			err := c.writeCommand(msg.StreamID, "onStatus", 0, nil,
+				amfObject{"level": "status", "code": "NetStream.Publish.Start", "description": "Start publishing."})
+			if err != nil {
+				p.Close()
+				return nil, err
+			}
+			return p, nil
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The tags published by the test encoder
+var testTags = []*Message{
+	// AVC sequence header, then a keyframe & G.711 audio
+	{Type: TypeVideo, StreamID: 1, Payload: []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1}},
+	{Type: TypeAudio, Timestamp: 0, StreamID: 1, Payload: append([]byte{0x82}, testPayload(160, 0)...)},
+	{Type: TypeVideo, Timestamp: 40, StreamID: 1, Payload: append([]byte{0x17, 1, 0, 0, 0}, testPayload(6000, 1)...)},
+	{Type: TypeAudio, Timestamp: 20, StreamID: 1, Payload: append([]byte{0x82}, testPayload(160, 2)...)},
+	{Type: TypeVideo, Timestamp: 80, StreamID: 1, Payload: append([]byte{0x27, 1, 0, 0, 0}, testPayload(300, 3)...)},
+}
+
+// The bytes an encoder sends to publish rtmp://host/app/key: the handshake,
+// the commands up to the publish, the metadata & tags, then the unpublish.
+// Like ffmpeg, it sets its chunk size first and sends the audio & video on
+// their own chunk streams.
+func testPublishSession(app string, key string, tags []*Message) []byte {
+	out := &bytes.Buffer{}
+	out.WriteByte(3)
+	out.Write(testPayload(2*handshakeSize, 9))
+
+	c := newTestConn(nil, out)
+	_ = c.writeControl(typeSetChunkSize, 4096)
+	c.writeChunkSize = 4096
+	_ = c.writeCommand(0, "connect", 1, amfObject{"app": app, "type": "nonprivate", "flashVer": "FMLE/3.0", "tcUrl": "rtmp://127.0.0.1/" + app})
+	_ = c.writeCommand(0, "releaseStream", 2, nil, key)
+	_ = c.writeCommand(0, "FCPublish", 3, nil, key)
+	_ = c.writeCommand(0, "createStream", 4, nil)
+	_ = c.writeCommand(1, "publish", 5, nil, key, app)
+	_ = c.writeMessage(4, &Message{Type: typeDataAMF0, StreamID: 1,
+		Payload: amfEncode("@setDataFrame", "onMetaData", amfObject{"width": 320, "height": 240, "videocodecid": 7, "audiocodecid": 8})})
+	for _, tag := range tags {
+		csid := uint8(6)
+		if tag.Type == TypeAudio {
+			csid = 4
+		}
+		_ = c.writeMessage(csid, tag)
+	}
+	_ = c.writeCommand(1, "FCUnpublish", 6, nil, key)
+	_ = c.writeCommand(1, "deleteStream", 7, nil, 1)
+	return out.Bytes()
+}
+
+// Replay a session to the server, returns the commands answered
+func replayTestSession(t *testing.T, s *Server, session []byte) (net.Conn, chan []interface{}) {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Write(session)
+
+	commands := make(chan []interface{}, 10)
+	go func() {
+		defer close(commands)
+		if _, err := io.ReadFull(conn, make([]byte, 1+2*handshakeSize)); err != nil {
+			return
+		}
+		c := newConn(conn)
+		for {
+			msg, err := c.readMessage()
+			if err != nil {
+				return
+			}
+			if values, err := decodeCommand(msg); err == nil && msg.Type == typeCommand {
+				commands <- values
+			}
+		}
+	}()
+	return conn, commands
+}
+
+// The status code of the onStatus answering the publish
+func waitTestPublishStatus(t *testing.T, commands chan []interface{}) string {
+	t.Helper()
+	for {
+		select {
+		case values, ok := <-commands:
+			if !ok {
+				t.Fatal("no onStatus")
+			}
+			if values[0] == "onStatus" {
+				return values[3].(amfObject)["code"].(string)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no onStatus")
+		}
+	}
+}
+
+func listenTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// A replayed publish session is answered up to the publish, then its
+// metadata & tags are read until the unpublish
+func TestPublishSession(t *testing.T) {
+	s := listenTestServer(t)
+	st, err := s.Stream("/live/key/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// the query of the key is not part of the path
+	_, commands := replayTestSession(t, s, testPublishSession("live", "key?token=secret", testTags))
+	p, err := st.Accept(5*time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	msg, err := p.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, ok := msg.Metadata()
+	if !ok || metadata["width"] != 320.0 || metadata["audiocodecid"] != 8.0 {
+		t.Fatalf("metadata %+v", msg)
+	}
+	for i, tag := range testTags {
+		msg, err := p.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg, tag) {
+			t.Fatalf("tag %d %+v", i, msg)
+		}
+	}
+	if _, err := p.ReadMessage(); err != io.EOF {
+		t.Fatalf("read after the unpublish: %v", err)
+	}
+
+	var answered []interface{}
+	for values := range commands {
+		answered = append(answered, values[0], values[1])
+		switch {
+		case values[1] == 1.0:
+			if status := values[3].(amfObject); status["code"] != "NetConnection.Connect.Success" {
+				t.Fatalf("connect answered %+v", status)
+			}
+		case values[1] == 4.0:
+			if len(values) != 4 || values[3] != 1.0 {
+				t.Fatalf("createStream answered %+v", values)
+			}
+		case values[0] == "onStatus":
+			if status := values[3].(amfObject); status["code"] != "NetStream.Publish.Start" {
+				t.Fatalf("publish answered %+v", status)
+			}
+			p.Close()
+		}
+	}
+	want := []interface{}{"_result", 1.0, "_result", 2.0, "_result", 3.0, "_result", 4.0, "onStatus", 0.0}
+	if !reflect.DeepEqual(answered, want) {
+		t.Fatalf("answered %v, want %v", answered, want)
+	}
+}
+
+// A stream is published by one encoder at a time, the unknown streams are refused
+func TestPublishRefused(t *testing.T) {
+	s := listenTestServer(t)
+	st, err := s.Stream("live/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if _, err := s.Stream("live/key"); err == nil {
+		t.Fatal("stream registered twice")
+	}
+
+	_, commands := replayTestSession(t, s, testPublishSession("live", "other", nil))
+	if code := waitTestPublishStatus(t, commands); code != "NetStream.Publish.BadName" {
+		t.Fatalf("unknown stream publish %s", code)
+	}
+
+	_, commands = replayTestSession(t, s, testPublishSession("live", "key", nil))
+	if code := waitTestPublishStatus(t, commands); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish %s", code)
+	}
+	_, commands = replayTestSession(t, s, testPublishSession("live", "key", nil))
+	if code := waitTestPublishStatus(t, commands); code != "NetStream.Publish.BadName" {
+		t.Fatalf("second publish %s", code)
+	}
+
+	// published again once the publisher is closed
+	p, err := st.Accept(time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	_, commands = replayTestSession(t, s, testPublishSession("live", "key", nil))
+	if code := waitTestPublishStatus(t, commands); code != "NetStream.Publish.Start" {
+		t.Fatalf("publish after close %s", code)
+	}
+	if _, err := st.Accept(100*time.Millisecond, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Accept(100*time.Millisecond, nil); err == nil {
+		t.Fatal("accepted without publisher")
+	}
+}
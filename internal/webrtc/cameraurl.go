@@ -0,0 +1,160 @@
+package webrtc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aler9/gortsplib/pkg/url"
+)
+
+// the user info of the URLs in a text, up to the last @ of the authority
+var credentialsReg = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/?#\s"'@]*(@[^/?#\s"'@]*)*@`)
+
+// RedactURLs hides the credentials of the URLs found in a text, so it can be logged
+func RedactURLs(text string) string {
+	return credentialsReg.ReplaceAllString(text, "${1}***@")
+}
+
+// the JSON fields of the configs holding a secret
+var secretFields = []string{"ice_credential", "whip_token", "restream_pass", "secret", "pin"}
+
+// the string values of the secret fields
+var secretFieldsReg = regexp.MustCompile(`("(?:` + strings.Join(secretFields, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// RedactConfigs hides the URL credentials & the secret fields of the JSON
+// configs, so they can be logged
+func RedactConfigs(configs string) string {
+	return secretFieldsReg.ReplaceAllString(RedactURLs(configs), `${1}"***"`)
+}
+
+// Check a RTSP camera URL: rtsp, rtsps, rtsp+http or rtsp+https (tunneled)
+// scheme, a host name, IPv4 or [IPv6] address, an optional port and optional
+// user:password credentials (Digest is preferred to Basic when the camera
+// offers both). The returned error does not contain the credentials.
+func validateRTSPURL(rawURL string) error {
+	_, rawURL = tunnelURL(rawURL)
+	// same parsing as the RTSP client, the % of the passwords are kept
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid camera URL: %s", RedactURLs(err.Error()))
+	}
+	if u.Host == "" {
+		return fmt.Errorf("camera URL %s has no host", RedactURLs(rawURL))
+	}
+	if u.User != nil && u.User.Username() == "" {
+		return fmt.Errorf("camera URL %s has a password but no user", RedactURLs(rawURL))
+	}
+
+	std := (*neturl.URL)(u)
+	if strings.HasSuffix(u.Host, ":") {
+		return fmt.Errorf("camera URL %s has an empty port", RedactURLs(rawURL))
+	}
+	if port := std.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("camera URL %s has an invalid port %s", RedactURLs(rawURL), port)
+		}
+	}
+
+	host := std.Hostname()
+	if strings.HasPrefix(u.Host, "[") {
+		// IPv6 literal, with an optional zone
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host = host[:i]
+		}
+		if ip := net.ParseIP(host); ip == nil || !strings.Contains(host, ":") {
+			return fmt.Errorf("camera URL %s has an invalid IPv6 address", RedactURLs(rawURL))
+		}
+		return nil
+	}
+	if net.ParseIP(host) != nil {
+		if strings.Contains(host, ":") {
+			return fmt.Errorf("camera URL %s has an IPv6 address without brackets", RedactURLs(rawURL))
+		}
+		return nil
+	}
+	if !validHostname(host) {
+		return fmt.Errorf("camera URL %s has an invalid host %q", RedactURLs(rawURL), host)
+	}
+	return nil
+}
+
+// DNS name, a last label made of digits would be a bad IPv4 address
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
+
+// TLS configuration of the rtsps cameras: the certificate is checked against
+// the CA file if set (instead of the system roots), skip-verify alone accepts
+// any certificate, and with a CA file only skips the host name check (cameras
+// reached by an address not in their certificate).
+func rtspTLSConfig(options Options) (*tls.Config, error) {
+	caFile := options.RTSPCAFile
+	skipVerify := options.RTSPSkipVerify
+	if caFile == "" && !skipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	var roots *x509.CertPool
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate in %s", caFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if !skipVerify {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.InsecureSkipVerify = true
+	if roots != nil {
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("the camera sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+	return tlsConfig, nil
+}
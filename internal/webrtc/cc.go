@@ -0,0 +1,111 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+// Congestion control bitrates (bps) used when not set in the options
+const (
+	defaultInitialBitrate = 2_500_000
+	defaultMinBitrate     = 100_000
+	defaultMaxBitrate     = 20_000_000
+)
+
+// BandwidthStats is the send side bandwidth estimate of a muxer
+type BandwidthStats struct {
+	// TargetBitrate is the GCC estimate (bps), the video is paced at 1.5x
+	TargetBitrate int `json:"target_bitrate"`
+	// Details are the states of the loss & delay based estimators
+	Details map[string]interface{} `json:"details"`
+}
+
+// Send the transport-cc header extension and estimate the bandwidth from the
+// feedback with GCC. The estimator must be added before the header extension
+// interceptor, so the sent packets it sees are already numbered.
+func (element *Muxer) registerCongestionControl(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	initialBitrate := element.Options.InitialBitrate
+	if initialBitrate <= 0 {
+		initialBitrate = defaultInitialBitrate
+	}
+	minBitrate := element.Options.MinBitrate
+	if minBitrate <= 0 {
+		minBitrate = defaultMinBitrate
+	}
+	maxBitrate := element.Options.MaxBitrate
+	if maxBitrate <= 0 {
+		maxBitrate = defaultMaxBitrate
+	}
+
+	options := []gcc.Option{
+		gcc.SendSideBWEInitialBitrate(initialBitrate),
+		gcc.SendSideBWEMinBitrate(minBitrate),
+		gcc.SendSideBWEMaxBitrate(maxBitrate),
+	}
+	if element.Options.PacingRate > 0 {
+		// the video is paced by the track pacers, see `onTargetBitrate`
+		options = append(options, gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	}
+
+	factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(options...)
+	})
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		element.estimator = estimator
+		estimator.OnTargetBitrateChange(element.onTargetBitrate)
+	})
+	i.Add(factory)
+
+	return webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
+}
+
+// The pacer of the video track of a forward, nil if the video is not paced
+func (element *Muxer) newPacer(f *rtspForward) *media.Pacer {
+	if element.Options.PacingRate <= 0 {
+		return nil
+	}
+	pacer := media.NewPacer(element.Options.PacingRate, element.Options.PacingQueueSize)
+	pacer.OnWriteError(f.writeError)
+	return pacer
+}
+
+// The forwards writing to a paced video track: the switcher output or the
+// layer of each simulcast encoding
+func (element *Muxer) pacedForwards() []*rtspForward {
+	var forwards []*rtspForward
+	for _, layer := range element.layers {
+		for _, f := range layer.forwards {
+			if f.pacer != nil {
+				forwards = append(forwards, f)
+			}
+		}
+	}
+	if element.switcher != nil && element.switcher.output != nil && element.switcher.output.pacer != nil {
+		forwards = append(forwards, element.switcher.output)
+	}
+	return forwards
+}
+
+func (element *Muxer) onTargetBitrate(bitrate int) {
+	for _, f := range element.pacedForwards() {
+		f.pacer.SetRate(bitrate * 3 / 2)
+	}
+	if element.switcher != nil {
+		element.switcher.onEstimate(uint64(bitrate), "gcc")
+	}
+}
+
+// BandwidthEstimate returns the GCC estimate (bps), 0 if the congestion control is disabled
+func (element *Muxer) BandwidthEstimate() int {
+	if element.estimator == nil {
+		return 0
+	}
+	return element.estimator.GetTargetBitrate()
+}
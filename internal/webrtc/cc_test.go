@@ -0,0 +1,110 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// The GCC estimate is given to the pacer (1.5x) & the switcher, which moves
+// to the low stream once it stays under the high stream bitrate
+func TestCongestionControlTargetBitrate(t *testing.T) {
+	layers := []*rtspLayer{{rid: "high"}, {rid: "low"}}
+	requested := make(chan *rtspLayer, 1)
+	m := &Muxer{
+		switcher: newStreamSwitcher(layers, media.CodecH264, func(layer *rtspLayer) { requested <- layer }),
+	}
+	pacer := media.NewPacer(5_000_000, 0)
+	defer pacer.Close()
+	m.switcher.output = &rtspForward{pacer: pacer}
+	m.switcher.bitrates = []uint64{1_600_000, 200_000}
+
+	m.onTargetBitrate(2_000_000)
+	if rate := pacer.Stats().Rate; rate != 3_000_000 {
+		t.Fatalf("pacer rate %d bps", rate)
+	}
+	if stats := m.switcher.stats(); stats.Estimate != 2_000_000 || stats.Pending != "" {
+		t.Fatalf("switch %+v", stats)
+	}
+
+	m.onTargetBitrate(400_000)
+	if rate := pacer.Stats().Rate; rate != 600_000 {
+		t.Fatalf("pacer rate %d bps", rate)
+	}
+	if stats := m.switcher.stats(); stats.Estimate != 400_000 || stats.Pending != "" {
+		t.Fatalf("switch before the hold time %+v", stats)
+	}
+	m.switcher.mutex.Lock()
+	m.switcher.directionSince = m.switcher.directionSince.Add(-switchDownHold)
+	m.switcher.mutex.Unlock()
+	m.onTargetBitrate(400_000)
+	if stats := m.switcher.stats(); stats.Active != "high" || stats.Pending != "low" {
+		t.Fatalf("switch %+v", stats)
+	}
+	select {
+	case layer := <-requested:
+		if layer != layers[1] {
+			t.Fatalf("keyframe requested on %s", layer.rid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no keyframe requested on the low stream")
+	}
+}
+
+// Each simulcast encoding has its pacer, following the estimate & counted
+// in the stats of its RID
+func TestCongestionControlTrackPacers(t *testing.T) {
+	m := &Muxer{}
+	for _, rid := range []string{"high", "low"} {
+		layer := &rtspLayer{rid: rid, source: &testSource{}}
+		f := &rtspForward{layer: layer, pacer: media.NewPacer(5_000_000, 0)}
+		defer f.pacer.Close()
+		layer.forwards = []*rtspForward{f, {layer: layer}}
+		m.layers = append(m.layers, layer)
+	}
+
+	m.onTargetBitrate(1_000_000)
+	stats := m.Stats().Pacers
+	if len(stats) != 2 || stats[0].RID != "high" || stats[1].RID != "low" {
+		t.Fatalf("pacers %+v", stats)
+	}
+	for _, pacer := range stats {
+		if pacer.Rate != 1_500_000 {
+			t.Fatalf("%s pacer rate %d bps", pacer.RID, pacer.Rate)
+		}
+	}
+}
+
+// The estimator of the PeerConnection starts at the initial bitrate
+func TestCongestionControlEstimator(t *testing.T) {
+	for _, options := range []Options{
+		{CongestionControl: true, InitialBitrate: 1_000_000},
+		{CongestionControl: true, InitialBitrate: 1_000_000, PacingRate: 5_000_000},
+	} {
+		m := &Muxer{Options: options}
+		if estimate := m.BandwidthEstimate(); estimate != 0 {
+			t.Fatalf("estimate %d bps without a PeerConnection", estimate)
+		}
+
+		mediaEngine := &webrtc.MediaEngine{}
+		if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+			t.Fatal(err)
+		}
+		registry := &interceptor.Registry{}
+		if err := m.registerCongestionControl(mediaEngine, registry); err != nil {
+			t.Fatal(err)
+		}
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+		pc, err := api.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate := m.BandwidthEstimate(); estimate != 1_000_000 {
+			t.Errorf("initial estimate %d bps, pacing %d", estimate, options.PacingRate)
+		}
+		pc.Close()
+	}
+}
@@ -0,0 +1,199 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// FEC payload types offered to Janus
+const (
+	videoREDPayloadType    = 97
+	videoULPFECPayloadType = 98
+	audioREDPayloadType    = 63
+)
+
+// max number of previous Opus frames carried by a RED packet
+const maxAudioRedundancy = 2
+
+// fecInterceptor wraps the video packets in RED and adds ULPFEC packets,
+// and wraps the Opus packets in RED with the previous frames. It's the first
+// interceptor the packets go through: the NACK responder caches the packets
+// with their new sequence numbers, and the FEC does not cover the
+// transport-cc extension, added after it.
+type fecInterceptor struct {
+	interceptor.NoOp
+	videoMimeType string
+	overhead      int
+	redundancy    int
+
+	mutex sync.Mutex
+	// payload types accepted in the answer, 0 if not
+	videoRED    uint8
+	videoULPFEC uint8
+	audioRED    uint8
+}
+
+func newFECInterceptor(videoMimeType string, overhead int, redundancy int) *fecInterceptor {
+	if redundancy > maxAudioRedundancy {
+		redundancy = maxAudioRedundancy
+	}
+	return &fecInterceptor{videoMimeType: videoMimeType, overhead: overhead, redundancy: redundancy}
+}
+
+// NewInterceptor is the interceptor factory, a muxer has a single PeerConnection
+func (f *fecInterceptor) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return f, nil
+}
+
+// Register the RED & ULPFEC codecs offered
+func (f *fecInterceptor) registerCodecs(m *webrtc.MediaEngine) error {
+	if f.overhead > 0 {
+		for _, codec := range []webrtc.RTPCodecParameters{
+			{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/red", ClockRate: 90000}, PayloadType: videoREDPayloadType},
+			{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/ulpfec", ClockRate: 90000}, PayloadType: videoULPFECPayloadType},
+		} {
+			if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+				return err
+			}
+		}
+	}
+	if f.redundancy > 0 {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/red", ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111"},
+			PayloadType:        audioREDPayloadType,
+		}
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Take the payload types Janus accepted, must be called before the answer is
+// set as the streams are bound then
+func (f *fecInterceptor) negotiate(answer string) {
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.videoRED, f.videoULPFEC, f.audioRED = 0, 0, 0
+	for _, md := range desc.MediaDescriptions {
+		for _, format := range md.MediaName.Formats {
+			pt, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := desc.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			switch name := strings.ToLower(codec.Name); {
+			case md.MediaName.Media == "video" && name == "red":
+				f.videoRED = uint8(pt)
+			case md.MediaName.Media == "video" && name == "ulpfec":
+				f.videoULPFEC = uint8(pt)
+			case md.MediaName.Media == "audio" && name == "red":
+				f.audioRED = uint8(pt)
+			}
+		}
+	}
+
+	if f.overhead > 0 && (f.videoRED == 0 || f.videoULPFEC == 0) {
+		log.Println("Janus did not accept red/ulpfec, the video is sent without FEC")
+	}
+	if f.redundancy > 0 && f.audioRED == 0 {
+		log.Println("Janus did not accept audio red, the audio is sent without redundancy")
+	}
+}
+
+// BindLocalStream wraps the video & Opus streams
+func (f *fecInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case strings.EqualFold(info.MimeType, f.videoMimeType) && f.overhead > 0 && f.videoRED != 0 && f.videoULPFEC != 0:
+		return ulpfecWriter(writer, f.overhead, f.videoRED, f.videoULPFEC)
+	case strings.EqualFold(info.MimeType, webrtc.MimeTypeOpus) && f.redundancy > 0 && f.audioRED != 0:
+		return audioREDWriter(writer, f.redundancy, f.audioRED)
+	}
+	return writer
+}
+
+// Send each video packet in RED, and a ULPFEC packet in RED after each group.
+// The FEC packets take sequence numbers, the following packets are shifted
+// (gaps are kept, so the losses before the track are still seen).
+func ulpfecWriter(writer interceptor.RTPWriter, overhead int, redPT uint8, ulpfecPT uint8) interceptor.RTPWriter {
+	ulpfec := media.NewULPFEC(overhead)
+	var mutex sync.Mutex
+	var inserted uint16
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// the FEC protects the packet the receiver gets out of RED
+		mediaHeader := header.Clone()
+		mediaHeader.SequenceNumber = header.SequenceNumber + inserted
+		raw, err := (&rtp.Packet{Header: mediaHeader, Payload: payload}).Marshal()
+		if err != nil {
+			return 0, err
+		}
+		fecPayload := ulpfec.Push(raw)
+
+		redHeader := mediaHeader.Clone()
+		redHeader.PayloadType = redPT
+		n, err := writer.Write(&redHeader, append([]byte{mediaHeader.PayloadType & 0x7F}, payload...), attributes)
+		if err != nil || fecPayload == nil {
+			return n, err
+		}
+
+		fecHeader := rtp.Header{
+			Version:        2,
+			PayloadType:    redPT,
+			SequenceNumber: mediaHeader.SequenceNumber + 1,
+			Timestamp:      mediaHeader.Timestamp,
+			SSRC:           mediaHeader.SSRC,
+		}
+		inserted++
+		if _, err := writer.Write(&fecHeader, append([]byte{ulpfecPT & 0x7F}, fecPayload...), nil); err != nil {
+			return n, err
+		}
+		return n, nil
+	})
+}
+
+// Send each Opus packet in RED with the previous frames
+func audioREDWriter(writer interceptor.RTPWriter, redundancy int, redPT uint8) interceptor.RTPWriter {
+	var mutex sync.Mutex
+	var previous []media.REDBlock
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		primary := media.REDBlock{PayloadType: header.PayloadType, Timestamp: header.Timestamp, Payload: payload}
+		redHeader := header.Clone()
+		redHeader.PayloadType = redPT
+		n, err := writer.Write(&redHeader, media.RED(primary, previous), attributes)
+
+		primary.Payload = append([]byte(nil), payload...)
+		previous = append(previous, primary)
+		if len(previous) > redundancy {
+			previous = previous[len(previous)-redundancy:]
+		}
+		return n, err
+	})
+}
@@ -0,0 +1,356 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+)
+
+// testRTPWriter collects the packets written by the FEC interceptor
+type testRTPWriter struct {
+	packets []*rtp.Packet
+}
+
+func (w *testRTPWriter) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	w.packets = append(w.packets, &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)})
+	return len(payload), nil
+}
+
+// The packet n of the test video, a single NALU
+func testFECPacket(sequenceNumber uint16, n int) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: sequenceNumber, Timestamp: uint32(n * 3600), SSRC: 1234},
+		Payload: testFrame(n, 300+n),
+	}
+}
+
+// Each video packet is sent in RED, a ULPFEC packet in RED follows each
+// group and shifts the next packets, a lost packet is recovered
+func TestULPFECWriterLayout(t *testing.T) {
+	w := &testRTPWriter{}
+	// 1 FEC packet every 4 media packets
+	writer := ulpfecWriter(w, 25, videoREDPayloadType, videoULPFECPayloadType)
+	for n := 0; n < 12; n++ {
+		pkt := testFECPacket(uint16(100+n), n)
+		if _, err := writer.Write(&pkt.Header, pkt.Payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.packets) != 15 {
+		t.Fatalf("%d packets written, want 12 media & 3 FEC", len(w.packets))
+	}
+
+	received := map[uint16][]byte{}
+	var fecs [][]byte
+	for i, pkt := range w.packets {
+		if pkt.SequenceNumber != uint16(100+i) || pkt.PayloadType != videoREDPayloadType || pkt.SSRC != 1234 {
+			t.Fatalf("packet %d header %+v", i, pkt.Header)
+		}
+		if i%5 == 4 {
+			if pkt.Payload[0] != videoULPFECPayloadType || pkt.Timestamp != w.packets[i-1].Timestamp {
+				t.Fatalf("packet %d is not the FEC of its group", i)
+			}
+			fecs = append(fecs, pkt.Payload[1:])
+			continue
+		}
+		n := i - i/5
+		if pkt.Payload[0] != 96 || string(pkt.Payload[1:]) != string(testFrame(n, 300+n)) {
+			t.Fatalf("packet %d is not the RED of the media packet %d", i, n)
+		}
+		// the packet the FEC protects, the 2nd of each group is lost
+		if i%5 == 1 {
+			continue
+		}
+		media := &rtp.Packet{Header: pkt.Header, Payload: pkt.Payload[1:]}
+		media.PayloadType = 96
+		raw, err := media.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[pkt.SequenceNumber] = raw
+	}
+
+	for i, fec := range fecs {
+		pkt := media.RecoverULPFEC(fec, 1234, received)
+		lost := &rtp.Packet{}
+		if pkt == nil || lost.Unmarshal(pkt) != nil {
+			t.Fatalf("the FEC %d recovers no packet", i)
+		}
+		n := 4*i + 1
+		if lost.SequenceNumber != uint16(100+5*i+1) || lost.Timestamp != uint32(n*3600) || lost.PayloadType != 96 ||
+			string(lost.Payload) != string(testFrame(n, 300+n)) {
+			t.Fatalf("the FEC %d recovers %+v", i, lost.Header)
+		}
+	}
+}
+
+// A sequence gap is kept, the group restarts after it
+func TestULPFECWriterGap(t *testing.T) {
+	w := &testRTPWriter{}
+	writer := ulpfecWriter(w, 25, videoREDPayloadType, videoULPFECPayloadType)
+	for _, n := range []int{0, 1, 3, 4, 5, 6} {
+		pkt := testFECPacket(uint16(n), n)
+		if _, err := writer.Write(&pkt.Header, pkt.Payload, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sequenceNumbers []uint16
+	for _, pkt := range w.packets {
+		sequenceNumbers = append(sequenceNumbers, pkt.SequenceNumber)
+	}
+	want := []uint16{0, 1, 3, 4, 5, 6, 7}
+	if len(sequenceNumbers) != len(want) || w.packets[6].Payload[0] != videoULPFECPayloadType {
+		t.Fatalf("sequence numbers %v, want %v and a FEC", sequenceNumbers, want)
+	}
+	for i := range want {
+		if sequenceNumbers[i] != want[i] {
+			t.Fatalf("sequence numbers %v, want %v", sequenceNumbers, want)
+		}
+	}
+	if base := binary.BigEndian.Uint16(w.packets[6].Payload[3:5]); base != 3 {
+		t.Fatalf("the FEC group starts at %d, want 3", base)
+	}
+}
+
+// Each Opus packet is sent in RED with the previous frames, up to the redundancy
+func TestAudioREDWriter(t *testing.T) {
+	w := &testRTPWriter{}
+	writer := audioREDWriter(w, 2, audioREDPayloadType)
+	for n := 0; n < 4; n++ {
+		header := rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: uint16(n), Timestamp: uint32(n * 960)}
+		if _, err := writer.Write(&header, []byte{byte(n), byte(n)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for n, pkt := range w.packets {
+		if pkt.PayloadType != audioREDPayloadType || pkt.SequenceNumber != uint16(n) || pkt.Timestamp != uint32(n*960) {
+			t.Fatalf("packet %d header %+v", n, pkt.Header)
+		}
+		redundant := n
+		if redundant > 2 {
+			redundant = 2
+		}
+		payload := pkt.Payload
+		for i := 0; i < redundant; i++ {
+			header := binary.BigEndian.Uint32(payload[4*i:])
+			frame := n - redundant + i
+			if header>>31 != 1 || byte(header>>24)&0x7F != 111 || (header>>10)&0x3FFF != uint32((n-frame)*960) || header&0x3FF != 2 {
+				t.Fatalf("packet %d block %d header %08x", n, i, header)
+			}
+		}
+		blocks := payload[4*redundant:]
+		if blocks[0] != 111 || len(blocks) != 1+2*(redundant+1) {
+			t.Fatalf("packet %d payload %v", n, payload)
+		}
+		for i := 0; i <= redundant; i++ {
+			frame := byte(n - redundant + i)
+			if blocks[1+2*i] != frame || blocks[2+2*i] != frame {
+				t.Fatalf("packet %d block %d is not the frame %d", n, i, frame)
+			}
+		}
+	}
+}
+
+// The answer of Janus, with the codecs given per media
+func testFECAnswer(video string, audio string) string {
+	return "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96" + video + "\r\na=rtpmap:96 H264/90000\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111" + audio + "\r\na=rtpmap:111 opus/48000/2\r\n"
+}
+
+// The streams are wrapped with the payload types Janus accepted
+func TestFECNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		answer   string
+		videoRED uint8
+		audioRED uint8
+	}{
+		{
+			name: "accepted",
+			answer: testFECAnswer(" 100 101\r\na=rtpmap:100 red/90000\r\na=rtpmap:101 ulpfec/90000",
+				" 120\r\na=rtpmap:120 red/48000/2"),
+			videoRED: 100,
+			audioRED: 120,
+		},
+		{
+			// the video FEC needs both codecs
+			name:     "no ulpfec",
+			answer:   testFECAnswer(" 100\r\na=rtpmap:100 red/90000", ""),
+			videoRED: 0,
+			audioRED: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFECInterceptor(webrtc.MimeTypeH264, 25, 5)
+			if f.redundancy != maxAudioRedundancy {
+				t.Fatalf("redundancy %d", f.redundancy)
+			}
+			f.negotiate(test.answer)
+
+			for _, stream := range []struct {
+				mimeType string
+				red      uint8
+			}{
+				{webrtc.MimeTypeH264, test.videoRED},
+				{webrtc.MimeTypeOpus, test.audioRED},
+			} {
+				w := &testRTPWriter{}
+				writer := f.BindLocalStream(&interceptor.StreamInfo{MimeType: stream.mimeType}, w)
+				header := rtp.Header{Version: 2, PayloadType: 96}
+				if _, err := writer.Write(&header, []byte{1, 2, 3}, nil); err != nil {
+					t.Fatal(err)
+				}
+				pt := w.packets[0].PayloadType
+				if (stream.red != 0 && pt != stream.red) || (stream.red == 0 && pt != 96) {
+					t.Fatalf("%s sent with the payload type %d, red %d", stream.mimeType, pt, stream.red)
+				}
+			}
+		})
+	}
+}
+
+// The muxer video goes over a link losing 1 packet out of 7, every lost
+// media packet must be recovered from the ULPFEC packets
+func TestFECRecoversLosses(t *testing.T) {
+	n := newTestVNet(t)
+
+	var dropping int32
+	var dropped int32
+	var count int
+	n.router.AddChunkFilter(func(c vnet.Chunk) bool {
+		addr, ok := c.SourceAddr().(*net.UDPAddr)
+		if !ok || atomic.LoadInt32(&dropping) == 0 || addr.IP.String() != testMuxerIP || len(c.UserData()) < 200 {
+			return true
+		}
+		count++
+		if count%7 != 0 {
+			return true
+		}
+		atomic.AddInt32(&dropped, 1)
+		return false
+	})
+
+	var mutex sync.Mutex
+	var ssrc uint32
+	received := map[uint16][]byte{}
+	var fecs [][]byte
+	done := make(chan struct{})
+	whip := newTestWHIPServer(t, n.whipNet, func(track *webrtc.TrackRemote) {
+		defer close(done)
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if pkt.PayloadType != videoREDPayloadType || len(pkt.Payload) < 1 || pkt.Payload[0]&0x80 != 0 {
+				t.Errorf("packet %d is not in a single block RED", pkt.SequenceNumber)
+				continue
+			}
+
+			mutex.Lock()
+			ssrc = pkt.SSRC
+			switch pkt.Payload[0] {
+			case videoULPFECPayloadType:
+				fecs = append(fecs, pkt.Payload[1:])
+			case 96:
+				// the packet the FEC protects
+				pkt.PayloadType = 96
+				pkt.Payload = pkt.Payload[1:]
+				raw, _ := pkt.Marshal()
+				received[pkt.SequenceNumber] = raw
+			default:
+				t.Errorf("RED block of payload type %d", pkt.Payload[0])
+			}
+			mutex.Unlock()
+		}
+	})
+
+	port := testUDPPort(t)
+	camera := startTestCamera(t, port, 3500)
+	defer camera.close()
+
+	m := NewMuxer(Options{
+		AudioSource: AudioSourceNone,
+		Sink:        SinkWHIP,
+		WHIPURL:     whip.URL + "/whip/endpoint",
+		SDP:         testCameraSDP(port),
+		FECOverhead: 25,
+	})
+	if msg, err := m.WriteHeader("1", "1", "", "sdp://inline", "", "", "cam"); err != nil {
+		t.Fatal(msg, err)
+	}
+	whip.waitConnected()
+	atomic.StoreInt32(&dropping, 1)
+	time.Sleep(3 * time.Second)
+	m.Close()
+	whip.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the track is not closed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(fecs) == 0 {
+		t.Fatal("no FEC packet received")
+	}
+	recovered := 0
+	for _, fec := range fecs {
+		if pkt := media.RecoverULPFEC(fec, ssrc, received); pkt != nil {
+			received[binary.BigEndian.Uint16(pkt[2:4])] = pkt
+			recovered++
+		}
+	}
+	if recovered == 0 || int32(recovered) > atomic.LoadInt32(&dropped) {
+		t.Fatalf("recovered %d packets, %d dropped", recovered, atomic.LoadInt32(&dropped))
+	}
+
+	// the FEC packets take sequence numbers, the media ones are renumbered
+	// so a packet still missing breaks its frame
+	var sequenceNumbers []int
+	for sequenceNumber := range received {
+		sequenceNumbers = append(sequenceNumbers, int(sequenceNumber))
+	}
+	sort.Ints(sequenceNumbers)
+	d := media.NewDepacketizer(media.CodecH264)
+	var frames []int
+	for i, sequenceNumber := range sequenceNumbers {
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(received[uint16(sequenceNumber)]); err != nil {
+			t.Fatal(err)
+		}
+		pkt.SequenceNumber = uint16(i)
+		aus, err := d.Push(pkt)
+		if err != nil {
+			t.Fatalf("packet %d: %v", sequenceNumber, err)
+		}
+		for _, au := range aus {
+			nalu := au.NALUs[len(au.NALUs)-1]
+			n := testFrameNumber(nalu)
+			if len(nalu) != 3500 || string(nalu) != string(testFrame(n, 3500)) {
+				t.Fatalf("frame %d is corrupted", n)
+			}
+			frames = append(frames, n)
+		}
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i] != frames[i-1]+1 {
+			t.Fatalf("frame %d follows %d", frames[i], frames[i-1])
+		}
+	}
+	t.Logf("%d frames, %d packets dropped, %d recovered", len(frames), atomic.LoadInt32(&dropped), recovered)
+}
@@ -0,0 +1,375 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtpcodecs/rtph265"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func init() {
+	RegisterSource("file", newFileSource, func(rawURL string, sdp string) error {
+		_, err := parseFileURL(rawURL)
+		return err
+	})
+}
+
+// frame rate of the Annex-B streams when not set in the URL
+const defaultFileFPS = 25
+
+// fileFrame is an access unit of a video file
+type fileFrame struct {
+	dts      time.Duration
+	pts      time.Duration
+	keyframe bool
+	// NALUs of an Annex-B stream, the MP4 samples are read when sent
+	nalus  [][]byte
+	sample media.MP4Sample
+}
+
+// fileSource plays a H.264/H.265 file in real time: an Annex-B elementary
+// stream (loaded in memory) or a MP4/fragmented MP4 file. The URL is
+// file:///path/clip.mp4?loop=true&seek=10s, Annex-B streams also take fps
+// and codec (h264 or h265, else from the .h265/.265/.hevc extension).
+type fileSource struct {
+	path  string
+	loop  bool
+	seek  time.Duration
+	fps   float64
+	codec media.Codec
+
+	mutex  sync.Mutex
+	file   *os.File
+	mp4    *media.MP4VideoTrack
+	frames []fileFrame
+	closed bool
+	done   chan struct{}
+
+	bytesSent uint64
+	loops     uint64
+	// position of the last sent frame, in ns
+	position int64
+}
+
+func newFileSource(rawURL string, options Options) (Source, error) {
+	s, err := parseFileURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.path); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The file source of a URL, the file is not opened
+func parseFileURL(rawURL string) (*fileSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file URL: %v", err)
+	}
+	s := &fileSource{path: u.Host + u.Path, fps: defaultFileFPS, done: make(chan struct{})}
+	// file:///C:/clips/a.mp4
+	if len(s.path) > 2 && s.path[0] == '/' && s.path[2] == ':' {
+		s.path = s.path[1:]
+	}
+	if s.path == "" {
+		return nil, fmt.Errorf("file URL %s has no path", rawURL)
+	}
+
+	query := u.Query()
+	if v := query.Get("loop"); v != "" {
+		if s.loop, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid file loop %q", v)
+		}
+	}
+	if v := query.Get("seek"); v != "" {
+		if s.seek, err = time.ParseDuration(v); err != nil {
+			seconds, err := strconv.ParseFloat(v, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid file seek %q", v)
+			}
+			s.seek = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if v := query.Get("fps"); v != "" {
+		if s.fps, err = strconv.ParseFloat(v, 64); err != nil || s.fps <= 0 {
+			return nil, fmt.Errorf("invalid file fps %q", v)
+		}
+	}
+	switch ext := strings.ToLower(filepath.Ext(s.path)); {
+	case query.Get("codec") == "h265", ext == ".h265", ext == ".265", ext == ".hevc":
+		s.codec = media.CodecH265
+	case query.Get("codec") == "", query.Get("codec") == "h264":
+		s.codec = media.CodecH264
+	default:
+		return nil, fmt.Errorf("invalid file codec %q", query.Get("codec"))
+	}
+	return s, nil
+}
+
+// Describe opens the file and reads its frames
+func (s *fileSource) Describe() ([]SourceTrack, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, errors.New("file source closed")
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var track SourceTrack
+	header := make([]byte, 8)
+	if _, err := file.ReadAt(header, 0); err == nil && isMP4Header(header) {
+		track, err = s.readMP4(file, info.Size())
+	} else {
+		track, err = s.readAnnexB(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(s.frames) == 0 {
+		file.Close()
+		return nil, fmt.Errorf("no frame in %s", s.path)
+	}
+	s.file = file
+	log.Printf("File source %s: %s, %d frames, loop %v, seek %v", s.path, track.MimeType, len(s.frames), s.loop, s.seek)
+	return []SourceTrack{track}, nil
+}
+
+func isMP4Header(header []byte) bool {
+	switch string(header[4:8]) {
+	case "ftyp", "styp", "moov", "moof", "free", "mdat":
+		return true
+	}
+	return false
+}
+
+func (s *fileSource) readMP4(file *os.File, size int64) (SourceTrack, error) {
+	mp4, err := media.ReadMP4VideoTrack(file, size)
+	if err != nil {
+		return SourceTrack{}, err
+	}
+	s.mp4 = mp4
+	s.codec = mp4.Codec
+	s.frames = make([]fileFrame, len(mp4.Samples))
+	timescale := time.Duration(mp4.Timescale)
+	for i, sample := range mp4.Samples {
+		s.frames[i] = fileFrame{
+			dts:      time.Duration(sample.DTS) * time.Second / timescale,
+			pts:      time.Duration(sample.DTS+int64(sample.CTSOffset)) * time.Second / timescale,
+			keyframe: sample.Sync,
+			sample:   sample,
+		}
+	}
+	return fileSourceTrack(mp4.Codec, mp4.VPS, mp4.SPS, mp4.PPS), nil
+}
+
+func (s *fileSource) readAnnexB(file *os.File) (SourceTrack, error) {
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return SourceTrack{}, err
+	}
+	s.mp4 = nil
+	s.frames = nil
+	nalus := media.SplitAnnexB(data)
+	for i, au := range media.AccessUnits(s.codec, nalus) {
+		t := time.Duration(float64(i) * float64(time.Second) / s.fps)
+		frame := fileFrame{dts: t, pts: t, nalus: au}
+		for _, nalu := range au {
+			frame.keyframe = frame.keyframe || media.IsKeyframe(s.codec, nalu)
+		}
+		s.frames = append(s.frames, frame)
+	}
+	vps, sps, pps := media.FirstParameterSets(s.codec, nalus)
+	return fileSourceTrack(s.codec, vps, sps, pps), nil
+}
+
+func fileSourceTrack(codec media.Codec, vps, sps, pps []byte) SourceTrack {
+	if codec == media.CodecH265 {
+		return SourceTrack{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, VPS: vps, SPS: sps, PPS: pps}
+	}
+	return SourceTrack{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SPS: sps, PPS: pps}
+}
+
+// rtpEncoder packetizes the access units of a video
+type rtpEncoder interface {
+	Encode(nalus [][]byte, pts time.Duration) ([]*rtp.Packet, error)
+}
+
+func newRTPEncoder(codec media.Codec) rtpEncoder {
+	if codec == media.CodecH265 {
+		e := &rtph265.Encoder{PayloadType: 96, PayloadMaxSize: media.DefaultMaxPayloadSize}
+		e.Init()
+		return e
+	}
+	e := &rtph264.Encoder{PayloadType: 96, PayloadMaxSize: media.DefaultMaxPayloadSize, PacketizationMode: 1}
+	e.Init()
+	return e
+}
+
+// Start sends the frames at their decode time from the seek position (the
+// previous keyframe), the timestamps keep increasing when looping. Returns
+// io.EOF at the end of the file when not looping.
+func (s *fileSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	s.mutex.Lock()
+	file, mp4, frames, codec, done := s.file, s.mp4, s.frames, s.codec, s.done
+	s.mutex.Unlock()
+	if file == nil {
+		if _, err := s.Describe(); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		file, mp4, frames, codec = s.file, s.mp4, s.frames, s.codec
+		s.mutex.Unlock()
+		if file == nil {
+			return errors.New("file source closed")
+		}
+	}
+	for _, track := range tracks {
+		if track != 0 {
+			return fmt.Errorf("file track %d not found", track)
+		}
+	}
+	if len(tracks) == 0 {
+		return errors.New("no file track started")
+	}
+
+	first := 0
+	for i, frame := range frames {
+		if frame.dts-frames[0].dts > s.seek {
+			break
+		}
+		if frame.keyframe {
+			first = i
+		}
+	}
+	base := frames[first].dts
+	ptsBase := frames[first].pts
+	for _, frame := range frames[first:] {
+		if frame.pts < ptsBase {
+			ptsBase = frame.pts
+		}
+	}
+	// the loop restarts one frame after the last one
+	duration := frames[len(frames)-1].dts - base
+	if len(frames)-first > 1 {
+		duration += duration / time.Duration(len(frames)-first-1)
+	} else {
+		duration += time.Second / defaultFileFPS
+	}
+
+	encoder := newRTPEncoder(codec)
+	begin := time.Now()
+	var offset time.Duration
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		for _, frame := range frames[first:] {
+			if wait := time.Until(begin.Add(offset + frame.dts - base)); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-done:
+					return errors.New("file source closed")
+				case <-timer.C:
+				}
+			} else {
+				select {
+				case <-done:
+					return errors.New("file source closed")
+				default:
+				}
+			}
+
+			nalus := frame.nalus
+			if mp4 != nil {
+				var err error
+				if nalus, err = mp4.NALUs(file, frame.sample); err != nil {
+					return err
+				}
+			}
+			pkts, err := encoder.Encode(nalus, offset+frame.pts-ptsBase)
+			if err != nil {
+				log.Println("Packetize file frame failed", err)
+				continue
+			}
+			for _, pkt := range pkts {
+				atomic.AddUint64(&s.bytesSent, uint64(len(pkt.Payload)))
+				onRTP(0, pkt)
+			}
+			atomic.StoreInt64(&s.position, int64(frame.dts))
+		}
+		if !s.loop {
+			return io.EOF
+		}
+		offset += duration
+		atomic.AddUint64(&s.loops, 1)
+	}
+}
+
+// RequestKeyframe is not supported, the keyframes are the ones of the file
+func (s *fileSource) RequestKeyframe() error {
+	return errors.New("a file source can not send a keyframe on request")
+}
+
+func (s *fileSource) WriteRTCP(track int, pkt rtcp.Packet) error {
+	return nil
+}
+
+func (s *fileSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *fileSource) Stats() SourceStats {
+	return SourceStats{
+		Type:          "file",
+		BytesReceived: atomic.LoadUint64(&s.bytesSent),
+		Details: map[string]interface{}{
+			"position": time.Duration(atomic.LoadInt64(&s.position)).Seconds(),
+			"loops":    atomic.LoadUint64(&s.loops),
+		},
+	}
+}
@@ -0,0 +1,179 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// number of frames of the file fixtures, at 25 fps
+const testFileFrames = 10
+
+func testParameterSets(t *testing.T) (sps []byte, pps []byte) {
+	t.Helper()
+	sets := strings.Split(testSPropParameterSets, ",")
+	sps, err := base64.StdEncoding.DecodeString(sets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pps, err = base64.StdEncoding.DecodeString(sets[1]); err != nil {
+		t.Fatal(err)
+	}
+	return sps, pps
+}
+
+// Write the frames in an Annex-B stream, the parameter sets in front of the IDR
+func writeTestAnnexB(t *testing.T, path string) {
+	sps, pps := testParameterSets(t)
+	var data []byte
+	for _, nalu := range [][]byte{sps, pps} {
+		data = append(append(data, 0, 0, 0, 1), nalu...)
+	}
+	for n := 0; n < testFileFrames; n++ {
+		data = append(append(data, 0, 0, 0, 1), testFrame(n, 3000)...)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Write the frames in a fragmented MP4 file
+func writeTestMP4(t *testing.T, path string) {
+	sps, pps := testParameterSets(t)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := media.NewFMP4Writer(file, []media.FMP4Track{{Type: media.FMP4H264, Timescale: 90000, SPS: sps, PPS: pps}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []media.FMP4Sample
+	for n := 0; n < testFileFrames; n++ {
+		samples = append(samples, media.FMP4Sample{Data: media.AVCCSample([][]byte{testFrame(n, 3000)}), Duration: 3600, Keyframe: n == 0})
+	}
+	if err := w.WriteFragment([][]media.FMP4Sample{samples}, []uint64{0}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Play the file source to its end, returns the sent packets
+func replayTestFile(t *testing.T, rawURL string) []*rtp.Packet {
+	t.Helper()
+	source, err := newFileSource(rawURL, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	tracks, err := source.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sps, pps := testParameterSets(t)
+	if len(tracks) != 1 || tracks[0].MimeType != "video/H264" || !bytes.Equal(tracks[0].SPS, sps) || !bytes.Equal(tracks[0].PPS, pps) {
+		t.Fatalf("file tracks %+v", tracks)
+	}
+
+	var pkts []*rtp.Packet
+	done := make(chan error)
+	begin := time.Now()
+	go func() {
+		done <- source.Start([]int{0}, func(track int, pkt *rtp.Packet) {
+			pkts = append(pkts, pkt)
+		}, func(track int, pkt rtcp.Packet) {})
+	}()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatalf("Start returned %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the file source did not end")
+	}
+	// sent in real time
+	if elapsed := time.Since(begin); elapsed < (testFileFrames-1)*40*time.Millisecond {
+		t.Errorf("%d frames sent in %v", testFileFrames, elapsed)
+	}
+	return pkts
+}
+
+func checkTestFilePackets(t *testing.T, pkts []*rtp.Packet) {
+	t.Helper()
+	d := media.NewDepacketizer(media.CodecH264)
+	var aus []media.AccessUnit
+	for i, pkt := range pkts {
+		if len(pkt.Payload) > media.DefaultMaxPayloadSize {
+			t.Fatalf("packet %d payload %d bytes", i, len(pkt.Payload))
+		}
+		out, err := d.Push(pkt)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		aus = append(aus, out...)
+	}
+	if len(aus) != testFileFrames {
+		t.Fatalf("got %d access units, want %d", len(aus), testFileFrames)
+	}
+	for n, au := range aus {
+		if !bytes.Equal(au.NALUs[len(au.NALUs)-1], testFrame(n, 3000)) {
+			t.Fatalf("access unit %d differs from the frame", n)
+		}
+		if au.Timestamp-aus[0].Timestamp != uint32(n*3600) {
+			t.Fatalf("access unit %d timestamp %d, want %d", n, au.Timestamp-aus[0].Timestamp, n*3600)
+		}
+	}
+	if !aus[0].Keyframe(media.CodecH264) {
+		t.Fatal("the first access unit is not a keyframe")
+	}
+}
+
+func TestFileSourceAnnexB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.h264")
+	writeTestAnnexB(t, path)
+	checkTestFilePackets(t, replayTestFile(t, "file://"+filepath.ToSlash(path)+"?fps=25"))
+}
+
+func TestFileSourceMP4(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	writeTestMP4(t, path)
+	checkTestFilePackets(t, replayTestFile(t, "file://"+filepath.ToSlash(path)))
+}
+
+// The muxer is closed at the end of the file, the source is not reconnected
+func TestFileSourceEndClosesMuxer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mp4")
+	writeTestMP4(t, path)
+	whip := newTestWHIPServer(t, nil, nil)
+
+	m := NewMuxer(Options{AudioSource: AudioSourceNone, Sink: SinkWHIP, WHIPURL: whip.URL + "/whip/endpoint"})
+	if msg, err := m.WriteHeader("1", "1", "", "file://"+filepath.ToSlash(path), "", "", "cam"); err != nil {
+		t.Fatal(msg, err)
+	}
+	defer m.Close()
+
+	// a retry would play the file again after a second
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		whip.mutex.Lock()
+		requests := strings.Join(whip.requests, ", ")
+		whip.mutex.Unlock()
+		if requests == "POST /whip/endpoint, DELETE /whip/resource/1" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the WHIP resource is not deleted at the end of the file, requests: %s", requests)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Build the video codec capability matching what the camera actually sends,
+// the video is always packetized with FU-A/FU (packetization-mode=1). The
+// profile & level come from the camera SPS, an error is returned without it.
+func videoCodecCapability(track SourceTrack) (webrtc.RTPCodecCapability, error) {
+	capability := webrtc.RTPCodecCapability{
+		MimeType:  track.MimeType,
+		ClockRate: 90000,
+		RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: "goog-remb", Parameter: ""},
+			{Type: "ccm", Parameter: "fir"},
+			{Type: "nack", Parameter: "pli"},
+		},
+	}
+
+	switch track.MimeType {
+	case webrtc.MimeTypeH264:
+		profileLevelID, err := media.H264ProfileLevelID(track.SPS)
+		if err != nil {
+			return capability, fmt.Errorf("can not parse the camera SPS: %v", err)
+		}
+		capability.SDPFmtpLine = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelID
+	case webrtc.MimeTypeH265:
+		profile, tier, level, err := media.H265ProfileTierLevel(track.SPS)
+		if err != nil {
+			return capability, fmt.Errorf("can not parse the camera SPS: %v", err)
+		}
+		capability.SDPFmtpLine = fmt.Sprintf("profile-id=%d;tier-flag=%d;level-id=%d", profile, tier, level)
+	}
+
+	log.Printf("Camera video codec %s, fmtp: %s", capability.MimeType, capability.SDPFmtpLine)
+	return capability, nil
+}
+
+func parseFmtp(line string) map[string]string {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(line, ";") {
+		tmp := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(tmp) == 2 {
+			params[strings.ToLower(tmp[0])] = strings.TrimSpace(tmp[1])
+		}
+	}
+	return params
+}
+
+// Check the video codec of the answer is compatible with the camera stream:
+// same H.264 profile & packetization-mode, same H.265 profile & tier.
+// The level may differ.
+func checkVideoAnswer(answer string, capability webrtc.RTPCodecCapability) error {
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return err
+	}
+
+	encoding := strings.TrimPrefix(capability.MimeType, "video/")
+	want := parseFmtp(capability.SDPFmtpLine)
+
+	var answered []string
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range md.MediaName.Formats {
+			pt, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := desc.GetCodecForPayloadType(uint8(pt))
+			if err != nil || !strings.EqualFold(codec.Name, encoding) {
+				continue
+			}
+			if videoFmtpMatch(capability.MimeType, want, parseFmtp(codec.Fmtp)) {
+				return nil
+			}
+			answered = append(answered, codec.Fmtp)
+		}
+	}
+
+	if len(answered) == 0 {
+		return fmt.Errorf("janus answer has no %s video, check the room videocodec", encoding)
+	}
+	return fmt.Errorf("janus answered %s with fmtp [%s], camera sends [%s]",
+		encoding, strings.Join(answered, "], ["), capability.SDPFmtpLine)
+}
+
+func videoFmtpMatch(mimeType string, want, got map[string]string) bool {
+	valueOr := func(params map[string]string, key string, value string) string {
+		if v, ok := params[key]; ok {
+			return v
+		}
+		return value
+	}
+
+	switch mimeType {
+	case webrtc.MimeTypeH264:
+		if valueOr(want, "packetization-mode", "0") != valueOr(got, "packetization-mode", "0") {
+			return false
+		}
+		// compare the profile_idc, the constraint flags & level may differ
+		wantProfile := valueOr(want, "profile-level-id", "42")
+		gotProfile := valueOr(got, "profile-level-id", "42")
+		return len(wantProfile) >= 2 && len(gotProfile) >= 2 && strings.EqualFold(wantProfile[:2], gotProfile[:2])
+	case webrtc.MimeTypeH265:
+		return valueOr(want, "profile-id", "1") == valueOr(got, "profile-id", "1") &&
+			valueOr(want, "tier-flag", "0") == valueOr(got, "tier-flag", "0")
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package webrtc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The answer of Janus with a video codec per payload type from 96, the fmtp
+// line is left out if empty
+func testVideoAnswer(codecs ...string) string {
+	var formats []string
+	var attributes string
+	for i, codec := range codecs {
+		pt := 96 + i
+		formats = append(formats, fmt.Sprint(pt))
+		name, fmtp := codec, ""
+		if i := strings.IndexByte(codec, ' '); i >= 0 {
+			name, fmtp = codec[:i], codec[i+1:]
+		}
+		attributes += fmt.Sprintf("a=rtpmap:%d %s/90000\r\n", pt, name)
+		if len(fmtp) > 0 {
+			attributes += fmt.Sprintf("a=fmtp:%d %s\r\n", pt, fmtp)
+		}
+	}
+	return "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF " + strings.Join(formats, " ") + "\r\n" + attributes
+}
+
+// The fmtp of the test camera SPS, the capability offered to Janus
+func TestVideoCodecCapability(t *testing.T) {
+	sps, err := base64.StdEncoding.DecodeString(strings.Split(testSPropParameterSets, ",")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	capability, err := videoCodecCapability(SourceTrack{MimeType: webrtc.MimeTypeH264, SPS: sps})
+	if err != nil || capability.SDPFmtpLine != "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f" {
+		t.Fatalf("fmtp %q, %v", capability.SDPFmtpLine, err)
+	}
+	// the parameter sets of the stream are needed
+	if _, err := videoCodecCapability(SourceTrack{MimeType: webrtc.MimeTypeH265}); err == nil {
+		t.Fatal("H265 capability without SPS")
+	}
+}
+
+// The profile & packetization mode answered must be the camera ones, the
+// level may differ
+func TestCheckVideoAnswer(t *testing.T) {
+	const (
+		baseline   = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f"
+		high       = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"
+		h265Main   = "profile-id=1;tier-flag=0;level-id=120"
+		h265Main10 = "profile-id=2;tier-flag=1;level-id=153"
+	)
+	tests := []struct {
+		name     string
+		mimeType string
+		fmtp     string
+		answer   string
+		err      bool
+	}{
+		{name: "baseline", mimeType: webrtc.MimeTypeH264, fmtp: baseline,
+			answer: testVideoAnswer("H264 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f")},
+		{name: "baseline other constraints & level", mimeType: webrtc.MimeTypeH264, fmtp: baseline,
+			answer: testVideoAnswer("H264 packetization-mode=1;profile-level-id=42e028")},
+		{name: "baseline answered high", mimeType: webrtc.MimeTypeH264, fmtp: baseline,
+			answer: testVideoAnswer("H264 packetization-mode=1;profile-level-id=64001f"), err: true},
+		{name: "baseline answered packetization-mode 0", mimeType: webrtc.MimeTypeH264, fmtp: baseline,
+			answer: testVideoAnswer("H264 profile-level-id=42c01f"), err: true},
+		{name: "high second format", mimeType: webrtc.MimeTypeH264, fmtp: high,
+			answer: testVideoAnswer("H264 packetization-mode=1;profile-level-id=42e01f", "H264 packetization-mode=1;profile-level-id=640c1f")},
+		{name: "high case insensitive", mimeType: webrtc.MimeTypeH264, fmtp: high,
+			answer: testVideoAnswer("h264 Packetization-Mode=1;Profile-Level-Id=64001F")},
+		{name: "high answered main", mimeType: webrtc.MimeTypeH264, fmtp: high,
+			answer: testVideoAnswer("H264 packetization-mode=1;profile-level-id=4d001f"), err: true},
+		{name: "H264 answered VP8", mimeType: webrtc.MimeTypeH264, fmtp: baseline,
+			answer: testVideoAnswer("VP8"), err: true},
+		{name: "H265 main", mimeType: webrtc.MimeTypeH265, fmtp: h265Main,
+			answer: testVideoAnswer("H265 profile-id=1;tier-flag=0;level-id=93")},
+		{name: "H265 main default fmtp", mimeType: webrtc.MimeTypeH265, fmtp: h265Main,
+			answer: testVideoAnswer("H265")},
+		{name: "H265 main answered main10", mimeType: webrtc.MimeTypeH265, fmtp: h265Main,
+			answer: testVideoAnswer("H265 profile-id=2;tier-flag=0;level-id=120"), err: true},
+		{name: "H265 main10 high tier", mimeType: webrtc.MimeTypeH265, fmtp: h265Main10,
+			answer: testVideoAnswer("H265 profile-id=2;tier-flag=1;level-id=120")},
+		{name: "H265 main10 answered main tier", mimeType: webrtc.MimeTypeH265, fmtp: h265Main10,
+			answer: testVideoAnswer("H265 profile-id=2;tier-flag=0;level-id=153"), err: true},
+		{name: "H265 main10 default fmtp", mimeType: webrtc.MimeTypeH265, fmtp: h265Main10,
+			answer: testVideoAnswer("H265"), err: true},
+		{name: "H265 answered H264", mimeType: webrtc.MimeTypeH265, fmtp: h265Main,
+			answer: testVideoAnswer("H264 packetization-mode=1;profile-level-id=42e01f"), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			capability := webrtc.RTPCodecCapability{MimeType: test.mimeType, ClockRate: 90000, SDPFmtpLine: test.fmtp}
+			if err := checkVideoAnswer(test.answer, capability); (err != nil) != test.err {
+				t.Fatalf("answer check error %v", err)
+			}
+		})
+	}
+}
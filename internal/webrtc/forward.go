@@ -0,0 +1,313 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// min interval between two logged errors of a track
+const writeErrorLogInterval = 10 * time.Second
+
+// rtpPacketWriter is a track the forwarded packets are written to
+type rtpPacketWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+}
+
+// rtspForward binds a camera track to the WebRTC track its packets are written to
+type rtspForward struct {
+	layer *rtspLayer
+	// index of the camera track in the layer tracks
+	sourceTrack int
+	track       *webrtc.TrackLocalStaticRTP
+	sender      *webrtc.RTPSender
+	// repacketizes the video to fit the WebRTC MTU, nil for audio
+	repacketizer *media.Repacketizer
+	// GOP resent on keyframe requests, nil for audio
+	gop *media.GOPCache
+	// switches the camera streams written to the track, nil if not adaptive
+	switcher *streamSwitcher
+	// paces the packets written to the track, nil if not paced
+	pacer *media.Pacer
+	// reorders the camera packets, nil for the switcher output
+	reorder *media.ReorderBuffer
+	// the packets waiting behind a gap are released by the flush timer when
+	// no packet follows, it runs with the camera packets
+	reorderMutex sync.Mutex
+	flushTimer   *time.Timer
+	reorderStop  bool
+	// track of the WHEP viewers, nil if not previewed
+	preview rtpPacketWriter
+	// records the reordered & repacketized packets, nil for the other layers
+	record func(pkt *rtp.Packet)
+
+	// output sequence numbers & timestamp offset, the timestamps move
+	// forward when a GOP is resent
+	mutex           sync.Mutex
+	started         bool
+	sequenceNumber  uint16
+	timestampOffset uint32
+	lastTimestamp   uint32
+	// negotiated rtp-stream-id extension, 0 when not simulcasting
+	ridExtensionID uint8
+
+	// last answered keyframe request, only used by the RTCP reader
+	lastKeyframeAnswer time.Time
+
+	// sent packets & octets, reported in the translated sender reports
+	packets uint32
+	octets  uint32
+
+	// camera packets that failed to be forwarded, and the last logged one
+	// (unix nanoseconds)
+	writeErrors       uint64
+	lastWriteErrorLog int64
+}
+
+// Count a forwarding error, it's logged at most every writeErrorLogInterval
+func (f *rtspForward) writeError(err error) {
+	n := atomic.AddUint64(&f.writeErrors, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&f.lastWriteErrorLog)
+	if now-last < int64(writeErrorLogInterval) || !atomic.CompareAndSwapInt64(&f.lastWriteErrorLog, last, now) {
+		return
+	}
+	log.Printf("Write RTP pkt error: %v (%d errors)", err, n)
+}
+
+func (f *rtspForward) writeRTP(pkt *rtp.Packet) error {
+	if f.reorder == nil {
+		return f.forwardRTP(pkt)
+	}
+	f.reorderMutex.Lock()
+	defer f.reorderMutex.Unlock()
+
+	pkts := f.reorder.Push(pkt, time.Now())
+	f.scheduleFlush()
+	for _, p := range pkts {
+		if err := f.forwardRTP(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Arm the flush timer at the reorder deadline
+func (f *rtspForward) scheduleFlush() {
+	deadline, ok := f.reorder.Deadline()
+	if !ok || f.reorderStop {
+		return
+	}
+	if f.flushTimer == nil {
+		f.flushTimer = time.AfterFunc(time.Until(deadline), f.flushReorder)
+	} else {
+		f.flushTimer.Reset(time.Until(deadline))
+	}
+}
+
+// Release the packets held by a gap after the latency
+func (f *rtspForward) flushReorder() {
+	f.reorderMutex.Lock()
+	defer f.reorderMutex.Unlock()
+
+	if f.reorderStop {
+		return
+	}
+	pkts := f.reorder.Flush(time.Now())
+	f.scheduleFlush()
+	for _, p := range pkts {
+		if err := f.forwardRTP(p); err != nil {
+			f.writeError(err)
+			return
+		}
+	}
+}
+
+// Stop the flush timer, the source is closed
+func (f *rtspForward) stopReorder() {
+	f.reorderMutex.Lock()
+	defer f.reorderMutex.Unlock()
+
+	f.reorderStop = true
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+	}
+}
+
+func (f *rtspForward) forwardRTP(pkt *rtp.Packet) error {
+	if f.repacketizer == nil {
+		if f.record != nil {
+			f.record(pkt)
+		}
+		return f.write(pkt)
+	}
+
+	pkts, err := f.repacketizer.Push(pkt)
+	if f.record != nil {
+		for _, p := range pkts {
+			f.record(p)
+		}
+	}
+	if f.switcher != nil {
+		if writeErr := f.switcher.write(f.layer, pkts); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+	for _, p := range pkts {
+		if writeErr := f.write(p); writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
+}
+
+func (f *rtspForward) write(pkt *rtp.Packet) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.writeLocked(pkt, pkt.Timestamp+f.timestampOffset)
+}
+
+func (f *rtspForward) writeLocked(pkt *rtp.Packet, timestamp uint32) error {
+	if !f.started {
+		f.started = true
+		f.sequenceNumber = pkt.SequenceNumber
+	}
+
+	// packets may be cached, write a copy
+	out := *pkt
+	out.SequenceNumber = f.sequenceNumber
+	out.Timestamp = timestamp
+	f.sequenceNumber++
+	f.lastTimestamp = timestamp
+	if f.preview != nil {
+		// before the rid, the viewers get a single encoding. A failed viewer
+		// does not hold the packet back from Janus.
+		if err := f.preview.WriteRTP(&out); err != nil {
+			f.writeError(err)
+		}
+	}
+	if f.ridExtensionID != 0 {
+		if err := out.Header.SetExtension(f.ridExtensionID, []byte(f.track.RID())); err != nil {
+			return err
+		}
+	}
+
+	if f.pacer != nil {
+		// a dropped packet is not counted, the write errors are reported
+		// by the pacer
+		f.pacer.Push(&out, f.writeTrack)
+		return nil
+	}
+	return f.writeTrack(&out)
+}
+
+// Write a packet to the track, it's counted in the sender reports once written
+func (f *rtspForward) writeTrack(pkt *rtp.Packet) error {
+	if err := f.track.WriteRTP(pkt); err != nil {
+		return err
+	}
+	atomic.AddUint32(&f.packets, 1)
+	atomic.AddUint32(&f.octets, uint32(len(pkt.Payload)))
+	return nil
+}
+
+// Resend the cached GOP, the frames get consecutive timestamps right after
+// the last sent one and the live stream is shifted after them. The peer
+// gets every frame the live ones depend on; a paced track spreads them with
+// its pacer. Returns the number of resent packets.
+func (f *rtspForward) resendGOP() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.gop == nil {
+		return 0
+	}
+	pkts := f.gop.Packets()
+	if len(pkts) == 0 {
+		return 0
+	}
+
+	base := f.lastTimestamp
+	frames := uint32(1)
+	previous := pkts[0].Timestamp
+	for _, pkt := range pkts {
+		if pkt.Timestamp != previous {
+			previous = pkt.Timestamp
+			frames++
+		}
+		if err := f.writeLocked(pkt, base+frames); err != nil {
+			return 0
+		}
+	}
+	f.timestampOffset += frames
+	return len(pkts)
+}
+
+func (f *rtspForward) setPreview(track rtpPacketWriter) {
+	f.mutex.Lock()
+	f.preview = track
+	f.mutex.Unlock()
+}
+
+func (f *rtspForward) setRIDExtension(id uint8) {
+	f.mutex.Lock()
+	f.ridExtensionID = id
+	f.mutex.Unlock()
+}
+
+// Continue the output with another camera stream: its packet of the given
+// timestamp follows the last sent one after delta. The GOP of that stream
+// is now resent on keyframe requests.
+func (f *rtspForward) rebase(timestamp uint32, delta uint32, gop *media.GOPCache) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.started {
+		f.timestampOffset = f.lastTimestamp + delta - timestamp
+	}
+	f.gop = gop
+}
+
+// SSRC of the encoding of the track, 0 before it is negotiated
+func (f *rtspForward) ssrc() webrtc.SSRC {
+	for _, encoding := range f.sender.GetParameters().Encodings {
+		if encoding.RID == f.track.RID() {
+			return encoding.SSRC
+		}
+	}
+	return 0
+}
+
+// Rewrite a camera sender report with our SSRC, the RTP timestamps are passed
+// through (plus the resent GOP offset) so the camera NTP/RTP pairs keep audio
+// and video aligned
+func (f *rtspForward) senderReport(sr *rtcp.SenderReport) *rtcp.SenderReport {
+	if f.switcher != nil {
+		return f.switcher.senderReport(f.layer, sr)
+	}
+
+	ssrc := f.ssrc()
+	if ssrc == 0 {
+		return nil
+	}
+
+	f.mutex.Lock()
+	offset := f.timestampOffset
+	f.mutex.Unlock()
+
+	return &rtcp.SenderReport{
+		SSRC:        uint32(ssrc),
+		NTPTime:     sr.NTPTime,
+		RTPTime:     sr.RTPTime + offset,
+		PacketCount: atomic.LoadUint32(&f.packets),
+		OctetCount:  atomic.LoadUint32(&f.octets),
+	}
+}
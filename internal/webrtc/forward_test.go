@@ -0,0 +1,169 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// The write errors are counted in the stats, logged once in the interval
+func TestForwardWriteErrors(t *testing.T) {
+	f := newTestForward(t)
+	f.writeError(errors.New("first"))
+	logged := atomic.LoadInt64(&f.lastWriteErrorLog)
+	if logged == 0 {
+		t.Fatal("the first error is not logged")
+	}
+	f.writeError(errors.New("second"))
+	if atomic.LoadInt64(&f.lastWriteErrorLog) != logged {
+		t.Fatal("the second error is logged in the interval")
+	}
+
+	m := &Muxer{layers: []*rtspLayer{{source: &testSource{}, forwards: []*rtspForward{f}}}}
+	f.reorder = m.newReorderBuffer(m.layers[0], 0)
+	if stats := m.Stats().Camera; len(stats) != 1 || stats[0].WriteErrors != 2 {
+		t.Fatalf("camera stats %+v", stats)
+	}
+}
+
+// A keyframe request resends the GOP from its keyframe, the frames follow the
+// last sent packet and go through the pacer of the track
+func TestForwardResendGOP(t *testing.T) {
+	f := newTestForward(t)
+	f.gop = media.NewGOPCache(0)
+	if n := f.resendGOP(); n != 0 {
+		t.Fatalf("%d packets resent without GOP", n)
+	}
+
+	var gop []*rtp.Packet
+	for i, timestamp := range []uint32{3000, 3000, 3000, 6000, 6000, 9000} {
+		gop = append(gop, &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: timestamp}, Payload: []byte{byte(i)}})
+	}
+	f.gop.Push(gop[:3], true)
+	f.gop.Push(gop[3:5], false)
+	f.gop.Push(gop[5:], false)
+	for _, pkt := range gop {
+		if err := f.write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is sent at 0 bps
+	f.pacer = media.NewPacer(0, 0)
+	defer f.pacer.Close()
+	if n := f.resendGOP(); n != 6 {
+		t.Fatalf("%d packets resent", n)
+	}
+	if queued := f.pacer.Stats().Queued; queued != 6 {
+		t.Fatalf("%d resent packets paced", queued)
+	}
+	if f.lastTimestamp != 9003 || f.sequenceNumber != 12 {
+		t.Fatalf("resent up to %d, sequence number %d", f.lastTimestamp, f.sequenceNumber)
+	}
+	// the live stream follows the resent frames
+	if err := f.write(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 6, Timestamp: 12000}}); err != nil {
+		t.Fatal(err)
+	}
+	if f.lastTimestamp != 12003 {
+		t.Fatalf("live packet at %d", f.lastTimestamp)
+	}
+}
+
+// testFailingWriter is a track whose writes fail, like a closing viewer
+type testFailingWriter struct{}
+
+func (testFailingWriter) WriteRTP(pkt *rtp.Packet) error {
+	return errors.New("viewer closed")
+}
+
+// A failed WHEP viewer counts a write error, the packets still go to Janus
+// with consecutive sequence numbers
+func TestForwardPreviewError(t *testing.T) {
+	f := newTestForward(t)
+	f.setPreview(testFailingWriter{})
+	for i := 0; i < 3; i++ {
+		if err := f.write(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(100 + i)}, Payload: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if packets := atomic.LoadUint32(&f.packets); packets != 3 || f.sequenceNumber != 103 {
+		t.Fatalf("%d packets sent, next sequence number %d", packets, f.sequenceNumber)
+	}
+	if n := atomic.LoadUint64(&f.writeErrors); n != 3 {
+		t.Fatalf("%d write errors", n)
+	}
+}
+
+// A paced packet is counted in the sender reports once written, a dropped one
+// is not counted
+func TestForwardPacedCounters(t *testing.T) {
+	f := newTestForward(t)
+	// nothing is sent at 0 bps, the third access unit is dropped
+	f.pacer = media.NewPacer(0, 2)
+	defer f.pacer.Close()
+	f.pacer.OnWriteError(f.writeError)
+	for i := 0; i < 3; i++ {
+		pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(3000 * i), Marker: true}, Payload: make([]byte, 100)}
+		if err := f.write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if packets := atomic.LoadUint32(&f.packets); packets != 0 {
+		t.Fatalf("%d queued packets counted", packets)
+	}
+
+	f.pacer.SetRate(1_000_000)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint32(&f.packets) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if packets, octets := atomic.LoadUint32(&f.packets), atomic.LoadUint32(&f.octets); packets != 2 || octets != 200 {
+		t.Fatalf("%d packets, %d octets counted", packets, octets)
+	}
+	if n := atomic.LoadUint64(&f.writeErrors); n != 0 {
+		t.Fatalf("%d write errors", n)
+	}
+}
+
+// A camera sender report is sent with the SSRC & counters of the track, its
+// RTP time follows the resent GOPs
+func TestForwardSenderReport(t *testing.T) {
+	f := newTestForward(t)
+	ssrc := uint32(f.ssrc())
+	if ssrc == 0 {
+		t.Fatal("no SSRC")
+	}
+	for i := 0; i < 3; i++ {
+		if err := f.write(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: 90000}, Payload: make([]byte, 50)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.timestampOffset = 6
+
+	sr := &rtcp.SenderReport{SSRC: 0xCAFE, NTPTime: 0xE5A1B2C3D4E5F607, RTPTime: 90000, PacketCount: 100, OctetCount: 10000}
+	report := f.senderReport(sr)
+	if report == nil || report.SSRC != ssrc || report.NTPTime != sr.NTPTime || report.RTPTime != 90006 ||
+		report.PacketCount != 3 || report.OctetCount != 150 {
+		t.Fatalf("sender report %+v", report)
+	}
+
+	// the adaptive output translates the reports of its active stream only
+	layers := []*rtspLayer{{rid: "h"}, {rid: "l"}}
+	for _, layer := range layers {
+		layer.forwards = []*rtspForward{{layer: layer}}
+	}
+	switcher := newStreamSwitcher(layers, media.CodecH264, func(*rtspLayer) {})
+	switcher.output = f
+	for i, layer := range layers {
+		layer.forwards[0].switcher = switcher
+		report := layer.forwards[0].senderReport(sr)
+		if active := i == switcher.active; (report != nil) != active || active && report.SSRC != ssrc {
+			t.Fatalf("layer %s sender report %+v", layer.rid, report)
+		}
+	}
+}
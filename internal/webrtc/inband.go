@@ -0,0 +1,115 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// errStoppedBeforeParameterSets is returned when the stream stops while its
+// parameter sets are waited for
+var errStoppedBeforeParameterSets = errors.New("camera stream stopped before its parameter sets")
+
+// inBandParameterSets depacketizes a video track until its SPS & PPS (and
+// VPS for H.265) are received, for the cameras not describing them
+type inBandParameterSets struct {
+	// described tracks, the video one gets the received parameter sets
+	tracks       []SourceTrack
+	track        int
+	codec        media.Codec
+	depacketizer *media.Depacketizer
+	vps          []byte
+	sps          []byte
+	pps          []byte
+	// closed when the parameter sets are received
+	done chan struct{}
+}
+
+// Video track of a description without its parameter sets, -1 if none
+func missingParameterSets(tracks []SourceTrack) int {
+	for i, track := range tracks {
+		switch track.MimeType {
+		case webrtc.MimeTypeH264:
+			if track.SPS == nil || track.PPS == nil {
+				return i
+			}
+		case webrtc.MimeTypeH265:
+			if track.VPS == nil || track.SPS == nil || track.PPS == nil {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Read the parameter sets missing in a description, nil if none is missing
+func newInBandParameterSets(tracks []SourceTrack) *inBandParameterSets {
+	index := missingParameterSets(tracks)
+	if index < 0 {
+		return nil
+	}
+	codec := media.CodecH264
+	if tracks[index].MimeType == webrtc.MimeTypeH265 {
+		codec = media.CodecH265
+	}
+	return &inBandParameterSets{
+		tracks:       tracks,
+		track:        index,
+		codec:        codec,
+		depacketizer: media.NewDepacketizer(codec),
+		done:         make(chan struct{}),
+	}
+}
+
+// Look for the parameter sets in a packet of a described track, returns the
+// tracks with them once they're all received
+func (p *inBandParameterSets) push(track int, pkt *rtp.Packet) ([]SourceTrack, bool) {
+	if track != p.track {
+		return nil, false
+	}
+	select {
+	case <-p.done:
+		return nil, false
+	default:
+	}
+	aus, _ := p.depacketizer.Push(pkt)
+	for _, au := range aus {
+		vps, sps, pps := media.FirstParameterSets(p.codec, au.NALUs)
+		if p.vps == nil {
+			p.vps = vps
+		}
+		if p.sps == nil {
+			p.sps = sps
+		}
+		if p.pps == nil {
+			p.pps = pps
+		}
+	}
+	if p.sps == nil || p.pps == nil || (p.codec == media.CodecH265 && p.vps == nil) {
+		return nil, false
+	}
+
+	// the described tracks may be shared, copy them
+	tracks := append([]SourceTrack(nil), p.tracks...)
+	tracks[p.track].VPS, tracks[p.track].SPS, tracks[p.track].PPS = p.vps, p.sps, p.pps
+	close(p.done)
+	return tracks, true
+}
+
+// Wait for the parameter sets until the stream stops or the timeout
+func (p *inBandParameterSets) wait(stopped chan struct{}, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return nil
+	case <-stopped:
+		return errStoppedBeforeParameterSets
+	case <-timer.C:
+		return fmt.Errorf("no %s parameter sets in the camera description nor in the stream after %v", p.tracks[p.track].MimeType, timeout)
+	}
+}
@@ -0,0 +1,60 @@
+package webrtc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The parameter sets missing in the description are read in the STAP-A in
+// front of the IDR, the described tracks are not changed
+func TestInBandParameterSets(t *testing.T) {
+	sps, pps := testParameterSets(t)
+	described := []SourceTrack{{MimeType: webrtc.MimeTypePCMU}, {MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}
+	if p := newInBandParameterSets([]SourceTrack{{MimeType: webrtc.MimeTypeH264, SPS: sps, PPS: pps}}); p != nil {
+		t.Fatal("parameter sets read though described")
+	}
+	p := newInBandParameterSets(described)
+	if p == nil || p.track != 1 {
+		t.Fatal("missing parameter sets not read")
+	}
+
+	stapA := []byte{24, byte(len(sps) >> 8), byte(len(sps))}
+	stapA = append(append(stapA, sps...), byte(len(pps)>>8), byte(len(pps)))
+	stapA = append(stapA, pps...)
+	pkts := []*rtp.Packet{
+		{Header: rtp.Header{Version: 2, SequenceNumber: 1}, Payload: stapA},
+		{Header: rtp.Header{Version: 2, SequenceNumber: 2, Marker: true}, Payload: testFrame(0, 100)},
+	}
+	// the audio packets are not read
+	if _, ok := p.push(0, pkts[0]); ok {
+		t.Fatal("parameter sets read in the audio track")
+	}
+	if _, ok := p.push(1, pkts[0]); ok {
+		t.Fatal("parameter sets received before the end of the access unit")
+	}
+	tracks, ok := p.push(1, pkts[1])
+	if !ok || !bytes.Equal(tracks[1].SPS, sps) || !bytes.Equal(tracks[1].PPS, pps) || described[1].SPS != nil {
+		t.Fatalf("tracks %+v, described %+v", tracks, described)
+	}
+	if err := p.wait(nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInBandParameterSetsWait(t *testing.T) {
+	described := []SourceTrack{{MimeType: webrtc.MimeTypeH265, ClockRate: 90000}}
+
+	stopped := make(chan struct{})
+	close(stopped)
+	if err := newInBandParameterSets(described).wait(stopped, time.Second); err != errStoppedBeforeParameterSets {
+		t.Fatalf("wait of a stopped stream: %v", err)
+	}
+	begin := time.Now()
+	if err := newInBandParameterSets(described).wait(nil, 100*time.Millisecond); err == nil || time.Since(begin) < 100*time.Millisecond {
+		t.Fatalf("wait without parameter sets: %v after %v", err, time.Since(begin))
+	}
+}
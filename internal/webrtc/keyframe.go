@@ -0,0 +1,99 @@
+package webrtc
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+)
+
+// How a keyframe request from Janus is answered
+const (
+	// KeyframeRequestGOP resends the cached GOP from the last keyframe
+	KeyframeRequestGOP = "gop"
+	// KeyframeRequestReplay asks the camera source, RTSP pauses & plays the stream
+	// as most cameras start with an IDR
+	KeyframeRequestReplay = "replay"
+	// KeyframeRequestNone only counts the requests
+	KeyframeRequestNone = "none"
+)
+
+// min interval between two answered keyframe requests
+const keyframeRequestInterval = time.Second
+
+// Read the RTCP of a sender (or of a simulcast encoding), it's required for the
+// interceptors (NACK) to work, keyframe requests of the video sender are answered
+func (element *Muxer) readRTCP(read func() ([]rtcp.Packet, interceptor.Attributes, error), f *rtspForward) {
+	for {
+		pkts, _, err := read()
+		if err != nil {
+			return
+		}
+		if f == nil {
+			continue
+		}
+
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				atomic.AddUint64(&element.keyframeStats.PLI, 1)
+				element.handleKeyframeRequest(f)
+			case *rtcp.FullIntraRequest:
+				atomic.AddUint64(&element.keyframeStats.FIR, 1)
+				element.handleKeyframeRequest(f)
+			case *rtcp.ReceiverReport:
+				element.webrtcReceiverReport(pkt, f)
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if element.switcher != nil {
+					element.switcher.onEstimate(uint64(pkt.Bitrate), "remb")
+				}
+			case *rtcp.TransportLayerCC:
+				if element.switcher != nil {
+					element.switcher.onTransportFeedback(pkt)
+				}
+			}
+		}
+	}
+}
+
+func (element *Muxer) handleKeyframeRequest(f *rtspForward) {
+	if time.Since(f.lastKeyframeAnswer) < keyframeRequestInterval {
+		atomic.AddUint64(&element.keyframeStats.Throttled, 1)
+		return
+	}
+	f.lastKeyframeAnswer = time.Now()
+
+	switch element.Options.KeyframeRequest {
+	case KeyframeRequestNone:
+	case KeyframeRequestReplay:
+		layer := f.layer
+		if element.switcher != nil {
+			layer = element.switcher.activeLayer()
+		}
+		element.replaySource(layer)
+	default:
+		if n := f.resendGOP(); n > 0 {
+			atomic.AddUint64(&element.keyframeStats.GOPResent, 1)
+		} else {
+			log.Println("Keyframe requested, but no GOP cached yet")
+		}
+	}
+}
+
+// Make the camera send a keyframe on a stream about to be switched to
+func (element *Muxer) requestLayerKeyframe(layer *rtspLayer) {
+	if element.Options.KeyframeRequest == KeyframeRequestReplay {
+		element.replaySource(layer)
+	}
+}
+
+// Ask the camera source for an IDR (RTSP pause & play)
+func (element *Muxer) replaySource(layer *rtspLayer) {
+	if err := layer.source.RequestKeyframe(); err != nil {
+		log.Println("Request camera keyframe failed", err)
+		return
+	}
+	atomic.AddUint64(&element.keyframeStats.Replays, 1)
+}
@@ -0,0 +1,471 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// defaultRecordSegmentDuration is the segment duration when not configured
+	defaultRecordSegmentDuration = 5 * time.Minute
+	// a fragment is written at each keyframe, or when it's this long
+	recordFragmentDuration = time.Second
+	// max timestamp gap (in seconds) bridged in a track timeline, a longer
+	// one is a camera reset
+	recordMaxGap = 10
+)
+
+var (
+	// ErrRecording is returned when the camera is already recorded
+	ErrRecording = errors.New("camera already recorded")
+	// ErrNotRecording is returned when the camera is not recorded
+	ErrNotRecording = errors.New("camera not recorded")
+)
+
+// RecordingStats are the counters of the local recording
+type RecordingStats struct {
+	Dir string `json:"dir"`
+	// Segment is the file being written, empty until the first keyframe
+	Segment  string `json:"segment"`
+	Segments int    `json:"segments"`
+	Bytes    int64  `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+}
+
+// recorder writes the packets forwarded from the first layer, reordered &
+// repacketized, to fragmented MP4 segments. A segment starts on a keyframe.
+type recorder struct {
+	dir             string
+	segmentDuration time.Duration
+	segmentSize     int64
+	retention       int
+	// recorded tracks, indexed like the layer forwards, nil if not recorded
+	tracks []*recordTrack
+
+	mutex         sync.Mutex
+	closed        bool
+	file          *os.File
+	writer        *media.FMP4Writer
+	segmentStart  time.Time
+	fragmentStart time.Time
+	segments      int
+	bytes         int64
+	err           error
+}
+
+// recordTrack is the timeline of a track in the current segment
+type recordTrack struct {
+	fmp4  media.FMP4Track
+	video bool
+	codec media.Codec
+	// reassembles the video access units, nil for audio
+	depacketizer *media.Depacketizer
+
+	// the track has samples in the segment
+	started       bool
+	lastTimestamp uint32
+	lastDuration  uint32
+	// decode time of the next sample & of the first sample of the fragment
+	dts     uint64
+	base    uint64
+	samples []media.FMP4Sample
+	// video sample waiting for the next one to get its duration
+	pending *recordPending
+}
+
+type recordPending struct {
+	sample    media.FMP4Sample
+	timestamp uint32
+}
+
+// The MP4 track of a camera track, nil if it can't be recorded
+func newRecordTrack(track SourceTrack) *recordTrack {
+	t := &recordTrack{fmp4: media.FMP4Track{Timescale: track.ClockRate, Channels: int(track.Channels)}}
+	switch track.MimeType {
+	case webrtc.MimeTypeH264, webrtc.MimeTypeH265:
+		t.video = true
+		t.fmp4.Type = media.FMP4H264
+		t.codec = media.CodecH264
+		if track.MimeType == webrtc.MimeTypeH265 {
+			t.fmp4.Type = media.FMP4H265
+			t.codec = media.CodecH265
+		}
+		t.fmp4.Timescale = 90000
+		t.fmp4.VPS, t.fmp4.SPS, t.fmp4.PPS = track.VPS, track.SPS, track.PPS
+		t.depacketizer = media.NewDepacketizer(t.codec)
+	case webrtc.MimeTypePCMU:
+		t.fmp4.Type = media.FMP4PCMU
+	case webrtc.MimeTypePCMA:
+		t.fmp4.Type = media.FMP4PCMA
+	case webrtc.MimeTypeOpus:
+		t.fmp4.Type = media.FMP4Opus
+		t.fmp4.Timescale = 48000
+	default:
+		return nil
+	}
+	if t.fmp4.Timescale == 0 {
+		t.fmp4.Timescale = 8000
+	}
+	if t.fmp4.Channels == 0 {
+		t.fmp4.Channels = 1
+	}
+	return t
+}
+
+// StartRecording records the camera to RecordDir/<room>_<id>, the first
+// segment starts with the next keyframe
+func (element *Muxer) StartRecording() error {
+	if len(element.Options.RecordDir) == 0 {
+		return errors.New("no record dir")
+	}
+	if element.stopped() || len(element.layers) == 0 {
+		return errors.New("camera not publishing")
+	}
+	element.recordMutex.Lock()
+	defer element.recordMutex.Unlock()
+	if element.recorder != nil {
+		return ErrRecording
+	}
+
+	dir := filepath.Join(element.Options.RecordDir, element.recordName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	r := &recorder{
+		dir:             dir,
+		segmentDuration: defaultRecordSegmentDuration,
+		segmentSize:     int64(element.Options.RecordSegmentSize) << 20,
+		retention:       element.Options.RecordRetention,
+	}
+	if element.Options.RecordSegmentDuration > 0 {
+		r.segmentDuration = time.Duration(element.Options.RecordSegmentDuration) * time.Second
+	}
+	layer := element.layers[0]
+	for _, f := range layer.forwards {
+		r.tracks = append(r.tracks, newRecordTrack(layer.tracks[f.sourceTrack]))
+	}
+	element.recorder = r
+	log.Printf("Record %s to %s", element.userId, dir)
+	return nil
+}
+
+// StopRecording closes the segment being written
+func (element *Muxer) StopRecording() error {
+	element.recordMutex.Lock()
+	r := element.recorder
+	element.recorder = nil
+	element.recordMutex.Unlock()
+	if r == nil {
+		return ErrNotRecording
+	}
+	log.Printf("Stop recording %s", element.userId)
+	return r.close()
+}
+
+// Recording returns the recording counters, nil if not recorded
+func (element *Muxer) Recording() *RecordingStats {
+	element.recordMutex.Lock()
+	r := element.recorder
+	element.recordMutex.Unlock()
+	if r == nil {
+		return nil
+	}
+	return r.stats()
+}
+
+// Record a packet forwarded from the first layer, reordered & repacketized
+func (element *Muxer) recordRTP(trackID int, pkt *rtp.Packet) {
+	element.recordMutex.Lock()
+	r := element.recorder
+	element.recordMutex.Unlock()
+	if r != nil {
+		r.writeRTP(trackID, pkt)
+	}
+}
+
+func (r *recorder) writeRTP(trackID int, pkt *rtp.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed || trackID < 0 || trackID >= len(r.tracks) || r.tracks[trackID] == nil {
+		return
+	}
+	t := r.tracks[trackID]
+	if !t.video {
+		if err := r.writeAudio(t, pkt); err != nil {
+			r.fail(err)
+		}
+		return
+	}
+	// a packet that can't be decoded is dropped like a lost one
+	aus, _ := t.depacketizer.Push(pkt)
+	for _, au := range aus {
+		if err := r.writeVideo(t, au); err != nil {
+			r.fail(err)
+			return
+		}
+	}
+}
+
+// Close the segment after a write error, the next keyframe starts a new one
+func (r *recorder) fail(err error) {
+	log.Println("Record camera failed", err)
+	r.err = err
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+	r.file = nil
+	r.writer = nil
+}
+
+func (r *recorder) writeVideo(t *recordTrack, au media.AccessUnit) error {
+	vps, sps, pps := media.FirstParameterSets(t.codec, au.NALUs)
+	keyframe := au.Keyframe(t.codec)
+	now := time.Now()
+
+	if keyframe && (r.writer == nil || r.rotate(now)) {
+		// a new segment has the in-band parameter sets of its keyframe
+		if sps != nil && pps != nil {
+			t.fmp4.VPS, t.fmp4.SPS, t.fmp4.PPS = vps, sps, pps
+		}
+		if err := r.closeSegment(); err != nil {
+			return err
+		}
+		if err := r.openSegment(now); err != nil {
+			return err
+		}
+	}
+	if r.writer == nil {
+		return nil
+	}
+
+	if t.pending != nil {
+		duration := au.Timestamp - t.pending.timestamp
+		if duration == 0 || duration > recordMaxGap*t.fmp4.Timescale {
+			duration = t.lastDuration
+		}
+		t.pending.sample.Duration = duration
+		t.append(t.pending.sample)
+		t.pending = nil
+	}
+	if keyframe || now.Sub(r.fragmentStart) >= recordFragmentDuration {
+		if err := r.writeFragment(now); err != nil {
+			return err
+		}
+	}
+	t.pending = &recordPending{
+		sample:    media.FMP4Sample{Data: media.AVCCSample(au.NALUs), Keyframe: keyframe},
+		timestamp: au.Timestamp,
+	}
+	return nil
+}
+
+func (r *recorder) writeAudio(t *recordTrack, pkt *rtp.Packet) error {
+	if r.writer == nil || len(pkt.Payload) == 0 {
+		return nil
+	}
+	var duration uint32
+	switch t.fmp4.Type {
+	case media.FMP4Opus:
+		duration = uint32(media.OpusPacketDuration(pkt.Payload))
+	default:
+		// 8 bits G.711 samples
+		duration = uint32(len(pkt.Payload) / t.fmp4.Channels)
+	}
+
+	if !t.started {
+		// aligned with the video by the arrival time
+		t.dts = uint64(time.Since(r.segmentStart).Seconds() * float64(t.fmp4.Timescale))
+	} else if gap := int64(int32(pkt.Timestamp - t.lastTimestamp - t.lastDuration)); gap < 0 {
+		// late or duplicated packet
+		return nil
+	} else if gap > 0 && gap < int64(recordMaxGap*t.fmp4.Timescale) {
+		// lost packets, the previous sample lasts until this one
+		if n := len(t.samples); n > 0 {
+			t.samples[n-1].Duration += uint32(gap)
+		}
+		t.dts += uint64(gap)
+	}
+	t.lastTimestamp = pkt.Timestamp
+	t.append(media.FMP4Sample{Data: append([]byte(nil), pkt.Payload...), Duration: duration, Keyframe: true})
+	return nil
+}
+
+func (t *recordTrack) append(sample media.FMP4Sample) {
+	if len(t.samples) == 0 {
+		t.base = t.dts
+	}
+	t.started = true
+	t.lastDuration = sample.Duration
+	t.samples = append(t.samples, sample)
+	t.dts += uint64(sample.Duration)
+}
+
+// The segment is full, it's rotated on a keyframe
+func (r *recorder) rotate(now time.Time) bool {
+	if now.Sub(r.segmentStart) >= r.segmentDuration {
+		return true
+	}
+	if r.segmentSize <= 0 {
+		return false
+	}
+	// with the samples of the fragment not written yet
+	size := r.writer.Size()
+	for _, t := range r.tracks {
+		if t == nil {
+			continue
+		}
+		for _, sample := range t.samples {
+			size += int64(len(sample.Data))
+		}
+		if t.pending != nil {
+			size += int64(len(t.pending.sample.Data))
+		}
+	}
+	return size >= r.segmentSize
+}
+
+func (r *recorder) openSegment(now time.Time) error {
+	var tracks []media.FMP4Track
+	for _, t := range r.tracks {
+		if t == nil {
+			continue
+		}
+		if t.video && (t.fmp4.SPS == nil || t.fmp4.PPS == nil || (t.codec == media.CodecH265 && t.fmp4.VPS == nil)) {
+			// wait for a keyframe with its parameter sets
+			return nil
+		}
+		tracks = append(tracks, t.fmp4)
+	}
+
+	name := filepath.Join(r.dir, now.Format("20060102-150405.000")+".mp4")
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	writer, err := media.NewFMP4Writer(file, tracks)
+	if err != nil {
+		file.Close()
+		os.Remove(name)
+		return err
+	}
+	r.file = file
+	r.writer = writer
+	r.segmentStart = now
+	r.fragmentStart = now
+	r.segments++
+	r.err = nil
+	for _, t := range r.tracks {
+		if t != nil {
+			t.started = false
+			t.dts = 0
+			t.samples = nil
+			t.pending = nil
+		}
+	}
+	log.Println("Record segment", name)
+	r.removeOldSegments()
+	return nil
+}
+
+// Write the samples of the tracks, the pending video sample stays for the
+// next fragment
+func (r *recorder) writeFragment(now time.Time) error {
+	var samples [][]media.FMP4Sample
+	var decodeTimes []uint64
+	for _, t := range r.tracks {
+		if t == nil {
+			continue
+		}
+		samples = append(samples, t.samples)
+		decodeTimes = append(decodeTimes, t.base)
+	}
+	err := r.writer.WriteFragment(samples, decodeTimes)
+	for _, t := range r.tracks {
+		if t != nil {
+			t.samples = nil
+		}
+	}
+	r.fragmentStart = now
+	return err
+}
+
+// Flush the segment being written & close its file
+func (r *recorder) closeSegment() error {
+	if r.writer == nil {
+		return nil
+	}
+	for _, t := range r.tracks {
+		if t != nil && t.pending != nil {
+			t.pending.sample.Duration = t.lastDuration
+			t.append(t.pending.sample)
+			t.pending = nil
+		}
+	}
+	err := r.writeFragment(time.Now())
+	r.bytes += r.writer.Size()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	r.writer = nil
+	return err
+}
+
+// Keep the last RecordRetention segments
+func (r *recorder) removeOldSegments() {
+	if r.retention <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.Println("List record segments failed", err)
+		return
+	}
+	var segments []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".mp4") {
+			segments = append(segments, file.Name())
+		}
+	}
+	// the names are timestamps
+	sort.Strings(segments)
+	for len(segments) > r.retention {
+		if err := os.Remove(filepath.Join(r.dir, segments[0])); err != nil {
+			log.Println("Remove record segment failed", err)
+		}
+		segments = segments[1:]
+	}
+}
+
+func (r *recorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	return r.closeSegment()
+}
+
+func (r *recorder) stats() *RecordingStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats := &RecordingStats{Dir: r.dir, Segments: r.segments, Bytes: r.bytes}
+	if r.writer != nil {
+		stats.Segment = filepath.Base(r.file.Name())
+		stats.Bytes += r.writer.Size()
+	}
+	if r.err != nil {
+		stats.Error = r.err.Error()
+	}
+	return stats
+}
@@ -0,0 +1,183 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// frames of a GOP of the recorded test camera
+const testRecordGOP = 10
+
+// Record the test camera H.264 and a PCMU mic
+func newTestRecorder(t *testing.T) *recorder {
+	sps, pps := testParameterSets(t)
+	return &recorder{
+		dir:             t.TempDir(),
+		segmentDuration: time.Hour,
+		tracks: []*recordTrack{
+			newRecordTrack(SourceTrack{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SPS: sps, PPS: pps}),
+			newRecordTrack(SourceTrack{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}),
+		},
+	}
+}
+
+// The NALU of the frame n, an IDR starts each GOP
+func testRecordNALU(n int) []byte {
+	nalu := testFrame(n, 600)
+	nalu[0] = 0x41
+	if n%testRecordGOP == 0 {
+		nalu[0] = 0x65
+	}
+	return nalu
+}
+
+// Write the frames [from, to) of the camera, a frame in a single NALU
+// packet followed by 40ms of PCMU
+func writeTestRecordFrames(r *recorder, from int, to int) {
+	for n := from; n < to; n++ {
+		r.writeRTP(0, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, Marker: true, SequenceNumber: uint16(n), Timestamp: uint32(n * 3600)},
+			Payload: testRecordNALU(n),
+		})
+		r.writeRTP(1, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 0, SequenceNumber: uint16(n), Timestamp: uint32(n * 320)},
+			Payload: bytes.Repeat([]byte{0xFF}, 320),
+		})
+	}
+}
+
+// The recorded segments, oldest first, and their video tracks
+func readTestSegments(t *testing.T, dir string) ([]string, []*media.MP4VideoTrack) {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var tracks []*media.MP4VideoTrack
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		track, err := media.ReadMP4VideoTrack(f, file.Size())
+		f.Close()
+		if err != nil {
+			t.Fatalf("segment %s: %v", file.Name(), err)
+		}
+		names = append(names, file.Name())
+		tracks = append(tracks, track)
+	}
+	return names, tracks
+}
+
+// Check a segment has the GOPs starting at the frame first
+func checkTestSegment(t *testing.T, dir string, name string, track *media.MP4VideoTrack, first int, gops int) {
+	t.Helper()
+	if len(track.Samples) != gops*testRecordGOP {
+		t.Fatalf("segment %s has %d samples, want %d", name, len(track.Samples), gops*testRecordGOP)
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i, sample := range track.Samples {
+		if sample.Sync != (i%testRecordGOP == 0) || sample.DTS != int64(i*3600) {
+			t.Fatalf("segment %s sample %d %+v", name, i, sample)
+		}
+		nalus, err := track.NALUs(f, sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nalus) != 1 || !bytes.Equal(nalus[0], testRecordNALU(first+i)) {
+			t.Fatalf("segment %s sample %d is not the frame %d", name, i, first+i)
+		}
+	}
+}
+
+// A rotated segment is named by its start time in milliseconds
+func waitTestSegmentName() {
+	time.Sleep(2 * time.Millisecond)
+}
+
+// The first segment starts on a keyframe, with the mic
+func TestRecorderStartsOnKeyframe(t *testing.T) {
+	r := newTestRecorder(t)
+	writeTestRecordFrames(r, 3, 2*testRecordGOP)
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, tracks := readTestSegments(t, r.dir)
+	if len(names) != 1 {
+		t.Fatalf("segments %v", names)
+	}
+	checkTestSegment(t, r.dir, names[0], tracks[0], testRecordGOP, 1)
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("ulaw")) {
+		t.Fatal("the segment has no PCMU track")
+	}
+	if stats := r.stats(); stats.Segments != 1 || stats.Bytes != int64(len(data)) || stats.Segment != "" || stats.Error != "" {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// A segment past its duration is rotated on the next keyframe
+func TestRecorderRotatesOnDuration(t *testing.T) {
+	r := newTestRecorder(t)
+	writeTestRecordFrames(r, 0, testRecordGOP+5)
+	// the segment is complete in the middle of the GOP
+	r.mutex.Lock()
+	r.segmentStart = r.segmentStart.Add(-r.segmentDuration)
+	r.mutex.Unlock()
+	waitTestSegmentName()
+	writeTestRecordFrames(r, testRecordGOP+5, 3*testRecordGOP)
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, tracks := readTestSegments(t, r.dir)
+	if len(names) != 2 {
+		t.Fatalf("segments %v", names)
+	}
+	checkTestSegment(t, r.dir, names[0], tracks[0], 0, 2)
+	checkTestSegment(t, r.dir, names[1], tracks[1], 2*testRecordGOP, 1)
+}
+
+// A segment over its size is rotated on the next keyframe, the oldest
+// segments over the retention are removed
+func TestRecorderRotatesOnSizeWithRetention(t *testing.T) {
+	r := newTestRecorder(t)
+	// a GOP is over 6000 bytes
+	r.segmentSize = 3000
+	r.retention = 2
+	for gop := 0; gop < 4; gop++ {
+		waitTestSegmentName()
+		writeTestRecordFrames(r, gop*testRecordGOP, (gop+1)*testRecordGOP)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, tracks := readTestSegments(t, r.dir)
+	if len(names) != 2 {
+		t.Fatalf("segments %v", names)
+	}
+	checkTestSegment(t, r.dir, names[0], tracks[0], 2*testRecordGOP, 1)
+	checkTestSegment(t, r.dir, names[1], tracks[1], 3*testRecordGOP, 1)
+	if stats := r.stats(); stats.Segments != 4 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,26 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Reorder the packets of a camera track (UDP may reorder, gortsplib only
+// reorders within a few packets) and count the camera leg losses. The missing
+// packets are NACKed to the camera if enabled, few cameras answer.
+func (element *Muxer) newReorderBuffer(layer *rtspLayer, trackID int) *media.ReorderBuffer {
+	latency := time.Duration(element.Options.ReorderLatency) * time.Millisecond
+
+	var onMissing func(ssrc uint32, sequenceNumbers []uint16)
+	if element.Options.CameraNACK {
+		onMissing = func(ssrc uint32, sequenceNumbers []uint16) {
+			_ = layer.source.WriteRTCP(trackID, &rtcp.TransportLayerNack{
+				MediaSSRC: ssrc,
+				Nacks:     rtcp.NackPairsFromSequenceNumbers(sequenceNumbers),
+			})
+		}
+	}
+	return media.NewReorderBuffer(latency, onMissing)
+}
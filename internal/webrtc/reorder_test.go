@@ -0,0 +1,120 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// A forward of a video track not negotiated yet, its packets are only counted
+func newTestForward(t *testing.T) *rtspForward {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, "video", "cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rtspForward{track: track, sender: sender}
+}
+
+// The packets behind a camera loss are forwarded after the latency, though
+// no packet follows
+func TestReorderFlushTimer(t *testing.T) {
+	f := newTestForward(t)
+	f.reorder = media.NewReorderBuffer(50*time.Millisecond, nil)
+	defer f.stopReorder()
+
+	for _, sequenceNumber := range []uint16{1, 3, 4} {
+		if err := f.writeRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sequenceNumber}, Payload: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadUint32(&f.packets); n != 1 {
+		t.Fatalf("%d packets forwarded before the latency, want 1", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadUint32(&f.packets); n != 3 {
+		t.Fatalf("%d packets forwarded after the latency, want 3", n)
+	}
+	if stats := f.reorder.Stats(); stats.Lost != 1 {
+		t.Fatalf("reorder stats %+v", stats)
+	}
+}
+
+// Only the report block of the video sender is kept
+func TestWebRTCReceiverReport(t *testing.T) {
+	f := newTestForward(t)
+	ssrc := uint32(f.ssrc())
+	if ssrc == 0 {
+		t.Fatal("no SSRC for the video sender")
+	}
+
+	m := &Muxer{}
+	m.webrtcReceiverReport(&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{
+		{SSRC: ssrc, TotalLost: 7, FractionLost: 12},
+		{SSRC: ssrc + 1, TotalLost: 50, FractionLost: 128},
+	}}, f)
+	if stats := m.Stats().WebRTC; stats.Lost != 7 || stats.FractionLost != 12 {
+		t.Fatalf("WebRTC stats %+v", stats)
+	}
+}
+
+// The recorder gets the forwarded packets, in order & repacketized
+func TestForwardRecordsOutput(t *testing.T) {
+	f := newTestForward(t)
+	f.reorder = media.NewReorderBuffer(time.Second, nil)
+	f.repacketizer = media.NewRepacketizer(media.CodecH264, 0)
+	defer f.stopReorder()
+	var recorded []*rtp.Packet
+	f.record = func(pkt *rtp.Packet) { recorded = append(recorded, pkt) }
+
+	// a frame in 3 FU-A fragments, the last 2 swapped by the network
+	frame := testFrame(1, 2500)
+	var pkts []*rtp.Packet
+	for i, chunk := range [][]byte{frame[1:1000], frame[1000:2000], frame[2000:]} {
+		fuHeader := frame[0] & 0x1F
+		switch i {
+		case 0:
+			fuHeader |= 0x80
+		case 2:
+			fuHeader |= 0x40
+		}
+		payload := append([]byte{frame[0]&0xE0 | 28, fuHeader}, chunk...)
+		pkts = append(pkts, &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, Marker: i == 2, SequenceNumber: uint16(10 + i), Timestamp: 3600}, Payload: payload})
+	}
+	for _, pkt := range []*rtp.Packet{pkts[0], pkts[2], pkts[1]} {
+		if err := f.writeRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := media.NewDepacketizer(media.CodecH264)
+	var aus []media.AccessUnit
+	for _, pkt := range recorded {
+		if len(pkt.Payload) > media.DefaultMaxPayloadSize {
+			t.Fatalf("recorded payload of %d bytes", len(pkt.Payload))
+		}
+		out, err := d.Push(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aus = append(aus, out...)
+	}
+	if len(aus) != 1 || len(aus[0].NALUs) != 1 || !bytes.Equal(aus[0].NALUs[0], frame) {
+		t.Fatalf("recorded %d packets, %d access units", len(recorded), len(aus))
+	}
+}
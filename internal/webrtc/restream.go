@@ -0,0 +1,68 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/restream"
+	"log"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/webrtc/v3"
+)
+
+// The RTSP track of a forwarded camera track
+func restreamTrack(track SourceTrack) gortsplib.Track {
+	switch track.MimeType {
+	case webrtc.MimeTypeH264:
+		return &gortsplib.TrackH264{PayloadType: 96, SPS: track.SPS, PPS: track.PPS, PacketizationMode: 1}
+	case webrtc.MimeTypeH265:
+		return &gortsplib.TrackH265{PayloadType: 96, VPS: track.VPS, SPS: track.SPS, PPS: track.PPS}
+	case webrtc.MimeTypePCMA:
+		return &gortsplib.TrackPCMA{}
+	case webrtc.MimeTypeOpus:
+		return &gortsplib.TrackOpus{PayloadType: 111, SampleRate: 48000, ChannelCount: 2}
+	}
+	return &gortsplib.TrackPCMU{}
+}
+
+// Republish the forwarded camera packets of the layers at
+// rtsp://RestreamAddress/<path>, the other simulcast layers at <path>_<rid>
+func (element *Muxer) startRestream(path string) error {
+	server, err := restream.Listen(element.Options.RestreamAddress)
+	if err != nil {
+		return err
+	}
+	element.restream = server
+
+	for i, layer := range element.layers {
+		var tracks gortsplib.Tracks
+		for _, f := range layer.forwards {
+			tracks = append(tracks, restreamTrack(layer.tracks[f.sourceTrack]))
+		}
+		layerPath := path
+		if i > 0 {
+			layerPath += "_" + layer.rid
+		}
+		stream, err := server.Publish(layerPath, tracks, element.Options.RestreamUser, element.Options.RestreamPass)
+		if err != nil {
+			element.closeRestream()
+			return err
+		}
+		layer.restream = stream
+		log.Printf("Restream %s at rtsp://%s/%s", RedactURLs(layer.url), element.Options.RestreamAddress, layerPath)
+	}
+	return nil
+}
+
+func (element *Muxer) closeRestream() {
+	for _, layer := range element.layers {
+		if layer.restream != nil {
+			layer.restream.Close()
+			layer.restream = nil
+		}
+	}
+	if element.restream != nil {
+		if err := element.restream.Close(); err != nil {
+			log.Println("Close RTSP restream server failed", err)
+		}
+		element.restream = nil
+	}
+}
@@ -0,0 +1,116 @@
+package webrtc
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtp"
+)
+
+// Play a restream over TCP, the received packets are sent to packets
+func startTestRestreamReader(rawURL string, packets chan *rtp.Packet) (*gortsplib.Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := gortsplib.TransportTCP
+	c := &gortsplib.Client{
+		Transport: &transport,
+		OnPacketRTP: func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+			select {
+			case packets <- ctx.Packet:
+			default:
+			}
+		},
+	}
+	if err := c.Start(u.Scheme, u.Host); err != nil {
+		return nil, err
+	}
+	tracks, baseURL, _, err := c.Describe(u)
+	if err == nil {
+		err = c.SetupAndPlay(tracks, baseURL)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// The readers of rtsp://RestreamAddress/<room>_<id> authenticate and share the
+// single camera session of the muxer
+func TestRestreamReaders(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	whip := newTestWHIPServer(t, nil, nil)
+	camera := newTestSource(t, true)
+	m := NewMuxer(Options{
+		AudioSource:     AudioSourceNone,
+		Sink:            SinkWHIP,
+		WHIPURL:         whip.URL + "/whip/endpoint",
+		RestreamAddress: addr,
+		RestreamUser:    "user",
+		RestreamPass:    "pass",
+		RTSPReadTimeout: 2,
+	})
+	if msg, err := m.WriteHeader("2", "1", "", camera, "", "", "cam"); err != nil {
+		t.Fatal(msg, err)
+	}
+	defer m.Close()
+
+	if c, err := startTestRestreamReader("rtsp://"+addr+"/1_2", make(chan *rtp.Packet, 1)); err == nil {
+		c.Close()
+		t.Fatal("restream read without the credentials")
+	} else if !strings.Contains(err.Error(), "401") {
+		t.Fatal(err)
+	}
+
+	var readers []chan *rtp.Packet
+	for i := 0; i < 3; i++ {
+		packets := make(chan *rtp.Packet, 100)
+		c, err := startTestRestreamReader("rtsp://user:pass@"+addr+"/1_2", packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		readers = append(readers, packets)
+	}
+	for i, packets := range readers {
+		// the camera frames, the in-band parameter sets aside
+		for received := 0; received < 3; {
+			select {
+			case pkt := <-packets:
+				if pkt.PayloadType != 96 {
+					t.Fatalf("reader %d packet %+v", i, pkt.Header)
+				}
+				if pkt.Payload[0]&0x1F == 24 {
+					continue
+				}
+				if n := testFrameNumber(pkt.Payload); string(pkt.Payload) != string(testFrame(n, 500)) {
+					t.Fatalf("reader %d frame %d is corrupted", i, n)
+				}
+				received++
+			case <-time.After(5 * time.Second):
+				t.Fatalf("reader %d receives no frame", i)
+			}
+		}
+	}
+
+	testSourcesMutex.Lock()
+	source := testSources[camera]
+	testSourcesMutex.Unlock()
+	if starts := atomic.LoadInt32(&source.starts); starts != 1 {
+		t.Fatalf("%d camera sessions for the readers", starts)
+	}
+}
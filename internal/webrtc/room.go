@@ -0,0 +1,156 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/janus"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// RoomTemplate holds the parameters used to create a VideoRoom room
+// when the target room does not exist yet.
+type RoomTemplate struct {
+	// Description is the room name shown by Janus, defaults to the room number
+	Description string `json:"description"`
+	// Publishers is the max number of concurrent publishers, defaults to 6
+	Publishers int `json:"publishers"`
+	// Bitrate is the max video bitrate for senders in bit/s, 0 means unlimited
+	Bitrate int `json:"bitrate"`
+	// VideoCodec forces the room video codec, defaults to the camera codec
+	VideoCodec string `json:"videocodec"`
+	// Secret is required to edit or destroy the room
+	Secret string `json:"secret"`
+}
+
+// janus videoroom error code returned by `create` when the room exists
+const janusVideoRoomErrorRoomExists = 427
+
+// rooms created by this process, keyed by janus server and room number,
+// with the number of our publishers currently joined
+var managedRooms = struct {
+	sync.Mutex
+	refs map[string]int
+}{refs: make(map[string]int)}
+
+func managedRoomKey(Janus string, room int) string {
+	return fmt.Sprintf("%s#%d", Janus, room)
+}
+
+// Create the room from the template if it does not exist yet,
+// returns true if the room was created by this call
+func (element *Muxer) createRoomIfNeeded(handle *janus.Handle, room int, Pin string) (bool, error) {
+	msg, err := handle.Request(map[string]interface{}{
+		"request": "exists",
+		"room":    room,
+	})
+	if err != nil {
+		return false, err
+	}
+	if exists, ok := msg.PluginData.Data["exists"].(bool); ok && exists {
+		return false, nil
+	}
+
+	template := element.Options.RoomTemplate
+	description := template.Description
+	if len(description) == 0 {
+		description = fmt.Sprint(room)
+	}
+	publishers := template.Publishers
+	if publishers <= 0 {
+		publishers = 6
+	}
+	videoCodec := template.VideoCodec
+	if len(videoCodec) == 0 {
+		videoCodec = strings.ToLower(strings.TrimPrefix(element.videoCodec, "video/"))
+	}
+
+	body := map[string]interface{}{
+		"request":     "create",
+		"room":        room,
+		"permanent":   false,
+		"description": description,
+		"publishers":  publishers,
+		"videocodec":  videoCodec,
+		"bitrate":     template.Bitrate,
+	}
+	if len(Pin) > 0 {
+		body["pin"] = Pin
+	}
+	if len(template.Secret) > 0 {
+		body["secret"] = template.Secret
+	}
+
+	msg, err = handle.Request(body)
+	if err != nil {
+		return false, err
+	}
+	data := msg.PluginData.Data
+	if data["error"] != nil {
+		// someone else created it in the meantime
+		if code, ok := data["error_code"].(float64); ok && int(code) == janusVideoRoomErrorRoomExists {
+			return false, nil
+		}
+		return false, fmt.Errorf("create room %d failed, reason: %s", room, data["error"])
+	}
+
+	log.Printf("Created room %d, videocodec: %s, publishers: %d", room, videoCodec, publishers)
+	return true, nil
+}
+
+// Keep track of the publishers joined to a room created by this process
+func (element *Muxer) retainRoom(Janus string, room int, created bool) {
+	key := managedRoomKey(Janus, room)
+
+	managedRooms.Lock()
+	defer managedRooms.Unlock()
+
+	if created {
+		managedRooms.refs[key] = 1
+	} else if _, ok := managedRooms.refs[key]; ok {
+		managedRooms.refs[key]++
+	} else {
+		return
+	}
+	element.managedRoom = key
+	element.roomNum = room
+}
+
+// Leave the managed room, destroy it if we are the last publisher
+func (element *Muxer) releaseRoom() {
+	if len(element.managedRoom) == 0 {
+		return
+	}
+	key := element.managedRoom
+	element.managedRoom = ""
+
+	managedRooms.Lock()
+	managedRooms.refs[key]--
+	last := managedRooms.refs[key] <= 0
+	if last {
+		delete(managedRooms.refs, key)
+	}
+	managedRooms.Unlock()
+
+	if !last || !element.Options.DestroyRoom || element.handle == nil {
+		return
+	}
+
+	body := map[string]interface{}{
+		"request": "destroy",
+		"room":    element.roomNum,
+	}
+	if len(element.Options.RoomTemplate.Secret) > 0 {
+		body["secret"] = element.Options.RoomTemplate.Secret
+	}
+	msg, err := element.handle.Request(body)
+	if err != nil {
+		log.Printf("Destroy room %d failed %s", element.roomNum, err)
+		return
+	}
+	if msg.PluginData.Data["error"] != nil {
+		log.Printf("Destroy room %d failed, reason: %s", element.roomNum, msg.PluginData.Data["error"])
+		return
+	}
+	log.Printf("Destroyed room %d, no more publishers", element.roomNum)
+}
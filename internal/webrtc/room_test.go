@@ -0,0 +1,183 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/janus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// testJanusServer is a Janus gateway answering the VideoRoom room requests,
+// it keeps the rooms & records the requests
+type testJanusServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	rooms    map[int]bool
+	requests []string
+	// room created by someone else once its exists request is answered
+	raced int
+}
+
+func newTestJanusServer(t *testing.T) *testJanusServer {
+	s := &testJanusServer{rooms: make(map[int]bool)}
+	upgrader := websocket.Upgrader{Subprotocols: []string{"janus-protocol"}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req struct {
+				Janus       string                 `json:"janus"`
+				Transaction string                 `json:"transaction"`
+				Body        map[string]interface{} `json:"body"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if err := conn.WriteJSON(s.answer(req.Janus, req.Transaction, req.Body)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testJanusServer) answer(request string, transaction string, body map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{"janus": "success", "transaction": transaction}
+	switch request {
+	case "create", "attach":
+		msg["data"] = map[string]interface{}{"id": 1}
+		return msg
+	case "message":
+	default:
+		msg["janus"] = "ack"
+		return msg
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	room := int(body["room"].(float64))
+	data := map[string]interface{}{"videoroom": "success", "room": room}
+	switch body["request"] {
+	case "exists":
+		data["exists"] = s.rooms[room]
+		if room == s.raced {
+			s.rooms[room] = true
+		}
+	case "create":
+		if s.rooms[room] {
+			data = map[string]interface{}{"videoroom": "event", "error_code": janusVideoRoomErrorRoomExists, "error": "Room exists"}
+			break
+		}
+		s.rooms[room] = true
+		data["videoroom"] = "created"
+	case "destroy":
+		delete(s.rooms, room)
+		data["videoroom"] = "destroyed"
+	}
+	s.requests = append(s.requests, body["request"].(string))
+	msg["plugindata"] = map[string]interface{}{"plugin": "janus.plugin.videoroom", "data": data}
+	return msg
+}
+
+// A muxer attached to the VideoRoom plugin of the server
+func newTestRoomMuxer(t *testing.T, s *testJanusServer) *Muxer {
+	t.Helper()
+	gateway, err := janus.Connect("ws" + strings.TrimPrefix(s.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gateway.Close() })
+	session, err := gateway.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := session.Attach("janus.plugin.videoroom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMuxer(Options{DestroyRoom: true})
+	m.videoCodec = "video/H264"
+	m.handle = handle
+	return m
+}
+
+func (s *testJanusServer) hasRoom(room int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rooms[room]
+}
+
+// The room is created by the first muxer, reused by the second one and
+// destroyed when the last one leaves
+func TestManagedRoomRefs(t *testing.T) {
+	s := newTestJanusServer(t)
+	first, second := newTestRoomMuxer(t, s), newTestRoomMuxer(t, s)
+
+	for i, m := range []*Muxer{first, second} {
+		created, err := m.createRoomIfNeeded(m.handle, 4321, "")
+		if err != nil || created != (i == 0) {
+			t.Fatalf("muxer %d created the room: %t, %v", i, created, err)
+		}
+		m.retainRoom(s.URL, 4321, created)
+	}
+	key := managedRoomKey(s.URL, 4321)
+	managedRooms.Lock()
+	refs := managedRooms.refs[key]
+	managedRooms.Unlock()
+	if refs != 2 {
+		t.Fatalf("%d publishers of the room", refs)
+	}
+
+	first.releaseRoom()
+	if !s.hasRoom(4321) {
+		t.Fatal("the room is destroyed with a publisher left")
+	}
+	// released once
+	first.releaseRoom()
+	second.releaseRoom()
+	if s.hasRoom(4321) {
+		t.Fatal("the room is not destroyed by the last publisher")
+	}
+	managedRooms.Lock()
+	_, ok := managedRooms.refs[key]
+	managedRooms.Unlock()
+	if ok {
+		t.Fatal("the destroyed room is still managed")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	want := []string{"exists", "create", "exists", "destroy"}
+	if strings.Join(s.requests, ",") != strings.Join(want, ",") {
+		t.Fatalf("requests %v, want %v", s.requests, want)
+	}
+}
+
+// A room created by someone else is never destroyed, even when it is created
+// between the exists & create requests
+func TestUnmanagedRoom(t *testing.T) {
+	s := newTestJanusServer(t)
+	s.rooms[4322] = true
+	s.raced = 4323
+	m := newTestRoomMuxer(t, s)
+	for _, room := range []int{4322, 4323} {
+		created, err := m.createRoomIfNeeded(m.handle, room, "")
+		if err != nil || created {
+			t.Fatalf("created the room %d: %t, %v", room, created, err)
+		}
+		m.retainRoom(s.URL, room, created)
+		m.releaseRoom()
+		if !s.hasRoom(room) {
+			t.Fatalf("the room %d of someone else is destroyed", room)
+		}
+	}
+}
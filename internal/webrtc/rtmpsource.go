@@ -0,0 +1,450 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"RTSPSender/internal/rtmp"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func init() {
+	RegisterSource("rtmp", newRTMPSource, func(rawURL string, sdp string) error {
+		// nothing is listened before Describe
+		_, err := newRTMPSource(rawURL, Options{})
+		return err
+	})
+}
+
+const (
+	defaultRTMPPort = "1935"
+	// time Describe & a reconnection wait for the encoder to publish
+	rtmpPublishTimeout = 30 * time.Second
+)
+
+// FLV codec ids
+const (
+	flvCodecAVC      = 7
+	flvCodecHEVC     = 12
+	flvSoundPCMA     = 7
+	flvSoundPCMU     = 8
+	flvSoundAAC      = 10
+	flvFrameCommand  = 5
+	flvPacketSeqHead = 0
+	flvPacketNALU    = 1
+	// enhanced RTMP packet types
+	flvExSequenceStart = 0
+	flvExCodedFrames   = 1
+	flvExCodedFramesX  = 3
+)
+
+// rtmpSource is an encoder pushing to the embedded RTMP server. The URL
+// rtmp://0.0.0.0:1935/live/key listens on the address and takes the publish
+// of app "live" with stream key "key". The H.264/H.265 video is packetized
+// to RTP, G.711 audio is passed through and AAC is dropped.
+type rtmpSource struct {
+	addr    string
+	path    string
+	options Options
+
+	mutex     sync.Mutex
+	server    *rtmp.Server
+	stream    *rtmp.Stream
+	publisher *rtmp.Publisher
+	video     *media.MP4VideoTrack
+	// FLV sound format of the audio, -1 without audio
+	sound  int
+	closed bool
+	done   chan struct{}
+
+	bytesReceived uint64
+}
+
+func newRTMPSource(rawURL string, options Options) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTMP URL: %v", RedactURLs(err.Error()))
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("RTMP URL %s has no listen address", RedactURLs(rawURL))
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultRTMPPort
+	}
+	path := strings.Trim(u.Path, "/")
+	if i := strings.LastIndexByte(path, '/'); i <= 0 || i == len(path)-1 {
+		return nil, fmt.Errorf("RTMP URL %s must end with /app/key", RedactURLs(rawURL))
+	}
+	return &rtmpSource{
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		path:    path,
+		options: options,
+		sound:   -1,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (s *rtmpSource) readTimeout() time.Duration {
+	return rtspReadTimeout(s.options)
+}
+
+// Describe starts listening and waits for the encoder to publish its video
+// sequence header
+func (s *rtmpSource) Describe() ([]SourceTrack, error) {
+	if err := s.waitPublisher(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.video == nil {
+		return nil, errors.New("RTMP source closed")
+	}
+	tracks := []SourceTrack{fileSourceTrack(s.video.Codec, s.video.VPS, s.video.SPS, s.video.PPS)}
+	switch s.sound {
+	case flvSoundPCMU:
+		tracks = append(tracks, SourceTrack{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 1})
+	case flvSoundPCMA:
+		tracks = append(tracks, SourceTrack{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 1})
+	case -1:
+	default:
+		log.Printf("RTMP %s audio format %d (AAC is %d) can not be forwarded, dropped", s.path, s.sound, flvSoundAAC)
+		tracks = append(tracks, SourceTrack{})
+	}
+	return tracks, nil
+}
+
+// Wait for a publisher and read up to its video sequence header
+func (s *rtmpSource) waitPublisher() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("RTMP source closed")
+	}
+	if s.publisher != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	if s.stream == nil {
+		server, err := rtmp.Listen(s.addr)
+		if err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+		stream, err := server.Stream(s.path)
+		if err != nil {
+			server.Close()
+			s.mutex.Unlock()
+			return err
+		}
+		s.server, s.stream = server, stream
+	}
+	stream := s.stream
+	s.mutex.Unlock()
+
+	log.Printf("Wait for an encoder publishing rtmp://%s/%s", s.addr, s.path)
+	publisher, err := stream.Accept(rtmpPublishTimeout, s.done)
+	if err != nil {
+		return err
+	}
+
+	var video *media.MP4VideoTrack
+	sound := -1
+	for video == nil {
+		_ = publisher.SetReadDeadline(time.Now().Add(s.readTimeout()))
+		msg, err := publisher.ReadMessage()
+		if err != nil {
+			publisher.Close()
+			return err
+		}
+		atomic.AddUint64(&s.bytesReceived, uint64(len(msg.Payload)))
+		switch msg.Type {
+		case rtmp.TypeVideo:
+			if video, err = flvSequenceHeader(msg.Payload); err != nil {
+				publisher.Close()
+				return err
+			}
+		case rtmp.TypeAudio:
+			if len(msg.Payload) > 0 && sound < 0 {
+				sound = int(msg.Payload[0] >> 4)
+			}
+		default:
+			if metadata, ok := msg.Metadata(); ok {
+				if id, ok := metadata["audiocodecid"].(float64); ok {
+					sound = int(id)
+				}
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		publisher.Close()
+		return errors.New("RTMP source closed")
+	}
+	if s.video != nil && s.video.Codec != video.Codec {
+		publisher.Close()
+		return fmt.Errorf("RTMP %s codec changed", s.path)
+	}
+	s.publisher, s.video = publisher, video
+	if s.sound < 0 {
+		s.sound = sound
+	}
+	log.Printf("RTMP encoder %s publishing %s", publisher.RemoteAddr(), s.path)
+	return nil
+}
+
+// The decoder configuration of a video sequence header, nil for other tags
+func flvSequenceHeader(payload []byte) (*media.MP4VideoTrack, error) {
+	codec, packetType, data, _, ok := flvVideoTag(payload)
+	if !ok || packetType != flvPacketSeqHead {
+		return nil, nil
+	}
+	return media.ParseDecoderConfig(codec, data)
+}
+
+// Split a FLV video tag, legacy (AVC, HEVC codec id 12) or enhanced
+// RTMP (avc1, hvc1 FourCC). packetType is a legacy AVCPacketType.
+func flvVideoTag(payload []byte) (codec media.Codec, packetType int, data []byte, cts int32, ok bool) {
+	if len(payload) < 5 {
+		return
+	}
+	if payload[0]&0x80 != 0 {
+		if (payload[0]>>4)&0x07 == flvFrameCommand {
+			return
+		}
+		switch string(payload[1:5]) {
+		case "avc1":
+			codec = media.CodecH264
+		case "hvc1":
+			codec = media.CodecH265
+		default:
+			return
+		}
+		switch payload[0] & 0x0F {
+		case flvExSequenceStart:
+			return codec, flvPacketSeqHead, payload[5:], 0, true
+		case flvExCodedFrames:
+			if len(payload) < 8 {
+				return
+			}
+			return codec, flvPacketNALU, payload[8:], flvCTS(payload[5:8]), true
+		case flvExCodedFramesX:
+			return codec, flvPacketNALU, payload[5:], 0, true
+		}
+		return
+	}
+
+	switch payload[0] & 0x0F {
+	case flvCodecAVC:
+		codec = media.CodecH264
+	case flvCodecHEVC:
+		codec = media.CodecH265
+	default:
+		return
+	}
+	if (payload[0] >> 4) == flvFrameCommand {
+		return
+	}
+	return codec, int(payload[1]), payload[5:], flvCTS(payload[2:5]), true
+}
+
+// signed 24 bits composition time offset, in ms
+func flvCTS(b []byte) int32 {
+	return int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8
+}
+
+// Start packetizes the published video (and G.711 audio) until the encoder
+// stops, a reconnection waits for the encoder to publish again
+func (s *rtmpSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	if err := s.waitPublisher(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	publisher, video, sound := s.publisher, s.video, s.sound
+	s.mutex.Unlock()
+	if publisher == nil {
+		return errors.New("RTMP source closed")
+	}
+	defer func() {
+		publisher.Close()
+		s.mutex.Lock()
+		if s.publisher == publisher {
+			s.publisher = nil
+		}
+		s.mutex.Unlock()
+	}()
+
+	videoIndex, audioIndex := -1, -1
+	for i, track := range tracks {
+		switch track {
+		case 0:
+			videoIndex = i
+		case 1:
+			audioIndex = i
+		default:
+			return fmt.Errorf("RTMP track %d not found", track)
+		}
+	}
+
+	encoder := newRTPEncoder(video.Codec)
+	audio := rtp.Header{
+		Version:        2,
+		PayloadType:    0,
+		SequenceNumber: uint16(rand.Uint32()),
+		SSRC:           rand.Uint32(),
+	}
+	if sound == flvSoundPCMA {
+		audio.PayloadType = 8
+	}
+	audioBase := rand.Uint32()
+
+	for {
+		_ = publisher.SetReadDeadline(time.Now().Add(s.readTimeout()))
+		msg, err := publisher.ReadMessage()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return errors.New("RTMP source closed")
+			}
+			return fmt.Errorf("RTMP encoder stopped: %v", err)
+		}
+		atomic.AddUint64(&s.bytesReceived, uint64(len(msg.Payload)))
+
+		switch msg.Type {
+		case rtmp.TypeVideo:
+			codec, packetType, data, cts, ok := flvVideoTag(msg.Payload)
+			if !ok || codec != video.Codec || videoIndex < 0 {
+				continue
+			}
+			if packetType == flvPacketSeqHead {
+				if config, err := media.ParseDecoderConfig(codec, data); err == nil {
+					video = config
+				}
+				continue
+			}
+			if packetType != flvPacketNALU {
+				continue
+			}
+			nalus, err := video.SplitNALUs(data)
+			if err != nil || len(nalus) == 0 {
+				log.Println("Invalid RTMP video frame", err)
+				continue
+			}
+			nalus = withParameterSets(video, nalus)
+			pts := time.Duration(int64(msg.Timestamp)+int64(cts)) * time.Millisecond
+			if pts < 0 {
+				pts = 0
+			}
+			pkts, err := encoder.Encode(nalus, pts)
+			if err != nil {
+				log.Println("Packetize RTMP video frame failed", err)
+				continue
+			}
+			for _, pkt := range pkts {
+				onRTP(videoIndex, pkt)
+			}
+		case rtmp.TypeAudio:
+			if audioIndex < 0 || len(msg.Payload) < 2 || int(msg.Payload[0]>>4) != sound {
+				continue
+			}
+			if sound != flvSoundPCMU && sound != flvSoundPCMA {
+				continue
+			}
+			audio.SequenceNumber++
+			audio.Timestamp = audioBase + msg.Timestamp*8
+			onRTP(audioIndex, &rtp.Packet{Header: audio, Payload: msg.Payload[1:]})
+		}
+	}
+}
+
+// Put the sequence header parameter sets before a keyframe not carrying them
+func withParameterSets(video *media.MP4VideoTrack, nalus [][]byte) [][]byte {
+	keyframe := false
+	for _, nalu := range nalus {
+		keyframe = keyframe || media.IsKeyframe(video.Codec, nalu)
+	}
+	if !keyframe {
+		return nalus
+	}
+	vps, sps, pps := media.FirstParameterSets(video.Codec, nalus)
+	if sps != nil && pps != nil && (vps != nil || video.Codec != media.CodecH265) {
+		return nalus
+	}
+	var sets [][]byte
+	for _, nalu := range [][]byte{video.VPS, video.SPS, video.PPS} {
+		if nalu != nil {
+			sets = append(sets, nalu)
+		}
+	}
+	return append(sets, nalus...)
+}
+
+// RequestKeyframe is not supported by RTMP, the encoder sends its keyframes
+// at its own interval
+func (s *rtmpSource) RequestKeyframe() error {
+	return errors.New("RTMP can not request a keyframe")
+}
+
+func (s *rtmpSource) WriteRTCP(track int, pkt rtcp.Packet) error {
+	return nil
+}
+
+func (s *rtmpSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.publisher != nil {
+		s.publisher.Close()
+		s.publisher = nil
+	}
+	if s.stream != nil {
+		s.stream.Close()
+		s.stream = nil
+	}
+	if s.server != nil {
+		err := s.server.Close()
+		s.server = nil
+		return err
+	}
+	return nil
+}
+
+func (s *rtmpSource) Stats() SourceStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	details := map[string]interface{}{
+		"listen":    s.addr,
+		"connected": s.publisher != nil,
+	}
+	if s.publisher != nil {
+		details["publisher"] = s.publisher.RemoteAddr().String()
+	}
+	return SourceStats{
+		Type:          "rtmp",
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		Details:       details,
+	}
+}
@@ -0,0 +1,292 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// FLV tags of the test encoder
+const (
+	testFLVPCMU = flvSoundPCMU<<4 | 0x02
+	testFLVAAC  = flvSoundAAC<<4 | 0x0F
+)
+
+// AMF0 values of the test encoder commands: string, float64, nil or an object
+// of string properties
+func testAMF(values ...interface{}) []byte {
+	var b []byte
+	appendString := func(s string) {
+		b = append(b, byte(len(s)>>8), byte(len(s)))
+		b = append(b, s...)
+	}
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			b = append(b, 2)
+			appendString(v)
+		case float64:
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+		case map[string]string:
+			b = append(b, 3)
+			for name, value := range v {
+				appendString(name)
+				b = append(b, 2)
+				appendString(value)
+			}
+			b = append(b, 0, 0, 9)
+		default:
+			b = append(b, 5)
+		}
+	}
+	return b
+}
+
+// A message in 128 bytes chunks, a full header then type 3 headers
+func testRTMPMessage(csid byte, typ byte, timestamp uint32, payload []byte) []byte {
+	b := []byte{csid, byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, 1, 0, 0, 0}
+	for {
+		n := len(payload)
+		if n > 128 {
+			n = 128
+		}
+		b = append(b, payload[:n]...)
+		payload = payload[n:]
+		if len(payload) == 0 {
+			return b
+		}
+		b = append(b, 0xC0|csid)
+	}
+}
+
+// testFLVTag is an audio or video tag published by the test encoder
+type testFLVTag struct {
+	typ       byte
+	timestamp uint32
+	payload   []byte
+}
+
+// The AVC sequence header of the parameter sets
+func testAVCSequenceHeader(sps []byte, pps []byte) []byte {
+	b := []byte{0x17, flvPacketSeqHead, 0, 0, 0, 1, sps[1], sps[2], sps[3], 0xFF, 0xE1, byte(len(sps) >> 8), byte(len(sps))}
+	b = append(append(b, sps...), 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
+
+// The AVC tag of the frame n, a single NALU with its length
+func testAVCFrame(n int, cts int) []byte {
+	nalu := testFrame(n, 700)
+	b := []byte{0x27, flvPacketNALU, byte(cts >> 16), byte(cts >> 8), byte(cts), 0, 0, 0, 0}
+	if nalu[0]&0x1F == 5 {
+		b[0] = 0x17
+	}
+	binary.BigEndian.PutUint32(b[5:], uint32(len(nalu)))
+	return append(b, nalu...)
+}
+
+// Publish the tags to rtmp://addr/live/key once the source listens, the
+// connection stays open until the end of the test
+func publishTestRTMP(t *testing.T, addr string, tags []testFLVTag) {
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error(err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	session := append([]byte{3}, make([]byte, 1536)...)
+	if _, err := conn.Write(session); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1+2*1536)); err != nil {
+		t.Error(err)
+		return
+	}
+	go io.Copy(ioutil.Discard, conn)
+
+	session = make([]byte, 1536)
+	session = append(session, testRTMPMessage(3, 20, 0, testAMF("connect", 1.0, map[string]string{"app": "live"}))...)
+	session = append(session, testRTMPMessage(3, 20, 0, testAMF("createStream", 2.0, nil))...)
+	session = append(session, testRTMPMessage(3, 20, 0, testAMF("publish", 3.0, nil, "key", "live"))...)
+	for _, tag := range tags {
+		csid := byte(4)
+		if tag.typ == 9 {
+			csid = 6
+		}
+		session = append(session, testRTMPMessage(csid, tag.typ, tag.timestamp, tag.payload)...)
+	}
+	if _, err := conn.Write(session); err != nil {
+		t.Error(err)
+	}
+}
+
+// A RTMP source of a free local port
+func newTestRTMPSource(t *testing.T) (Source, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	s, err := newRTMPSource("rtmp://"+addr+"/live/key", Options{RTSPReadTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, addr
+}
+
+// The frames of a GOP & 20ms of audio per frame, after the sequence header
+func testRTMPSession(t *testing.T, sound byte) []testFLVTag {
+	sps, pps := testParameterSets(t)
+	tags := []testFLVTag{
+		{typ: 8, payload: append([]byte{sound}, bytes.Repeat([]byte{0xFF}, 160)...)},
+		{typ: 9, payload: testAVCSequenceHeader(sps, pps)},
+	}
+	for n := 0; n < 25; n++ {
+		tags = append(tags,
+			testFLVTag{typ: 9, timestamp: uint32(n * 40), payload: testAVCFrame(n, 0)},
+			testFLVTag{typ: 8, timestamp: uint32(n * 40), payload: append([]byte{sound}, bytes.Repeat([]byte{byte(n)}, 160)...)},
+		)
+	}
+	return tags
+}
+
+// Read the packets of the tracks until the frame 24 is received
+func readTestRTMPSource(t *testing.T, s Source, tracks []int) ([]media.AccessUnit, []*rtp.Packet) {
+	t.Helper()
+	d := media.NewDepacketizer(media.CodecH264)
+	frames := make(chan media.AccessUnit, 100)
+	audio := make(chan *rtp.Packet, 100)
+	go s.Start(tracks, func(track int, pkt *rtp.Packet) {
+		if track == 1 {
+			audio <- pkt
+			return
+		}
+		aus, err := d.Push(pkt)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, au := range aus {
+			frames <- au
+		}
+	}, func(track int, pkt rtcp.Packet) {})
+
+	// the last frame ends with the next one
+	var aus []media.AccessUnit
+	for len(aus) < 24 {
+		select {
+		case au := <-frames:
+			aus = append(aus, au)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d frames received", len(aus))
+		}
+	}
+	var pkts []*rtp.Packet
+	for len(audio) > 0 {
+		pkts = append(pkts, <-audio)
+	}
+	return aus, pkts
+}
+
+// The AVC frames are packetized with the parameter sets before the IDR, the
+// G.711 tags are passed through at 8kHz
+func TestRTMPSourcePCMU(t *testing.T) {
+	s, addr := newTestRTMPSource(t)
+	go publishTestRTMP(t, addr, testRTMPSession(t, testFLVPCMU))
+
+	tracks, err := s.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sps, pps := testParameterSets(t)
+	if len(tracks) != 2 || tracks[0].MimeType != webrtc.MimeTypeH264 || !bytes.Equal(tracks[0].SPS, sps) || !bytes.Equal(tracks[0].PPS, pps) ||
+		tracks[1].MimeType != webrtc.MimeTypePCMU || tracks[1].ClockRate != 8000 {
+		t.Fatalf("tracks %+v", tracks)
+	}
+
+	aus, audio := readTestRTMPSource(t, s, []int{0, 1})
+	if len(aus[0].NALUs) != 3 || !bytes.Equal(aus[0].NALUs[0], sps) || !bytes.Equal(aus[0].NALUs[1], pps) {
+		t.Fatalf("the IDR has %d NALUs", len(aus[0].NALUs))
+	}
+	for n, au := range aus {
+		nalu := au.NALUs[len(au.NALUs)-1]
+		if !bytes.Equal(nalu, testFrame(n, 700)) || au.Timestamp-aus[0].Timestamp != uint32(n*3600) {
+			t.Fatalf("frame %d at %d", testFrameNumber(nalu), au.Timestamp-aus[0].Timestamp)
+		}
+	}
+	if len(audio) < 20 {
+		t.Fatalf("%d audio packets", len(audio))
+	}
+	// the first tag, giving the sound format, is read with the sequence header
+	for n, pkt := range audio {
+		if pkt.PayloadType != 0 || !bytes.Equal(pkt.Payload, bytes.Repeat([]byte{byte(n)}, 160)) ||
+			pkt.Timestamp-audio[0].Timestamp != uint32(n*320) || pkt.SequenceNumber-audio[0].SequenceNumber != uint16(n) {
+			t.Fatalf("audio packet %d %+v", n, pkt.Header)
+		}
+	}
+}
+
+// The AAC track is described without codec, its tags are dropped
+func TestRTMPSourceAACDropped(t *testing.T) {
+	s, addr := newTestRTMPSource(t)
+	go publishTestRTMP(t, addr, testRTMPSession(t, testFLVAAC))
+
+	tracks, err := s.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 || tracks[0].MimeType != webrtc.MimeTypeH264 || tracks[1].MimeType != "" {
+		t.Fatalf("tracks %+v", tracks)
+	}
+	if _, audio := readTestRTMPSource(t, s, []int{0, 1}); len(audio) != 0 {
+		t.Fatalf("%d AAC packets forwarded", len(audio))
+	}
+}
+
+func TestFLVVideoTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		codec      media.Codec
+		packetType int
+		cts        int32
+		ok         bool
+	}{
+		{name: "AVC NALU", payload: []byte{0x27, 1, 0xFF, 0xFF, 0xD8, 0x41}, codec: media.CodecH264, packetType: flvPacketNALU, cts: -40, ok: true},
+		{name: "HEVC sequence header", payload: []byte{0x1C, 0, 0, 0, 0, 1}, codec: media.CodecH265, packetType: flvPacketSeqHead, ok: true},
+		{name: "AVC command", payload: []byte{0x57, 0, 0, 0, 0, 0}},
+		{name: "VP6", payload: []byte{0x14, 0, 0, 0, 0, 0}},
+		{name: "enhanced hvc1 frames", payload: []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 40, 0x26}, codec: media.CodecH265, packetType: flvPacketNALU, cts: 40, ok: true},
+		{name: "enhanced avc1 frames without cts", payload: []byte{0x93, 'a', 'v', 'c', '1', 0x41}, codec: media.CodecH264, packetType: flvPacketNALU, ok: true},
+		{name: "enhanced av01", payload: []byte{0x90, 'a', 'v', '0', '1', 0}},
+		{name: "truncated", payload: []byte{0x17, 1}},
+	}
+	for _, test := range tests {
+		codec, packetType, _, cts, ok := flvVideoTag(test.payload)
+		if ok != test.ok || (ok && (codec != test.codec || packetType != test.packetType || cts != test.cts)) {
+			t.Errorf("%s: codec %v, packet type %d, cts %d, %v", test.name, codec, packetType, cts, ok)
+		}
+	}
+}
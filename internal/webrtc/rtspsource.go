@@ -0,0 +1,269 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/url"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func init() {
+	for _, scheme := range []string{"rtsp", "rtsps", "rtsp+http", "rtsp+https"} {
+		RegisterSource(scheme, newRTSPSource, func(rawURL string, sdp string) error {
+			return validateRTSPURL(rawURL)
+		})
+	}
+}
+
+// rtspSource reads a RTSP camera with gortsplib
+type rtspSource struct {
+	// RTSP URL, without the tunnel scheme
+	url     string
+	tunnel  string
+	options Options
+
+	mutex sync.Mutex
+	// described client, or not started yet if tracks is nil
+	client *gortsplib.Client
+	tracks gortsplib.Tracks
+	// client being described
+	connecting *gortsplib.Client
+	closed     bool
+	// transport chosen in the options, for the stats
+	transport string
+	// shared by the clients of the reconnections
+	bytesReceived uint64
+}
+
+func newRTSPSource(rawURL string, options Options) (Source, error) {
+	if err := validateRTSPURL(rawURL); err != nil {
+		return nil, err
+	}
+	tunnel, rtspURL := tunnelURL(rawURL)
+	if tunnel == "" && options.RTSPTransport == RTSPTransportHTTP {
+		tunnel = "http"
+	}
+	s := &rtspSource{url: rtspURL, tunnel: tunnel, options: options}
+
+	// check the options, the client is used by the first Describe
+	client, err := s.newClient()
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+// Describe connects and reads the tracks of the stream, the mutex is not
+// held while connecting so the source can be closed
+func (s *rtspSource) Describe() ([]SourceTrack, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("RTSP source closed")
+	}
+	c := s.client
+	if s.tracks != nil {
+		// a described client is not reused, the stream may have changed
+		c.Close()
+		c = nil
+	}
+	s.client = nil
+	s.tracks = nil
+	s.mutex.Unlock()
+
+	if c == nil {
+		var err error
+		c, err = s.newClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.BytesReceived = &s.bytesReceived
+	log.Printf("RTSP client %s: transport %s, read timeout %v, write timeout %v", RedactURLs(s.url), s.transport, c.ReadTimeout, c.WriteTimeout)
+
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the server
+	err = c.Start(u.Scheme, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.connecting = c
+	closed := s.closed
+	s.mutex.Unlock()
+	if closed {
+		c.Close()
+		return nil, fmt.Errorf("RTSP source closed")
+	}
+
+	// find published tracks
+	tracks, _, _, err := c.Describe(u)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connecting = nil
+	if err == nil && s.closed {
+		err = fmt.Errorf("RTSP source closed")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s.client = c
+	s.tracks = tracks
+
+	sourceTracks := make([]SourceTrack, len(tracks))
+	for i, track := range tracks {
+		sourceTracks[i] = rtspSourceTrack(track)
+	}
+	return sourceTracks, nil
+}
+
+// The codecs that can be forwarded to WebRTC
+func rtspSourceTrack(track gortsplib.Track) SourceTrack {
+	switch t := track.(type) {
+	case *gortsplib.TrackH264:
+		return SourceTrack{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SPS: t.SafeSPS(), PPS: t.SafePPS()}
+	case *gortsplib.TrackH265:
+		return SourceTrack{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, VPS: t.SafeVPS(), SPS: t.SafeSPS(), PPS: t.SafePPS()}
+	case *gortsplib.TrackPCMU:
+		return SourceTrack{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}
+	case *gortsplib.TrackPCMA:
+		return SourceTrack{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}
+	case *gortsplib.TrackOpus:
+		if t.SampleRate != 48000 {
+			log.Println("Skip camera opus track, unsupported sample rate:", t.SampleRate)
+			break
+		}
+		return SourceTrack{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	}
+	return SourceTrack{}
+}
+
+// Start sets up the tracks and plays the stream, the camera is described
+// again after an error
+func (s *rtspSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	s.mutex.Lock()
+	c, described := s.client, s.tracks
+	s.mutex.Unlock()
+	if described == nil {
+		if _, err := s.Describe(); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		c, described = s.client, s.tracks
+		s.mutex.Unlock()
+		if described == nil {
+			return fmt.Errorf("RTSP source closed")
+		}
+	}
+
+	// track ids follow the setup order
+	c.OnPacketRTP = func(p *gortsplib.ClientOnPacketRTPCtx) {
+		onRTP(p.TrackID, p.Packet)
+	}
+	if onRTCP != nil {
+		c.OnPacketRTCP = func(p *gortsplib.ClientOnPacketRTCPCtx) {
+			onRTCP(p.TrackID, p.Packet)
+		}
+	}
+
+	baseURL, err := url.Parse(s.url)
+	for _, i := range tracks {
+		if err != nil {
+			break
+		}
+		if i < 0 || i >= len(described) {
+			err = fmt.Errorf("RTSP track %d not found", i)
+			break
+		}
+		_, err = c.Setup(described[i], baseURL, 0, 0)
+	}
+	if err == nil {
+		_, err = c.Play(nil)
+	}
+	if err == nil {
+		err = c.Wait()
+	}
+
+	// the session is over, the next Start connects again
+	c.Close()
+	s.mutex.Lock()
+	if s.client == c {
+		s.client = nil
+		s.tracks = nil
+	}
+	s.mutex.Unlock()
+	return err
+}
+
+// RequestKeyframe pauses & plays the stream, most cameras start with an IDR
+func (s *rtspSource) RequestKeyframe() error {
+	s.mutex.Lock()
+	c := s.client
+	connected := s.tracks != nil
+	s.mutex.Unlock()
+	if !connected {
+		return fmt.Errorf("RTSP source not connected")
+	}
+	if _, err := c.Pause(); err != nil {
+		return err
+	}
+	_, err := c.Play(nil)
+	return err
+}
+
+func (s *rtspSource) WriteRTCP(track int, pkt rtcp.Packet) error {
+	s.mutex.Lock()
+	c := s.client
+	connected := s.tracks != nil
+	s.mutex.Unlock()
+	if !connected {
+		return nil
+	}
+	return c.WritePacketRTCP(track, pkt)
+}
+
+func (s *rtspSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.connecting != nil {
+		// Describe returns an error
+		s.connecting.Close()
+	}
+	if s.tracks == nil {
+		// not started
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	s.tracks = nil
+	return err
+}
+
+func (s *rtspSource) Stats() SourceStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return SourceStats{
+		Type:          "rtsp",
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		Details: map[string]interface{}{
+			"transport": s.transport,
+			"connected": s.tracks != nil,
+		},
+	}
+}
@@ -0,0 +1,385 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func init() {
+	RegisterSource("sdp", newSDPSource, validateSDPURL)
+}
+
+// sdpInlineHost is the URL host of the SDP given in Options.SDP
+const sdpInlineHost = "inline"
+
+// sdpMedia is the RTP & RTCP sockets of a media of the SDP
+type sdpMedia struct {
+	addr     *net.UDPAddr
+	rtcpPort int
+	rtp      *net.UDPConn
+	rtcp     *net.UDPConn
+
+	mutex sync.Mutex
+	// sender of the RTCP & SSRC of its stream, for the NACK & PLI
+	sender *net.UDPAddr
+	ssrc   uint32
+}
+
+// sdpSource receives plain RTP (ffmpeg, GStreamer) on the ports of a SDP:
+// sdp:///path/stream.sdp reads a file, sdp://inline uses Options.SDP. The
+// multicast connection addresses are joined, the others listen on all
+// interfaces. RTCP is on the a=rtcp port, else the next one.
+type sdpSource struct {
+	options Options
+	tracks  gortsplib.Tracks
+	medias  []*sdpMedia
+
+	mutex  sync.Mutex
+	bound  bool
+	closed bool
+	done   chan struct{}
+	// medias of the started tracks
+	started []*sdpMedia
+
+	bytesReceived uint64
+}
+
+func newSDPSource(rawURL string, options Options) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SDP URL: %v", err)
+	}
+
+	var description []byte
+	switch {
+	case u.Host == sdpInlineHost:
+		if options.SDP == "" {
+			// checked again with the client options
+			return &sdpSource{options: options, done: make(chan struct{})}, nil
+		}
+		description = []byte(options.SDP)
+	case u.Host+u.Path == "":
+		return nil, fmt.Errorf("SDP URL %s has no file", rawURL)
+	default:
+		path := u.Host + u.Path
+		// sdp:///C:/streams/a.sdp
+		if len(path) > 2 && path[0] == '/' && path[2] == ':' {
+			path = path[1:]
+		}
+		if description, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &sdpSource{options: options, done: make(chan struct{})}
+	if err := s.parse(description); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check a SDP URL, the inline SDP is parsed, the file is not read
+func validateSDPURL(rawURL string, sdp string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid SDP URL: %v", err)
+	}
+	switch {
+	case u.Host == sdpInlineHost:
+		if sdp == "" {
+			return fmt.Errorf("SDP URL %s needs the SDP of the client", rawURL)
+		}
+		return (&sdpSource{}).parse([]byte(sdp))
+	case u.Host+u.Path == "":
+		return fmt.Errorf("SDP URL %s has no file", rawURL)
+	}
+	return nil
+}
+
+// The tracks & addresses of the medias
+func (s *sdpSource) parse(description []byte) error {
+	// the line endings of a hand written file
+	if !strings.Contains(string(description), "\r\n") {
+		description = []byte(strings.ReplaceAll(string(description), "\n", "\r\n"))
+	}
+	var tracks gortsplib.Tracks
+	desc, err := tracks.Unmarshal(description, false)
+	if err != nil {
+		return fmt.Errorf("invalid SDP: %v", err)
+	}
+
+	for i, md := range desc.MediaDescriptions {
+		if md.MediaName.Port.Value <= 0 || md.MediaName.Port.Value > 65535 {
+			return fmt.Errorf("SDP media %d has no port", i+1)
+		}
+		m := &sdpMedia{addr: &net.UDPAddr{Port: md.MediaName.Port.Value}, rtcpPort: md.MediaName.Port.Value + 1}
+		connection := desc.ConnectionInformation
+		if md.ConnectionInformation != nil {
+			connection = md.ConnectionInformation
+		}
+		if connection != nil && connection.Address != nil {
+			// TTL & count suffixes of the multicast addresses
+			host := strings.Split(connection.Address.Address, "/")[0]
+			if ip := net.ParseIP(host); ip != nil && ip.IsMulticast() {
+				m.addr.IP = ip
+			}
+		}
+		if value, ok := md.Attribute("rtcp"); ok {
+			port, err := strconv.Atoi(strings.Fields(value + " ")[0])
+			if err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("SDP media %d has an invalid rtcp port %q", i+1, value)
+			}
+			m.rtcpPort = port
+		}
+		s.medias = append(s.medias, m)
+	}
+	s.tracks = tracks
+	return nil
+}
+
+func (s *sdpSource) readTimeout() time.Duration {
+	return rtspReadTimeout(s.options)
+}
+
+func listenSDPPort(ip net.IP, port int) (*net.UDPConn, error) {
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if ip != nil && ip.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+// Bind the ports of the medias
+func (s *sdpSource) bind() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("SDP source closed")
+	}
+	if s.bound {
+		return nil
+	}
+	for _, m := range s.medias {
+		var err error
+		if m.rtp, err = listenSDPPort(m.addr.IP, m.addr.Port); err == nil {
+			m.rtcp, err = listenSDPPort(m.addr.IP, m.rtcpPort)
+		}
+		if err != nil {
+			s.unbind()
+			return err
+		}
+		log.Printf("Listen to RTP on udp %s, RTCP on port %d", m.rtp.LocalAddr(), m.rtcpPort)
+	}
+	s.bound = true
+	return nil
+}
+
+func (s *sdpSource) unbind() {
+	for _, m := range s.medias {
+		if m.rtp != nil {
+			m.rtp.Close()
+			m.rtp = nil
+		}
+		if m.rtcp != nil {
+			m.rtcp.Close()
+			m.rtcp = nil
+		}
+	}
+	s.bound = false
+}
+
+// Describe binds the ports and returns the tracks of the SDP
+func (s *sdpSource) Describe() ([]SourceTrack, error) {
+	if s.tracks == nil {
+		if s.options.SDP == "" {
+			return nil, errors.New("no inline SDP in the options")
+		}
+		if err := s.parse([]byte(s.options.SDP)); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.bind(); err != nil {
+		return nil, err
+	}
+	tracks := make([]SourceTrack, len(s.tracks))
+	for i, track := range s.tracks {
+		tracks[i] = rtspSourceTrack(track)
+	}
+	return tracks, nil
+}
+
+// Start reads the RTP & RTCP of the selected tracks until no RTP is received
+// for the read timeout
+func (s *sdpSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	if _, err := s.Describe(); err != nil {
+		return err
+	}
+	for _, index := range tracks {
+		if index < 0 || index >= len(s.medias) {
+			return fmt.Errorf("SDP track %d not found", index)
+		}
+	}
+
+	started := make([]*sdpMedia, len(tracks))
+	for i, index := range tracks {
+		started[i] = s.medias[index]
+	}
+	s.mutex.Lock()
+	s.started = started
+	s.mutex.Unlock()
+
+	errs := make(chan error, 2*len(tracks))
+	for i, m := range started {
+		i, m := i, m
+		s.mutex.Lock()
+		rtpConn, rtcpConn := m.rtp, m.rtcp
+		s.mutex.Unlock()
+		if rtpConn == nil {
+			return errors.New("SDP source closed")
+		}
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				_ = rtpConn.SetReadDeadline(time.Now().Add(s.readTimeout()))
+				n, _, err := rtpConn.ReadFromUDP(buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				atomic.AddUint64(&s.bytesReceived, uint64(n))
+				pkt := &rtp.Packet{}
+				if err := pkt.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+					continue
+				}
+				m.mutex.Lock()
+				m.ssrc = pkt.SSRC
+				m.mutex.Unlock()
+				onRTP(i, pkt)
+			}
+		}()
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, sender, err := rtcpConn.ReadFromUDP(buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				m.mutex.Lock()
+				m.sender = sender
+				m.mutex.Unlock()
+				pkts, err := rtcp.Unmarshal(buf[:n])
+				if err != nil || onRTCP == nil {
+					continue
+				}
+				for _, pkt := range pkts {
+					onRTCP(i, pkt)
+				}
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-s.done:
+	}
+	// the readers end with the sockets, bound again by the next Start
+	s.mutex.Lock()
+	closed := s.closed
+	s.unbind()
+	s.mutex.Unlock()
+	if closed {
+		return errors.New("SDP source closed")
+	}
+	return fmt.Errorf("RTP stream stopped: %v", err)
+}
+
+// RequestKeyframe sends a PLI to the sender of the video RTCP
+func (s *sdpSource) RequestKeyframe() error {
+	for i, track := range s.tracks {
+		switch track.(type) {
+		case *gortsplib.TrackH264, *gortsplib.TrackH265:
+			m := s.medias[i]
+			m.mutex.Lock()
+			ssrc := m.ssrc
+			m.mutex.Unlock()
+			return s.writeRTCP(m, &rtcp.PictureLossIndication{MediaSSRC: ssrc})
+		}
+	}
+	return errors.New("no video track in the SDP")
+}
+
+// WriteRTCP sends the packet to the sender of the RTCP of the track
+func (s *sdpSource) WriteRTCP(track int, pkt rtcp.Packet) error {
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	if track < 0 || track >= len(started) {
+		return fmt.Errorf("SDP track %d not started", track)
+	}
+	return s.writeRTCP(started[track], pkt)
+}
+
+func (s *sdpSource) writeRTCP(m *sdpMedia, pkt rtcp.Packet) error {
+	m.mutex.Lock()
+	sender := m.sender
+	m.mutex.Unlock()
+	s.mutex.Lock()
+	conn := m.rtcp
+	s.mutex.Unlock()
+	if sender == nil || conn == nil {
+		return errors.New("no RTCP received from the RTP sender")
+	}
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteToUDP(data, sender)
+	return err
+}
+
+func (s *sdpSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.unbind()
+	return nil
+}
+
+func (s *sdpSource) Stats() SourceStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ports []int
+	for _, m := range s.medias {
+		ports = append(ports, m.addr.Port)
+	}
+	return SourceStats{
+		Type:          "sdp",
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		Details: map[string]interface{}{
+			"ports": ports,
+			"bound": s.bound,
+		},
+	}
+}
@@ -0,0 +1,235 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// The test camera sends RTP to an sdp:// source, described by testCameraSDP
+
+// SPS & PPS of the test camera, 320x240 Constrained Baseline 3.1
+const testSPropParameterSets = "Z0LAH9oFB+Q=,aM48gA=="
+
+// Find a free even UDP port followed by a free RTCP port
+func testUDPPort(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		if port%2 != 0 {
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1})
+		if err != nil {
+			continue
+		}
+		rtcp.Close()
+		return port
+	}
+	t.Fatal("no free UDP port")
+	return 0
+}
+
+func testCameraSDP(port int) string {
+	return "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=video " + strconv.Itoa(port) + " RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=" + testSPropParameterSets + "\r\n"
+}
+
+// The NALU of the frame n: an IDR every 25 frames, a single slice (first_mb
+// 0) with the frame number in the 2 bytes after the slice header byte
+func testFrame(n int, size int) []byte {
+	nalu := make([]byte, size)
+	nalu[0] = 0x41
+	if n%25 == 0 {
+		nalu[0] = 0x65
+	}
+	nalu[1] = 0x88
+	binary.BigEndian.PutUint16(nalu[2:4], uint16(n))
+	for i := 4; i < size; i++ {
+		nalu[i] = byte(n + i)
+	}
+	return nalu
+}
+
+// Frame number of a NALU built by `testFrame`
+func testFrameNumber(nalu []byte) int {
+	return int(binary.BigEndian.Uint16(nalu[2:4]))
+}
+
+// testCamera sends a frame every 20ms, in FU-A fragments over 1000 bytes
+type testCamera struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startTestCamera(t *testing.T, port int, frameSize int) *testCamera {
+	t.Helper()
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCamera{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		defer conn.Close()
+
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		var sequenceNumber uint16
+		for n := 0; ; n++ {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			nalu := testFrame(n, frameSize)
+			payloads := [][]byte{nalu}
+			if len(nalu) > 1000 {
+				payloads = nil
+			}
+			for i := 1; len(nalu) > 1000 && i < len(nalu); i += 1000 {
+				end := i + 1000
+				header := nalu[0] & 0x1F
+				if i == 1 {
+					header |= 0x80
+				}
+				if end >= len(nalu) {
+					end = len(nalu)
+					header |= 0x40
+				}
+				payloads = append(payloads, append([]byte{nalu[0]&0xE0 | 28, header}, nalu[i:end]...))
+			}
+			for i, payload := range payloads {
+				raw, _ := (&rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						Marker:         i == len(payloads)-1,
+						PayloadType:    96,
+						SequenceNumber: sequenceNumber,
+						Timestamp:      uint32(n * 1800),
+						SSRC:           0x1234,
+					},
+					Payload: payload,
+				}).Marshal()
+				sequenceNumber++
+				conn.Write(raw)
+			}
+		}
+	}()
+	return c
+}
+
+func (c *testCamera) close() {
+	close(c.stop)
+	<-c.done
+}
+
+// The inline & file SDP describe the H.264 track of the camera with its
+// parameter sets, the frames sent are received until the source is closed
+func TestSDPSource(t *testing.T) {
+	port := testUDPPort(t)
+	path := filepath.Join(t.TempDir(), "cam.sdp")
+	// a hand written file
+	if err := ioutil.WriteFile(path, []byte(strings.ReplaceAll(testCameraSDP(port), "\r\n", "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sps, pps := testParameterSets(t)
+
+	for _, rawURL := range []string{"sdp://inline", "sdp://" + filepath.ToSlash(path)} {
+		s, err := newSDPSource(rawURL, Options{SDP: testCameraSDP(port)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracks, err := s.Describe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tracks) != 1 || tracks[0].MimeType != webrtc.MimeTypeH264 || tracks[0].ClockRate != 90000 ||
+			string(tracks[0].SPS) != string(sps) || string(tracks[0].PPS) != string(pps) {
+			t.Fatalf("%s tracks %+v", rawURL, tracks)
+		}
+
+		frames := make(chan int, 100)
+		d := media.NewDepacketizer(media.CodecH264)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- s.Start([]int{0}, func(track int, pkt *rtp.Packet) {
+				aus, _ := d.Push(pkt)
+				for _, au := range aus {
+					nalu := au.NALUs[len(au.NALUs)-1]
+					n := testFrameNumber(nalu)
+					if string(nalu) != string(testFrame(n, 2500)) {
+						t.Errorf("frame %d is corrupted", n)
+					}
+					frames <- n
+				}
+			}, func(track int, pkt rtcp.Packet) {})
+		}()
+		camera := startTestCamera(t, port, 2500)
+		for i := 0; i < 3; i++ {
+			select {
+			case <-frames:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: no frame received", rawURL)
+			}
+		}
+		camera.close()
+		if stats := s.Stats(); stats.Type != "sdp" || stats.BytesReceived == 0 {
+			t.Fatalf("stats %+v", stats)
+		}
+
+		s.Close()
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatal("Start ended without error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Start does not return on Close")
+		}
+	}
+}
+
+func TestSDPSourceErrors(t *testing.T) {
+	for _, test := range []struct {
+		url string
+		sdp string
+	}{
+		{url: "sdp://"},
+		{url: "sdp://" + filepath.ToSlash(filepath.Join(t.TempDir(), "missing.sdp"))},
+		{url: "sdp://inline", sdp: "v=0\r\nm=video 0 RTP/AVP 96\r\n"},
+	} {
+		if _, err := newSDPSource(test.url, Options{SDP: test.sdp}); err == nil {
+			t.Errorf("%s %q is a valid SDP source", test.url, test.sdp)
+		}
+	}
+	// the inline SDP may be given with the client options
+	s, err := newSDPSource("sdp://inline", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Describe(); err == nil {
+		t.Fatal("described without inline SDP")
+	}
+}
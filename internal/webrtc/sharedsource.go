@@ -0,0 +1,370 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// max number of packets queued for a slow subscriber before they're dropped
+const sourceSubscriberQueueSize = 1024
+
+// sharedSource is a camera source pulled once for all the muxers publishing
+// it. It's started with all its forwardable tracks while a muxer is
+// started, and closed with its last muxer.
+type sharedSource struct {
+	key    string
+	source Source
+	// wait for the video parameter sets in the stream when the description
+	// has none
+	parameterSetsTimeout time.Duration
+
+	mutex       sync.Mutex
+	refs        int
+	tracks      []SourceTrack
+	subscribers map[*sourceSubscriber]struct{}
+	// started tracks of the running Start, closed done when it returns
+	started []int
+	done    chan struct{}
+	err     error
+	// reads the parameter sets of the video in the stream, nil if the
+	// description has them
+	inBand *inBandParameterSets
+}
+
+var (
+	sharedSourcesMutex sync.Mutex
+	sharedSources      = map[string]*sharedSource{}
+)
+
+// The options of the source itself, muxers with other ones use another source
+func sharedSourceKey(rawURL string, options Options) string {
+	return fmt.Sprintf("%s|%s|%d|%d|%s|%t|%s|%t|%s", rawURL,
+		options.RTSPTransport, options.RTSPReadTimeout, options.RTSPWriteTimeout, options.RTSPKeepalive,
+		options.RTSPAnyPort, options.RTSPCAFile, options.RTSPSkipVerify, options.SDP)
+}
+
+// Get a subscription to the shared source of a camera URL, created by its
+// first user. The subscription must be closed.
+func acquireSource(rawURL string, options Options) (Source, error) {
+	key := sharedSourceKey(rawURL, options)
+
+	sharedSourcesMutex.Lock()
+	defer sharedSourcesMutex.Unlock()
+
+	shared, ok := sharedSources[key]
+	if !ok {
+		source, err := newSource(rawURL, options)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedSource{
+			key:                  key,
+			source:               source,
+			parameterSetsTimeout: rtspReadTimeout(options),
+			subscribers:          make(map[*sourceSubscriber]struct{}),
+		}
+		sharedSources[key] = shared
+	} else {
+		log.Println("Share the camera source", RedactURLs(rawURL))
+	}
+	shared.mutex.Lock()
+	shared.refs++
+	shared.mutex.Unlock()
+	return &sourceSubscriber{
+		shared: shared,
+		queue:  make(chan func(), sourceSubscriberQueueSize),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (s *sharedSource) release() {
+	sharedSourcesMutex.Lock()
+	s.mutex.Lock()
+	s.refs--
+	last := s.refs == 0
+	s.mutex.Unlock()
+	if last {
+		delete(sharedSources, s.key)
+	}
+	sharedSourcesMutex.Unlock()
+
+	if last {
+		if err := s.source.Close(); err != nil {
+			log.Println("Close camera source failed", err)
+		}
+	}
+}
+
+// Describe the source once, for all the subscribers
+func (s *sharedSource) describe() ([]SourceTrack, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.tracks != nil {
+		return s.tracks, nil
+	}
+	tracks, err := s.source.Describe()
+	if err != nil {
+		return nil, err
+	}
+	s.tracks = tracks
+	return tracks, nil
+}
+
+// Describe the source, a video track without its parameter sets in the
+// description waits for them in the stream, until the timeout
+func (s *sharedSource) describeParameterSets() ([]SourceTrack, error) {
+	tracks, err := s.describe()
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	if s.inBand == nil {
+		if s.inBand = newInBandParameterSets(tracks); s.inBand == nil {
+			s.mutex.Unlock()
+			return tracks, nil
+		}
+		log.Printf("No %s parameter sets in the camera description, wait for them in the stream", tracks[s.inBand.track].MimeType)
+	}
+	inBand := s.inBand
+	s.mutex.Unlock()
+
+	stopped, err := s.run()
+	if err != nil {
+		return nil, err
+	}
+	err = inBand.wait(stopped, s.parameterSetsTimeout)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == errStoppedBeforeParameterSets {
+		return nil, fmt.Errorf("%v: %v", err, s.err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.tracks, nil
+}
+
+// The tracks a muxer can forward
+func forwardableTrack(track SourceTrack) bool {
+	switch track.MimeType {
+	case webrtc.MimeTypeH264, webrtc.MimeTypeH265, webrtc.MimeTypePCMU, webrtc.MimeTypePCMA, webrtc.MimeTypeOpus:
+		return true
+	}
+	return false
+}
+
+// Start the source if it's not running, returns the channel closed when it stops
+func (s *sharedSource) run() (chan struct{}, error) {
+	tracks, err := s.describe()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.done != nil {
+		return s.done, nil
+	}
+	var started []int
+	for i, track := range tracks {
+		if forwardableTrack(track) {
+			started = append(started, i)
+		}
+	}
+	s.started = started
+	done := make(chan struct{})
+	s.done = done
+	go func() {
+		err := s.source.Start(started, s.dispatchRTP, s.dispatchRTCP)
+		s.mutex.Lock()
+		s.err = err
+		s.done = nil
+		s.mutex.Unlock()
+		close(done)
+	}()
+	return done, nil
+}
+
+// Copy the packet of a started track to the subscribers of the track
+func (s *sharedSource) dispatchRTP(track int, pkt *rtp.Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.started[track]
+	if s.inBand != nil {
+		if tracks, ok := s.inBand.push(index, pkt); ok {
+			s.tracks = tracks
+			s.inBand = nil
+		}
+	}
+	for sub := range s.subscribers {
+		for position, subTrack := range sub.tracks {
+			if subTrack != index {
+				continue
+			}
+			// the muxers change the headers
+			out := &rtp.Packet{Header: pkt.Header.Clone(), Payload: pkt.Payload}
+			onRTP, position := sub.onRTP, position
+			sub.push(func() { onRTP(position, out) })
+		}
+	}
+}
+
+func (s *sharedSource) dispatchRTCP(track int, pkt rtcp.Packet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := s.started[track]
+	for sub := range s.subscribers {
+		if sub.onRTCP == nil {
+			continue
+		}
+		for position, subTrack := range sub.tracks {
+			if subTrack == index {
+				onRTCP, position := sub.onRTCP, position
+				sub.push(func() { onRTCP(position, pkt) })
+			}
+		}
+	}
+}
+
+// sourceSubscriber is the Source of a muxer, a subscription to a shared
+// source. Its packets are queued & delivered by the goroutine of its Start,
+// a slow or failed muxer doesn't hold the others back.
+type sourceSubscriber struct {
+	shared *sharedSource
+
+	// described track indexes of the running Start, set under the shared mutex
+	tracks []int
+	onRTP  func(track int, pkt *rtp.Packet)
+	onRTCP func(track int, pkt rtcp.Packet)
+
+	queue     chan func()
+	closed    chan struct{}
+	closeOnce sync.Once
+	dropped   uint64
+}
+
+func (sub *sourceSubscriber) push(deliver func()) {
+	select {
+	case sub.queue <- deliver:
+	default:
+		atomic.AddUint64(&sub.dropped, 1)
+	}
+}
+
+func (sub *sourceSubscriber) Describe() ([]SourceTrack, error) {
+	return sub.shared.describeParameterSets()
+}
+
+// Start subscribes to the tracks until the shared source stops or the
+// subscription is closed
+func (sub *sourceSubscriber) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	select {
+	case <-sub.closed:
+		return errors.New("camera source closed")
+	default:
+	}
+	done, err := sub.shared.run()
+	if err != nil {
+		return err
+	}
+
+	shared := sub.shared
+	shared.mutex.Lock()
+	for _, index := range tracks {
+		if index < 0 || index >= len(shared.tracks) || !forwardableTrack(shared.tracks[index]) {
+			shared.mutex.Unlock()
+			return fmt.Errorf("camera track %d can not be forwarded", index)
+		}
+	}
+	sub.tracks = append([]int(nil), tracks...)
+	sub.onRTP = onRTP
+	sub.onRTCP = onRTCP
+	shared.subscribers[sub] = struct{}{}
+	shared.mutex.Unlock()
+
+	defer func() {
+		shared.mutex.Lock()
+		delete(shared.subscribers, sub)
+		shared.mutex.Unlock()
+		// not delivered to the next Start
+		for len(sub.queue) > 0 {
+			<-sub.queue
+		}
+	}()
+	for {
+		select {
+		case deliver := <-sub.queue:
+			deliver()
+		case <-done:
+			shared.mutex.Lock()
+			err := shared.err
+			shared.mutex.Unlock()
+			return err
+		case <-sub.closed:
+			return errors.New("camera source closed")
+		}
+	}
+}
+
+func (sub *sourceSubscriber) RequestKeyframe() error {
+	return sub.shared.source.RequestKeyframe()
+}
+
+// WriteRTCP sends the packet about a subscribed track with its index in the
+// shared source tracks
+func (sub *sourceSubscriber) WriteRTCP(track int, pkt rtcp.Packet) error {
+	shared := sub.shared
+	shared.mutex.Lock()
+	if track < 0 || track >= len(sub.tracks) {
+		shared.mutex.Unlock()
+		return fmt.Errorf("camera track %d not started", track)
+	}
+	index := sub.tracks[track]
+	started := -1
+	for i, startedTrack := range shared.started {
+		if startedTrack == index {
+			started = i
+		}
+	}
+	shared.mutex.Unlock()
+	if started < 0 {
+		return fmt.Errorf("camera track %d not started", track)
+	}
+	return shared.source.WriteRTCP(started, pkt)
+}
+
+// Close ends the subscription, the shared source is closed with the last one
+func (sub *sourceSubscriber) Close() error {
+	sub.closeOnce.Do(func() {
+		close(sub.closed)
+		sub.shared.release()
+	})
+	return nil
+}
+
+func (sub *sourceSubscriber) Stats() SourceStats {
+	stats := sub.shared.source.Stats()
+	details := make(map[string]interface{}, len(stats.Details)+2)
+	for k, v := range stats.Details {
+		details[k] = v
+	}
+	sub.shared.mutex.Lock()
+	details["subscribers"] = sub.shared.refs
+	sub.shared.mutex.Unlock()
+	details["dropped"] = atomic.LoadUint64(&sub.dropped)
+	stats.Details = details
+	return stats
+}
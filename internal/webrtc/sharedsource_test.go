@@ -0,0 +1,130 @@
+package webrtc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// testSource describes a H.264 track without parameter sets and sends the
+// frames, with the SPS & PPS in a STAP-A before the IDRs if inBand
+type testSource struct {
+	inBand bool
+	closed chan struct{}
+	once   sync.Once
+	// number of Start calls, the camera sessions
+	starts int32
+}
+
+var (
+	testSourcesMutex sync.Mutex
+	testSources      = map[string]*testSource{}
+)
+
+func init() {
+	RegisterSource("test", func(rawURL string, options Options) (Source, error) {
+		testSourcesMutex.Lock()
+		defer testSourcesMutex.Unlock()
+		s, ok := testSources[rawURL]
+		if !ok {
+			return nil, errors.New("unknown test source")
+		}
+		return s, nil
+	}, nil)
+}
+
+func newTestSource(t *testing.T, inBand bool) string {
+	rawURL := "test://" + strings.ReplaceAll(t.Name(), "/", "-")
+	testSourcesMutex.Lock()
+	testSources[rawURL] = &testSource{inBand: inBand, closed: make(chan struct{})}
+	testSourcesMutex.Unlock()
+	return rawURL
+}
+
+func (s *testSource) Describe() ([]SourceTrack, error) {
+	return []SourceTrack{{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}}, nil
+}
+
+func (s *testSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	atomic.AddInt32(&s.starts, 1)
+	sets := strings.Split(testSPropParameterSets, ",")
+	sps, _ := base64.StdEncoding.DecodeString(sets[0])
+	pps, _ := base64.StdEncoding.DecodeString(sets[1])
+	var sequenceNumber uint16
+	for n := 0; ; n++ {
+		select {
+		case <-s.closed:
+			return errors.New("test source closed")
+		case <-time.After(20 * time.Millisecond):
+		}
+		frame := testFrame(n, 500)
+		if s.inBand && frame[0]&0x1F == 5 {
+			stapA := []byte{24, byte(len(sps) >> 8), byte(len(sps))}
+			stapA = append(append(stapA, sps...), byte(len(pps)>>8), byte(len(pps)))
+			onRTP(0, &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: sequenceNumber, Timestamp: uint32(n * 3600)}, Payload: append(stapA, pps...)})
+			sequenceNumber++
+		}
+		onRTP(0, &rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, SequenceNumber: sequenceNumber, Timestamp: uint32(n * 3600)}, Payload: frame})
+		sequenceNumber++
+	}
+}
+
+func (s *testSource) RequestKeyframe() error                     { return nil }
+func (s *testSource) WriteRTCP(track int, pkt rtcp.Packet) error { return nil }
+func (s *testSource) Stats() SourceStats                         { return SourceStats{Type: "test"} }
+
+func (s *testSource) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+// The SPS & PPS missing in the description are read in the stream
+func TestSharedSourceInBandParameterSets(t *testing.T) {
+	source, err := acquireSource(newTestSource(t, true), Options{RTSPReadTimeout: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	tracks, err := source.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sps, pps := testParameterSets(t)
+	if !bytes.Equal(tracks[0].SPS, sps) || !bytes.Equal(tracks[0].PPS, pps) {
+		t.Fatalf("tracks %+v", tracks)
+	}
+	capability, err := videoCodecCapability(tracks[0])
+	if err != nil || !strings.Contains(capability.SDPFmtpLine, "profile-level-id=42c01f") {
+		t.Fatalf("fmtp %s, %v", capability.SDPFmtpLine, err)
+	}
+}
+
+// No default profile is advertised when the stream has no SPS either
+func TestSharedSourceNoParameterSets(t *testing.T) {
+	source, err := acquireSource(newTestSource(t, false), Options{RTSPReadTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	begin := time.Now()
+	if tracks, err := source.Describe(); err == nil {
+		t.Fatalf("tracks %+v without parameter sets", tracks)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Fatalf("Describe failed after %v, want the 1s timeout", elapsed)
+	}
+	if _, err := videoCodecCapability(SourceTrack{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}); err == nil {
+		t.Fatal("fmtp without the SPS")
+	}
+}
@@ -0,0 +1,130 @@
+package webrtc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// SourceTrack is a track of a camera stream
+type SourceTrack struct {
+	// MimeType is the WebRTC codec of the track (video/H264, video/H265,
+	// audio/PCMU, audio/PCMA or audio/opus), empty if it can not be forwarded
+	MimeType  string
+	ClockRate uint32
+	Channels  uint16
+	// VPS, SPS & PPS are the video parameter sets known before the stream starts
+	VPS []byte
+	SPS []byte
+	PPS []byte
+}
+
+// SourceStats are the counters of a camera source
+type SourceStats struct {
+	RID           string `json:"rid,omitempty"`
+	Type          string `json:"type"`
+	BytesReceived uint64 `json:"bytes_received"`
+	// Details are the source specific states
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Source is a camera stream ingest, chosen by the scheme of the camera URL
+type Source interface {
+	// Describe connects to the camera and returns its tracks
+	Describe() ([]SourceTrack, error)
+	// Start delivers the packets of the selected tracks (indexes of the
+	// described tracks) until the stream ends or the source is closed. The
+	// track of the callbacks is the index in tracks, onRTCP may be nil.
+	// Start blocks, it can be called again after an error to reconnect.
+	// It returns io.EOF when the stream has ended, it is not reconnected.
+	Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error
+	// RequestKeyframe makes the camera send a keyframe, if the source can
+	RequestKeyframe() error
+	// WriteRTCP sends a RTCP packet (e.g. a NACK) about a track (index in the
+	// started tracks) to the camera
+	WriteRTCP(track int, pkt rtcp.Packet) error
+	// Close stops the source, a blocked Start returns
+	Close() error
+	// Stats returns the source counters
+	Stats() SourceStats
+}
+
+// SourceFactory creates the Source of a camera URL. It checks the URL and
+// the options but must not connect, that's done by Describe.
+type SourceFactory func(rawURL string, options Options) (Source, error)
+
+// SourceValidator checks a camera URL without side effect: nothing is
+// connected, opened or read. sdp is the SDP given with the camera.
+type SourceValidator func(rawURL string, sdp string) error
+
+var (
+	sourcesMutex     sync.RWMutex
+	sourceFactories  = map[string]SourceFactory{}
+	sourceValidators = map[string]SourceValidator{}
+)
+
+// RegisterSource makes the camera URLs of a scheme use the sources of a
+// factory, they're checked by validate before, if not nil
+func RegisterSource(scheme string, factory SourceFactory, validate SourceValidator) {
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+
+	sourceFactories[strings.ToLower(scheme)] = factory
+	sourceValidators[strings.ToLower(scheme)] = validate
+}
+
+// The lower case scheme of a camera URL
+func cameraURLScheme(rawURL string) (string, error) {
+	i := strings.Index(rawURL, "://")
+	if i <= 0 {
+		return "", fmt.Errorf("camera URL %s has no scheme", RedactURLs(rawURL))
+	}
+	return strings.ToLower(rawURL[:i]), nil
+}
+
+// Create the source of a camera URL from the factory of its scheme
+func newSource(rawURL string, options Options) (Source, error) {
+	scheme, err := cameraURLScheme(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sourcesMutex.RLock()
+	factory, ok := sourceFactories[scheme]
+	sourcesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported camera URL scheme %q", scheme)
+	}
+	return factory(rawURL, options)
+}
+
+// ValidateCameraURL checks a camera URL has a supported scheme and is valid
+// for its source, sdp is the SDP of the client (sdp://inline). No source is
+// created. The returned error does not contain the credentials.
+func ValidateCameraURL(rawURL string, sdp string) error {
+	scheme, err := cameraURLScheme(rawURL)
+	if err != nil {
+		return err
+	}
+
+	sourcesMutex.RLock()
+	_, ok := sourceFactories[scheme]
+	validate := sourceValidators[scheme]
+	sourcesMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("unsupported camera URL scheme %q", scheme)
+	}
+	if validate == nil {
+		return nil
+	}
+	return validate(rawURL, sdp)
+}
+
+// IsPushURL tells if the camera of a URL is an encoder pushing to the
+// embedded server, its Describe waits for the encoder to publish
+func IsPushURL(rawURL string) bool {
+	return strings.HasPrefix(strings.ToLower(rawURL), "rtmp://")
+}
@@ -0,0 +1,140 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+)
+
+// Stats of a muxer
+type Stats struct {
+	KeyframeRequests KeyframeRequestStats `json:"keyframe_requests"`
+	// StreamSwitch is set when the camera streams are switched adaptively
+	StreamSwitch *StreamSwitchStats `json:"stream_switch,omitempty"`
+	// Bandwidth is set when the congestion control is enabled
+	Bandwidth *BandwidthStats `json:"bandwidth,omitempty"`
+	// Pacers are the counters of the paced video tracks
+	Pacers []PacerTrackStats `json:"pacers,omitempty"`
+	// Camera are the counters of the RTSP tracks (camera leg)
+	Camera []CameraTrackStats `json:"camera"`
+	// Sources are the counters of the camera sources, one per layer
+	Sources []SourceStats `json:"sources"`
+	// WebRTC is the video loss reported by Janus (WebRTC leg)
+	WebRTC WebRTCLegStats `json:"webrtc"`
+	// Viewers is the number of WHEP preview viewers
+	Viewers int `json:"viewers"`
+	// Recording is set while the camera is recorded
+	Recording *RecordingStats `json:"recording,omitempty"`
+}
+
+// CameraTrackStats are the counters of a RTSP track
+type CameraTrackStats struct {
+	RID   string `json:"rid,omitempty"`
+	Track int    `json:"track"`
+	Media string `json:"media"`
+	media.ReorderStats
+	// WriteErrors is the number of packets that failed to be forwarded
+	WriteErrors uint64 `json:"write_errors"`
+}
+
+// PacerTrackStats are the counters of the pacer of a video track, the RID
+// is empty for the output of the stream switcher
+type PacerTrackStats struct {
+	RID string `json:"rid,omitempty"`
+	media.PacerStats
+}
+
+// WebRTCLegStats are taken from the receiver reports of Janus
+type WebRTCLegStats struct {
+	// Lost is the cumulative number of packets lost
+	Lost uint32 `json:"lost"`
+	// FractionLost is the loss of the last report interval, in 1/256
+	FractionLost uint32 `json:"fraction_lost"`
+}
+
+// KeyframeRequestStats counts the keyframe requests received from Janus
+// and how they were answered
+type KeyframeRequestStats struct {
+	// PLI is the number of picture loss indications received
+	PLI uint64 `json:"pli"`
+	// FIR is the number of full intra requests received
+	FIR uint64 `json:"fir"`
+	// GOPResent is the number of requests answered from the GOP cache
+	GOPResent uint64 `json:"gop_resent"`
+	// Replays is the number of RTSP PLAY restarts
+	Replays uint64 `json:"replays"`
+	// Throttled is the number of requests ignored because they came too fast
+	Throttled uint64 `json:"throttled"`
+}
+
+// Keep the loss of the video reported by Janus, the report blocks of the
+// other streams (audio, retransmissions) are skipped
+func (element *Muxer) webrtcReceiverReport(rr *rtcp.ReceiverReport, f *rtspForward) {
+	ssrc := uint32(f.ssrc())
+	for _, report := range rr.Reports {
+		if report.SSRC != ssrc {
+			continue
+		}
+		atomic.StoreUint32(&element.webrtcLost, report.TotalLost)
+		atomic.StoreUint32(&element.webrtcFractionLost, uint32(report.FractionLost))
+	}
+}
+
+// Stats returns the muxer counters
+func (element *Muxer) Stats() Stats {
+	stats := Stats{
+		KeyframeRequests: KeyframeRequestStats{
+			PLI:       atomic.LoadUint64(&element.keyframeStats.PLI),
+			FIR:       atomic.LoadUint64(&element.keyframeStats.FIR),
+			GOPResent: atomic.LoadUint64(&element.keyframeStats.GOPResent),
+			Replays:   atomic.LoadUint64(&element.keyframeStats.Replays),
+			Throttled: atomic.LoadUint64(&element.keyframeStats.Throttled),
+		},
+	}
+	if element.switcher != nil {
+		switchStats := element.switcher.stats()
+		stats.StreamSwitch = &switchStats
+	}
+	for _, layer := range element.layers {
+		sourceStats := layer.source.Stats()
+		sourceStats.RID = layer.rid
+		stats.Sources = append(stats.Sources, sourceStats)
+		for trackID, f := range layer.forwards {
+			if f.reorder == nil {
+				continue
+			}
+			track := CameraTrackStats{
+				RID:          layer.rid,
+				Track:        trackID,
+				Media:        "audio",
+				ReorderStats: f.reorder.Stats(),
+				WriteErrors:  atomic.LoadUint64(&f.writeErrors),
+			}
+			if f.repacketizer != nil {
+				track.Media = "video"
+			}
+			stats.Camera = append(stats.Camera, track)
+		}
+	}
+	stats.Viewers = element.Viewers()
+	stats.Recording = element.Recording()
+	stats.WebRTC = WebRTCLegStats{
+		Lost:         atomic.LoadUint32(&element.webrtcLost),
+		FractionLost: atomic.LoadUint32(&element.webrtcFractionLost),
+	}
+	for _, f := range element.pacedForwards() {
+		pacerStats := PacerTrackStats{PacerStats: f.pacer.Stats()}
+		if f.layer != nil {
+			pacerStats.RID = f.layer.rid
+		}
+		stats.Pacers = append(stats.Pacers, pacerStats)
+	}
+	if element.estimator != nil {
+		stats.Bandwidth = &BandwidthStats{
+			TargetBitrate: element.estimator.GetTargetBitrate(),
+			Details:       element.estimator.GetStats(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,358 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// Adaptive stream switching, the hold times give the hysteresis
+const (
+	// switch down when the estimate stays under the active stream bitrate this long
+	switchDownHold = 2 * time.Second
+	// switch up when the estimate stays over the upper stream bitrate this long,
+	// and no congestion was reported meanwhile
+	switchUpHold = 10 * time.Second
+	// estimate headroom over the upper stream bitrate needed to switch up, in percent
+	switchUpHeadroom = 130
+	// lost packets in the transport-cc feedback (percent) handled as a congestion
+	switchLossThreshold = 10
+	// window of the stream bitrate & transport-cc loss measures
+	switchMeasureWindow = time.Second
+	// max number of switches kept in the history
+	switchHistorySize = 20
+)
+
+// StreamSwitch is a switch between two camera streams
+type StreamSwitch struct {
+	Time   time.Time `json:"time"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	// Estimate is the bandwidth estimate (bps) when the switch was decided
+	Estimate uint64 `json:"estimate"`
+}
+
+// StreamSwitchStats is the state of the adaptive stream switching
+type StreamSwitchStats struct {
+	// Active is the RID of the stream sent
+	Active string `json:"active"`
+	// Pending is the RID of the stream sent from its next keyframe
+	Pending string `json:"pending,omitempty"`
+	// Estimate is the latest bandwidth estimate (bps)
+	Estimate uint64 `json:"estimate"`
+	// Bitrates are the measured bitrates (bps) of the streams
+	Bitrates map[string]uint64 `json:"bitrates"`
+	History  []StreamSwitch    `json:"history"`
+}
+
+// streamSwitcher writes one of the camera streams to a single video track,
+// the output keeps its SSRC, sequence numbers & timestamps across switches
+type streamSwitcher struct {
+	output *rtspForward
+	layers []*rtspLayer
+	codec  media.Codec
+	// asks the camera for a keyframe on the pending stream
+	requestKeyframe func(layer *rtspLayer)
+
+	mutex         sync.Mutex
+	active        int
+	pending       int
+	pendingReason string
+	lastWrite     time.Time
+	lastSwitch    time.Time
+
+	// latest estimate of each source (REMB, GCC), the lowest one is used
+	estimates      map[string]uint64
+	estimate       uint64
+	direction      int
+	directionSince time.Time
+	lastCongestion time.Time
+
+	// stream bitrates
+	bitrates    []uint64
+	octets      []uint64
+	windowStart []time.Time
+
+	// transport-cc feedback packet status
+	feedbackTotal int
+	feedbackLost  int
+	feedbackStart time.Time
+
+	history []StreamSwitch
+}
+
+func newStreamSwitcher(layers []*rtspLayer, codec media.Codec, requestKeyframe func(layer *rtspLayer)) *streamSwitcher {
+	return &streamSwitcher{
+		layers:          layers,
+		codec:           codec,
+		requestKeyframe: requestKeyframe,
+		pending:         -1,
+		estimates:       make(map[string]uint64),
+		bitrates:        make([]uint64, len(layers)),
+		octets:          make([]uint64, len(layers)),
+		windowStart:     make([]time.Time, len(layers)),
+	}
+}
+
+func (s *streamSwitcher) layerIndex(layer *rtspLayer) int {
+	for i, l := range s.layers {
+		if l == layer {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *streamSwitcher) activeLayer() *rtspLayer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.layers[s.active]
+}
+
+// Write the repacketized access units of a camera stream, the pending stream
+// replaces the active one at its first keyframe
+func (s *streamSwitcher) write(layer *rtspLayer, pkts []*rtp.Packet) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.layerIndex(layer)
+	for _, pkt := range pkts {
+		s.measure(i, len(pkt.Payload))
+	}
+	if s.output == nil {
+		return nil
+	}
+
+	for start := 0; start < len(pkts); {
+		end := start + 1
+		for end < len(pkts) && pkts[end].Timestamp == pkts[start].Timestamp {
+			end++
+		}
+		au := pkts[start:end]
+		start = end
+
+		if i == s.pending && s.keyframe(au) {
+			s.switchLocked(au[0].Timestamp)
+		}
+		if i != s.active {
+			continue
+		}
+		for _, pkt := range au {
+			if err := s.output.write(pkt); err != nil {
+				return err
+			}
+		}
+		s.lastWrite = time.Now()
+	}
+	return nil
+}
+
+func (s *streamSwitcher) keyframe(au []*rtp.Packet) bool {
+	for _, pkt := range au {
+		if media.IsKeyframePacket(s.codec, pkt.Payload) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *streamSwitcher) switchLocked(timestamp uint32) {
+	// the new stream starts after the wall clock time elapsed since the last frame
+	delta := uint32(1)
+	if !s.lastWrite.IsZero() {
+		if elapsed := uint32(time.Since(s.lastWrite) * 90000 / time.Second); elapsed > delta {
+			delta = elapsed
+		}
+	}
+	s.output.rebase(timestamp, delta, s.layers[s.pending].forwards[0].gop)
+
+	entry := StreamSwitch{
+		Time:     time.Now(),
+		From:     s.layers[s.active].rid,
+		To:       s.layers[s.pending].rid,
+		Reason:   s.pendingReason,
+		Estimate: s.estimate,
+	}
+	s.history = append(s.history, entry)
+	if len(s.history) > switchHistorySize {
+		s.history = s.history[len(s.history)-switchHistorySize:]
+	}
+	log.Printf("Switched camera stream %s -> %s (%s)", entry.From, entry.To, entry.Reason)
+
+	s.active = s.pending
+	s.pending = -1
+	s.lastSwitch = entry.Time
+	s.direction = 0
+}
+
+// Measure the bitrate of a camera stream
+func (s *streamSwitcher) measure(i int, octets int) {
+	now := time.Now()
+	if s.windowStart[i].IsZero() {
+		s.windowStart[i] = now
+	}
+	s.octets[i] += uint64(octets)
+
+	elapsed := now.Sub(s.windowStart[i])
+	if elapsed < switchMeasureWindow {
+		return
+	}
+	bitrate := s.octets[i] * 8 * uint64(time.Second) / uint64(elapsed)
+	if s.bitrates[i] == 0 {
+		s.bitrates[i] = bitrate
+	} else {
+		s.bitrates[i] = (s.bitrates[i]*3 + bitrate) / 4
+	}
+	s.octets[i] = 0
+	s.windowStart[i] = now
+}
+
+// Switch to another stream from its next keyframe
+func (s *streamSwitcher) requestLocked(to int, reason string) {
+	if to == s.pending {
+		return
+	}
+	s.pending = to
+	s.pendingReason = reason
+	log.Printf("Switching camera stream %s -> %s at next keyframe (%s)", s.layers[s.active].rid, s.layers[to].rid, reason)
+
+	if s.requestKeyframe != nil {
+		go s.requestKeyframe(s.layers[to])
+	}
+}
+
+// Handle a bandwidth estimate (REMB, GCC)
+func (s *streamSwitcher) onEstimate(estimate uint64, source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.estimates[source] = estimate
+	bitrate := estimate
+	for name, e := range s.estimates {
+		if e < bitrate {
+			bitrate, source = e, name
+		}
+	}
+	s.estimate = bitrate
+	now := time.Now()
+
+	direction := 0
+	if s.active+1 < len(s.layers) && s.bitrates[s.active] > 0 && bitrate < s.bitrates[s.active] {
+		direction = 1
+	} else if s.active > 0 && s.bitrates[s.active-1] > 0 && bitrate > s.bitrates[s.active-1]*switchUpHeadroom/100 &&
+		now.Sub(s.lastCongestion) >= switchUpHold {
+		direction = -1
+	}
+	if direction != s.direction {
+		s.direction = direction
+		s.directionSince = now
+	}
+
+	switch {
+	case direction == 0:
+		// a switch down on congestion is kept
+		if s.pending >= 0 && now.Sub(s.lastCongestion) >= switchUpHold {
+			log.Printf("Camera stream switch to %s canceled, estimate %d bps", s.layers[s.pending].rid, bitrate)
+			s.pending = -1
+		}
+	case direction > 0 && now.Sub(s.directionSince) >= switchDownHold:
+		s.requestLocked(s.active+1, fmt.Sprintf("%s %d bps < %d bps", source, bitrate, s.bitrates[s.active]))
+	case direction < 0 && now.Sub(s.directionSince) >= switchUpHold:
+		s.requestLocked(s.active-1, fmt.Sprintf("%s %d bps > %d bps", source, bitrate, s.bitrates[s.active-1]))
+	}
+}
+
+// Handle a congestion signal (Janus slowlink, transport-cc losses),
+// switch down right away
+func (s *streamSwitcher) onCongestion(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastCongestion = time.Now()
+	if s.active+1 >= len(s.layers) || time.Since(s.lastSwitch) < switchDownHold {
+		return
+	}
+	s.requestLocked(s.active+1, reason)
+}
+
+// Count the lost packets reported by the transport-cc feedback
+func (s *streamSwitcher) onTransportFeedback(pkt *rtcp.TransportLayerCC) {
+	lost, total := 0, 0
+	count := func(symbol uint16, n int) {
+		if remaining := int(pkt.PacketStatusCount) - total; n > remaining {
+			n = remaining
+		}
+		total += n
+		if symbol == rtcp.TypeTCCPacketNotReceived {
+			lost += n
+		}
+	}
+	for _, chunk := range pkt.PacketChunks {
+		switch chunk := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			count(chunk.PacketStatusSymbol, int(chunk.RunLength))
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range chunk.SymbolList {
+				count(symbol, 1)
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	now := time.Now()
+	if s.feedbackStart.IsZero() {
+		s.feedbackStart = now
+	}
+	s.feedbackTotal += total
+	s.feedbackLost += lost
+	congested := false
+	if now.Sub(s.feedbackStart) >= switchMeasureWindow {
+		congested = s.feedbackTotal > 0 && s.feedbackLost*100/s.feedbackTotal >= switchLossThreshold
+		lost, total = s.feedbackLost, s.feedbackTotal
+		s.feedbackTotal, s.feedbackLost = 0, 0
+		s.feedbackStart = now
+	}
+	s.mutex.Unlock()
+
+	if congested {
+		s.onCongestion(fmt.Sprintf("transport-cc lost %d/%d", lost, total))
+	}
+}
+
+// Translate the sender reports of the active stream only
+func (s *streamSwitcher) senderReport(layer *rtspLayer, sr *rtcp.SenderReport) *rtcp.SenderReport {
+	s.mutex.Lock()
+	active := s.layers[s.active] == layer
+	s.mutex.Unlock()
+
+	if !active || s.output == nil {
+		return nil
+	}
+	return s.output.senderReport(sr)
+}
+
+func (s *streamSwitcher) stats() StreamSwitchStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := StreamSwitchStats{
+		Active:   s.layers[s.active].rid,
+		Estimate: s.estimate,
+		Bitrates: make(map[string]uint64),
+		History:  append([]StreamSwitch(nil), s.history...),
+	}
+	if s.pending >= 0 {
+		stats.Pending = s.layers[s.pending].rid
+	}
+	for i, layer := range s.layers {
+		stats.Bitrates[layer.rid] = s.bitrates[i]
+	}
+	return stats
+}
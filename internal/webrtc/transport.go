@@ -0,0 +1,156 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/aler9/gortsplib/pkg/headers"
+)
+
+// How the RTSP stream is received
+const (
+	// RTSPTransportAuto tries UDP, then TCP if no packet is received
+	RTSPTransportAuto = "auto"
+	// RTSPTransportUDP receives the packets on UDP ports
+	RTSPTransportUDP = "udp"
+	// RTSPTransportMulticast joins the multicast group of the camera
+	RTSPTransportMulticast = "udp_multicast"
+	// RTSPTransportTCP interleaves the packets in the RTSP connection, works behind NAT
+	RTSPTransportTCP = "tcp"
+	// RTSPTransportHTTP interleaves the packets in a RTSP connection tunneled over
+	// HTTP, to the port of the URL (80 by default)
+	RTSPTransportHTTP = "http"
+)
+
+// Request sent to keep the RTSP session alive
+const (
+	// RTSPKeepaliveAuto sends GET_PARAMETER if the camera supports it, else OPTIONS
+	RTSPKeepaliveAuto = "auto"
+	// RTSPKeepaliveOptions always sends OPTIONS
+	RTSPKeepaliveOptions = "options"
+	// RTSPKeepaliveGetParameter always sends GET_PARAMETER
+	RTSPKeepaliveGetParameter = "get_parameter"
+)
+
+// RTSP timeouts used when not set in the options
+const (
+	defaultRTSPReadTimeout  = 10 * time.Second
+	defaultRTSPWriteTimeout = 10 * time.Second
+)
+
+// The read timeout of the camera sources
+func rtspReadTimeout(options Options) time.Duration {
+	if options.RTSPReadTimeout > 0 {
+		return time.Duration(options.RTSPReadTimeout) * time.Second
+	}
+	return defaultRTSPReadTimeout
+}
+
+// Create the RTSP client of the camera stream from the options
+func (s *rtspSource) newClient() (*gortsplib.Client, error) {
+	c := &gortsplib.Client{
+		UserAgent:     "RTSPSender",
+		ReadTimeout:   defaultRTSPReadTimeout,
+		WriteTimeout:  defaultRTSPWriteTimeout,
+		AnyPortEnable: s.options.RTSPAnyPort,
+	}
+	tlsConfig, err := rtspTLSConfig(s.options)
+	if err != nil {
+		return nil, err
+	}
+	c.TLSConfig = tlsConfig
+	if s.options.RTSPReadTimeout > 0 {
+		c.ReadTimeout = time.Duration(s.options.RTSPReadTimeout) * time.Second
+	}
+	if s.options.RTSPWriteTimeout > 0 {
+		c.WriteTimeout = time.Duration(s.options.RTSPWriteTimeout) * time.Second
+	}
+
+	var transport gortsplib.Transport
+	switch s.options.RTSPTransport {
+	case "", RTSPTransportAuto:
+	case RTSPTransportUDP:
+		transport = gortsplib.TransportUDP
+		c.Transport = &transport
+	case RTSPTransportMulticast:
+		transport = gortsplib.TransportUDPMulticast
+		c.Transport = &transport
+	case RTSPTransportTCP, RTSPTransportHTTP:
+		transport = gortsplib.TransportTCP
+		c.Transport = &transport
+	default:
+		return nil, fmt.Errorf("unknown RTSP transport %q", s.options.RTSPTransport)
+	}
+
+	transportName := s.options.RTSPTransport
+	if transportName == "" {
+		transportName = RTSPTransportAuto
+	}
+	if s.tunnel != "" {
+		// only the interleaved packets go through the tunnel
+		transport = gortsplib.TransportTCP
+		c.Transport = &transport
+		dial, err := s.tunnelDialer()
+		if err != nil {
+			return nil, err
+		}
+		c.DialContext = dial
+		transportName = s.tunnel + " tunnel"
+	}
+
+	keepalive := s.options.RTSPKeepalive
+	switch keepalive {
+	case "", RTSPKeepaliveAuto, RTSPKeepaliveOptions, RTSPKeepaliveGetParameter:
+	default:
+		return nil, fmt.Errorf("unknown RTSP keepalive %q", keepalive)
+	}
+
+	// the transport of each track, auto falls back to TCP with a new setup
+	c.OnRequest = func(req *base.Request) {
+		if req.Method != base.Setup {
+			return
+		}
+		var th headers.Transport
+		if err := th.Unmarshal(req.Header["Transport"]); err != nil {
+			return
+		}
+		label := gortsplib.TransportUDP
+		if th.Protocol == headers.TransportProtocolTCP {
+			label = gortsplib.TransportTCP
+		} else if th.Delivery != nil && *th.Delivery == headers.TransportDeliveryMulticast {
+			label = gortsplib.TransportUDPMulticast
+		}
+		log.Printf("RTSP transport of %s: %s", req.URL.CloneWithoutCredentials(), label)
+	}
+
+	// gortsplib keeps the session alive with GET_PARAMETER if the OPTIONS
+	// response lists it, else with OPTIONS
+	if keepalive == RTSPKeepaliveOptions || keepalive == RTSPKeepaliveGetParameter {
+		c.OnResponse = func(res *base.Response) {
+			public, ok := res.Header["Public"]
+			if !ok || len(public) != 1 {
+				if keepalive == RTSPKeepaliveGetParameter && res.StatusCode == base.StatusOK {
+					res.Header["Public"] = base.HeaderValue{string(base.GetParameter)}
+				}
+				return
+			}
+			var methods []string
+			for _, m := range strings.Split(public[0], ",") {
+				if m = strings.TrimSpace(m); m != "" && base.Method(m) != base.GetParameter {
+					methods = append(methods, m)
+				}
+			}
+			if keepalive == RTSPKeepaliveGetParameter {
+				methods = append(methods, string(base.GetParameter))
+			}
+			res.Header["Public"] = base.HeaderValue{strings.Join(methods, ", ")}
+		}
+	}
+
+	s.transport = transportName
+	return c, nil
+}
@@ -0,0 +1,134 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/base"
+)
+
+// The RTSP options of a client config give the transport & timeouts of its
+// RTSP client
+func TestRTSPClientOptions(t *testing.T) {
+	udp, multicast, tcp := gortsplib.TransportUDP, gortsplib.TransportUDPMulticast, gortsplib.TransportTCP
+	tests := []struct {
+		name         string
+		url          string
+		options      Options
+		transport    *gortsplib.Transport
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		label        string
+		tunneled     bool
+		err          bool
+	}{
+		{name: "defaults", url: "rtsp://10.0.0.3/stream", readTimeout: 10 * time.Second, writeTimeout: 10 * time.Second, label: "auto"},
+		{
+			name:         "udp",
+			url:          "rtsp://10.0.0.3/stream",
+			options:      Options{RTSPTransport: RTSPTransportUDP, RTSPReadTimeout: 5, RTSPWriteTimeout: 7},
+			transport:    &udp,
+			readTimeout:  5 * time.Second,
+			writeTimeout: 7 * time.Second,
+			label:        "udp",
+		},
+		{
+			name:         "udp multicast",
+			url:          "rtsp://10.0.0.3/stream",
+			options:      Options{RTSPTransport: RTSPTransportMulticast, RTSPReadTimeout: 30},
+			transport:    &multicast,
+			readTimeout:  30 * time.Second,
+			writeTimeout: 10 * time.Second,
+			label:        "udp_multicast",
+		},
+		{
+			name:         "tcp",
+			url:          "rtsp://10.0.0.3/stream",
+			options:      Options{RTSPTransport: RTSPTransportTCP, RTSPWriteTimeout: 3},
+			transport:    &tcp,
+			readTimeout:  10 * time.Second,
+			writeTimeout: 3 * time.Second,
+			label:        "tcp",
+		},
+		{
+			name:         "http",
+			url:          "rtsp://10.0.0.3/stream",
+			options:      Options{RTSPTransport: RTSPTransportHTTP},
+			transport:    &tcp,
+			readTimeout:  10 * time.Second,
+			writeTimeout: 10 * time.Second,
+			label:        "http tunnel",
+			tunneled:     true,
+		},
+		{
+			// the tunnel of the URL wins over the transport
+			name:         "rtsp+https URL",
+			url:          "rtsp+https://10.0.0.3/stream",
+			options:      Options{RTSPTransport: RTSPTransportUDP},
+			transport:    &tcp,
+			readTimeout:  10 * time.Second,
+			writeTimeout: 10 * time.Second,
+			label:        "https tunnel",
+			tunneled:     true,
+		},
+		{name: "unknown transport", url: "rtsp://10.0.0.3/stream", options: Options{RTSPTransport: "quic"}, err: true},
+		{name: "unknown keepalive", url: "rtsp://10.0.0.3/stream", options: Options{RTSPKeepalive: "ping"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, err := newRTSPSource(test.url, test.options)
+			if (err != nil) != test.err {
+				t.Fatalf("source error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			s := source.(*rtspSource)
+			c := s.client
+			if (c.Transport == nil) != (test.transport == nil) || c.Transport != nil && *c.Transport != *test.transport {
+				t.Fatalf("transport %v, want %v", c.Transport, test.transport)
+			}
+			if c.ReadTimeout != test.readTimeout || c.WriteTimeout != test.writeTimeout {
+				t.Fatalf("timeouts %v %v", c.ReadTimeout, c.WriteTimeout)
+			}
+			if s.transport != test.label || (c.DialContext != nil) != test.tunneled {
+				t.Fatalf("transport %q, tunneled %t", s.transport, c.DialContext != nil)
+			}
+		})
+	}
+}
+
+// The OPTIONS response lists the keepalive request gortsplib must send
+func TestRTSPClientKeepalive(t *testing.T) {
+	tests := []struct {
+		keepalive string
+		public    base.HeaderValue
+		want      base.HeaderValue
+	}{
+		// gortsplib chooses from the camera methods
+		{keepalive: "", public: base.HeaderValue{"OPTIONS, DESCRIBE, GET_PARAMETER"}, want: base.HeaderValue{"OPTIONS, DESCRIBE, GET_PARAMETER"}},
+		{keepalive: RTSPKeepaliveAuto, public: nil, want: nil},
+		{keepalive: RTSPKeepaliveOptions, public: base.HeaderValue{"OPTIONS, DESCRIBE, SETUP, GET_PARAMETER, PLAY"}, want: base.HeaderValue{"OPTIONS, DESCRIBE, SETUP, PLAY"}},
+		{keepalive: RTSPKeepaliveOptions, public: nil, want: nil},
+		{keepalive: RTSPKeepaliveGetParameter, public: base.HeaderValue{"OPTIONS, DESCRIBE, SETUP, PLAY"}, want: base.HeaderValue{"OPTIONS, DESCRIBE, SETUP, PLAY, GET_PARAMETER"}},
+		{keepalive: RTSPKeepaliveGetParameter, public: nil, want: base.HeaderValue{"GET_PARAMETER"}},
+	}
+	for _, test := range tests {
+		source, err := newRTSPSource("rtsp://10.0.0.3/stream", Options{RTSPKeepalive: test.keepalive})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := source.(*rtspSource).client
+		res := &base.Response{StatusCode: base.StatusOK, Header: base.Header{}}
+		if test.public != nil {
+			res.Header["Public"] = test.public
+		}
+		if c.OnResponse != nil {
+			c.OnResponse(res)
+		}
+		if public := res.Header["Public"]; len(public) != len(test.want) || len(public) > 0 && public[0] != test.want[0] {
+			t.Fatalf("keepalive %q: Public %v, want %v", test.keepalive, public, test.want)
+		}
+	}
+}
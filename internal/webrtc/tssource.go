@@ -0,0 +1,488 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func init() {
+	RegisterSource("udp", newTSSource, validateTSURL)
+}
+
+const (
+	// socket buffer of the TS datagrams
+	tsReadBuffer = 4 << 20
+	// datagrams waiting for the demuxer
+	tsQueueSize = 4096
+	// the PCR clock is reset when a frame is due further than this
+	tsMaxClockDrift = 2 * time.Second
+	// max G.711 bytes per RTP packet
+	tsMaxG711Payload = 960
+)
+
+// tsSource receives a MPEG-TS stream over UDP, unicast or multicast (also
+// RTP/MP2T). The URL udp://239.0.0.1:5000?iface=eth0 joins the group on the
+// interface, udp://0.0.0.0:5000 or udp://@:5000 listens on a port. The
+// frames are released following the PCR.
+type tsSource struct {
+	addr    *net.UDPAddr
+	iface   string
+	options Options
+
+	mutex   sync.Mutex
+	conn    *net.UDPConn
+	streams []media.TSStream
+	closed  bool
+	done    chan struct{}
+
+	bytesReceived uint64
+	resyncs       uint64
+}
+
+// Check a UDP URL, its host is not resolved
+func validateTSURL(rawURL string, sdp string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid UDP URL: %v", err)
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("UDP URL %s has no port", rawURL)
+	}
+	if port, err := strconv.Atoi(u.Port()); err != nil || port > 65535 {
+		return fmt.Errorf("UDP URL %s has an invalid port", rawURL)
+	}
+	if u.Query().Get("iface") != "" {
+		if ip := net.ParseIP(u.Hostname()); ip != nil && !ip.IsMulticast() {
+			return fmt.Errorf("UDP URL %s: iface is only used by multicast addresses", rawURL)
+		}
+	}
+	return nil
+}
+
+func newTSSource(rawURL string, options Options) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP URL: %v", err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("UDP URL %s has no port", rawURL)
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), u.Port()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid UDP URL %s: %v", rawURL, err)
+	}
+	iface := u.Query().Get("iface")
+	if iface != "" {
+		if !addr.IP.IsMulticast() {
+			return nil, fmt.Errorf("UDP URL %s: iface is only used by multicast addresses", rawURL)
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return nil, fmt.Errorf("UDP URL %s: %v", rawURL, err)
+		}
+	}
+	return &tsSource{addr: addr, iface: iface, options: options, done: make(chan struct{})}, nil
+}
+
+func (s *tsSource) readTimeout() time.Duration {
+	return rtspReadTimeout(s.options)
+}
+
+// Open the socket, joining the multicast group
+func (s *tsSource) listen() (*net.UDPConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, errors.New("UDP source closed")
+	}
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	var conn *net.UDPConn
+	var err error
+	if s.addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if s.iface != "" {
+			if ifi, err = net.InterfaceByName(s.iface); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, s.addr)
+	} else {
+		conn, err = net.ListenUDP("udp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadBuffer(tsReadBuffer); err != nil {
+		log.Println("Set UDP read buffer failed", err)
+	}
+	log.Println("Listen to MPEG-TS on udp", conn.LocalAddr())
+	s.conn = conn
+	return conn, nil
+}
+
+// The TS packets of a datagram, without the RTP header of RTP/MP2T
+func tsPackets(datagram []byte) [][]byte {
+	if len(datagram) > 12 && datagram[0] != 0x47 && datagram[0]&0xC0 == 0x80 {
+		var header rtp.Header
+		if n, err := header.Unmarshal(datagram); err == nil {
+			datagram = datagram[n:]
+		}
+	}
+	var packets [][]byte
+	for len(datagram) >= media.TSPacketSize {
+		packets = append(packets, datagram[:media.TSPacketSize])
+		datagram = datagram[media.TSPacketSize:]
+	}
+	return packets
+}
+
+// Describe waits for the PMT and the video parameter sets
+func (s *tsSource) Describe() ([]SourceTrack, error) {
+	conn, err := s.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	demuxer := media.NewTSDemuxer()
+	var video *media.TSStream
+	var vps, sps, pps []byte
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(s.readTimeout())
+	for {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if demuxer.Streams() != nil && video != nil {
+				return nil, fmt.Errorf("no video parameter sets received on %s: %v", s.addr, err)
+			}
+			return nil, fmt.Errorf("no MPEG-TS stream received on %s: %v", s.addr, err)
+		}
+		atomic.AddUint64(&s.bytesReceived, uint64(n))
+
+		for _, pkt := range tsPackets(buf[:n]) {
+			frames, err := demuxer.Push(pkt)
+			if err != nil {
+				continue
+			}
+			if video == nil {
+				for _, stream := range demuxer.Streams() {
+					if stream.StreamType == media.TSStreamH264 || stream.StreamType == media.TSStreamH265 {
+						stream := stream
+						video = &stream
+						break
+					}
+				}
+			}
+			for _, frame := range frames {
+				if video == nil || frame.PID != video.PID {
+					continue
+				}
+				frameVPS, frameSPS, framePPS := media.FirstParameterSets(tsVideoCodec(video.StreamType), media.SplitAnnexB(frame.Data))
+				if vps == nil {
+					vps = frameVPS
+				}
+				if sps == nil {
+					sps = frameSPS
+				}
+				if pps == nil {
+					pps = framePPS
+				}
+			}
+		}
+		if demuxer.Streams() != nil && video == nil {
+			return nil, fmt.Errorf("no H264/H265 stream in the MPEG-TS program on %s", s.addr)
+		}
+		if video != nil && sps != nil && pps != nil && (vps != nil || video.StreamType != media.TSStreamH265) {
+			break
+		}
+	}
+
+	streams := demuxer.Streams()
+	tracks := make([]SourceTrack, len(streams))
+	for i, stream := range streams {
+		switch {
+		case stream.PID == video.PID:
+			tracks[i] = fileSourceTrack(tsVideoCodec(stream.StreamType), vps, sps, pps)
+		case stream.StreamType == media.TSStreamPrivate && stream.Registration == "Opus":
+			tracks[i] = SourceTrack{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+		case stream.StreamType == media.TSStreamPCMU:
+			tracks[i] = SourceTrack{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 1}
+		case stream.StreamType == media.TSStreamPCMA:
+			tracks[i] = SourceTrack{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 1}
+		default:
+			log.Printf("MPEG-TS stream 0x%x (PID %d) can not be forwarded, dropped", stream.StreamType, stream.PID)
+		}
+	}
+
+	s.mutex.Lock()
+	s.streams = streams
+	s.mutex.Unlock()
+	return tracks, nil
+}
+
+func tsVideoCodec(streamType uint8) media.Codec {
+	if streamType == media.TSStreamH265 {
+		return media.CodecH265
+	}
+	return media.CodecH264
+}
+
+// tsTrack packetizes an elementary stream, the RTP timestamps follow the PTS
+type tsTrack struct {
+	index     int
+	stream    media.TSStream
+	clockRate int64
+	encoder   rtpEncoder
+	header    rtp.Header
+	// 90 kHz time since the first PTS
+	started bool
+	lastPTS int64
+	elapsed int64
+}
+
+func (t *tsTrack) timestamp(pts int64) uint32 {
+	if t.started {
+		t.elapsed += media.TSTimestampDiff(pts, t.lastPTS)
+	}
+	t.started = true
+	t.lastPTS = pts
+	return t.header.Timestamp + uint32(t.elapsed*t.clockRate/90000)
+}
+
+func (t *tsTrack) packets(frame media.TSFrame) []*rtp.Packet {
+	timestamp := t.timestamp(frame.PTS)
+	var pkts []*rtp.Packet
+	switch {
+	case t.encoder != nil:
+		au, err := t.encoder.Encode(media.SplitAnnexB(frame.Data), 0)
+		if err != nil {
+			log.Println("Packetize MPEG-TS video frame failed", err)
+			return nil
+		}
+		for _, pkt := range au {
+			pkt.Timestamp = timestamp
+		}
+		return au
+	case t.clockRate == 48000:
+		for _, packet := range media.OpusTSPackets(frame.Data) {
+			pkts = append(pkts, t.packet(timestamp, packet))
+			timestamp += uint32(media.OpusPacketDuration(packet))
+		}
+	default:
+		for data := frame.Data; len(data) > 0; {
+			n := len(data)
+			if n > tsMaxG711Payload {
+				n = tsMaxG711Payload
+			}
+			pkts = append(pkts, t.packet(timestamp, data[:n]))
+			timestamp += uint32(n)
+			data = data[n:]
+		}
+	}
+	return pkts
+}
+
+func (t *tsTrack) packet(timestamp uint32, payload []byte) *rtp.Packet {
+	t.header.SequenceNumber++
+	header := t.header
+	header.Timestamp = timestamp
+	return &rtp.Packet{Header: header, Payload: payload}
+}
+
+// pcrClock maps the PCR to the wall clock
+type pcrClock struct {
+	set  bool
+	pcr  int64
+	time time.Time
+}
+
+// Due time of a decode timestamp, zero before the first PCR
+func (c *pcrClock) due(dts int64) time.Time {
+	if !c.set {
+		return time.Time{}
+	}
+	return c.time.Add(time.Duration(media.TSTimestampDiff(dts, c.pcr)) * time.Second / 90000)
+}
+
+// Start demuxes the datagrams, the frames are sent at their DTS on the PCR clock
+func (s *tsSource) Start(tracks []int, onRTP func(track int, pkt *rtp.Packet), onRTCP func(track int, pkt rtcp.Packet)) error {
+	conn, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	streams := s.streams
+	s.mutex.Unlock()
+	if streams == nil {
+		if _, err := s.Describe(); err != nil {
+			return err
+		}
+		s.mutex.Lock()
+		streams = s.streams
+		s.mutex.Unlock()
+	}
+
+	selected := make(map[uint16]*tsTrack)
+	for i, index := range tracks {
+		if index < 0 || index >= len(streams) {
+			return fmt.Errorf("MPEG-TS track %d not found", index)
+		}
+		t := &tsTrack{
+			index:  i,
+			stream: streams[index],
+			header: rtp.Header{
+				Version:        2,
+				SequenceNumber: uint16(rand.Uint32()),
+				Timestamp:      rand.Uint32(),
+				SSRC:           rand.Uint32(),
+			},
+		}
+		switch stream := streams[index]; {
+		case stream.StreamType == media.TSStreamH264 || stream.StreamType == media.TSStreamH265:
+			t.clockRate = 90000
+			t.encoder = newRTPEncoder(tsVideoCodec(stream.StreamType))
+		case stream.StreamType == media.TSStreamPrivate:
+			t.clockRate = 48000
+			t.header.PayloadType = 111
+		case stream.StreamType == media.TSStreamPCMA:
+			t.clockRate = 8000
+			t.header.PayloadType = 8
+		default:
+			t.clockRate = 8000
+		}
+		selected[streams[index].PID] = t
+	}
+
+	// the datagrams are read while the frames wait for their time
+	datagrams := make(chan []byte, tsQueueSize)
+	readErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			buf := make([]byte, 65536)
+			_ = conn.SetReadDeadline(time.Now().Add(s.readTimeout()))
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			atomic.AddUint64(&s.bytesReceived, uint64(n))
+			select {
+			case datagrams <- buf[:n]:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	demuxer := media.NewTSDemuxer()
+	var clock pcrClock
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		var datagram []byte
+		select {
+		case datagram = <-datagrams:
+		case err := <-readErr:
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return errors.New("UDP source closed")
+			}
+			return fmt.Errorf("MPEG-TS stream stopped: %v", err)
+		case <-s.done:
+			return errors.New("UDP source closed")
+		}
+
+		for _, pkt := range tsPackets(datagram) {
+			frames, err := demuxer.Push(pkt)
+			if err != nil {
+				continue
+			}
+			if pcr, ok, discontinuity := demuxer.PCR(); ok {
+				now := time.Now()
+				if expected := clock.due(pcr); !clock.set || discontinuity || now.Sub(expected) > tsMaxClockDrift || expected.Sub(now) > tsMaxClockDrift {
+					if clock.set {
+						atomic.AddUint64(&s.resyncs, 1)
+					}
+					clock = pcrClock{set: true, pcr: pcr, time: now}
+				}
+			}
+
+			for _, frame := range frames {
+				t, ok := selected[frame.PID]
+				if !ok {
+					continue
+				}
+				if wait := time.Until(clock.due(frame.DTS)); wait > 0 && wait < tsMaxClockDrift {
+					timer.Reset(wait)
+					select {
+					case <-timer.C:
+					case <-s.done:
+						return errors.New("UDP source closed")
+					}
+				}
+				for _, rtpPkt := range t.packets(frame) {
+					onRTP(t.index, rtpPkt)
+				}
+			}
+		}
+	}
+}
+
+// RequestKeyframe is not supported, the keyframes are the ones of the encoder
+func (s *tsSource) RequestKeyframe() error {
+	return errors.New("a MPEG-TS source can not request a keyframe")
+}
+
+func (s *tsSource) WriteRTCP(track int, pkt rtcp.Packet) error {
+	return nil
+}
+
+func (s *tsSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *tsSource) Stats() SourceStats {
+	return SourceStats{
+		Type:          "udp",
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		Details: map[string]interface{}{
+			"listen":      s.addr.String(),
+			"pcr_resyncs": atomic.LoadUint64(&s.resyncs),
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package webrtc
+
+import (
+	"RTSPSender/internal/media"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	testTSFrames   = 50
+	testTSPMTPID   = 0x1000
+	testTSVideoPID = 0x100
+	// the timestamps wrap around 33 bits in the middle of the file
+	testTSBase = 1<<33 - 20*3600
+)
+
+// testTSFile writes a H.264 program, the PAT & PMT before each frame and the
+// PCR on the video PID
+type testTSFile struct {
+	data []byte
+	cc   map[uint16]byte
+}
+
+// Packetize a section or a PES, the PCR in the first packet if pcr >= 0
+func (f *testTSFile) write(pid uint16, payload []byte, pcr int64) {
+	for first := true; first || len(payload) > 0; first = false {
+		var af []byte
+		if first && pcr >= 0 {
+			af = []byte{0x10, byte(pcr >> 25), byte(pcr >> 17), byte(pcr >> 9), byte(pcr >> 1), byte(pcr<<7) | 0x7E, 0}
+		}
+		room := 184
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		n := len(payload)
+		if n > room {
+			n = room
+		} else if n < room {
+			// stuffing in the adaptation field
+			if af == nil {
+				af = []byte{}
+				room--
+			}
+			if len(af) == 0 && n < room {
+				af = append(af, 0)
+				room--
+			}
+			af = append(af, bytes.Repeat([]byte{0xFF}, room-n)...)
+		}
+
+		pkt := []byte{0x47, byte(pid>>8) & 0x1F, byte(pid), 0x10 | f.cc[pid]}
+		if first {
+			pkt[1] |= 0x40
+		}
+		if af != nil {
+			pkt[3] |= 0x20
+			pkt = append(append(pkt, byte(len(af))), af...)
+		}
+		f.data = append(append(f.data, pkt...), payload[:n]...)
+		payload = payload[n:]
+		f.cc[pid] = (f.cc[pid] + 1) & 0x0F
+	}
+}
+
+func testTSFileSection(tableID byte, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(length>>8), byte(length), 0, 1, 0xC1, 0, 0}
+	return append(append(section, body...), 0, 0, 0, 0)
+}
+
+func testTSFileTimestamp(prefix byte, ts int64) []byte {
+	ts &= 1<<33 - 1
+	return []byte{prefix<<4 | byte(ts>>30&0x07)<<1 | 1, byte(ts >> 22), byte(ts>>15&0x7F)<<1 | 1, byte(ts >> 7), byte(ts&0x7F)<<1 | 1}
+}
+
+// Write the frames at 25 fps, the parameter sets in front of the IDRs
+func writeTestTS(t *testing.T, path string) {
+	sps, pps := testParameterSets(t)
+	f := &testTSFile{cc: make(map[uint16]byte)}
+	pat := testTSFileSection(0x00, []byte{0, 1, 0xE0 | testTSPMTPID>>8, testTSPMTPID & 0xFF})
+	pmt := testTSFileSection(0x02, []byte{
+		0xE0 | testTSVideoPID>>8, testTSVideoPID & 0xFF, 0xF0, 0,
+		media.TSStreamH264, 0xE0 | testTSVideoPID>>8, testTSVideoPID & 0xFF, 0xF0, 0,
+	})
+	for n := 0; n < testTSFrames; n++ {
+		f.write(0, pat, -1)
+		f.write(testTSPMTPID, pmt, -1)
+
+		var data []byte
+		frame := testFrame(n, 3000)
+		if frame[0]&0x1F == 5 {
+			for _, nalu := range [][]byte{sps, pps} {
+				data = append(append(data, 0, 0, 0, 1), nalu...)
+			}
+		}
+		data = append(append(data, 0, 0, 0, 1), frame...)
+
+		// unbounded PES, the PTS one frame after the DTS
+		dts := testTSBase + int64(n)*3600
+		pes := []byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0xC0, 10}
+		pes = append(pes, testTSFileTimestamp(0x03, dts+3600)...)
+		pes = append(pes, testTSFileTimestamp(0x01, dts)...)
+		f.write(testTSVideoPID, append(pes, data...), dts&(1<<33-1))
+	}
+	if err := ioutil.WriteFile(path, f.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send the TS file in datagrams of 7 packets, about in real time
+func sendTestTS(t *testing.T, path string, port int) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	for len(data) > 0 {
+		n := 7 * media.TSPacketSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			t.Error(err)
+			return
+		}
+		data = data[n:]
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTSSourceUDP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.ts")
+	writeTestTS(t, path)
+	port := testUDPPort(t)
+
+	source, err := newTSSource(fmt.Sprintf("udp://127.0.0.1:%d", port), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		// the socket is opened by Describe
+		time.Sleep(200 * time.Millisecond)
+		sendTestTS(t, path, port)
+	}()
+
+	tracks, err := source.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sps, pps := testParameterSets(t)
+	if len(tracks) != 1 || tracks[0].MimeType != "video/H264" || !bytes.Equal(tracks[0].SPS, sps) || !bytes.Equal(tracks[0].PPS, pps) {
+		t.Fatalf("TS tracks %+v", tracks)
+	}
+
+	var mutex sync.Mutex
+	var pkts []*rtp.Packet
+	done := make(chan error, 1)
+	go func() {
+		done <- source.Start([]int{0}, func(track int, pkt *rtp.Packet) {
+			mutex.Lock()
+			pkts = append(pkts, pkt)
+			mutex.Unlock()
+		}, func(track int, pkt rtcp.Packet) {})
+	}()
+	<-sent
+	time.Sleep(200 * time.Millisecond)
+	source.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	d := media.NewDepacketizer(media.CodecH264)
+	var aus []media.AccessUnit
+	for i, pkt := range pkts {
+		if pkt.PayloadType != 96 || len(pkt.Payload) > media.DefaultMaxPayloadSize {
+			t.Fatalf("packet %d: payload type %d, %d bytes", i, pkt.PayloadType, len(pkt.Payload))
+		}
+		out, err := d.Push(pkt)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		aus = append(aus, out...)
+	}
+	// the last frame is not completed, some may be read by Describe
+	if len(aus) < testTSFrames/2 {
+		t.Fatalf("got %d access units", len(aus))
+	}
+	first := testFrameNumber(aus[0].NALUs[len(aus[0].NALUs)-1])
+	for i, au := range aus {
+		n := first + i
+		if !bytes.Equal(au.NALUs[len(au.NALUs)-1], testFrame(n, 3000)) {
+			t.Fatalf("access unit %d is not the frame %d", i, n)
+		}
+		if n%25 == 0 && (len(au.NALUs) != 3 || !bytes.Equal(au.NALUs[0], sps) || !au.Keyframe(media.CodecH264)) {
+			t.Fatalf("access unit of the frame %d has no parameter sets", n)
+		}
+		// across the PTS wrap
+		if au.Timestamp-aus[0].Timestamp != uint32(i*3600) {
+			t.Fatalf("access unit %d timestamp %d, want %d", i, au.Timestamp-aus[0].Timestamp, i*3600)
+		}
+	}
+}
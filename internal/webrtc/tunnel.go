@@ -0,0 +1,288 @@
+package webrtc
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL schemes of the RTSP streams tunneled over HTTP, the port of the URL is
+// the HTTP one (80 or 443 by default)
+var tunnelSchemes = map[string]string{
+	"rtsp+http":  "http",
+	"rtsp+https": "https",
+}
+
+// Split a camera URL in the tunnel (http, https or none) and the RTSP URL
+func tunnelURL(rawURL string) (string, string) {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return "", rawURL
+	}
+	if tunnel, ok := tunnelSchemes[strings.ToLower(rawURL[:i])]; ok {
+		return tunnel, "rtsp" + rawURL[i:]
+	}
+	return "", rawURL
+}
+
+// Dial the HTTP server of the camera (or its reverse proxy) instead of the
+// RTSP address, and return the tunnel as the RTSP connection
+func (s *rtspSource) tunnelDialer() (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	u, err := neturl.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if s.tunnel == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	path := u.RequestURI()
+
+	var tlsConfig *tls.Config
+	if s.tunnel == "https" {
+		tlsConfig, err = rtspTLSConfig(s.options)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialHTTPTunnel(ctx, host, path, tlsConfig)
+	}, nil
+}
+
+// Declared length of the POST bodies, a new POST sharing the session cookie
+// is opened before it's reached
+const tunnelPostLength = 32767
+
+// timeout of the POST reopened when the write deadline is not set
+const tunnelPostTimeout = 10 * time.Second
+
+// httpTunnelConn is a RTSP connection tunneled in two HTTP requests (Apple
+// QuickTime tunneling): the server writes the RTSP data in the GET response,
+// the client writes it base64 encoded in the POST body.
+type httpTunnelConn struct {
+	get    net.Conn
+	reader *bufio.Reader
+
+	host          string
+	path          string
+	tlsConfig     *tls.Config
+	sessionCookie string
+
+	// serializes the writes, the POST is replaced under it
+	writeMutex sync.Mutex
+	// bytes written in the POST body
+	written int
+
+	mutex         sync.Mutex
+	post          net.Conn
+	writeDeadline time.Time
+	closed        bool
+}
+
+// Open the GET & POST connections sharing a session cookie
+func dialHTTPTunnel(ctx context.Context, host string, path string, tlsConfig *tls.Config) (net.Conn, error) {
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+	c := &httpTunnelConn{host: host, path: path, tlsConfig: tlsConfig, sessionCookie: hex.EncodeToString(cookie)}
+
+	get, err := dialHTTP(ctx, host, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = get.SetDeadline(deadline)
+	}
+	_, err = fmt.Fprintf(get, "GET %s HTTP/1.0\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: RTSPSender\r\n"+
+		"x-sessioncookie: %s\r\n"+
+		"Accept: application/x-rtsp-tunnelled\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n\r\n", path, host, c.sessionCookie)
+	if err != nil {
+		get.Close()
+		return nil, err
+	}
+	// the response body is the RTSP stream, read from the same reader
+	reader := bufio.NewReader(get)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		get.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		get.Close()
+		return nil, fmt.Errorf("RTSP over HTTP tunnel refused by %s: %s", host, res.Status)
+	}
+	_ = get.SetDeadline(time.Time{})
+	c.get, c.reader = get, reader
+
+	if c.post, err = c.dialPost(ctx); err != nil {
+		get.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Open a POST of the session, the server does not answer it
+func (c *httpTunnelConn) dialPost(ctx context.Context) (net.Conn, error) {
+	post, err := dialHTTP(ctx, c.host, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(post, "POST %s HTTP/1.0\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: RTSPSender\r\n"+
+		"x-sessioncookie: %s\r\n"+
+		"Content-Type: application/x-rtsp-tunnelled\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Content-Length: %d\r\n"+
+		"Expires: Sun, 9 Jan 1972 00:00:00 GMT\r\n\r\n", c.path, c.host, c.sessionCookie, tunnelPostLength)
+	if err != nil {
+		post.Close()
+		return nil, err
+	}
+	return post, nil
+}
+
+// Replace the POST whose body is full, must be called under writeMutex
+func (c *httpTunnelConn) reopenPost() error {
+	c.mutex.Lock()
+	deadline := c.writeDeadline
+	c.mutex.Unlock()
+	if deadline.IsZero() {
+		deadline = time.Now().Add(tunnelPostTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	post, err := c.dialPost(ctx)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_ = post.SetWriteDeadline(c.writeDeadline)
+	if c.closed {
+		post.Close()
+		return net.ErrClosed
+	}
+	c.post.Close()
+	c.post = post
+	c.written = 0
+	return nil
+}
+
+func dialHTTP(ctx context.Context, host string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (c *httpTunnelConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Each write is encoded on its own, the servers decode the chunks separately.
+// The chunks over the POST length are split.
+func (c *httpTunnelConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	n := 0
+	for n < len(b) {
+		chunk := b[n:]
+		if max := tunnelPostLength / 4 * 3; len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		encoded := base64.StdEncoding.EncodeToString(chunk)
+		if c.written+len(encoded) > tunnelPostLength {
+			if err := c.reopenPost(); err != nil {
+				return n, err
+			}
+		}
+
+		c.mutex.Lock()
+		post := c.post
+		c.mutex.Unlock()
+		written, err := post.Write([]byte(encoded))
+		c.written += written
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (c *httpTunnelConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	err := c.get.Close()
+	if err2 := c.post.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (c *httpTunnelConn) LocalAddr() net.Addr {
+	return c.get.LocalAddr()
+}
+
+func (c *httpTunnelConn) RemoteAddr() net.Addr {
+	return c.get.RemoteAddr()
+}
+
+func (c *httpTunnelConn) SetDeadline(t time.Time) error {
+	if err := c.get.SetDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *httpTunnelConn) SetReadDeadline(t time.Time) error {
+	return c.get.SetReadDeadline(t)
+}
+
+// SetWriteDeadline applies to the current & the reopened POSTs
+func (c *httpTunnelConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+	return c.post.SetWriteDeadline(t)
+}
@@ -0,0 +1,168 @@
+package webrtc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTunnelRequest is a request received by the test tunnel server
+type testTunnelRequest struct {
+	method        string
+	sessionCookie string
+	contentLength int
+	// the whole body sent, until the connection is closed
+	body []byte
+}
+
+// testTunnelServer answers the tunnel GET with the given RTSP data and
+// records the requests
+type testTunnelServer struct {
+	listener net.Listener
+	response []byte
+
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	requests []*testTunnelRequest
+}
+
+func newTestTunnelServer(t *testing.T, response []byte) *testTunnelServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testTunnelServer{listener: listener, response: response}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// recorded in the order the client opened them
+			r := &testTunnelRequest{}
+			s.mutex.Lock()
+			s.requests = append(s.requests, r)
+			s.mutex.Unlock()
+			s.wg.Add(1)
+			go s.serve(conn, r)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *testTunnelServer) serve(conn net.Conn, r *testTunnelRequest) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	r.method, r.sessionCookie = req.Method, req.Header.Get("x-sessioncookie")
+	s.mutex.Unlock()
+
+	if req.Method == http.MethodGet {
+		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: application/x-rtsp-tunnelled\r\n\r\n"))
+		conn.Write(s.response)
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+	contentLength, _ := strconv.Atoi(req.Header.Get("Content-Length"))
+	body, _ := ioutil.ReadAll(reader)
+	s.mutex.Lock()
+	r.contentLength, r.body = contentLength, body
+	s.mutex.Unlock()
+}
+
+// Decode the base64 chunks of a POST body, each chunk is padded on its own
+func decodeTunnelBody(t *testing.T, body string) []byte {
+	t.Helper()
+	var out []byte
+	for len(body) > 0 {
+		end := len(body)
+		if i := strings.IndexByte(body, '='); i >= 0 {
+			for end = i; end < len(body) && body[end] == '='; end++ {
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(body[:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, decoded...)
+		body = body[end:]
+	}
+	return out
+}
+
+func TestHTTPTunnelReopensPost(t *testing.T) {
+	response := []byte("RTSP/1.0 200 OK\r\nCSeq: 1\r\n\r\n")
+	s := newTestTunnelServer(t, response)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialHTTPTunnel(ctx, s.listener.Addr().String(), "/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(response))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, response) {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	// RTSP requests & interleaved RTCP, then a chunk over the POST length
+	var sent []byte
+	for i := 0; i < 300; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 100+i%200)
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, chunk...)
+	}
+	chunk := bytes.Repeat([]byte("large"), 10000)
+	if n, err := conn.Write(chunk); err != nil || n != len(chunk) {
+		t.Fatal(n, err)
+	}
+	sent = append(sent, chunk...)
+	conn.Close()
+	s.listener.Close()
+	s.wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.requests) < 2 || s.requests[0].method != http.MethodGet {
+		t.Fatalf("got %d requests", len(s.requests))
+	}
+	cookie := s.requests[0].sessionCookie
+	var posts int
+	var body string
+	for _, r := range s.requests[1:] {
+		if r.method != http.MethodPost || r.sessionCookie != cookie {
+			t.Fatalf("%s request with the session cookie %q, want POST %q", r.method, r.sessionCookie, cookie)
+		}
+		if r.contentLength != tunnelPostLength || len(r.body) > r.contentLength {
+			t.Fatalf("POST body of %d bytes, Content-Length %d", len(r.body), r.contentLength)
+		}
+		posts++
+		body += string(r.body)
+	}
+	if want := len(base64.StdEncoding.EncodeToString(sent)) / tunnelPostLength; posts <= want {
+		t.Fatalf("%d POSTs, want more than %d", posts, want)
+	}
+	if !bytes.Equal(decodeTunnelBody(t, body), sent) {
+		t.Fatal("the POST bodies differ from the written data")
+	}
+}
@@ -2,22 +2,28 @@ package webrtc
 
 import (
 	"RTSPSender/internal/janus"
+	"RTSPSender/internal/media"
+	"RTSPSender/internal/restream"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aler9/gortsplib/pkg/url"
-
 	"github.com/pion/mediadevices"
 
-	"github.com/aler9/gortsplib"
 	"github.com/pion/dtls/v2/pkg/protocol/extension"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 
 	"github.com/pion/mediadevices/pkg/codec/opus" // This is required to use opus audio encoder
@@ -27,20 +33,81 @@ import (
 )
 
 type Muxer struct {
+	// guards status, stop & pc, used by the camera, RTCP & viewer goroutines
+	stateMutex         sync.Mutex
 	status             webrtc.ICEConnectionState
 	stop               bool
 	pc                 *webrtc.PeerConnection
-	rtspClient         *gortsplib.Client
+	layers             []*rtspLayer
 	audioCodecSelector *mediadevices.CodecSelector
 	stopSendingAudio   bool
 	rtspRetryTimes     int
 	userId             string
+	videoCodec         string
+	videoCapability    webrtc.RTPCodecCapability
+	handle             *janus.Handle
+	whip               *whipSession
+	managedRoom        string
+	roomNum            int
+	keyframeStats      KeyframeRequestStats
+	switcher           *streamSwitcher
+	estimator          cc.BandwidthEstimator
+	fec                *fecInterceptor
+	webrtcLost         uint32
+	webrtcFractionLost uint32
+	previewVideo       *webrtc.TrackLocalStaticRTP
+	previewAudio       *webrtc.TrackLocalStaticRTP
+	previewForward     *rtspForward
+	viewersMutex       sync.Mutex
+	viewers            map[string]*whepViewer
+	restream           *restream.Server
+	recordName         string
+	recordMutex        sync.Mutex
+	recorder           *recorder
 
 	Hangup  bool
 	Options Options
 	Janus   *janus.Gateway
 }
 
+// SimulcastLayer is a camera stream published as a simulcast encoding
+type SimulcastLayer struct {
+	// RID is the encoding id, e.g. "h" for the main stream and "l" for the sub stream
+	RID string `json:"rid"`
+	// URL of the RTSP stream
+	URL string `json:"url"`
+}
+
+// rtspLayer is a camera source feeding one video encoding,
+// the first layer also feeds the camera audio
+type rtspLayer struct {
+	rid      string
+	url      string
+	source   Source
+	tracks   []SourceTrack
+	forwards []*rtspForward
+	// republishes the forwarded tracks, nil if not restreamed
+	restream *restream.Stream
+}
+
+// Audio sources of a client
+const (
+	// AudioSourceMic publishes the local microphone selected by the `Mic` name hash
+	AudioSourceMic = "mic"
+	// AudioSourceCamera publishes the G.711 or Opus track of the RTSP camera
+	AudioSourceCamera = "camera"
+	// AudioSourceNone publishes video only
+	AudioSourceNone = "none"
+)
+
+// Sinks the PeerConnection is published to
+const (
+	// SinkJanus joins the Janus VideoRoom of the client
+	SinkJanus = "janus"
+	// SinkWHIP publishes to the WHIPURL endpoint
+	SinkWHIP = "whip"
+)
+
 type Options struct {
 	// ICEServers is a required array of ICE server URLs to connect to (e.g., STUN or TURN server URLs)
 	ICEServers []string
@@ -52,15 +119,108 @@ type Options struct {
 	PortMin uint16
 	// PortMin is an optional maximum (inclusive) ephemeral UDP port range for the ICEServers connections
 	PortMax uint16
+	// AudioSource is an optional audio source (mic, camera or none), defaults to mic
+	AudioSource string
+	// MaxPayloadSize is an optional max RTP payload size of the video packets, defaults to 1200
+	MaxPayloadSize int
+	// KeyframeRequest is an optional way to answer PLI/FIR (gop, replay or none), defaults to gop
+	KeyframeRequest string
+	// GOPCacheSize is an optional max number of cached video packets, defaults to 2048
+	GOPCacheSize int
+	// CreateRoom is an optional flag to create the VideoRoom from RoomTemplate if it does not exist
+	CreateRoom bool
+	// DestroyRoom is an optional flag to destroy a created room when the last publisher leaves
+	DestroyRoom bool
+	// RoomTemplate holds the parameters used by CreateRoom
+	RoomTemplate RoomTemplate
+	// Simulcast is an optional list of camera streams published as simulcast encodings
+	// of the video track, highest quality first. The RTSP URL is used if it is empty
+	Simulcast []SimulcastLayer
+	// Adaptive is an optional flag to publish a single video encoding, switched
+	// between the Simulcast streams according to the estimated bandwidth
+	Adaptive bool
+	// CongestionControl is an optional flag to send the transport-cc header extension,
+	// estimate the bandwidth with GCC and pace the packets
+	CongestionControl bool
+	// InitialBitrate, MinBitrate and MaxBitrate are optional GCC bitrates in bps
+	InitialBitrate int
+	MinBitrate     int
+	MaxBitrate     int
+	// PacingRate is an optional rate (bps) each video track is paced at, with
+	// CongestionControl the rate follows the bandwidth estimate (x1.5) after the start
+	PacingRate int
+	// PacingQueueSize is an optional max number of packets queued by the pacer of a track
+	PacingQueueSize int
+	// FECOverhead is an optional ULPFEC overhead, in percent of the video packets
+	FECOverhead int
+	// AudioRedundancy is an optional number (1 or 2) of previous Opus frames sent
+	// again in RED with each mic packet
+	AudioRedundancy int
+	// ReorderLatency is an optional time in ms a missing camera packet is waited for
+	ReorderLatency int
+	// CameraNACK is an optional flag to send RTCP NACKs for the missing camera packets
+	CameraNACK bool
+	// RTSPTransport is an optional RTSP transport (auto, udp, udp_multicast, tcp or http), defaults to auto.
+	// The rtsp+http and rtsp+https URLs are always tunneled over HTTP
+	RTSPTransport string
+	// RTSPReadTimeout and RTSPWriteTimeout are optional RTSP timeouts in seconds, default to 10
+	RTSPReadTimeout  int
+	RTSPWriteTimeout int
+	// RTSPKeepalive is an optional keepalive request (auto, options or get_parameter), defaults to auto
+	RTSPKeepalive string
+	// RTSPAnyPort is an optional flag to accept packets from other ports than the announced ones
+	RTSPAnyPort bool
+	// RTSPCAFile is an optional PEM file of the CA the rtsps camera certificates must be signed by
+	RTSPCAFile string
+	// RTSPSkipVerify is an optional flag to skip the rtsps certificate check (only the
+	// host name check if RTSPCAFile is set)
+	RTSPSkipVerify bool
+	// SDP is an optional inline SDP of the plain RTP received by the sdp://inline camera URL
+	SDP string
+	// Sink is an optional destination of the PeerConnection (janus or whip), defaults to janus
+	Sink string
+	// WHIPURL is the WHIP endpoint the whip sink publishes to
+	WHIPURL string
+	// WHIPToken is an optional bearer token of the WHIP endpoint
+	WHIPToken string
+	// WHIPTrickle is an optional flag to POST the offer before the ICE gathering
+	// completes, the candidates are then sent with PATCH requests
+	WHIPTrickle bool
+	// WHEPMaxViewers is an optional max number of local WHEP preview viewers, defaults to 4
+	WHEPMaxViewers int
+	// RestreamAddress is an optional address (e.g. :8554) of a RTSP server republishing
+	// the camera at rtsp://host:port/<room>_<id>
+	RestreamAddress string
+	// RestreamUser and RestreamPass are optional credentials of the restream readers
+	RestreamUser string
+	RestreamPass string
+	// RecordDir is an optional directory the camera is recorded to, in <room>_<id>
+	// fragmented MP4 segments
+	RecordDir string
+	// Record is an optional flag to record the camera from the start of the publishing
+	Record bool
+	// RecordSegmentDuration is an optional segment duration in seconds, defaults to 300
+	RecordSegmentDuration int
+	// RecordSegmentSize is an optional max segment size in MB, the segments are
+	// rotated on the next keyframe
+	RecordSegmentSize int
+	// RecordRetention is an optional number of segments kept, the older ones are removed
+	RecordRetention int
 }
 
+// testSettingEngine configures the PeerConnections of the muxers in the
+// tests, e.g. to run them on a simulated network
+var testSettingEngine func(s *webrtc.SettingEngine)
+
 func NewMuxer(options Options) *Muxer {
 	tmp := Muxer{Options: options}
 	tmp.rtspRetryTimes = 3
 	return &tmp
 }
 
-func (element *Muxer) NewPeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+// NewPeerConnection creates a PeerConnection with the default audio codecs and
+// `video` as the only video codec
+func (element *Muxer) NewPeerConnection(configuration webrtc.Configuration, video webrtc.RTPCodecCapability) (*webrtc.PeerConnection, error) {
 	if len(element.Options.ICEServers) > 0 {
 		configuration.ICEServers = append(configuration.ICEServers, webrtc.ICEServer{
 			URLs:           element.Options.ICEServers,
@@ -70,32 +230,73 @@ func (element *Muxer) NewPeerConnection(configuration webrtc.Configuration) (*we
 		})
 	}
 	m := &webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
-		return nil, err
-	}
-
-	videoRTCPFeedback := []webrtc.RTCPFeedback{
-		{Type: "goog-remb", Parameter: ""},
-		{Type: "ccm", Parameter: "fir"},
-		{Type: "nack", Parameter: "pli"},
-	}
+	// same audio codecs as `RegisterDefaultCodecs`
 	for _, codec := range []webrtc.RTPCodecParameters{
 		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, Channels: 0, SDPFmtpLine: "profile-id=1", RTCPFeedback: videoRTCPFeedback},
-			PayloadType:        96,
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1", RTCPFeedback: nil},
+			PayloadType:        111,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+			PayloadType:        9,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+			PayloadType:        0,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
+			PayloadType:        8,
 		},
 	} {
-		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+
+	// the exact codec the camera sends, so Janus can not pick another profile
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: video, PayloadType: 96}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+
+	element.fec = nil
+	if element.Options.FECOverhead > 0 || element.Options.AudioRedundancy > 0 {
+		element.fec = newFECInterceptor(video.MimeType, element.Options.FECOverhead, element.Options.AudioRedundancy)
+		if err := element.fec.registerCodecs(m); err != nil {
+			return nil, err
+		}
+	}
+
+	// simulcast encodings are identified by the rtp-stream-id header extension
+	if element.simulcast() {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.SDESRTPStreamIDURI}, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
 	}
 
 	i := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+	if element.Options.AudioSource == AudioSourceCamera {
+		// sender reports are translated from the camera ones, see `connectRTSPCamera`
+		if err := registerInterceptorsWithoutSenderReports(m, i); err != nil {
+			return nil, err
+		}
+	} else if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
 		return nil, err
 	}
+	if element.Options.CongestionControl {
+		if err := element.registerCongestionControl(m, i); err != nil {
+			return nil, err
+		}
+	}
+	if element.fec != nil {
+		// added last, so it's the first one the packets go through
+		i.Add(element.fec)
+	}
 	s := webrtc.SettingEngine{}
 	s.SetSRTPProtectionProfiles(extension.SRTP_AES128_CM_HMAC_SHA1_80)
+	if testSettingEngine != nil {
+		testSettingEngine(&s)
+	}
 
 	if element.Options.PortMin > 0 && element.Options.PortMax > 0 && element.Options.PortMax > element.Options.PortMin {
 		err := s.SetEphemeralUDPPortRange(element.Options.PortMin, element.Options.PortMax)
@@ -117,6 +318,21 @@ func (element *Muxer) NewPeerConnection(configuration webrtc.Configuration) (*we
 	return api.NewPeerConnection(configuration)
 }
 
+// Same as `webrtc.RegisterDefaultInterceptors` without generating sender reports
+func registerInterceptorsWithoutSenderReports(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	if err := webrtc.ConfigureNack(m, i); err != nil {
+		return err
+	}
+
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	i.Add(receiver)
+
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
 func (element *Muxer) WriteHeader(
 	ID string,
 	Room string,
@@ -124,60 +340,229 @@ func (element *Muxer) WriteHeader(
 	RTSP string,
 	Janus string,
 	Mic string,
-	Display string) (string, error) {
+	Display string) (msg string, err error) {
+
+	// the caller drops a failed muxer, release what was opened
+	defer func() {
+		if err != nil {
+			element.Close()
+		}
+	}()
+
+	layers := element.Options.Simulcast
+	if len(layers) == 0 {
+		layers = []SimulcastLayer{{URL: RTSP}}
+	}
+	rids := make(map[string]bool)
+	for _, layer := range layers {
+		if len(layers) > 1 && (len(layer.RID) == 0 || rids[layer.RID]) {
+			return "Invalid simulcast layers", fmt.Errorf("simulcast layer rid %q is empty or duplicated", layer.RID)
+		}
+		rids[layer.RID] = true
+		if len(layer.URL) == 0 {
+			layer.URL = RTSP
+		}
+		source, err := acquireSource(layer.URL, element.Options)
+		if err != nil {
+			return "Invalid camera URL", err
+		}
+		element.layers = append(element.layers, &rtspLayer{rid: layer.RID, url: layer.URL, source: source})
+	}
+
+	// Get video track info from the camera sources
+	var videoTrackIDs []int
+	var videoType string
+	for i, layer := range element.layers {
+		trackID, mimeType, err := element.videoTrackID(layer)
+		if err != nil {
+			return "Get video Track id error: ", err
+		}
+		if i > 0 && mimeType != videoType {
+			return "Simulcast codec mismatch", fmt.Errorf("simulcast layer %s is %s, layer %s is %s", layer.rid, mimeType, element.layers[0].rid, videoType)
+		}
+		videoType = mimeType
+		videoTrackIDs = append(videoTrackIDs, trackID)
+	}
+	element.videoCodec = videoType
+	element.videoCapability, err = videoCodecCapability(element.layers[0].tracks[videoTrackIDs[0]])
+	if err != nil {
+		return "Unknown camera video profile", err
+	}
 
 	peerConnection, err := element.NewPeerConnection(webrtc.Configuration{
 		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
-	})
+	}, element.videoCapability)
 	if err != nil {
 		return "Create pc failed", err
 	}
+	element.stateMutex.Lock()
+	element.pc = peerConnection
+	element.stateMutex.Unlock()
 	element.userId = ID
 
 	// Get audio track
 	var hasAudio = false
-	audioTrack, err := element.getAudioTrack(Mic)
-	if err != nil {
-		// if there is not a video device for use, send audio anyway
-		log.Println("Can not find audio track, error:", err)
-		hasAudio = false
-	} else {
-		// Add audio track
-		_, err = peerConnection.AddTransceiverFromTrack(audioTrack,
-			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	switch element.Options.AudioSource {
+	case AudioSourceNone:
+		log.Println("Audio disabled, publish video only")
+	case AudioSourceCamera:
+		// added after the video track
+	default:
+		audioTrack, err := element.getAudioTrack(Mic)
 		if err != nil {
-			return "Add audio track failed", err
+			// if there is not a video device for use, send audio anyway
+			log.Println("Can not find audio track, error:", err)
+			hasAudio = false
+		} else {
+			// Add audio track
+			_, err = peerConnection.AddTransceiverFromTrack(audioTrack,
+				webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+			if err != nil {
+				return "Add audio track failed", err
+			}
+			hasAudio = true
 		}
-		hasAudio = true
 	}
 
-	// Get video track info from RTSP URL
-	rtspVideoTrack, videoType, err := element.videoTrackID(RTSP)
-	if err != nil || rtspVideoTrack == nil {
-		element.rtspClient.Close()
-		return "Get video Track id error: ", err
+	// Create a video track, with one encoding per simulcast layer
+	videoCodec := media.CodecH264
+	if videoType == webrtc.MimeTypeH265 {
+		videoCodec = media.CodecH265
 	}
+	if element.Options.Adaptive && len(element.layers) > 1 {
+		element.switcher = newStreamSwitcher(element.layers, videoCodec, element.requestLayerKeyframe)
+	}
+	var videoSender *webrtc.RTPSender
+	var videoTrack *webrtc.TrackLocalStaticRTP
+	for i, layer := range element.layers {
+		if i == 0 || element.simulcast() {
+			var trackOptions []func(*webrtc.TrackLocalStaticRTP)
+			if element.simulcast() {
+				trackOptions = append(trackOptions, webrtc.WithRTPStreamID(layer.rid))
+			}
+			videoTrack, err = webrtc.NewTrackLocalStaticRTP(element.videoCapability, "video", "rtsp", trackOptions...)
+			if err != nil {
+				return "Create video track failed", err
+			}
+			if i == 0 {
+				videoSender, err = peerConnection.AddTrack(videoTrack)
+			} else {
+				err = videoSender.AddEncoding(videoTrack)
+			}
+			if err != nil {
+				return "Add video track failed", err
+			}
+		}
 
-	// Create a video track
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: videoType}, "video", "rtsp")
-	if err != nil {
-		return "Create video track failed", err
-	} else if _, err = peerConnection.AddTrack(videoTrack); err != nil {
-		return "Add video track failed", err
+		repacketizer := media.NewRepacketizer(videoCodec, element.Options.MaxPayloadSize)
+		sourceTrack := layer.tracks[videoTrackIDs[i]]
+		repacketizer.SetParameterSets(sourceTrack.VPS, sourceTrack.SPS, sourceTrack.PPS)
+		gop := media.NewGOPCache(element.Options.GOPCacheSize)
+		repacketizer.SetGOPCache(gop)
+		f := &rtspForward{
+			layer:        layer,
+			sourceTrack:  videoTrackIDs[i],
+			track:        videoTrack,
+			sender:       videoSender,
+			repacketizer: repacketizer,
+			gop:          gop,
+			switcher:     element.switcher,
+		}
+		layer.forwards = append(layer.forwards, f)
+
+		if element.switcher != nil {
+			// the RTCP is read by the switcher output
+			continue
+		}
+		f.pacer = element.newPacer(f)
+		if i == 0 {
+			go element.readRTCP(videoSender.ReadRTCP, f)
+		} else {
+			sender, rid := videoSender, layer.rid
+			go element.readRTCP(func() ([]rtcp.Packet, interceptor.Attributes, error) {
+				return sender.ReadSimulcastRTCP(rid)
+			}, f)
+		}
+	}
+	if element.switcher != nil {
+		element.switcher.output = &rtspForward{
+			track:  videoTrack,
+			sender: videoSender,
+			gop:    element.layers[0].forwards[0].gop,
+		}
+		element.switcher.output.pacer = element.newPacer(element.switcher.output)
+		go element.readRTCP(videoSender.ReadRTCP, element.switcher.output)
+	}
+
+	// Create the camera audio track
+	if element.Options.AudioSource == AudioSourceCamera {
+		layer := element.layers[0]
+		audioTrackID, audioCapability := cameraAudioTrack(layer)
+		if audioTrackID < 0 {
+			log.Println("Can not find camera audio track (PCMU/PCMA/Opus), rtsp=", RedactURLs(layer.url))
+		} else {
+			audioTrack, err := webrtc.NewTrackLocalStaticRTP(audioCapability, "audio", "rtsp")
+			if err != nil {
+				return "Create camera audio track failed", err
+			}
+			audioSender, err := peerConnection.AddTrack(audioTrack)
+			if err != nil {
+				return "Add camera audio track failed", err
+			}
+			layer.forwards = append(layer.forwards, &rtspForward{layer: layer, sourceTrack: audioTrackID, track: audioTrack, sender: audioSender})
+			go element.readRTCP(audioSender.ReadRTCP, nil)
+			hasAudio = true
+		}
+	}
+
+	if err := element.setupPreview(); err != nil {
+		return "Create preview track failed", err
+	}
+	if len(element.Options.RestreamAddress) > 0 {
+		if err := element.startRestream(Room + "_" + ID); err != nil {
+			return "Start RTSP restream failed", err
+		}
+	}
+	element.recordName = Room + "_" + ID
+	if element.Options.Record {
+		if err := element.StartRecording(); err != nil {
+			return "Start recording failed", err
+		}
 	}
 
 	// Connect to RTSP Camera
-	element.connectRTSPCamera(RTSP, rtspVideoTrack, videoTrack)
+	for _, layer := range element.layers {
+		for trackID, f := range layer.forwards {
+			f.reorder = element.newReorderBuffer(layer, trackID)
+			if layer == element.layers[0] {
+				trackID := trackID
+				f.record = func(pkt *rtp.Packet) { element.recordRTP(trackID, pkt) }
+			}
+		}
+		element.connectRTSPCamera(layer)
+	}
 
 	// RTC state callbacks
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		element.stateMutex.Lock()
 		element.status = connectionState
+		element.stateMutex.Unlock()
 		log.Println("ICEConnectionState:", connectionState)
+		if connectionState == webrtc.ICEConnectionStateFailed && element.whip != nil {
+			go element.restartWHIPICE()
+		}
 	})
 	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
 		log.Println("PeerConnectionState:", connectionState)
 	})
 
+	if element.Options.Sink == SinkWHIP {
+		element.whip = newWHIPSession(element.Options.WHIPURL, element.Options.WHIPToken, element.Options.WHIPTrickle)
+		if element.Options.WHIPTrickle {
+			peerConnection.OnICECandidate(element.whip.onCandidate)
+		}
+	}
+
 	// Wait offer & answer steps are completed
 	gatherCompletePromise := webrtc.GatheringCompletePromise(peerConnection)
 
@@ -188,7 +573,10 @@ func (element *Muxer) WriteHeader(
 	if err = peerConnection.SetLocalDescription(offer); err != nil {
 		return "Set local sdp failed", err
 	}
-	element.pc = peerConnection
+
+	if element.whip != nil {
+		return element.connectWHIPAndSendOffer(peerConnection, gatherCompletePromise)
+	}
 
 	waitT := time.NewTimer(time.Second * 10)
 	select {
@@ -226,7 +614,7 @@ func (element *Muxer) connectJanusAndSendMsgs(
 	// Send keep-alive to janus in every 30s
 	go func() {
 		for {
-			if element.stop {
+			if element.stopped() {
 				return
 			}
 			if _, keepAliveErr := session.KeepAlive(); keepAliveErr != nil {
@@ -239,6 +627,7 @@ func (element *Muxer) connectJanusAndSendMsgs(
 
 	// Receive janus message
 	go element.janusEventsHandle(handle)
+	element.handle = handle
 
 	roomNum, _ := strconv.Atoi(Room)
 	publisherID, err := strconv.Atoi(ID)
@@ -247,6 +636,14 @@ func (element *Muxer) connectJanusAndSendMsgs(
 		log.Printf("Room number invalid %s", err)
 	}
 
+	if element.Options.CreateRoom {
+		roomCreated, err := element.createRoomIfNeeded(handle, roomNum, Pin)
+		if err != nil {
+			return fmt.Sprintf("Create room %s failed", Room), err
+		}
+		element.retainRoom(Janus, roomNum, roomCreated)
+	}
+
 	msg, err := handle.Message(map[string]interface{}{
 		"request": "join",
 		"ptype":   "publisher",
@@ -256,11 +653,13 @@ func (element *Muxer) connectJanusAndSendMsgs(
 		"pin":     Pin,
 	}, nil)
 	if err != nil {
+		element.releaseRoom()
 		return fmt.Sprintf("Join room %s failed", Room), err
 	}
 	if msg != nil && msg.Plugindata.Data != nil {
 		data := msg.Plugindata.Data
 		if data["error"] != nil {
+			element.releaseRoom()
 			return fmt.Sprintf("Join room %s failed", Room), fmt.Errorf("join room %s failed, reason: %s", Room, data["error"])
 		}
 	}
@@ -282,13 +681,21 @@ func (element *Muxer) connectJanusAndSendMsgs(
 
 	// set remote sdp
 	if msg.Jsep != nil {
+		answer := msg.Jsep["sdp"].(string)
+		if err = checkVideoAnswer(answer, element.videoCapability); err != nil {
+			return fmt.Sprintf("Video codec mismatch in room %s", Room), err
+		}
+		if element.fec != nil {
+			element.fec.negotiate(answer)
+		}
 		err = pc.SetRemoteDescription(webrtc.SessionDescription{
 			Type: webrtc.SDPTypeAnswer,
-			SDP:  msg.Jsep["sdp"].(string),
+			SDP:  answer,
 		})
 		if err != nil {
 			return fmt.Sprintf("No remote sdp found %s error", Room), err
 		}
+		element.bindRIDExtension()
 
 		return "", nil
 	} else {
@@ -347,98 +754,130 @@ func (element *Muxer) getAudioTrack(deviceNameHash string) (*mediadevices.AudioT
 	}
 }
 
-// Get RTSP video track id
-func (element *Muxer) videoTrackID(rtsp string) (gortsplib.Track, string, error) {
-	c := gortsplib.Client{
-		UserAgent: "RTSPSender",
-		// ReadTimeout: 8,
-	}
-
-	element.rtspClient = &c
-
-	videoCodeType := webrtc.MimeTypeH264
-
-	// parse URL
-	u, err := url.Parse(rtsp)
-	if err != nil {
-		return nil, videoCodeType, err
-	}
-
-	// connect to the server
-	err = c.Start(u.Scheme, u.Host)
+// Describe the camera stream & find its video track
+func (element *Muxer) videoTrackID(layer *rtspLayer) (int, string, error) {
+	tracks, err := layer.source.Describe()
 	if err != nil {
-		return nil, videoCodeType, err
+		return -1, "", err
 	}
+	layer.tracks = tracks
 
-	// find published tracks
-	tracks, _, _, err := c.Describe(u)
-	if err != nil {
-		return nil, videoCodeType, err
-	}
-
-	trackIndex := -1
 	for i, track := range tracks {
 		// find the video track h264 or h265
-		if _, ok := track.(*gortsplib.TrackH264); ok {
-			videoCodeType = webrtc.MimeTypeH264
-			trackIndex = i
-			break
-		} else if _, ok := track.(*gortsplib.TrackH265); ok {
-			videoCodeType = webrtc.MimeTypeH265
-			trackIndex = i
-			break
+		if track.MimeType == webrtc.MimeTypeH264 || track.MimeType == webrtc.MimeTypeH265 {
+			return i, track.MimeType, nil
 		}
 	}
 
-	if trackIndex < 0 {
-		fmt.Println("Can not find video track, rtsp=", rtsp)
-		return nil, videoCodeType, err
-	}
+	log.Println("Can not find video track, rtsp=", RedactURLs(layer.url))
+	return -1, "", fmt.Errorf("no H264/H265 video track in %s", RedactURLs(layer.url))
+}
 
-	return tracks[trackIndex], videoCodeType, nil
+// Get the first camera audio track that can be passed through to WebRTC
+func cameraAudioTrack(layer *rtspLayer) (int, webrtc.RTPCodecCapability) {
+	for i, track := range layer.tracks {
+		switch track.MimeType {
+		case webrtc.MimeTypePCMU, webrtc.MimeTypePCMA, webrtc.MimeTypeOpus:
+			return i, webrtc.RTPCodecCapability{MimeType: track.MimeType, ClockRate: track.ClockRate, Channels: track.Channels}
+		}
+	}
+	return -1, webrtc.RTPCodecCapability{}
 }
 
-// Connect to RTSP camera & get video pkg data from video stream
-func (element *Muxer) connectRTSPCamera(rtsp string, videoTrack gortsplib.Track, track *webrtc.TrackLocalStaticRTP) {
-	// parse URL
-	baseURL, err := url.Parse(rtsp)
-	if err != nil {
-		log.Print("Parse URL error:", err)
-		return
+// Connect to the camera & get video (and audio) pkg data from the stream
+func (element *Muxer) connectRTSPCamera(layer *rtspLayer) {
+	rtsp := layer.url
+	forwards := layer.forwards
+	tracks := make([]int, len(forwards))
+	for i, f := range forwards {
+		tracks[i] = f.sourceTrack
+		// a new session restarts the sequence numbers
+		f.reorder.Reset()
 	}
 
 	// pass the video data to Pion
-	go func() {
-		element.rtspClient.OnPacketRTP = func(p *gortsplib.ClientOnPacketRTPCtx) {
-			err := track.WriteRTP(p.Packet)
-			if err != nil {
-				fmt.Println("Write RTP pkt error:", err)
+	onRTP := func(trackID int, pkt *rtp.Packet) {
+		if layer.restream != nil {
+			layer.restream.WriteRTP(trackID, pkt)
+		}
+		if err := forwards[trackID].writeRTP(pkt); err != nil {
+			forwards[trackID].writeError(err)
+		}
+	}
+	var onRTCP func(trackID int, pkt rtcp.Packet)
+	if element.Options.AudioSource == AudioSourceCamera {
+		onRTCP = func(trackID int, pkt rtcp.Packet) {
+			sr, ok := pkt.(*rtcp.SenderReport)
+			pc := element.peerConnection()
+			if !ok || pc == nil {
+				return
+			}
+			if report := forwards[trackID].senderReport(sr); report != nil {
+				_ = pc.WriteRTCP([]rtcp.Packet{report})
 			}
 		}
+	}
 
-		_, err = element.rtspClient.Setup(videoTrack, baseURL, 0, 0)
-		_, err = element.rtspClient.Play(nil)
-		err = element.rtspClient.Wait()
-
-		if err != nil {
+	go func() {
+		err := layer.source.Start(tracks, onRTP, onRTCP)
+		if err == io.EOF {
+			log.Printf("Camera stream %s ended, close WebRTC", RedactURLs(rtsp))
+			element.Close()
+		} else if err != nil {
 			log.Println("Connect to RTSP camera error:", err)
 			// retry
-			if element.rtspRetryTimes > 0 && !element.stop {
+			if element.rtspRetryTimes > 0 && !element.stopped() {
 				element.rtspRetryTimes--
 				time.AfterFunc(1*time.Second, func() {
-					if !element.stop {
-						log.Println("Reconnect to RTSP", rtsp)
-						element.connectRTSPCamera(rtsp, videoTrack, track)
+					if !element.stopped() {
+						log.Println("Reconnect to RTSP", RedactURLs(rtsp))
+						element.connectRTSPCamera(layer)
 					}
 				})
 			} else {
-				log.Printf("Reconnect to RTSP %s failed, close WebRTC", rtsp)
+				log.Printf("Reconnect to RTSP %s failed, close WebRTC", RedactURLs(rtsp))
 				element.Close()
 			}
 		}
 	}()
 }
 
+func (element *Muxer) closeSources() {
+	for _, layer := range element.layers {
+		if err := layer.source.Close(); err != nil {
+			log.Println("Close camera source failed", err)
+		}
+		for _, f := range layer.forwards {
+			if f.reorder != nil {
+				f.stopReorder()
+			}
+		}
+	}
+}
+
+// The layers are published as simulcast encodings, rather than switched
+func (element *Muxer) simulcast() bool {
+	return len(element.layers) > 1 && !element.Options.Adaptive
+}
+
+// Tag the simulcast encodings with the negotiated rtp-stream-id extension
+func (element *Muxer) bindRIDExtension() {
+	if !element.simulcast() {
+		return
+	}
+	f := element.layers[0].forwards[0]
+	for _, ext := range f.sender.GetParameters().HeaderExtensions {
+		if ext.URI != sdp.SDESRTPStreamIDURI {
+			continue
+		}
+		for _, layer := range element.layers {
+			layer.forwards[0].setRIDExtension(uint8(ext.ID))
+		}
+		return
+	}
+	log.Println("Janus did not negotiate the rtp-stream-id extension, simulcast layers can not be told apart")
+}
+
 func (element *Muxer) closeAudioDriverIfNecessary() {
 	log.Println("Closing microphone...")
 	audioDrivers := driver.GetManager().Query(driver.FilterAudioRecorder())
@@ -477,12 +916,22 @@ func (element *Muxer) Unmute() {
 	}
 }
 
+// Close unpublishes the camera, it may be called from several goroutines
+// (e.g. the end of a file source), the muxer is closed once
 func (element *Muxer) Close() {
+	element.stateMutex.Lock()
 	if element.stop {
+		element.stateMutex.Unlock()
 		log.Println("This WebRTC instance is stopping, please wait...")
 		return
 	}
 	element.stop = true
+	pc := element.pc
+	element.pc = nil
+	element.stateMutex.Unlock()
+
+	element.releaseRoom()
+	element.handle = nil
 
 	if element.Janus != nil {
 		err := element.Janus.Close()
@@ -492,25 +941,49 @@ func (element *Muxer) Close() {
 		element.Janus = nil
 	}
 
-	if element.rtspClient != nil {
-		err := element.rtspClient.Close()
-		log.Println("Close RTSP client failed", err)
-		element.rtspClient = nil
+	if element.whip != nil {
+		if err := element.whip.close(); err != nil {
+			log.Println("Delete WHIP resource failed", err)
+		}
+		element.whip = nil
 	}
 
-	if element.pc != nil {
+	element.closeViewers()
+	element.closeRestream()
+	if err := element.StopRecording(); err != nil && err != ErrNotRecording {
+		log.Println("Close recording failed", err)
+	}
+	element.closeSources()
+	for _, f := range element.pacedForwards() {
+		f.pacer.Close()
+	}
+
+	if pc != nil {
 		element.closeAudioDriverIfNecessary()
 
 		log.Println("Closing pc...")
-		err := element.pc.Close()
+		err := pc.Close()
 		if err != nil {
 			log.Println("Close pc failed", err)
 		}
-		element.pc = nil
 		log.Println("Close pc finished")
 	}
+}
 
-	element.stop = false
+// Tell if the muxer is closed
+func (element *Muxer) stopped() bool {
+	element.stateMutex.Lock()
+	defer element.stateMutex.Unlock()
+
+	return element.stop
+}
+
+// The PeerConnection of the muxer, nil once closed
+func (element *Muxer) peerConnection() *webrtc.PeerConnection {
+	element.stateMutex.Lock()
+	defer element.stateMutex.Unlock()
+
+	return element.pc
 }
 
 func (element *Muxer) janusEventsHandle(handle *janus.Handle) {
@@ -518,7 +991,11 @@ func (element *Muxer) janusEventsHandle(handle *janus.Handle) {
 		msg := <-handle.Events
 		switch msg := msg.(type) {
 		case *janus.SlowLinkMsg:
-			log.Println("SlowLinkMsg type, user:", handle.User)
+			log.Println("SlowLinkMsg type, user:", handle.User, "uplink:", msg.Uplink, "lost:", msg.Lost)
+			// uplink: Janus is missing packets we send
+			if msg.Uplink && element.switcher != nil {
+				element.switcher.onCongestion(fmt.Sprintf("slowlink, lost %d", msg.Lost))
+			}
 		case *janus.MediaMsg:
 			if msg.Type == "audio" {
 				if !msg.Receiving {
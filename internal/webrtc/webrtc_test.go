@@ -0,0 +1,51 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The first G.711 or Opus track of the camera is published
+func TestCameraAudioTrack(t *testing.T) {
+	video := SourceTrack{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+	tests := []struct {
+		name   string
+		tracks []SourceTrack
+		index  int
+		codec  webrtc.RTPCodecCapability
+	}{
+		{
+			name:   "PCMA",
+			tracks: []SourceTrack{video, {MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 1}},
+			index:  1,
+			codec:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000, Channels: 1},
+		},
+		{
+			name:   "opus first",
+			tracks: []SourceTrack{{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, video},
+			index:  0,
+			codec:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		},
+		{
+			// AAC can not be forwarded
+			name:   "after AAC",
+			tracks: []SourceTrack{video, {ClockRate: 44100, Channels: 2}, {MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}},
+			index:  2,
+			codec:  webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		},
+		{
+			name:   "video only",
+			tracks: []SourceTrack{video, {ClockRate: 44100}},
+			index:  -1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, codec := cameraAudioTrack(&rtspLayer{tracks: test.tracks})
+			if index != test.index || codec.MimeType != test.codec.MimeType || codec.ClockRate != test.codec.ClockRate || codec.Channels != test.codec.Channels {
+				t.Fatalf("track %d %+v, want %d %+v", index, codec, test.index, test.codec)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package webrtc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// defaultWHEPMaxViewers is the viewer limit of a camera when not configured
+const defaultWHEPMaxViewers = 4
+
+var (
+	// ErrViewerLimit is returned when a camera has WHEPMaxViewers viewers
+	ErrViewerLimit = errors.New("too many viewers")
+	// ErrViewerNotFound is returned for an unknown or closed viewer
+	ErrViewerNotFound = errors.New("viewer not found")
+)
+
+// whepViewer is a local preview subscribed with WHEP, it receives the
+// packets published to Janus on its own PeerConnection
+type whepViewer struct {
+	id string
+	pc *webrtc.PeerConnection
+}
+
+// Feed the preview tracks from the packets of the first layer (or of the
+// adaptive output), the camera audio included. The viewers share the tracks,
+// each one is a binding of its PeerConnection.
+func (element *Muxer) setupPreview() error {
+	video := element.layers[0].forwards[0]
+	if element.switcher != nil {
+		video = element.switcher.output
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(element.videoCapability, "video", "preview")
+	if err != nil {
+		return err
+	}
+	video.setPreview(track)
+	element.previewForward = video
+	element.previewVideo = track
+
+	if element.Options.AudioSource == AudioSourceCamera && len(element.layers[0].forwards) > 1 {
+		audio := element.layers[0].forwards[1]
+		track, err := webrtc.NewTrackLocalStaticRTP(audio.track.Codec(), "audio", "preview")
+		if err != nil {
+			return err
+		}
+		audio.setPreview(track)
+		element.previewAudio = track
+	}
+	return nil
+}
+
+func (element *Muxer) maxViewers() int {
+	if element.Options.WHEPMaxViewers > 0 {
+		return element.Options.WHEPMaxViewers
+	}
+	return defaultWHEPMaxViewers
+}
+
+// A receive only PeerConnection of the preview codecs, with NACK responses
+func (element *Muxer) newViewerPeerConnection() (*webrtc.PeerConnection, error) {
+	configuration := webrtc.Configuration{}
+	if len(element.Options.ICEServers) > 0 {
+		configuration.ICEServers = append(configuration.ICEServers, webrtc.ICEServer{
+			URLs:           element.Options.ICEServers,
+			Username:       element.Options.ICEUsername,
+			Credential:     element.Options.ICECredential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: element.previewVideo.Codec(), PayloadType: 96}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	if element.previewAudio != nil {
+		codec := element.previewAudio.Codec()
+		payloadType := webrtc.PayloadType(111)
+		switch codec.MimeType {
+		case webrtc.MimeTypePCMU:
+			payloadType = 0
+		case webrtc.MimeTypePCMA:
+			payloadType = 8
+		}
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: payloadType}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	s := webrtc.SettingEngine{}
+	if testSettingEngine != nil {
+		testSettingEngine(&s)
+	}
+	if element.Options.PortMin > 0 && element.Options.PortMax > 0 && element.Options.PortMax > element.Options.PortMin {
+		if err := s.SetEphemeralUDPPortRange(element.Options.PortMin, element.Options.PortMax); err != nil {
+			return nil, err
+		}
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
+	return api.NewPeerConnection(configuration)
+}
+
+// AddViewer answers the WHEP offer of a viewer, returns the viewer id & the answer
+func (element *Muxer) AddViewer(offer string) (string, string, error) {
+	if element.stopped() || element.previewVideo == nil {
+		return "", "", errors.New("camera not publishing")
+	}
+	element.viewersMutex.Lock()
+	if len(element.viewers) >= element.maxViewers() {
+		element.viewersMutex.Unlock()
+		return "", "", ErrViewerLimit
+	}
+	// reserved until the answer is ready
+	id := newViewerID()
+	viewer := &whepViewer{id: id}
+	if element.viewers == nil {
+		element.viewers = make(map[string]*whepViewer)
+	}
+	element.viewers[id] = viewer
+	element.viewersMutex.Unlock()
+
+	answer, err := element.answerViewer(viewer, offer)
+	if err != nil {
+		element.RemoveViewer(id)
+		return "", "", err
+	}
+	log.Printf("WHEP viewer %s subscribed to %s", id, element.userId)
+	return id, answer, nil
+}
+
+func (element *Muxer) answerViewer(viewer *whepViewer, offer string) (string, error) {
+	pc, err := element.newViewerPeerConnection()
+	if err != nil {
+		return "", err
+	}
+	element.viewersMutex.Lock()
+	viewer.pc = pc
+	element.viewersMutex.Unlock()
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			element.RemoveViewer(viewer.id)
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	videoSender, err := pc.AddTrack(element.previewVideo)
+	if err != nil {
+		return "", err
+	}
+	go element.readViewerRTCP(videoSender)
+	if element.previewAudio != nil && strings.Contains(offer, "m=audio") {
+		audioSender, err := pc.AddTrack(element.previewAudio)
+		if err != nil {
+			return "", err
+		}
+		go element.readViewerRTCP(audioSender)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-time.After(10 * time.Second):
+		return "", errors.New("gatherCompletePromise wait")
+	case <-gatherComplete:
+	}
+	sdp := pc.LocalDescription().SDP
+	if err := checkVideoAnswer(sdp, element.videoCapability); err != nil {
+		return "", err
+	}
+	return sdp, nil
+}
+
+// Keyframe requests of the viewers are answered like the Janus ones, the
+// receiver reports are not mixed with the Janus leg
+func (element *Muxer) readViewerRTCP(sender *webrtc.RTPSender) {
+	isVideo := sender.Track() == element.previewVideo
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if !isVideo {
+			continue
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				atomic.AddUint64(&element.keyframeStats.PLI, 1)
+				element.handleKeyframeRequest(element.previewForward)
+			case *rtcp.FullIntraRequest:
+				atomic.AddUint64(&element.keyframeStats.FIR, 1)
+				element.handleKeyframeRequest(element.previewForward)
+			}
+		}
+	}
+}
+
+// AddViewerCandidates adds the candidates of a trickle-ice-sdpfrag of a viewer
+func (element *Muxer) AddViewerCandidates(id string, frag string) error {
+	element.viewersMutex.Lock()
+	viewer, ok := element.viewers[id]
+	element.viewersMutex.Unlock()
+	if !ok || viewer.pc == nil {
+		return ErrViewerNotFound
+	}
+	mid := ""
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if len(mid) > 0 {
+				candidate.SDPMid = &mid
+			}
+			if err := viewer.pc.AddICECandidate(candidate); err != nil {
+				return fmt.Errorf("invalid candidate: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveViewer closes the PeerConnection of a viewer
+func (element *Muxer) RemoveViewer(id string) error {
+	element.viewersMutex.Lock()
+	viewer, ok := element.viewers[id]
+	delete(element.viewers, id)
+	element.viewersMutex.Unlock()
+	if !ok {
+		return ErrViewerNotFound
+	}
+	if viewer.pc != nil {
+		log.Printf("WHEP viewer %s left %s", id, element.userId)
+		return viewer.pc.Close()
+	}
+	return nil
+}
+
+// Viewers returns the number of WHEP viewers
+func (element *Muxer) Viewers() int {
+	element.viewersMutex.Lock()
+	defer element.viewersMutex.Unlock()
+	return len(element.viewers)
+}
+
+func (element *Muxer) closeViewers() {
+	element.viewersMutex.Lock()
+	var ids []string
+	for id := range element.viewers {
+		ids = append(ids, id)
+	}
+	element.viewersMutex.Unlock()
+	for _, id := range ids {
+		if err := element.RemoveViewer(id); err != nil && err != ErrViewerNotFound {
+			log.Println("Close viewer pc failed", err)
+		}
+	}
+}
+
+func newViewerID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,243 @@
+package webrtc
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// A muxer previewing its video forward, without the camera & Janus legs
+func newTestWHEPMuxer(t *testing.T, maxViewers int) (*Muxer, *rtspForward) {
+	t.Helper()
+	f := newTestForward(t)
+	m := &Muxer{
+		Options:         Options{AudioSource: AudioSourceNone, WHEPMaxViewers: maxViewers},
+		videoCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: testH264Fmtp},
+		layers:          []*rtspLayer{{forwards: []*rtspForward{f}}},
+	}
+	f.layer = m.layers[0]
+	if err := m.setupPreview(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.closeViewers)
+	return m, f
+}
+
+// testWHEPViewer is a receive only PeerConnection on the network of the
+// WHIP endpoint
+type testWHEPViewer struct {
+	pc *webrtc.PeerConnection
+	// the video track received
+	tracks chan *webrtc.TrackRemote
+}
+
+func newTestWHEPViewer(t *testing.T, n *testVNet) *testWHEPViewer {
+	t.Helper()
+	m := &webrtc.MediaEngine{}
+	codec := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: testH264Fmtp}, PayloadType: 102}
+	if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		t.Fatal(err)
+	}
+	s := webrtc.SettingEngine{}
+	s.SetVNet(n.whipNet)
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	v := &testWHEPViewer{pc: pc, tracks: make(chan *webrtc.TrackRemote, 1)}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		v.tracks <- track
+	})
+	return v
+}
+
+// The offer, with its candidates if gathered
+func (v *testWHEPViewer) offer(t *testing.T, gather bool) string {
+	t.Helper()
+	offer, err := v.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(v.pc)
+	if err := v.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if !gather {
+		return offer.SDP
+	}
+	<-gathered
+	return v.pc.LocalDescription().SDP
+}
+
+func (v *testWHEPViewer) answer(t *testing.T, answer string) {
+	t.Helper()
+	if err := v.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Forward frames until the viewer gets one, the forwarded RTP of the frame n
+// is a single NALU
+func (v *testWHEPViewer) receive(t *testing.T, f *rtspForward) (*webrtc.TrackRemote, *rtp.Packet) {
+	t.Helper()
+	received := make(chan *rtp.Packet, 1)
+	go func() {
+		track := <-v.tracks
+		v.tracks <- track
+		pkt, _, err := track.ReadRTP()
+		if err == nil {
+			received <- pkt
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for n := 0; ; n++ {
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, Marker: true, SequenceNumber: uint16(n), Timestamp: uint32(n * 3600)},
+			Payload: testFrame(n, 200),
+		}
+		if err := f.write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case pkt := <-received:
+			return <-v.tracks, pkt
+		case <-deadline:
+			t.Fatal("the viewer receives no forwarded RTP")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// The viewer gets the forwarded video, its PLIs are answered like the Janus
+// ones, it's closed on DELETE
+func TestWHEPViewerReceivesForwardedRTP(t *testing.T) {
+	n := newTestVNet(t)
+	m, f := newTestWHEPMuxer(t, 0)
+	v := newTestWHEPViewer(t, n)
+
+	id, answer, err := m.AddViewer(v.offer(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer, "a=candidate:") || m.Viewers() != 1 {
+		t.Fatalf("answer of %d viewers:\n%s", m.Viewers(), answer)
+	}
+	v.answer(t, answer)
+
+	track, pkt := v.receive(t, f)
+	if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) || pkt.PayloadType != 102 {
+		t.Fatalf("track %+v, packet %+v", track.Codec(), pkt.Header)
+	}
+	if n := testFrameNumber(pkt.Payload); string(pkt.Payload) != string(testFrame(n, 200)) {
+		t.Fatalf("frame %d is corrupted", n)
+	}
+
+	if err := v.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&m.keyframeStats.PLI) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the viewer PLI is not handled")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := m.RemoveViewer(id); err != nil || m.Viewers() != 0 {
+		t.Fatalf("removed: %v, %d viewers", err, m.Viewers())
+	}
+	if err := m.RemoveViewer(id); err != ErrViewerNotFound {
+		t.Fatalf("removed again: %v", err)
+	}
+	if err := m.AddViewerCandidates(id, "a=mid:0\r\n"); err != ErrViewerNotFound {
+		t.Fatalf("trickle of a removed viewer: %v", err)
+	}
+}
+
+// The offers over the viewer limit are refused until a viewer leaves
+func TestWHEPViewerLimit(t *testing.T) {
+	n := newTestVNet(t)
+	m, _ := newTestWHEPMuxer(t, 2)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		id, _, err := m.AddViewer(newTestWHEPViewer(t, n).offer(t, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, _, err := m.AddViewer(newTestWHEPViewer(t, n).offer(t, false)); err != ErrViewerLimit {
+		t.Fatalf("viewer over the limit: %v", err)
+	}
+	if err := m.RemoveViewer(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.AddViewer(newTestWHEPViewer(t, n).offer(t, false)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Viewers() != 2 {
+		t.Fatalf("%d viewers", m.Viewers())
+	}
+
+	// an invalid offer doesn't take a place
+	if _, _, err := m.AddViewer("v=0"); err == nil {
+		t.Fatal("invalid offer answered")
+	}
+	if m.Viewers() != 2 {
+		t.Fatalf("%d viewers after an invalid offer", m.Viewers())
+	}
+}
+
+// The viewer offers without candidates and trickles them
+func TestWHEPViewerTrickle(t *testing.T) {
+	n := newTestVNet(t)
+	m, f := newTestWHEPMuxer(t, 0)
+	v := newTestWHEPViewer(t, n)
+
+	offer := v.offer(t, false)
+	if strings.Contains(offer, "a=candidate:") {
+		t.Fatal("the offer has candidates")
+	}
+	id, answer, err := m.AddViewer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.answer(t, answer)
+
+	<-webrtc.GatheringCompletePromise(v.pc)
+	sdp := v.pc.LocalDescription().SDP
+	frag := "a=mid:" + testSDPValue(sdp, "a=mid:") + "\r\n"
+	for _, candidate := range testSDPLines(sdp, "a=candidate:") {
+		frag += "a=candidate:" + candidate + "\r\n"
+	}
+	if err := m.AddViewerCandidates(id, frag); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddViewerCandidates(id, "a=candidate:invalid\r\n"); err == nil {
+		t.Fatal("invalid candidate added")
+	}
+	v.receive(t, f)
+}
+
+// No viewer until the camera is published
+func TestWHEPNotPublishing(t *testing.T) {
+	m := &Muxer{}
+	if _, _, err := m.AddViewer("v=0"); err == nil || m.Viewers() != 0 {
+		t.Fatalf("viewer added: %v", err)
+	}
+}
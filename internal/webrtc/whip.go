@@ -0,0 +1,435 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// timeout of the WHIP requests
+const whipRequestTimeout = 10 * time.Second
+
+// whipSession is a WHIP resource: the offer is POSTed to the endpoint, the
+// trickled candidates & the ICE restarts are PATCHed to the resource of the
+// Location header, which is deleted on Close.
+type whipSession struct {
+	client   *http.Client
+	endpoint string
+	token    string
+	trickle  bool
+
+	mutex    sync.Mutex
+	resource string
+	etag     string
+	// ICE credentials & first media of the offer, for the SDP fragments
+	ufrag string
+	pwd   string
+	media string
+	mid   string
+	// candidates gathered before the resource is created
+	pending    []string
+	restarting bool
+}
+
+func newWHIPSession(endpoint string, token string, trickle bool) *whipSession {
+	return &whipSession{
+		client:   &http.Client{Timeout: whipRequestTimeout},
+		endpoint: endpoint,
+		token:    token,
+		trickle:  trickle,
+	}
+}
+
+func (w *whipSession) newRequest(method string, target string, contentType string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(w.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	return req, nil
+}
+
+// publish POSTs the offer, returns the answer of the created resource
+func (w *whipSession) publish(offer string) (string, error) {
+	if len(w.endpoint) == 0 {
+		return "", errors.New("no WHIP endpoint URL")
+	}
+	if err := w.setOffer(offer); err != nil {
+		return "", err
+	}
+	req, err := w.newRequest(http.MethodPost, w.endpoint, "application/sdp", []byte(offer))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/sdp")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("WHIP endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	location := resp.Header.Get("Location")
+	if len(location) == 0 {
+		return "", errors.New("WHIP answer without Location")
+	}
+	base, err := url.Parse(w.endpoint)
+	if err != nil {
+		return "", err
+	}
+	resource, err := base.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid WHIP Location %q: %v", location, err)
+	}
+
+	w.mutex.Lock()
+	w.resource = resource.String()
+	w.etag = resp.Header.Get("ETag")
+	pending := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+	log.Println("WHIP resource created", RedactURLs(w.resource))
+
+	if len(pending) > 0 {
+		go w.sendCandidates(pending)
+	}
+	return string(body), nil
+}
+
+// Keep the ICE credentials & the bundled media of the offer
+func (w *whipSession) setOffer(offer string) error {
+	desc := &sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return err
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return errors.New("no media in the offer")
+	}
+	first := desc.MediaDescriptions[0]
+	ufrag, ok := first.Attribute("ice-ufrag")
+	if !ok {
+		ufrag, _ = desc.Attribute("ice-ufrag")
+	}
+	pwd, ok := first.Attribute("ice-pwd")
+	if !ok {
+		pwd, _ = desc.Attribute("ice-pwd")
+	}
+	mid, _ := first.Attribute("mid")
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.ufrag, w.pwd = ufrag, pwd
+	w.media = first.MediaName.String()
+	w.mid = mid
+	return nil
+}
+
+// onCandidate trickles a local candidate, nil ends the candidates
+func (w *whipSession) onCandidate(candidate *webrtc.ICECandidate) {
+	line := "a=end-of-candidates"
+	if candidate != nil {
+		line = "a=" + candidate.ToJSON().Candidate
+	}
+
+	w.mutex.Lock()
+	if w.restarting {
+		// sent at once in the restart fragment
+		w.mutex.Unlock()
+		return
+	}
+	if len(w.resource) == 0 {
+		w.pending = append(w.pending, line)
+		w.mutex.Unlock()
+		return
+	}
+	w.mutex.Unlock()
+	go w.sendCandidates([]string{line})
+}
+
+func (w *whipSession) sendCandidates(lines []string) {
+	w.mutex.Lock()
+	if !w.trickle {
+		w.mutex.Unlock()
+		return
+	}
+	frag := w.fragment(lines)
+	etag := w.etag
+	w.mutex.Unlock()
+
+	resp, err := w.patch([]byte(frag), etag)
+	if err != nil {
+		log.Println("WHIP trickle failed", err)
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusUnsupportedMediaType:
+		log.Println("WHIP endpoint does not support trickle ICE,", resp.Status)
+		w.mutex.Lock()
+		w.trickle = false
+		w.mutex.Unlock()
+	default:
+		log.Println("WHIP trickle failed,", resp.Status)
+	}
+}
+
+// restart PATCHes the credentials & candidates of an ICE restart offer,
+// returns the answer fragment
+func (w *whipSession) restart(offer string) (string, error) {
+	if err := w.setOffer(offer); err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates" {
+			lines = append(lines, line)
+		}
+	}
+	w.mutex.Lock()
+	frag := w.fragment(lines)
+	w.mutex.Unlock()
+
+	// any ETag, the restart creates a new one
+	resp, err := w.patch([]byte(frag), "\"*\"")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WHIP ICE restart answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	w.mutex.Lock()
+	w.etag = resp.Header.Get("ETag")
+	w.mutex.Unlock()
+	return string(body), nil
+}
+
+func (w *whipSession) patch(frag []byte, etag string) (*http.Response, error) {
+	w.mutex.Lock()
+	resource := w.resource
+	w.mutex.Unlock()
+	if len(resource) == 0 {
+		return nil, errors.New("no WHIP resource")
+	}
+	req, err := w.newRequest(http.MethodPatch, resource, "application/trickle-ice-sdpfrag", frag)
+	if err != nil {
+		return nil, err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-Match", etag)
+	}
+	return w.client.Do(req)
+}
+
+// The trickle-ice-sdpfrag of the candidate lines, in the bundled media
+func (w *whipSession) fragment(lines []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\n", w.ufrag)
+	fmt.Fprintf(&b, "a=ice-pwd:%s\r\n", w.pwd)
+	fmt.Fprintf(&b, "m=%s\r\n", w.media)
+	if len(w.mid) > 0 {
+		fmt.Fprintf(&b, "a=mid:%s\r\n", w.mid)
+	}
+	for _, line := range lines {
+		b.WriteString(line + "\r\n")
+	}
+	return b.String()
+}
+
+// close deletes the resource
+func (w *whipSession) close() error {
+	w.mutex.Lock()
+	resource := w.resource
+	w.resource = ""
+	w.mutex.Unlock()
+	if len(resource) == 0 {
+		return nil
+	}
+	req, err := w.newRequest(http.MethodDelete, resource, "", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("WHIP endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Apply the credentials & candidates of a restart answer fragment to the
+// previous answer
+func whipRestartAnswer(answer string, frag string) (string, error) {
+	desc := &sdp.SessionDescription{}
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+	var ufrag, pwd string
+	var candidates []string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, strings.TrimPrefix(line, "a="))
+		}
+	}
+	if len(ufrag) == 0 || len(pwd) == 0 {
+		return "", errors.New("no ICE credentials in the WHIP restart answer")
+	}
+
+	replace := func(attributes []sdp.Attribute) []sdp.Attribute {
+		var res []sdp.Attribute
+		for _, a := range attributes {
+			switch a.Key {
+			case "ice-ufrag":
+				a.Value = ufrag
+			case "ice-pwd":
+				a.Value = pwd
+			case "candidate", "end-of-candidates":
+				continue
+			}
+			res = append(res, a)
+		}
+		return res
+	}
+	desc.Attributes = replace(desc.Attributes)
+	for i, md := range desc.MediaDescriptions {
+		md.Attributes = replace(md.Attributes)
+		if i > 0 {
+			continue
+		}
+		// bundled, the first media carries the candidates
+		for _, c := range candidates {
+			md.Attributes = append(md.Attributes, sdp.NewAttribute("candidate", strings.TrimPrefix(c, "candidate:")))
+		}
+		if len(candidates) > 0 {
+			md.Attributes = append(md.Attributes, sdp.NewPropertyAttribute("end-of-candidates"))
+		}
+	}
+	out, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Publish the PeerConnection to the WHIP endpoint
+func (element *Muxer) connectWHIPAndSendOffer(pc *webrtc.PeerConnection, gatherComplete <-chan struct{}) (string, error) {
+	if !element.Options.WHIPTrickle {
+		waitT := time.NewTimer(time.Second * 10)
+		select {
+		case <-waitT.C:
+			return "", errors.New("gatherCompletePromise wait")
+		case <-gatherComplete:
+			// Completed
+		}
+	}
+
+	answer, err := element.whip.publish(pc.LocalDescription().SDP)
+	if err != nil {
+		return "Publish to WHIP endpoint failed", err
+	}
+	if err = checkVideoAnswer(answer, element.videoCapability); err != nil {
+		return "Video codec mismatch in WHIP answer", err
+	}
+	if element.fec != nil {
+		element.fec.negotiate(answer)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		return "Set WHIP answer failed", err
+	}
+	element.bindRIDExtension()
+	return "", nil
+}
+
+// Restart ICE through the WHIP resource after a connectivity failure, the
+// client is hung up if the endpoint refuses it
+func (element *Muxer) restartWHIPICE() {
+	pc, whip := element.peerConnection(), element.whip
+	if pc == nil || whip == nil || element.stopped() {
+		return
+	}
+	whip.mutex.Lock()
+	if whip.restarting {
+		whip.mutex.Unlock()
+		return
+	}
+	whip.restarting = true
+	whip.mutex.Unlock()
+	defer func() {
+		whip.mutex.Lock()
+		whip.restarting = false
+		whip.mutex.Unlock()
+	}()
+
+	log.Println("ICE failed, restart it through the WHIP resource")
+	err := func() error {
+		offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+		if err != nil {
+			return err
+		}
+		// the restart gathers again, the previous gathering is complete
+		gatherComplete := webrtc.GatheringCompletePromise(pc)
+		if err = pc.SetLocalDescription(offer); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(10 * time.Second):
+			return errors.New("gatherCompletePromise wait")
+		case <-gatherComplete:
+		}
+		frag, err := whip.restart(pc.LocalDescription().SDP)
+		if err != nil {
+			return err
+		}
+		answer, err := whipRestartAnswer(pc.RemoteDescription().SDP, frag)
+		if err != nil {
+			return err
+		}
+		return pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	}()
+	if err != nil {
+		log.Println("WHIP ICE restart failed", err)
+		element.handleUserHangup()
+	}
+}
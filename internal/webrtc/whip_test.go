@@ -0,0 +1,484 @@
+package webrtc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+)
+
+const testWHIPToken = "secret-token"
+
+// H.264 fmtp of the test camera answered by the WHIP endpoint
+const testH264Fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42c01f"
+
+// Addresses of the muxer & the WHIP endpoint on the test network
+const (
+	testMuxerIP = "10.0.0.1"
+	testWHIPIP  = "10.0.0.2"
+)
+
+// testVNet is a simulated network between the muxer & the WHIP endpoint
+type testVNet struct {
+	router   *vnet.Router
+	muxerNet *vnet.Net
+	whipNet  *vnet.Net
+}
+
+// Create the network the muxer PeerConnections run on until the end of the test
+func newTestVNet(t *testing.T) *testVNet {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testVNet{
+		router:   router,
+		muxerNet: vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{testMuxerIP}}),
+		whipNet:  vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{testWHIPIP}}),
+	}
+	if err := router.AddNet(n.muxerNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.AddNet(n.whipNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { router.Stop() })
+	testSettingEngine = func(s *webrtc.SettingEngine) { s.SetVNet(n.muxerNet) }
+	t.Cleanup(func() { testSettingEngine = nil })
+	return n
+}
+
+// Publish the test camera to the WHIP endpoint on a test network
+func startTestWHIPMuxer(t *testing.T, whip *testWHIPServer, n *testVNet, trickle bool) *Muxer {
+	t.Helper()
+	port := testUDPPort(t)
+	path := filepath.Join(t.TempDir(), "cam.sdp")
+	if err := ioutil.WriteFile(path, []byte(testCameraSDP(port)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	camera := startTestCamera(t, port, 500)
+	t.Cleanup(camera.close)
+
+	m := NewMuxer(Options{
+		AudioSource: AudioSourceNone,
+		Sink:        SinkWHIP,
+		WHIPURL:     whip.URL + "/whip/endpoint",
+		WHIPToken:   testWHIPToken,
+		WHIPTrickle: trickle,
+	})
+	if msg, err := m.WriteHeader("1", "1", "", "sdp://"+filepath.ToSlash(path), "", "", "cam"); err != nil {
+		t.Fatal(msg, err)
+	}
+	return m
+}
+
+// Wait for the PATCHes received by the endpoint
+func (w *testWHIPServer) waitPatches(n int) []testWHIPPatch {
+	w.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mutex.Lock()
+		patches := append([]testWHIPPatch(nil), w.patches...)
+		w.mutex.Unlock()
+		if len(patches) >= n {
+			return patches
+		}
+		if time.Now().After(deadline) {
+			w.t.Fatalf("got %d WHIP PATCHes, want %d", len(patches), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// The resource of the Location header is deleted on Close
+func TestWHIPPublishAndDelete(t *testing.T) {
+	n := newTestVNet(t)
+	whip := newTestWHIPServer(t, n.whipNet, nil)
+	whip.token = testWHIPToken
+
+	m := startTestWHIPMuxer(t, whip, n, false)
+	whip.waitConnected()
+
+	m.whip.mutex.Lock()
+	resource, etag := m.whip.resource, m.whip.etag
+	m.whip.mutex.Unlock()
+	if resource != whip.URL+"/whip/resource/1" || etag != `"1"` {
+		t.Fatalf("WHIP resource %s, ETag %s", resource, etag)
+	}
+
+	m.Close()
+	whip.mutex.Lock()
+	defer whip.mutex.Unlock()
+	if requests := strings.Join(whip.requests, ", "); requests != "POST /whip/endpoint, DELETE /whip/resource/1" {
+		t.Fatalf("WHIP requests: %s", requests)
+	}
+}
+
+// The candidates are PATCHed to the resource with its ETag
+func TestWHIPTrickle(t *testing.T) {
+	n := newTestVNet(t)
+	whip := newTestWHIPServer(t, n.whipNet, nil)
+
+	m := startTestWHIPMuxer(t, whip, n, true)
+	defer m.Close()
+	whip.waitConnected()
+
+	var candidates int
+	var ended bool
+	for !ended {
+		patches := whip.waitPatches(1)
+		candidates, ended = 0, false
+		for _, patch := range patches {
+			if patch.ifMatch != `"1"` || patch.contentType != "application/trickle-ice-sdpfrag" || patch.status != http.StatusNoContent {
+				t.Fatalf("trickle PATCH If-Match %s, Content-Type %s, answered %d", patch.ifMatch, patch.contentType, patch.status)
+			}
+			m.whip.mutex.Lock()
+			ufrag := m.whip.ufrag
+			m.whip.mutex.Unlock()
+			if testSDPValue(patch.body, "a=ice-ufrag:") != ufrag || !strings.Contains(patch.body, "m=video ") {
+				t.Fatalf("trickle fragment %q", patch.body)
+			}
+			candidates += len(testSDPLines(patch.body, "a=candidate:"))
+			ended = ended || strings.Contains(patch.body, "a=end-of-candidates")
+		}
+		if !ended {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	if candidates == 0 {
+		t.Fatal("no candidate trickled")
+	}
+}
+
+// An endpoint without trickle ICE answers the PATCH 405, no more candidates
+// are sent to it
+func TestWHIPTrickleNotAllowed(t *testing.T) {
+	n := newTestVNet(t)
+	whip := newTestWHIPServer(t, n.whipNet, nil)
+	whip.noTrickle = true
+
+	m := startTestWHIPMuxer(t, whip, n, true)
+	defer m.Close()
+	whip.waitConnected()
+
+	patches := whip.waitPatches(1)
+	if patches[0].status != http.StatusMethodNotAllowed {
+		t.Fatalf("trickle PATCH answered %d", patches[0].status)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m.whip.mutex.Lock()
+		trickle := m.whip.trickle
+		m.whip.mutex.Unlock()
+		if !trickle {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("trickle ICE still on after the 405")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	before := len(whip.waitPatches(1))
+	m.whip.onCandidate(nil)
+	time.Sleep(200 * time.Millisecond)
+	if after := len(whip.waitPatches(1)); after != before {
+		t.Fatalf("%d PATCHes sent after the 405", after-before)
+	}
+}
+
+// The ICE restart offer is PATCHed with If-Match "*", the answer fragment
+// gives the new credentials & ETag
+func TestWHIPICERestart(t *testing.T) {
+	n := newTestVNet(t)
+	whip := newTestWHIPServer(t, n.whipNet, nil)
+
+	m := startTestWHIPMuxer(t, whip, n, false)
+	defer m.Close()
+	whip.waitConnected()
+
+	m.restartWHIPICE()
+	patches := whip.waitPatches(1)
+	if len(patches) != 1 || patches[0].ifMatch != `"*"` || patches[0].status != http.StatusOK {
+		t.Fatalf("ICE restart PATCHes %+v", patches)
+	}
+	m.whip.mutex.Lock()
+	ufrag, etag := m.whip.ufrag, m.whip.etag
+	m.whip.mutex.Unlock()
+	if testSDPValue(patches[0].body, "a=ice-ufrag:") != ufrag || len(testSDPLines(patches[0].body, "a=candidate:")) == 0 || etag != `"2"` {
+		t.Fatalf("ICE restart fragment %q, ETag %s", patches[0].body, etag)
+	}
+	if m.Hangup {
+		t.Fatal("hung up after the ICE restart")
+	}
+
+	whip.mutex.Lock()
+	answerUfrag := testSDPValue(whip.pc.LocalDescription().SDP, "a=ice-ufrag:")
+	whip.mutex.Unlock()
+	if remote := testSDPValue(m.pc.RemoteDescription().SDP, "a=ice-ufrag:"); remote != answerUfrag {
+		t.Fatalf("remote ufrag %s after the restart, want %s", remote, answerUfrag)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.pc.ICEConnectionState() != webrtc.ICEConnectionStateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("ICE %s after the restart", m.pc.ICEConnectionState())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// testWHIPServer is a WHIP endpoint answering the offers with a pion
+// PeerConnection, it sends the transport-cc feedback but no NACK so nothing
+// is retransmitted
+type testWHIPServer struct {
+	*httptest.Server
+	t   *testing.T
+	api *webrtc.API
+	// reads the tracks received, they are drained if nil
+	onTrack func(*webrtc.TrackRemote)
+	// closed when the PeerConnection is connected
+	connected chan struct{}
+
+	// token expected in the Authorization header if not empty
+	token string
+	// trickle PATCHes are answered 405 Method Not Allowed
+	noTrickle bool
+
+	mutex    sync.Mutex
+	pc       *webrtc.PeerConnection
+	etag     string
+	requests []string
+	patches  []testWHIPPatch
+}
+
+// testWHIPPatch is a PATCH received by the test WHIP endpoint
+type testWHIPPatch struct {
+	ifMatch     string
+	contentType string
+	body        string
+	status      int
+}
+
+// Create the endpoint, its PeerConnection is on the network n if not nil
+func newTestWHIPServer(t *testing.T, n *vnet.Net, onTrack func(*webrtc.TrackRemote)) *testWHIPServer {
+	m := &webrtc.MediaEngine{}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: testH264Fmtp}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/red", ClockRate: 90000}, PayloadType: videoREDPayloadType},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/ulpfec", ClockRate: 90000}, PayloadType: videoULPFECPayloadType},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 111}, webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.ConfigureTWCCSender(m, i); err != nil {
+		t.Fatal(err)
+	}
+	s := webrtc.SettingEngine{}
+	if n != nil {
+		s.SetVNet(n)
+	}
+
+	w := &testWHIPServer{
+		t:         t,
+		api:       webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)),
+		onTrack:   onTrack,
+		connected: make(chan struct{}),
+	}
+	w.Server = httptest.NewServer(http.HandlerFunc(w.serveHTTP))
+	t.Cleanup(w.close)
+	return w
+}
+
+func (w *testWHIPServer) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.requests = append(w.requests, r.Method+" "+r.URL.Path)
+	if len(w.token) > 0 && r.Header.Get("Authorization") != "Bearer "+w.token {
+		http.Error(rw, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		answer, err := w.answer(string(body))
+		if err != nil {
+			w.t.Error(err)
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/sdp")
+		rw.Header().Set("Location", "/whip/resource/1")
+		w.etag = `"1"`
+		rw.Header().Set("ETag", w.etag)
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(answer))
+	case http.MethodPatch:
+		patch := testWHIPPatch{ifMatch: r.Header.Get("If-Match"), contentType: r.Header.Get("Content-Type"), body: string(body)}
+		switch {
+		case patch.ifMatch == `"*"`:
+			frag, err := w.restart(patch.body)
+			if err != nil {
+				w.t.Error(err)
+				patch.status = http.StatusBadRequest
+				break
+			}
+			w.etag = `"2"`
+			rw.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+			rw.Header().Set("ETag", w.etag)
+			patch.status = http.StatusOK
+			rw.WriteHeader(patch.status)
+			rw.Write([]byte(frag))
+		case w.noTrickle:
+			patch.status = http.StatusMethodNotAllowed
+		case patch.ifMatch != w.etag:
+			patch.status = http.StatusPreconditionFailed
+		default:
+			for _, candidate := range testSDPLines(patch.body, "a=candidate:") {
+				mid := testSDPValue(patch.body, "a=mid:")
+				if err := w.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: "candidate:" + candidate, SDPMid: &mid}); err != nil {
+					w.t.Error(err)
+				}
+			}
+			patch.status = http.StatusNoContent
+		}
+		w.patches = append(w.patches, patch)
+		if patch.status != http.StatusOK {
+			rw.WriteHeader(patch.status)
+		}
+	case http.MethodDelete:
+		rw.WriteHeader(http.StatusOK)
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (w *testWHIPServer) answer(offer string) (string, error) {
+	pc, err := w.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	w.pc = pc
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(w.connected) })
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if w.onTrack != nil {
+			w.onTrack(track)
+			return
+		}
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+// Answer an ICE restart fragment: the previous offer with the new
+// credentials, the answer credentials & candidates are returned
+func (w *testWHIPServer) restart(frag string) (string, error) {
+	offer := w.pc.RemoteDescription().SDP
+	for _, key := range []string{"a=ice-ufrag:", "a=ice-pwd:"} {
+		offer = strings.ReplaceAll(offer, key+testSDPValue(offer, key), key+testSDPValue(frag, key))
+	}
+	if err := w.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	mid := testSDPValue(frag, "a=mid:")
+	for _, candidate := range testSDPLines(frag, "a=candidate:") {
+		if err := w.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: "candidate:" + candidate, SDPMid: &mid}); err != nil {
+			return "", err
+		}
+	}
+	answer, err := w.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(w.pc)
+	if err := w.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+
+	sdp := w.pc.LocalDescription().SDP
+	out := "a=ice-ufrag:" + testSDPValue(sdp, "a=ice-ufrag:") + "\r\n"
+	out += "a=ice-pwd:" + testSDPValue(sdp, "a=ice-pwd:") + "\r\n"
+	for _, candidate := range testSDPLines(sdp, "a=candidate:") {
+		out += "a=candidate:" + candidate + "\r\n"
+	}
+	return out, nil
+}
+
+// The values of the SDP lines starting with prefix
+func testSDPLines(sdp string, prefix string) []string {
+	var values []string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			values = append(values, strings.TrimPrefix(line, prefix))
+		}
+	}
+	return values
+}
+
+// The value of the first SDP line starting with prefix
+func testSDPValue(sdp string, prefix string) string {
+	if values := testSDPLines(sdp, prefix); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (w *testWHIPServer) waitConnected() {
+	w.t.Helper()
+	select {
+	case <-w.connected:
+	case <-time.After(10 * time.Second):
+		w.t.Fatal("the WHIP endpoint is not connected")
+	}
+}
+
+func (w *testWHIPServer) close() {
+	w.Server.Close()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pc != nil {
+		w.pc.Close()
+		w.pc = nil
+	}
+}
@@ -17,7 +17,6 @@ import (
 	"bufio"
 	"os/signal"
 	"path/filepath"
-	"regexp"
 	"sync"
 	"syscall"
 
@@ -97,7 +96,7 @@ func StartPublishing(p *C.char) int {
 
 	c := strings.Fields(C.GoString(p))
 	configs := strings.Join(c, "")
-	log.Printf("StartPublishing..., Configs = %s", configs)
+	log.Printf("StartPublishing..., Configs = %s", webrtc.RedactConfigs(configs))
 
 	if len(configs) == 0 {
 		log.Println("Missing mandatory field `configs`!")
@@ -111,12 +110,19 @@ func StartPublishing(p *C.char) int {
 		return -2
 	}
 
-	rtsp := client.URL
-	var validURL = regexp.MustCompile(config.RTSPReg)
-	if !validURL.MatchString(rtsp) {
-		log.Println("Please input validate RTSP camera URL!")
+	if err := webrtc.ValidateCameraURL(client.URL, client.SDP); err != nil {
+		log.Println("Please input validate RTSP camera URL!", err)
 		return -9
 	}
+	for _, layer := range client.Simulcast {
+		if len(layer.URL) == 0 {
+			continue
+		}
+		if err := webrtc.ValidateCameraURL(layer.URL, client.SDP); err != nil {
+			log.Printf("Please input validate RTSP URL for simulcast layer %s! %v", layer.RID, err)
+			return -9
+		}
+	}
 
 	room := client.Room
 	if len(room) == 0 {
@@ -129,6 +135,10 @@ func StartPublishing(p *C.char) int {
 		return -4
 	}
 	uuid := room + "_" + id
+	if config.Config.Failed(uuid) {
+		// PublishingState reported the failed background publish, start again
+		config.Config.DelClient(uuid)
+	}
 	if config.Config.Exist(uuid) {
 		log.Printf("Camera ID %s is currently publishing!", id)
 		return -5
@@ -151,7 +161,15 @@ func StartPublishing(p *C.char) int {
 		return -11
 	}
 
-	msg, err := Stream2WebRTC(uuid)
+	if webrtc.IsPushURL(client.URL) {
+		// the encoder may publish long after, don't hold the other DLL calls
+		startedSuccess = true
+		go streamPushWebRTC(uuid)
+		log.Printf("Waiting for the encoder of camera %s in Room %s, see PublishingState", id, room)
+		return 0
+	}
+
+	msg, err := StreamWebRTC(uuid)
 
 	if err != nil {
 		if len(msg) == 0 {
@@ -209,34 +227,85 @@ func StopPublishing(ID int64, Room int64) int {
 	return 0
 }
 
-//Stream2WebRTC RTSP stream video over WebRTC
-func Stream2WebRTC(uuid string) (string, error) {
-	if !config.Config.Exist(uuid) {
-		return "", fmt.Errorf(fmt.Sprintf("Stream %s NOT found", uuid))
+//PublishingState : 1 publishing, 0 waiting for the camera, -3 the background publish failed
+//export PublishingState
+func PublishingState(ID int64, Room int64) int {
+	globalMutex.RLock()
+	defer globalMutex.RUnlock()
+
+	if ID <= 0 || Room <= 0 {
+		log.Print("Please input room number and Camera ID")
+		return -1
 	}
 
-	client := config.Config.Clients[uuid]
-	muxerWebRTC := webrtc.NewMuxer(webrtc.Options{
-		ICEServers:    client.ICEServers,
-		ICEUsername:   client.ICEUsername,
-		ICECredential: client.ICECredential,
-	})
-
-	msg, err := muxerWebRTC.WriteHeader(
-		client.ID,
-		client.Room,
-		client.Pin,
-		client.URL,
-		client.Janus,
-		client.Mic,
-		client.Display)
-	if err != nil {
-		return msg, err
+	state, ok := config.Config.State(fmt.Sprint(Room) + "_" + fmt.Sprint(ID))
+	if !ok {
+		log.Printf("Camera ID %d not exist!", ID)
+		return -2
+	}
+	switch state.State {
+	case config.StatePublishing:
+		return 1
+	case config.StateFailed:
+		log.Printf("Camera ID %d publish failed: %s", ID, state.Error)
+		return -3
+	default:
+		return 0
+	}
+}
+
+//StartRecording :
+//export StartRecording
+func StartRecording(ID int64, Room int64) int {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+
+	if ID <= 0 || Room <= 0 {
+		log.Print("Please input room number and Camera ID")
+		return -1
+	}
+	log.Printf("StartRecording ID = %d, Room = %d", ID, Room)
+
+	muxer := config.Config.WebRTC(fmt.Sprint(Room) + "_" + fmt.Sprint(ID))
+	if muxer == nil {
+		log.Printf("Camera ID %d is not publishing!", ID)
+		return -2
 	}
+	if err := muxer.StartRecording(); err == webrtc.ErrRecording {
+		log.Printf("Camera ID %d is already recorded!", ID)
+		return -3
+	} else if err != nil {
+		log.Println("StartRecording failed", err)
+		return -4
+	}
+	return 0
+}
+
+//StopRecording :
+//export StopRecording
+func StopRecording(ID int64, Room int64) int {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
 
-	config.Config.AddRTC2Stream(uuid, muxerWebRTC)
+	if ID <= 0 || Room <= 0 {
+		log.Print("Please input room number and Camera ID")
+		return -1
+	}
+	log.Printf("StopRecording ID = %d, Room = %d", ID, Room)
 
-	return "", nil
+	muxer := config.Config.WebRTC(fmt.Sprint(Room) + "_" + fmt.Sprint(ID))
+	if muxer == nil {
+		log.Printf("Camera ID %d is not publishing!", ID)
+		return -2
+	}
+	if err := muxer.StopRecording(); err == webrtc.ErrNotRecording {
+		log.Printf("Camera ID %d is not recorded!", ID)
+		return -3
+	} else if err != nil {
+		log.Println("StopRecording failed", err)
+		return -4
+	}
+	return 0
 }
 
 // test
@@ -310,9 +379,8 @@ func testFromCLI() {
 
 func testStart(uuid string) {
 	url := testCameras[uuid]
-	var validURL = regexp.MustCompile(config.RTSPReg)
-	if !validURL.MatchString(url) {
-		log.Println("Please input validate RTSP camera URL!")
+	if err := webrtc.ValidateCameraURL(url, ""); err != nil {
+		log.Println("Please input validate RTSP camera URL!", err)
 		return
 	}
 
@@ -339,7 +407,7 @@ func testStart(uuid string) {
 		return
 	}
 
-	_, err := Stream2WebRTC(uuid)
+	_, err := StreamWebRTC(uuid)
 	if err != nil {
 		log.Println(err)
 	}